@@ -5,10 +5,12 @@ go 1.24.4
 require (
 	github.com/OneOfOne/xxhash v1.2.8
 	github.com/google/uuid v1.6.0
+	github.com/klauspost/reedsolomon v1.12.6
 	github.com/oschwald/geoip2-golang v1.13.0
 	github.com/quic-go/quic-go v0.58.0
 	github.com/xtaci/kcp-go v5.4.20+incompatible
 	github.com/xtaci/smux v1.5.50
+	golang.org/x/crypto v0.46.0
 	golang.org/x/net v0.48.0
 	golang.org/x/sys v0.39.0
 	google.golang.org/protobuf v1.36.11
@@ -16,7 +18,6 @@ require (
 
 require (
 	github.com/klauspost/cpuid/v2 v2.3.0 // indirect
-	github.com/klauspost/reedsolomon v1.12.6 // indirect
 	github.com/oschwald/maxminddb-golang v1.13.1 // indirect
 	github.com/pkg/errors v0.9.1 // indirect
 	github.com/templexxx/cpufeat v0.0.0-20180724012125-cef66df7f161 // indirect
@@ -24,5 +25,4 @@ require (
 	github.com/tjfoc/gmsm v1.4.1 // indirect
 	github.com/xtaci/lossyconn v0.0.0-20200209145036-adba10fffc37 // indirect
 	go.uber.org/mock v0.6.0 // indirect
-	golang.org/x/crypto v0.46.0 // indirect
 )
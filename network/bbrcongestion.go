@@ -0,0 +1,246 @@
+package network
+
+import (
+	"fmt"
+	"time"
+)
+
+/*
+BbrCongestion 实现了 BBR 拥塞控制算法，根据测量的瓶颈带宽和最小 rtt 估算链路的带宽时延积，不把丢包当作拥塞信号。
+
+算法原理：
+
+1. 测量：
+   - 以最小 rtt 为一轮，每轮统计被确认的字节数得到一个投递速率样本，瓶颈带宽取最近 10 轮样本的最大值。
+   - 最小 rtt 取 10 秒内 rtt 采样的最小值，超过 10 秒没有更新时进入 PROBE_RTT 重新测量。
+
+2. 状态机：
+   - STARTUP：每收到一个确认窗口就增加相应字节数，快速探测带宽，连续 3 轮带宽增长不到 25% 认为管道已满，进入 DRAIN。
+   - DRAIN：窗口降到一个带宽时延积，排空 STARTUP 造成的排队，在途数据不超过带宽时延积后进入 PROBE_BW。
+   - PROBE_BW：增益按 1.25、0.75、1、1、1、1、1、1 每轮循环，先多发探测更多带宽，再少发排空探测造成的排队。
+   - PROBE_RTT：窗口降到最小值保持至少 200ms，让队列排空以测得真实的最小 rtt，之后回到之前的状态。
+
+PacingRate 返回增益乘以瓶颈带宽，FrameMgr 开启发送节奏控制时按这个速率发送。
+没有开启时增益只能作用在拥塞窗口上：窗口 = 2 * 增益 * 瓶颈带宽 * 最小 rtt。
+*/
+
+const (
+	bbr_status_startup   = 0
+	bbr_status_drain     = 1
+	bbr_status_probe_bw  = 2
+	bbr_status_probe_rtt = 3
+
+	bbr_startup_gain   = 2.885
+	bbr_cwnd_gain      = 2.0
+	bbr_bw_win         = 10
+	bbr_full_bw_thresh = 1.25
+	bbr_full_bw_rounds = 3
+	bbr_min_rtt_win    = 10 * time.Second
+	bbr_probe_rtt_time = 200 * time.Millisecond
+)
+
+var bbr_pacing_gain = []float64{1.25, 0.75, 1, 1, 1, 1, 1, 1}
+
+type BbrCongestion struct {
+	flight congestionFlight
+	status int
+	cwnd   int
+
+	bwSamples      [bbr_bw_win]float64
+	round          int
+	roundStart     time.Time
+	roundDelivered int
+	btlbw          float64 // 字节每秒
+
+	minRtt         time.Duration
+	minRttStamp    time.Time
+	probeRttDone   time.Time
+	probeRttSample bool
+	priorStatus    int
+
+	fullBw      float64
+	fullBwCount int
+	filled      bool
+
+	cycleIndex int
+	lossNum    int
+}
+
+func (b *BbrCongestion) Init() {
+	b.flight.init()
+	b.status = bbr_status_startup
+	b.cwnd = congestionInitSegs * b.flight.mss
+	b.bwSamples = [bbr_bw_win]float64{}
+	b.round = 0
+	b.roundStart = time.Now()
+	b.roundDelivered = 0
+	b.btlbw = 0
+	b.minRtt = 0
+	b.minRttStamp = time.Now()
+	b.fullBw = 0
+	b.fullBwCount = 0
+	b.filled = false
+	b.cycleIndex = 0
+	b.lossNum = 0
+}
+
+func (b *BbrCongestion) RecvAck(id int, size int) {
+	acked := b.flight.ack(id)
+	if acked <= 0 {
+		return
+	}
+	b.roundDelivered += acked
+
+	now := time.Now()
+	if elapsed := now.Sub(b.roundStart); elapsed >= b.getMinRtt() {
+		b.bwSamples[b.round%bbr_bw_win] = float64(b.roundDelivered) / elapsed.Seconds()
+		b.round++
+		b.roundStart = now
+		b.roundDelivered = 0
+
+		b.btlbw = 0
+		for _, bw := range b.bwSamples {
+			if bw > b.btlbw {
+				b.btlbw = bw
+			}
+		}
+		b.onRound()
+	}
+
+	b.checkProbeRtt(now)
+	b.updateCwnd(acked)
+}
+
+func (b *BbrCongestion) onRound() {
+	switch b.status {
+	case bbr_status_startup:
+		if b.btlbw >= b.fullBw*bbr_full_bw_thresh {
+			b.fullBw = b.btlbw
+			b.fullBwCount = 0
+		} else {
+			b.fullBwCount++
+			if b.fullBwCount >= bbr_full_bw_rounds {
+				b.filled = true
+				b.status = bbr_status_drain
+			}
+		}
+	case bbr_status_probe_bw:
+		b.cycleIndex = (b.cycleIndex + 1) % len(bbr_pacing_gain)
+	}
+}
+
+func (b *BbrCongestion) checkProbeRtt(now time.Time) {
+	if b.status == bbr_status_drain && b.flight.inflight <= b.bdp() {
+		b.status = bbr_status_probe_bw
+		b.cycleIndex = 0
+	}
+
+	if b.status != bbr_status_probe_rtt && b.minRtt > 0 && now.Sub(b.minRttStamp) > bbr_min_rtt_win {
+		b.priorStatus = b.status
+		b.status = bbr_status_probe_rtt
+		b.probeRttSample = false
+		d := bbr_probe_rtt_time
+		if b.minRtt > d {
+			d = b.minRtt
+		}
+		b.probeRttDone = now.Add(d)
+	} else if b.status == bbr_status_probe_rtt && now.After(b.probeRttDone) {
+		b.minRttStamp = now
+		if b.filled {
+			b.status = bbr_status_probe_bw
+			b.cycleIndex = 0
+		} else {
+			b.status = b.priorStatus
+		}
+	}
+}
+
+func (b *BbrCongestion) bdp() int {
+	return int(b.btlbw * b.getMinRtt().Seconds())
+}
+
+func (b *BbrCongestion) updateCwnd(acked int) {
+	mincwnd := congestionMinSegs * b.flight.mss
+	if b.status == bbr_status_probe_rtt {
+		b.cwnd = mincwnd
+		return
+	}
+
+	gain := bbr_cwnd_gain
+	switch b.status {
+	case bbr_status_startup:
+		gain = bbr_startup_gain
+	case bbr_status_drain:
+		gain = 1
+	case bbr_status_probe_bw:
+		gain = bbr_cwnd_gain * bbr_pacing_gain[b.cycleIndex]
+	}
+	target := int(gain * float64(b.bdp()))
+
+	if b.filled {
+		b.cwnd += acked
+		if b.cwnd > target {
+			b.cwnd = target
+		}
+	} else if b.btlbw <= 0 || b.cwnd < target {
+		b.cwnd += acked
+	}
+	if b.cwnd < mincwnd {
+		b.cwnd = mincwnd
+	}
+}
+
+// PacingRate 返回瓶颈带宽乘以当前状态的增益。
+func (b *BbrCongestion) PacingRate() int {
+	gain := 1.0
+	switch b.status {
+	case bbr_status_startup:
+		gain = bbr_startup_gain
+	case bbr_status_drain:
+		gain = 1 / bbr_startup_gain
+	case bbr_status_probe_bw:
+		gain = bbr_pacing_gain[b.cycleIndex]
+	}
+	return int(gain * b.btlbw)
+}
+
+func (b *BbrCongestion) CanSend(id int, size int) bool {
+	return b.flight.canSend(id, size, b.cwnd)
+}
+
+func (b *BbrCongestion) Update() {
+}
+
+func (b *BbrCongestion) Info() string {
+	return fmt.Sprintf("bbr status %v cwnd %v btlbw %.0f minrtt %v inflight %v round %v loss %v", b.status, b.cwnd,
+		b.btlbw, b.minRtt, b.flight.inflight, b.round, b.lossNum)
+}
+
+func (b *BbrCongestion) OnRtt(rtt time.Duration) {
+	if rtt <= 0 {
+		return
+	}
+	if b.status == bbr_status_probe_rtt && !b.probeRttSample {
+		// PROBE_RTT 期间重新测量
+		b.probeRttSample = true
+		b.minRtt = rtt
+		b.minRttStamp = time.Now()
+		return
+	}
+	if b.minRtt <= 0 || rtt <= b.minRtt {
+		b.minRtt = rtt
+		b.minRttStamp = time.Now()
+	}
+}
+
+// OnLoss BBR 不把丢包当作拥塞信号，只做统计。
+func (b *BbrCongestion) OnLoss(id int, size int) {
+	b.lossNum++
+}
+
+func (b *BbrCongestion) getMinRtt() time.Duration {
+	if b.minRtt <= 0 {
+		return congestionDefaultRtt
+	}
+	return b.minRtt
+}
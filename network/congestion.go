@@ -1,5 +1,11 @@
 package network
 
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
 /*
 Congestion 定义了一个用于网络拥塞控制的接口。
 
@@ -25,6 +31,10 @@ Congestion 定义了一个用于网络拥塞控制的接口。
   返回一个描述当前拥塞控制状态的信息字符串，用于调试和监测目的。
 
 实现该接口的类型应具备相应的业务逻辑，以适应不同的网络条件和表现出合理的拥塞控制特性。
+
+需要 rtt 和丢包信息的算法可以再实现 CongestionEvent，FrameMgr 会在收到 ACK 和重传时通知。
+
+内置的算法通过 NewCongestion 按名字创建：bb（BBCongestion）、bbr（BbrCongestion）、cubic（CubicCongestion）、reno（RenoCongestion）。
 */
 
 type Congestion interface {
@@ -34,3 +44,93 @@ type Congestion interface {
 	Update()
 	Info() string
 }
+
+// CongestionEvent 是 Congestion 的可选扩展，用于接收 rtt 采样和丢包事件。
+type CongestionEvent interface {
+	// OnRtt 收到没有重传过的帧的 ACK 时调用，在 RecvAck 之前
+	OnRtt(rtt time.Duration)
+	// OnLoss 帧被判定丢失并重传时调用，重传前已经对同一个 id 调用过 CanSend
+	OnLoss(id int, size int)
+}
+
+var gCongestions = map[string]func() Congestion{
+	"bb":    func() Congestion { return &BBCongestion{} },
+	"bbr":   func() Congestion { return &BbrCongestion{} },
+	"cubic": func() Congestion { return &CubicCongestion{} },
+	"reno":  func() Congestion { return &RenoCongestion{} },
+}
+
+// NewCongestion 按名字创建拥塞控制算法，name 为空表示不使用拥塞控制，返回 nil。
+func NewCongestion(name string) (Congestion, error) {
+	if name == "" {
+		return nil, nil
+	}
+	f, ok := gCongestions[strings.ToLower(name)]
+	if !ok {
+		return nil, errors.New("undefined congestion " + name)
+	}
+	return f(), nil
+}
+
+const (
+	congestionMinMss   = 512
+	congestionInitSegs = 10 // 初始窗口的包数
+	congestionMinSegs  = 4  // 最小窗口的包数
+
+	congestionDefaultRtt = 100 * time.Millisecond // 还没有 rtt 采样时使用
+)
+
+// congestionFlight 记录已发送未确认的帧，同一个 id 重传时不重复计算在途字节数，重复的 ACK 也只计算一次。
+type congestionFlight struct {
+	outstanding map[int]int
+	inflight    int
+	mss         int
+}
+
+func (cf *congestionFlight) init() {
+	cf.outstanding = make(map[int]int)
+	cf.inflight = 0
+	cf.mss = congestionMinMss
+}
+
+// congestionPacingRate 返回基于窗口的算法的发送速率，还没有 rtt 采样时返回 0。
+func congestionPacingRate(cwnd int, ssthresh int, srtt time.Duration) int {
+	if srtt <= 0 {
+		return 0
+	}
+	gain := 1.2
+	if cwnd < ssthresh {
+		gain = 2
+	}
+	return int(gain * float64(cwnd) / srtt.Seconds())
+}
+
+// canSend 检查窗口是否允许发送，重传总是允许，否则丢包时可能再也收不到 ACK。
+func (cf *congestionFlight) canSend(id int, size int, cwnd int) bool {
+	if size < 0 {
+		panic("error size")
+	}
+	if size > cf.mss {
+		cf.mss = size
+	}
+	if _, ok := cf.outstanding[id]; ok {
+		return true
+	}
+	if cf.inflight > 0 && cf.inflight+size > cwnd {
+		return false
+	}
+	cf.outstanding[id] = size
+	cf.inflight += size
+	return true
+}
+
+// ack 返回确认的字节数，不在途的帧返回 0。
+func (cf *congestionFlight) ack(id int) int {
+	size, ok := cf.outstanding[id]
+	if !ok {
+		return 0
+	}
+	delete(cf.outstanding, id)
+	cf.inflight -= size
+	return size
+}
@@ -2,7 +2,9 @@ package network
 
 import (
 	"fmt"
+	"github.com/esrrhs/gohome/common"
 	"github.com/esrrhs/gohome/list"
+	"math/rand"
 	"testing"
 	"time"
 )
@@ -171,3 +173,187 @@ func TestBB2(t *testing.T) {
 		}
 	}
 }
+
+// lossyLink 模拟一条有带宽、延迟、随机丢包和有限队列的单向链路
+type lossyLink struct {
+	rate     int // 字节每秒
+	delay    time.Duration
+	loss     float64
+	maxQueue time.Duration // 排队超过这个时间的包直接丢弃
+	rnd      *rand.Rand
+	busy     time.Time
+	queue    []lossyPacket
+	drops    int
+}
+
+type lossyPacket struct {
+	f  *Frame
+	at time.Time
+}
+
+func (l *lossyLink) send(f *Frame, size int) {
+	now := time.Now()
+	if l.rnd.Float64() < l.loss {
+		return
+	}
+	if l.busy.Before(now) {
+		l.busy = now
+	}
+	if l.rate > 0 {
+		if l.busy.Sub(now) > l.maxQueue {
+			l.drops++
+			return
+		}
+		l.busy = l.busy.Add(time.Duration(size) * time.Second / time.Duration(l.rate))
+	}
+	l.queue = append(l.queue, lossyPacket{f, l.busy.Add(l.delay)})
+}
+
+func (l *lossyLink) recv(fm *FrameMgr) {
+	now := time.Now()
+	n := 0
+	for n < len(l.queue) && !l.queue[n].at.After(now) {
+		fm.OnRecvFrame(l.queue[n].f)
+		n++
+	}
+	l.queue = l.queue[n:]
+}
+
+func runLossyTransfer(t *testing.T, name string, size int, link lossyLink, pacing bool) (time.Duration, int, FrameMgrStats) {
+	sender := NewFrameMgr(500, 100000, 1024*1024, 10000, 200, 0, 0)
+	ct, err := NewCongestion(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ct != nil {
+		sender.SetCongestion(ct)
+	}
+	if pacing {
+		sender.SetPacing(0, 2*1024)
+	}
+	return runLossyTransferWith(t, sender, size, link)
+}
+
+func runLossyTransferWith(t *testing.T, sender *FrameMgr, size int, link lossyLink) (time.Duration, int, FrameMgrStats) {
+	receiver := NewFrameMgr(500, 100000, 1024*1024, 10000, 200, 0, 0)
+
+	rnd := rand.New(rand.NewSource(1))
+	up := &link
+	up.rnd = rnd
+	down := &lossyLink{delay: link.delay, loss: link.loss, rnd: rnd}
+
+	send := make([]byte, size)
+	begin := time.Now()
+	recv := 0
+	for recv < size && time.Since(begin) < 20*time.Second {
+		if left := sender.GetSendBufferLeft(); left > 0 && len(send) > 0 {
+			n := common.MinOfInt(left, len(send))
+			sender.WriteSendBuffer(send[:n])
+			send = send[n:]
+		}
+		sender.Update()
+		for e := sender.GetSendList().Front(); e != nil; e = e.Next() {
+			f := e.Value.(*Frame)
+			b, _ := sender.MarshalFrame(f)
+			up.send(f, len(b))
+		}
+		up.recv(receiver)
+
+		receiver.Update()
+		for e := receiver.GetSendList().Front(); e != nil; e = e.Next() {
+			down.send(e.Value.(*Frame), 0)
+		}
+		down.recv(sender)
+
+		if n := receiver.GetRecvBufferSize(); n > 0 {
+			recv += n
+			receiver.SkipRecvBuffer(n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if recv != size {
+		t.Fatalf("recv %d bytes, want %d", recv, size)
+	}
+	sender.Update()
+	return time.Since(begin), up.drops, sender.Stats()
+}
+
+func TestCongestionLossyLink(t *testing.T) {
+	size := 512 * 1024
+	link := lossyLink{rate: 2 * 1024 * 1024, delay: 20 * time.Millisecond, loss: 0.02, maxQueue: 100 * time.Millisecond}
+	_, nodrops, _ := runLossyTransfer(t, "", size, link, false)
+	for _, name := range []string{"bb", "bbr", "cubic", "reno"} {
+		cost, drops, st := runLossyTransfer(t, name, size, link, false)
+		t.Logf("%-5s cost %v goodput %.0fKB/s queue drops %d retransmits %d", name, cost,
+			float64(size)/1024/cost.Seconds(), drops, st.Retransmits)
+		if name != "bb" && drops >= nodrops {
+			t.Errorf("%s queue drops %d, should less than no congestion %d", name, drops, nodrops)
+		}
+	}
+	t.Logf("none queue drops %d", nodrops)
+}
+
+func TestCongestionOnLoss(t *testing.T) {
+	for _, name := range []string{"cubic", "reno"} {
+		ct, _ := NewCongestion(name)
+		ct.Init()
+		ev := ct.(CongestionEvent)
+		id := 0
+		for i := 0; i < 1000; i++ {
+			if ct.CanSend(id, 1000) {
+				ct.RecvAck(id, 1000)
+				id++
+			}
+		}
+		before := ct.Info()
+		ev.OnLoss(id, 1000)
+		ev.OnLoss(id+1, 1000)
+		after := ct.Info()
+
+		var cwnd1, cwnd2 int
+		fmt.Sscanf(before, name+" cwnd %d", &cwnd1)
+		fmt.Sscanf(after, name+" cwnd %d", &cwnd2)
+		if cwnd2 >= cwnd1 || cwnd2 < cwnd1/2 {
+			t.Errorf("%s cwnd %d -> %d after loss", name, cwnd1, cwnd2)
+		}
+	}
+
+	if _, err := NewCongestion("vegas"); err == nil {
+		t.Error("unknown congestion should fail")
+	}
+	if ct, err := NewCongestion(""); ct != nil || err != nil {
+		t.Error("empty congestion should return nil")
+	}
+}
+
+// 队列很浅的限速链路上，突发发送会把自己的包挤丢
+func TestCongestionPacing(t *testing.T) {
+	size := 512 * 1024
+	link := lossyLink{rate: 1024 * 1024, delay: 20 * time.Millisecond, maxQueue: 5 * time.Millisecond}
+
+	// 固定速率低于链路带宽，不会有排队丢包
+	_, drops, _ := runLossyTransfer(t, "", size/4, link, false)
+	sender := NewFrameMgr(500, 100000, 1024*1024, 10000, 200, 0, 0)
+	sender.SetPacing(900*1024, 2*1024)
+	if st := sender.Stats(); st.PacingRate != 0 {
+		t.Errorf("stats before Update %+v", st)
+	}
+	_, pdrops, st := runLossyTransferWith(t, sender, size/4, link)
+	t.Logf("fixed rate queue drops %d, without pacing %d", pdrops, drops)
+	if pdrops != 0 || drops <= 0 || st.PacingRate != 900*1024 || st.PacedNum <= 0 {
+		t.Errorf("fixed rate pacing drops %d without %d stats %+v", pdrops, drops, st)
+	}
+
+	// 跟随拥塞控制的速率
+	for _, name := range []string{"bbr", "cubic", "reno"} {
+		_, drops, _ := runLossyTransfer(t, name, size, link, false)
+		pcost, pdrops, st := runLossyTransfer(t, name, size, link, true)
+		t.Logf("%-5s queue drops %d, with pacing %d cost %v paced %d rate %d", name, drops, pdrops, pcost, st.PacedNum, st.PacingRate)
+		if st.PacedNum <= 0 || st.PacingRate <= 0 {
+			t.Errorf("%s pacing not work, paced %d rate %d", name, st.PacedNum, st.PacingRate)
+		}
+		if name == "bbr" && pdrops >= drops {
+			t.Errorf("bbr queue drops with pacing %d, should less than %d", pdrops, drops)
+		}
+	}
+}
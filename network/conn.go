@@ -1,11 +1,16 @@
 package network
 
 import (
+	"context"
 	"errors"
-	"github.com/esrrhs/gohome/common"
+	"fmt"
 	"io"
+	"net"
+	"sort"
 	"strings"
+	"sync"
 	"syscall"
+	"time"
 )
 
 /*
@@ -22,6 +27,11 @@ Conn 提供网络连接的抽象和具体实现，支持多种网络协议的连
 - KCP
 - QUIC
 - RHTTP
+- TLS
+- WS/WSS
+- UNIX/UNIXPACKET
+
+以上协议都通过 RegisterProto 注册到协议表中，使用方也可以注册自己的协议，之后同样通过 NewConn 创建。
 */
 
 // Conn 接口定义了网络连接的基本操作。
@@ -33,60 +43,127 @@ type Conn interface {
 	Info() string
 
 	Dial(dst string) (Conn, error)
+	DialContext(ctx context.Context, dst string) (Conn, error)
 
 	Listen(dst string) (Conn, error)
 	Accept() (Conn, error)
+	AcceptContext(ctx context.Context) (Conn, error)
+
+	// LocalAddr 返回本端地址，listener 返回监听地址。
+	LocalAddr() net.Addr
+	// RemoteAddr 返回对端地址，listener 返回 nil。
+	RemoteAddr() net.Addr
+
+	// SetDeadline 同时设置读写的截止时间，零值表示不超时，listener 不支持。
+	SetDeadline(t time.Time) error
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+}
+
+// ProtoFactory 用于创建某个协议的 Conn，config 为该协议自己的配置对象，为 nil 时使用默认配置。
+type ProtoFactory func(config interface{}) (Conn, error)
+
+type protoEntry struct {
+	factory  ProtoFactory
+	reliable bool
+}
+
+var (
+	gProtoLock sync.RWMutex
+	gProtos    = make(map[string]*protoEntry)
+)
+
+// RegisterProto 注册一个协议，之后即可通过 NewConn 创建，协议名不区分大小写，reliable 表示是否为可靠协议。
+func RegisterProto(name string, factory ProtoFactory, reliable bool) error {
+	name = strings.ToLower(name)
+	if name == "" {
+		return errors.New("empty proto name")
+	}
+	if factory == nil {
+		return errors.New("nil proto factory " + name)
+	}
+
+	gProtoLock.Lock()
+	defer gProtoLock.Unlock()
+
+	if _, ok := gProtos[name]; ok {
+		return errors.New("proto already registered " + name)
+	}
+	gProtos[name] = &protoEntry{factory: factory, reliable: reliable}
+	return nil
 }
 
-// NewConn 创建一个新的网络连接，支持的协议包括 TCP, UDP, RUDP, RICMP, KCP, QUIC 及 RHTTP。
+func mustRegisterProto(name string, factory ProtoFactory, reliable bool) {
+	if err := RegisterProto(name, factory, reliable); err != nil {
+		panic(err)
+	}
+}
+
+// errProtoConfig 返回协议不支持该配置类型的错误。
+func errProtoConfig(proto string, config interface{}) error {
+	return fmt.Errorf("proto %s not support config type %T", proto, config)
+}
+
+// NewConn 创建一个新的网络连接，使用协议的默认配置，内置支持 TCP, UDP, RUDP, RICMP, KCP, QUIC, RHTTP, TLS, WS/WSS 及 UNIX/UNIXPACKET。
 func NewConn(proto string) (Conn, error) {
+	return NewConnWithConfig(proto, nil)
+}
+
+// NewConnWithConfig 创建一个新的网络连接，config 会原样传给协议注册的 ProtoFactory。
+func NewConnWithConfig(proto string, config interface{}) (Conn, error) {
 	proto = strings.ToLower(proto)
-	if proto == "tcp" {
-		return &TcpConn{}, nil
-	} else if proto == "udp" {
-		return &UdpConn{}, nil
-	} else if proto == "rudp" {
-		return &RudpConn{}, nil
-	} else if proto == "ricmp" {
-		return &RicmpConn{id: common.UniqueId()}, nil
-	} else if proto == "kcp" {
-		return &KcpConn{}, nil
-	} else if proto == "quic" {
-		return &QuicConn{}, nil
-	} else if proto == "rhttp" {
-		return &RhttpConn{}, nil
+
+	gProtoLock.RLock()
+	entry, ok := gProtos[proto]
+	gProtoLock.RUnlock()
+
+	if !ok {
+		return nil, errors.New("undefined proto " + proto)
 	}
-	return nil, errors.New("undefined proto " + proto)
+	return entry.factory(config)
 }
 
-// SupportReliableProtos 返回支持的可靠协议列表。
-func SupportReliableProtos() []string {
+func protoNames(reliable bool) []string {
+	gProtoLock.RLock()
+	defer gProtoLock.RUnlock()
+
 	ret := make([]string, 0)
-	ret = append(ret, "tcp")
-	ret = append(ret, "rudp")
-	ret = append(ret, "ricmp")
-	ret = append(ret, "kcp")
-	ret = append(ret, "quic")
-	ret = append(ret, "rhttp")
+	for name, entry := range gProtos {
+		if entry.reliable == reliable {
+			ret = append(ret, name)
+		}
+	}
+	sort.Strings(ret)
 	return ret
 }
 
+// SupportReliableProtos 返回支持的可靠协议列表。
+func SupportReliableProtos() []string {
+	return protoNames(true)
+}
+
 // SupportProtos 返回支持的所有协议列表，包括可靠和不可靠的协议。
 func SupportProtos() []string {
 	ret := make([]string, 0)
 	ret = append(ret, SupportReliableProtos()...)
-	ret = append(ret, "udp")
+	ret = append(ret, protoNames(false)...)
 	return ret
 }
 
 // HasReliableProto 检查指定的协议是否为支持的可靠协议。
 func HasReliableProto(proto string) bool {
-	return common.HasString(SupportReliableProtos(), proto)
+	gProtoLock.RLock()
+	defer gProtoLock.RUnlock()
+	entry, ok := gProtos[strings.ToLower(proto)]
+	return ok && entry.reliable
 }
 
 // HasProto 检查指定的协议是否为支持的协议。
 func HasProto(proto string) bool {
-	return common.HasString(SupportProtos(), proto)
+	gProtoLock.RLock()
+	defer gProtoLock.RUnlock()
+	_, ok := gProtos[strings.ToLower(proto)]
+	return ok
 }
 
 // gControlOnConnSetup 用于注册连接设置的控制函数。
@@ -96,3 +173,95 @@ var gControlOnConnSetup func(network, address string, c syscall.RawConn) error
 func RegisterDialerController(fn func(network, address string, c syscall.RawConn) error) {
 	gControlOnConnSetup = fn
 }
+
+// aLongTimeAgo 是一个已经过去的时间点，设置为截止时间可以立即唤醒阻塞中的调用。
+var aLongTimeAgo = time.Unix(1, 0)
+
+var errListenerDeadline = errors.New("listener can not set deadline")
+
+// watchContext 在 ctx 结束时调用 fn 打断阻塞中的操作，返回的函数用于停止监视，并等待 fn 执行完毕。
+func watchContext(ctx context.Context, fn func()) func() {
+	if ctx.Done() == nil {
+		return func() {}
+	}
+	done := make(chan struct{})
+	exit := make(chan struct{})
+	go func() {
+		defer close(exit)
+		select {
+		case <-ctx.Done():
+			fn()
+		case <-done:
+		}
+	}()
+	return func() {
+		close(done)
+		<-exit
+	}
+}
+
+// connDeadline 记录读写的截止时间，供基于轮询实现的 Conn 使用。
+type connDeadline struct {
+	lock  sync.Mutex
+	read  time.Time
+	write time.Time
+}
+
+func (d *connDeadline) setRead(t time.Time) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.read = t
+}
+
+func (d *connDeadline) setWrite(t time.Time) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.write = t
+}
+
+func (d *connDeadline) readDeadline() time.Time {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.read
+}
+
+func (d *connDeadline) writeDeadline() time.Time {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.write
+}
+
+func (d *connDeadline) readTimeout() bool {
+	t := d.readDeadline()
+	return !t.IsZero() && !time.Now().Before(t)
+}
+
+func (d *connDeadline) writeTimeout() bool {
+	t := d.writeDeadline()
+	return !t.IsZero() && !time.Now().Before(t)
+}
+
+// pollSleep 用于轮询等待，休眠不会越过截止时间。
+func pollSleep(deadline time.Time) {
+	d := time.Millisecond * 100
+	if !deadline.IsZero() {
+		left := time.Until(deadline)
+		if left < d {
+			d = left
+		}
+	}
+	if d > 0 {
+		time.Sleep(d)
+	}
+}
+
+// deadlineTimer 返回一个在截止时间触发的 channel，截止时间为零值时返回 nil channel。
+func deadlineTimer(deadline time.Time) (<-chan time.Time, func()) {
+	if deadline.IsZero() {
+		return nil, func() {}
+	}
+	timer := time.NewTimer(time.Until(deadline))
+	return timer.C, func() {
+		timer.Stop()
+	}
+}
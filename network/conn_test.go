@@ -43,12 +43,17 @@ func TestNewConn(t *testing.T) {
 
 func TestSupportReliableProtos(t *testing.T) {
 	expected := map[string]bool{
-		"tcp":   true,
-		"rudp":  true,
-		"ricmp": true,
-		"kcp":   true,
-		"quic":  true,
-		"rhttp": true,
+		"tcp":    true,
+		"rudp":   true,
+		"ricmp":  true,
+		"kcp":    true,
+		"quic":   true,
+		"rhttp":  true,
+		"rhttps": true,
+		"tls":    true,
+		"unix":   true,
+		"ws":     true,
+		"wss":    true,
 	}
 
 	protos := SupportReliableProtos()
@@ -65,10 +70,10 @@ func TestSupportReliableProtos(t *testing.T) {
 func TestSupportProtos(t *testing.T) {
 	protos := SupportProtos()
 
-	// Must contain all reliable protos plus "udp"
+	// Must contain all reliable protos plus "udp" and "unixpacket"
 	reliableProtos := SupportReliableProtos()
-	if len(protos) != len(reliableProtos)+1 {
-		t.Fatalf("SupportProtos() returned %d protos, want %d", len(protos), len(reliableProtos)+1)
+	if len(protos) != len(reliableProtos)+2 {
+		t.Fatalf("SupportProtos() returned %d protos, want %d", len(protos), len(reliableProtos)+2)
 	}
 
 	set := make(map[string]bool)
@@ -83,6 +88,9 @@ func TestSupportProtos(t *testing.T) {
 	if !set["udp"] {
 		t.Error("SupportProtos() missing \"udp\"")
 	}
+	if !set["unixpacket"] {
+		t.Error("SupportProtos() missing \"unixpacket\"")
+	}
 }
 
 func TestHasReliableProto(t *testing.T) {
@@ -114,3 +122,61 @@ func TestHasProto(t *testing.T) {
 		t.Error("HasProto(\"\") = true, want false")
 	}
 }
+
+func TestRegisterProto(t *testing.T) {
+	defer func() {
+		gProtoLock.Lock()
+		delete(gProtos, "testproto")
+		gProtoLock.Unlock()
+	}()
+
+	var got interface{}
+	err := RegisterProto("TestProto", func(config interface{}) (Conn, error) {
+		got = config
+		return &TcpConn{}, nil
+	}, true)
+	if err != nil {
+		t.Fatalf("RegisterProto returned error: %v", err)
+	}
+
+	if err := RegisterProto("testproto", func(config interface{}) (Conn, error) {
+		return nil, nil
+	}, false); err == nil {
+		t.Fatal("RegisterProto duplicate should return error")
+	}
+	if err := RegisterProto("", nil, false); err == nil {
+		t.Fatal("RegisterProto empty name should return error")
+	}
+
+	if !HasProto("testproto") || !HasReliableProto("TESTPROTO") {
+		t.Fatal("registered proto not found")
+	}
+
+	cfg := &struct{ a int }{1}
+	conn, err := NewConnWithConfig("testproto", cfg)
+	if err != nil || conn == nil {
+		t.Fatalf("NewConnWithConfig returned %v %v", conn, err)
+	}
+	if got != cfg {
+		t.Fatal("config not passed to factory")
+	}
+}
+
+func TestNewConnWithConfig(t *testing.T) {
+	rc := DefaultRudpConfig()
+	rc.MaxWin = 123
+	conn, err := NewConnWithConfig("rudp", rc)
+	if err != nil {
+		t.Fatalf("NewConnWithConfig returned error: %v", err)
+	}
+	if conn.(*RudpConn).GetConfig() != rc {
+		t.Fatal("rudp config not set")
+	}
+
+	if _, err := NewConnWithConfig("rudp", DefaultUdpConfig()); err == nil {
+		t.Fatal("NewConnWithConfig with wrong config type should return error")
+	}
+	if _, err := NewConnWithConfig("tcp", rc); err == nil {
+		t.Fatal("NewConnWithConfig tcp with config should return error")
+	}
+}
@@ -0,0 +1,160 @@
+package network
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+/*
+CubicCongestion 实现了 CUBIC 拥塞控制算法（RFC 8312），适合高带宽高延迟的链路。
+
+算法原理：
+
+1. 慢启动和 NewReno 相同，窗口小于慢启动阈值时每个 rtt 翻倍。
+
+2. 拥塞避免阶段窗口按距离上次丢包的时间 t 的三次函数增长：W(t) = C*(t-K)^3 + Wmax，单位为包。
+   - Wmax 是上次丢包时的窗口，K 是窗口从降窗后的大小回到 Wmax 需要的时间。
+   - 窗口远小于 Wmax 时快速增长，接近 Wmax 时趋于平缓，超过后再加速探测更大的带宽。
+   - 同时计算 Reno 在相同时间能达到的窗口，取两者的较大值，保证在低延迟链路上不比 Reno 差。
+
+3. 丢包时窗口乘以 beta（0.7），如果本次 Wmax 比上次小，说明有新的流加入，使用快速收敛进一步降低 Wmax。
+   同一个恢复期内（一个 srtt）的多次丢包只处理一次。
+*/
+
+const (
+	cubic_c    = 0.4
+	cubic_beta = 0.7
+)
+
+type CubicCongestion struct {
+	flight       congestionFlight
+	cwnd         int
+	cwndFrac     float64
+	ssthresh     int
+	wmax         float64
+	lastWmax     float64
+	k            float64
+	epochStart   time.Time
+	srtt         time.Duration
+	recoverStart time.Time
+	lossNum      int
+}
+
+func (c *CubicCongestion) Init() {
+	c.flight.init()
+	c.cwnd = congestionInitSegs * c.flight.mss
+	c.cwndFrac = 0
+	c.ssthresh = 1 << 30
+	c.wmax = 0
+	c.lastWmax = 0
+	c.k = 0
+	c.epochStart = time.Time{}
+	c.srtt = 0
+	c.recoverStart = time.Time{}
+	c.lossNum = 0
+}
+
+func (c *CubicCongestion) RecvAck(id int, size int) {
+	acked := c.flight.ack(id)
+	if acked <= 0 || c.inRecovery() {
+		return
+	}
+	if c.cwnd < c.ssthresh {
+		c.cwnd += acked
+		return
+	}
+
+	mss := float64(c.flight.mss)
+	cur := float64(c.cwnd) / mss
+	now := time.Now()
+	if c.epochStart.IsZero() {
+		c.epochStart = now
+		if cur < c.wmax {
+			c.k = math.Cbrt((c.wmax - cur) / cubic_c)
+		} else {
+			c.k = 0
+			c.wmax = cur
+		}
+	}
+
+	rtt := c.getSrtt().Seconds()
+	t := now.Sub(c.epochStart).Seconds() + rtt
+	target := cubic_c*math.Pow(t-c.k, 3) + c.wmax
+	// Reno 在相同时间能达到的窗口
+	west := c.wmax*cubic_beta + 3*(1-cubic_beta)/(1+cubic_beta)*t/rtt
+	if west > target {
+		target = west
+	}
+
+	if target > cur {
+		c.cwndFrac += float64(acked) * (target - cur) / cur
+	} else {
+		c.cwndFrac += float64(acked) * 0.01 / cur
+	}
+	if c.cwndFrac >= 1 {
+		c.cwnd += int(c.cwndFrac)
+		c.cwndFrac -= math.Floor(c.cwndFrac)
+	}
+}
+
+// PacingRate 返回窗口除以 srtt，慢启动时乘以 2，拥塞避免时乘以 1.2，给窗口增长留出余量。
+func (c *CubicCongestion) PacingRate() int {
+	return congestionPacingRate(c.cwnd, c.ssthresh, c.srtt)
+}
+
+func (c *CubicCongestion) CanSend(id int, size int) bool {
+	return c.flight.canSend(id, size, c.cwnd)
+}
+
+func (c *CubicCongestion) Update() {
+}
+
+func (c *CubicCongestion) Info() string {
+	return fmt.Sprintf("cubic cwnd %v ssthresh %v wmax %.1f k %.3f inflight %v srtt %v loss %v", c.cwnd, c.ssthresh,
+		c.wmax, c.k, c.flight.inflight, c.srtt, c.lossNum)
+}
+
+func (c *CubicCongestion) OnRtt(rtt time.Duration) {
+	if c.srtt <= 0 {
+		c.srtt = rtt
+	} else {
+		c.srtt = (7*c.srtt + rtt) / 8
+	}
+}
+
+func (c *CubicCongestion) OnLoss(id int, size int) {
+	c.lossNum++
+	if c.inRecovery() {
+		return
+	}
+	c.recoverStart = time.Now()
+	c.epochStart = time.Time{}
+
+	cur := float64(c.cwnd) / float64(c.flight.mss)
+	if cur < c.lastWmax {
+		// 快速收敛，给新加入的流让出带宽
+		c.lastWmax = cur
+		c.wmax = cur * (1 + cubic_beta) / 2
+	} else {
+		c.lastWmax = cur
+		c.wmax = cur
+	}
+
+	c.cwnd = int(float64(c.cwnd) * cubic_beta)
+	if c.cwnd < congestionMinSegs*c.flight.mss {
+		c.cwnd = congestionMinSegs * c.flight.mss
+	}
+	c.ssthresh = c.cwnd
+}
+
+func (c *CubicCongestion) getSrtt() time.Duration {
+	if c.srtt <= 0 {
+		return congestionDefaultRtt
+	}
+	return c.srtt
+}
+
+func (c *CubicCongestion) inRecovery() bool {
+	return !c.recoverStart.IsZero() && time.Since(c.recoverStart) < c.getSrtt()
+}
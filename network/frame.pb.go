@@ -79,11 +79,15 @@ func (FrameData_TYPE) EnumDescriptor() ([]byte, []int) {
 type Frame_TYPE int32
 
 const (
-	Frame_DATA Frame_TYPE = 0
-	Frame_REQ  Frame_TYPE = 1
-	Frame_ACK  Frame_TYPE = 2
-	Frame_PING Frame_TYPE = 3
-	Frame_PONG Frame_TYPE = 4
+	Frame_DATA       Frame_TYPE = 0
+	Frame_REQ        Frame_TYPE = 1
+	Frame_ACK        Frame_TYPE = 2
+	Frame_PING       Frame_TYPE = 3
+	Frame_PONG       Frame_TYPE = 4
+	Frame_FEC        Frame_TYPE = 5
+	Frame_SACK       Frame_TYPE = 6
+	Frame_PMTU_PROBE Frame_TYPE = 7
+	Frame_PMTU_ACK   Frame_TYPE = 8
 )
 
 // Enum value maps for Frame_TYPE.
@@ -94,13 +98,21 @@ var (
 		2: "ACK",
 		3: "PING",
 		4: "PONG",
+		5: "FEC",
+		6: "SACK",
+		7: "PMTU_PROBE",
+		8: "PMTU_ACK",
 	}
 	Frame_TYPE_value = map[string]int32{
-		"DATA": 0,
-		"REQ":  1,
-		"ACK":  2,
-		"PING": 3,
-		"PONG": 4,
+		"DATA":       0,
+		"REQ":        1,
+		"ACK":        2,
+		"PING":       3,
+		"PONG":       4,
+		"FEC":        5,
+		"SACK":       6,
+		"PMTU_PROBE": 7,
+		"PMTU_ACK":   8,
 	}
 )
 
@@ -136,6 +148,8 @@ type FrameData struct {
 	Type          int32                  `protobuf:"varint,1,opt,name=type,proto3" json:"type,omitempty"`
 	Data          []byte                 `protobuf:"bytes,2,opt,name=data,proto3" json:"data,omitempty"`
 	Compress      bool                   `protobuf:"varint,3,opt,name=compress,proto3" json:"compress,omitempty"`
+	Features      int32                  `protobuf:"varint,4,opt,name=features,proto3" json:"features,omitempty"`
+	Compresstype  int32                  `protobuf:"varint,5,opt,name=compresstype,proto3" json:"compresstype,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
@@ -191,6 +205,20 @@ func (x *FrameData) GetCompress() bool {
 	return false
 }
 
+func (x *FrameData) GetFeatures() int32 {
+	if x != nil {
+		return x.Features
+	}
+	return 0
+}
+
+func (x *FrameData) GetCompresstype() int32 {
+	if x != nil {
+		return x.Compresstype
+	}
+	return 0
+}
+
 type Frame struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
 	Type          int32                  `protobuf:"varint,1,opt,name=type,proto3" json:"type,omitempty"`
@@ -200,6 +228,8 @@ type Frame struct {
 	Data          *FrameData             `protobuf:"bytes,5,opt,name=data,proto3" json:"data,omitempty"`
 	Dataid        []int32                `protobuf:"varint,6,rep,packed,name=dataid,proto3" json:"dataid,omitempty"`
 	Acked         bool                   `protobuf:"varint,7,opt,name=acked,proto3" json:"acked,omitempty"`
+	Fecnum        int32                  `protobuf:"varint,8,opt,name=fecnum,proto3" json:"fecnum,omitempty"`
+	Ranges        []int32                `protobuf:"varint,9,rep,packed,name=ranges,proto3" json:"ranges,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
@@ -283,21 +313,37 @@ func (x *Frame) GetAcked() bool {
 	return false
 }
 
+func (x *Frame) GetFecnum() int32 {
+	if x != nil {
+		return x.Fecnum
+	}
+	return 0
+}
+
+func (x *Frame) GetRanges() []int32 {
+	if x != nil {
+		return x.Ranges
+	}
+	return nil
+}
+
 var File_frame_proto protoreflect.FileDescriptor
 
 const file_frame_proto_rawDesc = "" +
 	"\n" +
-	"\vframe.proto\"\x90\x01\n" +
+	"\vframe.proto\"\xd0\x01\n" +
 	"\tFrameData\x12\x12\n" +
 	"\x04type\x18\x01 \x01(\x05R\x04type\x12\x12\n" +
 	"\x04data\x18\x02 \x01(\fR\x04data\x12\x1a\n" +
-	"\bcompress\x18\x03 \x01(\bR\bcompress\"?\n" +
+	"\bcompress\x18\x03 \x01(\bR\bcompress\x12\x1a\n" +
+	"\bfeatures\x18\x04 \x01(\x05R\bfeatures\x12\"\n" +
+	"\fcompresstype\x18\x05 \x01(\x05R\fcompresstype\"?\n" +
 	"\x04TYPE\x12\r\n" +
 	"\tUSER_DATA\x10\x00\x12\b\n" +
 	"\x04CONN\x10\x01\x12\v\n" +
 	"\aCONNRSP\x10\x02\x12\t\n" +
 	"\x05CLOSE\x10\x03\x12\x06\n" +
-	"\x02HB\x10\x04\"\xe5\x01\n" +
+	"\x02HB\x10\x04\"\xc6\x02\n" +
 	"\x05Frame\x12\x12\n" +
 	"\x04type\x18\x01 \x01(\x05R\x04type\x12\x16\n" +
 	"\x06resend\x18\x02 \x01(\bR\x06resend\x12\x1a\n" +
@@ -306,13 +352,20 @@ const file_frame_proto_rawDesc = "" +
 	"\x04data\x18\x05 \x01(\v2\n" +
 	".FrameDataR\x04data\x12\x16\n" +
 	"\x06dataid\x18\x06 \x03(\x05R\x06dataid\x12\x14\n" +
-	"\x05acked\x18\a \x01(\bR\x05acked\"6\n" +
+	"\x05acked\x18\a \x01(\bR\x05acked\x12\x16\n" +
+	"\x06fecnum\x18\b \x01(\x05R\x06fecnum\x12\x16\n" +
+	"\x06ranges\x18\t \x03(\x05R\x06ranges\"g\n" +
 	"\x04TYPE\x12\b\n" +
 	"\x04DATA\x10\x00\x12\a\n" +
 	"\x03REQ\x10\x01\x12\a\n" +
 	"\x03ACK\x10\x02\x12\b\n" +
 	"\x04PING\x10\x03\x12\b\n" +
-	"\x04PONG\x10\x04B\fZ\n" +
+	"\x04PONG\x10\x04\x12\a\n" +
+	"\x03FEC\x10\x05\x12\b\n" +
+	"\x04SACK\x10\x06\x12\x0e\n" +
+	"\n" +
+	"PMTU_PROBE\x10\a\x12\f\n" +
+	"\bPMTU_ACK\x10\bB\fZ\n" +
 	"./;networkb\x06proto3"
 
 var (
@@ -0,0 +1,247 @@
+package network
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+)
+
+/*
+FrameCodec 是 Frame 的紧凑二进制编码，替代发送热路径上的 protobuf，编码时直接追加到调用方的缓冲区，不分配内存。
+
+格式为 magic(1) | type(1) | flags(2) | id(4)，之后按 flags 依次出现：
+  - sendtime(8)、fecnum(4)
+  - dataid、ranges：个数(2) 加上每个 4 字节
+  - data：type(1)，compresstype(1)，features(4)，剩下的字节都是 data.data
+
+整数都是大端序。protobuf 编码的 Frame 第一个字节是字段标签，不会是 frameCodecMagic，所以接收端可以直接区分两种编码，
+总是能解析；发送端在对端的 CONN 或 CONNRSP 中看到 frameFeatureBinary 后才使用二进制编码，和旧版本通信时仍然使用 protobuf。
+
+发送时使用 GetFrameBuffer 取得缓冲区，MarshalFrameTo 追加编码，发送完成后 PutFrameBuffer 放回。
+*/
+
+const (
+	frameFeatureBinary = 1 << 3
+
+	frameCodecMagic     = 0xFB
+	frameCodecHeaderLen = 8
+	frameBufferSize     = 2048
+
+	frameFlagResend       = 1 << 0
+	frameFlagAcked        = 1 << 1
+	frameFlagSendtime     = 1 << 2
+	frameFlagFecnum       = 1 << 3
+	frameFlagDataid       = 1 << 4
+	frameFlagRanges       = 1 << 5
+	frameFlagData         = 1 << 6
+	frameFlagCompress     = 1 << 7
+	frameFlagCompresstype = 1 << 8
+	frameFlagFeatures     = 1 << 9
+)
+
+var errFrameCodecShort = errors.New("frame codec packet too short")
+
+var gFrameBufferPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 0, frameBufferSize)
+		return &b
+	},
+}
+
+// GetFrameBuffer 从池中取一个长度为 0 的缓冲区。
+func GetFrameBuffer() *[]byte {
+	b := gFrameBufferPool.Get().(*[]byte)
+	*b = (*b)[:0]
+	return b
+}
+
+// PutFrameBuffer 放回缓冲区，之后不能再使用其中的数据。
+func PutFrameBuffer(b *[]byte) {
+	gFrameBufferPool.Put(b)
+}
+
+// frameCodecSupported 检查帧能不能用二进制编码，超出编码范围的交给 protobuf。
+func frameCodecSupported(f *Frame) bool {
+	if f.Type < 0 || f.Type > 0xFF || len(f.Dataid) > 0xFFFF || len(f.Ranges) > 0xFFFF {
+		return false
+	}
+	if f.Data != nil && (f.Data.Type < 0 || f.Data.Type > 0xFF || f.Data.Compresstype < 0 || f.Data.Compresstype > 0xFF) {
+		return false
+	}
+	return true
+}
+
+func appendFrameInt32s(dst []byte, v []int32) []byte {
+	dst = binary.BigEndian.AppendUint16(dst, uint16(len(v)))
+	for _, id := range v {
+		dst = binary.BigEndian.AppendUint32(dst, uint32(id))
+	}
+	return dst
+}
+
+// encodeFrame 把帧编码追加到 dst，调用前需要 frameCodecSupported 检查。
+func encodeFrame(dst []byte, f *Frame) []byte {
+	var flags uint16
+	if f.Resend {
+		flags |= frameFlagResend
+	}
+	if f.Acked {
+		flags |= frameFlagAcked
+	}
+	if f.Sendtime != 0 {
+		flags |= frameFlagSendtime
+	}
+	if f.Fecnum != 0 {
+		flags |= frameFlagFecnum
+	}
+	if len(f.Dataid) > 0 {
+		flags |= frameFlagDataid
+	}
+	if len(f.Ranges) > 0 {
+		flags |= frameFlagRanges
+	}
+	if f.Data != nil {
+		flags |= frameFlagData
+		if f.Data.Compress {
+			flags |= frameFlagCompress
+		}
+		if f.Data.Compresstype != 0 {
+			flags |= frameFlagCompresstype
+		}
+		if f.Data.Features != 0 {
+			flags |= frameFlagFeatures
+		}
+	}
+
+	dst = append(dst, frameCodecMagic, byte(f.Type))
+	dst = binary.BigEndian.AppendUint16(dst, flags)
+	dst = binary.BigEndian.AppendUint32(dst, uint32(f.Id))
+	if flags&frameFlagSendtime != 0 {
+		dst = binary.BigEndian.AppendUint64(dst, uint64(f.Sendtime))
+	}
+	if flags&frameFlagFecnum != 0 {
+		dst = binary.BigEndian.AppendUint32(dst, uint32(f.Fecnum))
+	}
+	if flags&frameFlagDataid != 0 {
+		dst = appendFrameInt32s(dst, f.Dataid)
+	}
+	if flags&frameFlagRanges != 0 {
+		dst = appendFrameInt32s(dst, f.Ranges)
+	}
+	if flags&frameFlagData != 0 {
+		dst = append(dst, byte(f.Data.Type))
+		if flags&frameFlagCompresstype != 0 {
+			dst = append(dst, byte(f.Data.Compresstype))
+		}
+		if flags&frameFlagFeatures != 0 {
+			dst = binary.BigEndian.AppendUint32(dst, uint32(f.Data.Features))
+		}
+		dst = append(dst, f.Data.Data...)
+	}
+	return dst
+}
+
+func isBinaryFrame(b []byte) bool {
+	return len(b) > 0 && b[0] == frameCodecMagic
+}
+
+func decodeFrameInt32s(b []byte) ([]int32, []byte, error) {
+	if len(b) < 2 {
+		return nil, nil, errFrameCodecShort
+	}
+	n := int(binary.BigEndian.Uint16(b))
+	b = b[2:]
+	if len(b) < n*4 {
+		return nil, nil, errFrameCodecShort
+	}
+	v := make([]int32, n)
+	for i := range v {
+		v[i] = int32(binary.BigEndian.Uint32(b[i*4:]))
+	}
+	return v, b[n*4:], nil
+}
+
+// frameBox 让解码的 Frame 和 FrameData 只分配一次。
+type frameBox struct {
+	f  Frame
+	fd FrameData
+}
+
+// decodeFrame 解码二进制帧，data 会拷贝出来，b 可以在返回后复用。
+func decodeFrame(b []byte) (*Frame, error) {
+	if len(b) < frameCodecHeaderLen {
+		return nil, errFrameCodecShort
+	}
+	if b[0] != frameCodecMagic {
+		return nil, errors.New("frame codec magic mismatch")
+	}
+	box := &frameBox{}
+	f := &box.f
+	f.Type = int32(b[1])
+	flags := binary.BigEndian.Uint16(b[2:])
+	f.Id = int32(binary.BigEndian.Uint32(b[4:]))
+	f.Resend = flags&frameFlagResend != 0
+	f.Acked = flags&frameFlagAcked != 0
+	b = b[frameCodecHeaderLen:]
+
+	if flags&frameFlagSendtime != 0 {
+		if len(b) < 8 {
+			return nil, errFrameCodecShort
+		}
+		f.Sendtime = int64(binary.BigEndian.Uint64(b))
+		b = b[8:]
+	}
+	if flags&frameFlagFecnum != 0 {
+		if len(b) < 4 {
+			return nil, errFrameCodecShort
+		}
+		f.Fecnum = int32(binary.BigEndian.Uint32(b))
+		b = b[4:]
+	}
+	var err error
+	if flags&frameFlagDataid != 0 {
+		if f.Dataid, b, err = decodeFrameInt32s(b); err != nil {
+			return nil, err
+		}
+	}
+	if flags&frameFlagRanges != 0 {
+		if f.Ranges, b, err = decodeFrameInt32s(b); err != nil {
+			return nil, err
+		}
+	}
+	if flags&frameFlagData != 0 {
+		fd := &box.fd
+		if len(b) < 1 {
+			return nil, errFrameCodecShort
+		}
+		fd.Type = int32(b[0])
+		b = b[1:]
+		fd.Compress = flags&frameFlagCompress != 0
+		if flags&frameFlagCompresstype != 0 {
+			if len(b) < 1 {
+				return nil, errFrameCodecShort
+			}
+			fd.Compresstype = int32(b[0])
+			b = b[1:]
+		}
+		if flags&frameFlagFeatures != 0 {
+			if len(b) < 4 {
+				return nil, errFrameCodecShort
+			}
+			fd.Features = int32(binary.BigEndian.Uint32(b))
+			b = b[4:]
+		}
+		if len(b) > 0 {
+			fd.Data = make([]byte, len(b))
+			copy(fd.Data, b)
+		}
+		f.Data = fd
+	} else if len(b) > 0 {
+		return nil, errors.New("frame codec trailing data")
+	}
+	return f, nil
+}
+
+func (fm *FrameMgr) useBinary() bool {
+	return fm.features&frameFeatureBinary != 0 && fm.peerFeatures&frameFeatureBinary != 0
+}
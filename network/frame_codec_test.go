@@ -0,0 +1,162 @@
+package network
+
+import (
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+)
+
+func testCodecFrames() []*Frame {
+	return []*Frame{
+		{Type: (int32)(Frame_DATA), Id: 12345, Sendtime: time.Now().UnixNano(), Resend: true,
+			Data: &FrameData{Type: (int32)(FrameData_USER_DATA), Data: []byte("hello world"), Compress: true, Compresstype: frameCompressFlate}},
+		{Type: (int32)(Frame_DATA), Id: 0, Data: &FrameData{Type: (int32)(FrameData_CONN), Features: 15}},
+		{Type: (int32)(Frame_DATA), Id: 99999, Data: &FrameData{Type: (int32)(FrameData_HB)}},
+		{Type: (int32)(Frame_ACK), Dataid: []int32{1, 2, 3, 99999}},
+		{Type: (int32)(Frame_REQ), Ranges: []int32{5, 3, 100, 1}},
+		{Type: (int32)(Frame_SACK), Id: 7, Ranges: []int32{9, 2}},
+		{Type: (int32)(Frame_PING), Sendtime: 1},
+		{Type: (int32)(Frame_FEC), Id: 1, Fecnum: 2, Dataid: []int32{10, 11}, Data: &FrameData{Data: []byte{1, 2, 3}}},
+		{Type: (int32)(Frame_PMTU_ACK), Id: 1200},
+	}
+}
+
+func newTestBinaryFrameMgr() *FrameMgr {
+	fm := NewFrameMgr(800, 100000, 1024*1024, 1000, 50, 0, 0)
+	fm.peerFeatures = fm.features
+	return fm
+}
+
+func TestFrameCodecRoundTrip(t *testing.T) {
+	fm := newTestBinaryFrameMgr()
+	for i, f := range testCodecFrames() {
+		mb, err := fm.MarshalFrame(f)
+		if err != nil || !isBinaryFrame(mb) {
+			t.Fatalf("frame %d marshal %v", i, err)
+		}
+		rf, err := fm.UnmarshalFrame(mb)
+		if err != nil {
+			t.Fatalf("frame %d unmarshal %v", i, err)
+		}
+		if !proto.Equal(f, rf) {
+			t.Errorf("frame %d diff %v %v", i, f, rf)
+		}
+		for n := 1; n < len(mb); n++ {
+			if rf, err := fm.UnmarshalFrame(mb[:n]); err == nil && proto.Equal(f, rf) {
+				t.Errorf("frame %d truncated to %d decoded", i, n)
+			}
+		}
+	}
+
+	// 还没有协商时使用 protobuf，两种编码都能解析
+	old := NewFrameMgr(800, 100000, 1024*1024, 1000, 50, 0, 0)
+	for i, f := range testCodecFrames() {
+		mb, err := old.MarshalFrame(f)
+		if err != nil || isBinaryFrame(mb) {
+			t.Fatalf("frame %d marshal %v", i, err)
+		}
+		if rf, err := fm.UnmarshalFrame(mb); err != nil || !proto.Equal(f, rf) {
+			t.Errorf("frame %d proto decode %v", i, err)
+		}
+	}
+}
+
+func TestFrameCodecCrypto(t *testing.T) {
+	fc1, _ := NewFrameCrypto("aes-gcm", []byte("key"), 0, 0)
+	fc2, _ := NewFrameCrypto("aes-gcm", []byte("key"), 0, 0)
+	sender := newTestBinaryFrameMgr()
+	sender.SetCrypto(fc1)
+	receiver := newTestBinaryFrameMgr()
+	receiver.SetCrypto(fc2)
+
+	bp := GetFrameBuffer()
+	defer PutFrameBuffer(bp)
+	for i, f := range testCodecFrames() {
+		mb, err := sender.MarshalFrameTo((*bp)[:0], f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		*bp = mb
+		if rf, err := receiver.UnmarshalFrame(mb); err != nil || !proto.Equal(f, rf) {
+			t.Errorf("frame %d crypto decode %v", i, err)
+		}
+	}
+}
+
+func TestFrameCodecNegotiate(t *testing.T) {
+	client := NewFrameMgr(800, 100000, 1024*1024, 1000, 50, 0, 0)
+	server := NewFrameMgr(800, 100000, 1024*1024, 1000, 50, 0, 0)
+	runFrameMgrPair(t, client, server, 50*1024, func(id int32) bool {
+		return id%7 == 3
+	})
+	if !client.useBinary() || !server.useBinary() {
+		t.Fatal("binary codec not negotiated")
+	}
+
+	client = NewFrameMgr(800, 100000, 1024*1024, 1000, 50, 0, 0)
+	server = NewFrameMgr(800, 100000, 1024*1024, 1000, 50, 0, 0)
+	server.features = 0
+	runFrameMgrPair(t, client, server, 50*1024, func(id int32) bool {
+		return false
+	})
+	mb, _ := client.MarshalFrame(testCodecFrames()[0])
+	if client.useBinary() || isBinaryFrame(mb) {
+		t.Fatal("binary codec with old peer")
+	}
+}
+
+func TestFrameCodecAllocs(t *testing.T) {
+	fm := newTestBinaryFrameMgr()
+	f := &Frame{Type: (int32)(Frame_DATA), Id: 1, Sendtime: 1,
+		Data: &FrameData{Type: (int32)(FrameData_USER_DATA), Data: make([]byte, 800)}}
+	allocs := testing.AllocsPerRun(1000, func() {
+		bp := GetFrameBuffer()
+		mb, _ := fm.MarshalFrameTo(*bp, f)
+		*bp = mb
+		PutFrameBuffer(bp)
+	})
+	if allocs != 0 {
+		t.Errorf("MarshalFrameTo allocs %v", allocs)
+	}
+}
+
+func benchmarkMarshalFrame(b *testing.B, fm *FrameMgr) {
+	f := &Frame{Type: (int32)(Frame_DATA), Id: 1, Sendtime: time.Now().UnixNano(),
+		Data: &FrameData{Type: (int32)(FrameData_USER_DATA), Data: make([]byte, 800)}}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		bp := GetFrameBuffer()
+		mb, _ := fm.MarshalFrameTo(*bp, f)
+		*bp = mb
+		PutFrameBuffer(bp)
+	}
+}
+
+func benchmarkUnmarshalFrame(b *testing.B, fm *FrameMgr) {
+	f := &Frame{Type: (int32)(Frame_DATA), Id: 1, Sendtime: time.Now().UnixNano(),
+		Data: &FrameData{Type: (int32)(FrameData_USER_DATA), Data: make([]byte, 800)}}
+	mb, _ := fm.MarshalFrame(f)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		fm.UnmarshalFrame(mb)
+	}
+}
+
+func BenchmarkMarshalFrameProto(b *testing.B) {
+	benchmarkMarshalFrame(b, NewFrameMgr(800, 100000, 1024*1024, 1000, 50, 0, 0))
+}
+
+func BenchmarkMarshalFrameBinary(b *testing.B) {
+	benchmarkMarshalFrame(b, newTestBinaryFrameMgr())
+}
+
+func BenchmarkUnmarshalFrameProto(b *testing.B) {
+	benchmarkUnmarshalFrame(b, NewFrameMgr(800, 100000, 1024*1024, 1000, 50, 0, 0))
+}
+
+func BenchmarkUnmarshalFrameBinary(b *testing.B) {
+	benchmarkUnmarshalFrame(b, newTestBinaryFrameMgr())
+}
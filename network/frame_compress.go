@@ -0,0 +1,95 @@
+package network
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+
+	"github.com/esrrhs/gohome/common"
+)
+
+/*
+FrameCompress 定义了 FrameMgr 支持的压缩算法，压缩后的 FrameData 在 compresstype 中标明使用的算法。
+
+zlib 是原来的算法，所有版本都能解压；flate 去掉了 zlib 的头和校验，使用最快的压缩级别，更适合小的帧。
+对端不支持 frameFeatureCompress 时只使用 zlib。
+*/
+
+const (
+	frameFeatureCompress = 1 << 2
+
+	frameCompressZlib  = 0
+	frameCompressFlate = 1
+)
+
+type frameCompressor struct {
+	id         int32
+	compress   func(src []byte) []byte
+	decompress func(src []byte) ([]byte, error)
+}
+
+var gFrameCompressors = map[string]*frameCompressor{
+	"zlib":  {id: frameCompressZlib, compress: common.CompressData, decompress: common.DeCompressData},
+	"flate": {id: frameCompressFlate, compress: flateCompress, decompress: flateDecompress},
+}
+
+func getFrameCompressor(name string) (*frameCompressor, error) {
+	c, ok := gFrameCompressors[name]
+	if !ok {
+		return nil, errors.New("unsupported compress " + name)
+	}
+	return c, nil
+}
+
+func getFrameCompressorById(id int32) (*frameCompressor, error) {
+	for _, c := range gFrameCompressors {
+		if c.id == id {
+			return c, nil
+		}
+	}
+	return nil, errors.New("unsupported compress type")
+}
+
+func flateCompress(src []byte) []byte {
+	var b bytes.Buffer
+	w, _ := flate.NewWriter(&b, flate.BestSpeed)
+	w.Write(src)
+	w.Close()
+	return b.Bytes()
+}
+
+func flateDecompress(src []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(src))
+	defer r.Close()
+	var out bytes.Buffer
+	if _, err := io.Copy(&out, r); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// compressFrameData 按配置压缩，压缩后没有变小就保持原样。
+func (fm *FrameMgr) compressFrameData(fd *FrameData) {
+	if fm.compressor == nil || len(fd.Data) <= fm.config.CompressMinSize {
+		return
+	}
+	c := fm.compressor
+	if c.id != frameCompressZlib && fm.peerFeatures&frameFeatureCompress == 0 {
+		c = gFrameCompressors["zlib"]
+	}
+	newb := c.compress(fd.Data)
+	if len(newb) < len(fd.Data) {
+		fd.Data = newb
+		fd.Compress = true
+		fd.Compresstype = c.id
+	}
+}
+
+func (fm *FrameMgr) decompressFrameData(fd *FrameData) ([]byte, error) {
+	c, err := getFrameCompressorById(fd.Compresstype)
+	if err != nil {
+		return nil, err
+	}
+	return c.decompress(fd.Data)
+}
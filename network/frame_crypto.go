@@ -0,0 +1,304 @@
+package network
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+/*
+FrameCrypto 为 FrameMgr 的每个包提供 AEAD 加密和认证，支持 aes-gcm 和 chacha20-poly1305。
+
+包格式为 salt(12) | epoch(4) | counter(8) | 密文，前 24 字节作为附加数据参与认证。
+  - salt 是每端创建时生成的，前 4 字节为 unix 时间，后 8 字节随机，保证双方即使使用同一个预共享密钥，两个方向的密钥也不同。
+  - epoch 每轮换一次加一，密钥为 HMAC-SHA256(psk, salt || epoch)，按包数或时间轮换。
+  - counter 在整个连接内递增，和 epoch 一起组成 nonce，同时用于防重放窗口。
+
+收到第一个认证通过的包后，接收端锁定对端的 salt，之后其他 salt 的包都丢弃，防止把别的会话的包重放进来。
+listener 上的所有连接共用一个 frameSaltCache，salt 的时间和本地相差超过 frameCryptoSaltMaxSkew 或者窗口内已经见过的不能建立会话，
+所以截获的会话换一个地址，或者在连接关闭后重放都会被拒绝。
+*/
+
+const (
+	frameCryptoSaltLen     = 12
+	frameCryptoHeaderLen   = frameCryptoSaltLen + 4 + 8
+	frameCryptoReplayWin   = 1024
+	frameCryptoKdfContext  = "gohome frame crypto"
+	frameCryptoSaltMaxSkew = 5 * time.Minute
+)
+
+type FrameCrypto struct {
+	algo           string
+	psk            []byte
+	rotatePkgs     uint64
+	rotateInterval time.Duration
+
+	sendlock      sync.Mutex
+	sendSalt      [frameCryptoSaltLen]byte
+	sendEpoch     uint32
+	sendCounter   uint64
+	sendEpochPkgs uint64
+	sendEpochTime time.Time
+	sendAead      cipher.AEAD
+
+	recvlock     sync.Mutex
+	recvSalt     [frameCryptoSaltLen]byte
+	recvLocked   bool
+	recvMaxEpoch uint32
+	recvAeads    map[uint32]cipher.AEAD
+	replay       frameReplayWindow
+	salts        *frameSaltCache // listener 共用，dialer 为 nil
+}
+
+// NewFrameCrypto 创建一个连接使用的加密器，rotatePkgs、rotateInterval 为 0 表示不按该条件轮换。
+func NewFrameCrypto(algo string, psk []byte, rotatePkgs int, rotateInterval time.Duration) (*FrameCrypto, error) {
+	if algo != "aes-gcm" && algo != "chacha20-poly1305" {
+		return nil, errors.New("unsupported crypto " + algo)
+	}
+	if len(psk) <= 0 {
+		return nil, errors.New("empty crypto key")
+	}
+
+	fc := &FrameCrypto{
+		algo:           algo,
+		psk:            append([]byte(nil), psk...),
+		rotatePkgs:     uint64(rotatePkgs),
+		rotateInterval: rotateInterval,
+		sendEpochTime:  time.Now(),
+		recvAeads:      make(map[uint32]cipher.AEAD),
+	}
+	binary.BigEndian.PutUint32(fc.sendSalt[:], uint32(time.Now().Unix()))
+	if _, err := rand.Read(fc.sendSalt[4:]); err != nil {
+		return nil, err
+	}
+	aead, err := fc.newAead(fc.sendSalt[:], fc.sendEpoch)
+	if err != nil {
+		return nil, err
+	}
+	fc.sendAead = aead
+	return fc, nil
+}
+
+// newFrameCryptoByConfig 根据 RudpConfig/RicmpConfig 的配置创建，没有配置加密时返回 nil。
+func newFrameCryptoByConfig(algo string, key string, rotatePkgs int, rotateMs int) (*FrameCrypto, error) {
+	if algo == "" {
+		return nil, nil
+	}
+	return NewFrameCrypto(algo, []byte(key), rotatePkgs, time.Duration(rotateMs)*time.Millisecond)
+}
+
+func (fc *FrameCrypto) newAead(salt []byte, epoch uint32) (cipher.AEAD, error) {
+	mac := hmac.New(sha256.New, fc.psk)
+	mac.Write([]byte(frameCryptoKdfContext))
+	mac.Write(salt)
+	var eb [4]byte
+	binary.BigEndian.PutUint32(eb[:], epoch)
+	mac.Write(eb[:])
+	key := mac.Sum(nil)
+
+	if fc.algo == "chacha20-poly1305" {
+		return chacha20poly1305.New(key)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (fc *FrameCrypto) rotate() error {
+	if fc.rotatePkgs > 0 && fc.sendEpochPkgs >= fc.rotatePkgs ||
+		fc.rotateInterval > 0 && time.Since(fc.sendEpochTime) >= fc.rotateInterval {
+		aead, err := fc.newAead(fc.sendSalt[:], fc.sendEpoch+1)
+		if err != nil {
+			return err
+		}
+		fc.sendEpoch++
+		fc.sendAead = aead
+		fc.sendEpochPkgs = 0
+		fc.sendEpochTime = time.Now()
+	}
+	return nil
+}
+
+// Seal 加密一个包，返回新分配的内存。
+func (fc *FrameCrypto) Seal(plain []byte) ([]byte, error) {
+	return fc.SealTo(nil, plain)
+}
+
+// SealTo 加密一个包并追加到 dst，dst 的容量足够时不分配内存，plain 不能和 dst 重叠。
+func (fc *FrameCrypto) SealTo(dst []byte, plain []byte) ([]byte, error) {
+	fc.sendlock.Lock()
+	defer fc.sendlock.Unlock()
+
+	if err := fc.rotate(); err != nil {
+		return nil, err
+	}
+	fc.sendCounter++
+	fc.sendEpochPkgs++
+
+	if dst == nil {
+		dst = make([]byte, 0, frameCryptoHeaderLen+len(plain)+fc.sendAead.Overhead())
+	}
+	start := len(dst)
+	dst = append(dst, fc.sendSalt[:]...)
+	dst = binary.BigEndian.AppendUint32(dst, fc.sendEpoch)
+	dst = binary.BigEndian.AppendUint64(dst, fc.sendCounter)
+
+	header := dst[start:]
+	nonce := header[frameCryptoSaltLen:frameCryptoHeaderLen]
+	return fc.sendAead.Seal(dst, nonce, plain, header), nil
+}
+
+// Open 校验并解密一个包，认证失败、重放或者不属于当前会话的包返回错误。
+func (fc *FrameCrypto) Open(packet []byte) ([]byte, error) {
+	if len(packet) < frameCryptoHeaderLen {
+		return nil, errors.New("crypto packet too short")
+	}
+	salt := packet[:frameCryptoSaltLen]
+	epoch := binary.BigEndian.Uint32(packet[frameCryptoSaltLen:])
+	counter := binary.BigEndian.Uint64(packet[frameCryptoSaltLen+4:])
+
+	fc.recvlock.Lock()
+	defer fc.recvlock.Unlock()
+
+	if fc.recvLocked {
+		if !bytes.Equal(salt, fc.recvSalt[:]) {
+			return nil, errors.New("crypto salt mismatch")
+		}
+		// 只保留当前和上一个 epoch 的密钥，容忍轮换时的乱序
+		if epoch+1 < fc.recvMaxEpoch {
+			return nil, errors.New("crypto epoch too old")
+		}
+	}
+	if !fc.replay.check(counter) {
+		return nil, errors.New("crypto replay packet")
+	}
+
+	aead, ok := fc.recvAeads[epoch]
+	if !ok || !fc.recvLocked {
+		var err error
+		aead, err = fc.newAead(salt, epoch)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	nonce := packet[frameCryptoSaltLen:frameCryptoHeaderLen]
+	plain, err := aead.Open(nil, nonce, packet[frameCryptoHeaderLen:], packet[:frameCryptoHeaderLen])
+	if err != nil {
+		return nil, err
+	}
+
+	// 认证通过后才修改状态，伪造的包不会影响会话
+	if !fc.recvLocked {
+		if fc.salts != nil && !fc.salts.use(salt) {
+			return nil, errors.New("crypto salt replayed")
+		}
+		copy(fc.recvSalt[:], salt)
+		fc.recvLocked = true
+		fc.recvMaxEpoch = epoch
+	}
+	fc.replay.accept(counter)
+	fc.recvAeads[epoch] = aead
+	if epoch > fc.recvMaxEpoch {
+		fc.recvMaxEpoch = epoch
+	}
+	for e := range fc.recvAeads {
+		if e+1 < fc.recvMaxEpoch {
+			delete(fc.recvAeads, e)
+		}
+	}
+	return plain, nil
+}
+
+// Overhead 返回每个包增加的字节数。
+func (fc *FrameCrypto) Overhead() int {
+	return frameCryptoHeaderLen + fc.sendAead.Overhead()
+}
+
+// frameSaltCache 记录 listener 上见过的对端 salt，时间窗口内同一个 salt 只能建立一次会话。
+type frameSaltCache struct {
+	lock      sync.Mutex
+	salts     map[[frameCryptoSaltLen]byte]int64 // salt 和过期时间
+	lastPrune int64
+}
+
+func newFrameSaltCache() *frameSaltCache {
+	return &frameSaltCache{salts: make(map[[frameCryptoSaltLen]byte]int64)}
+}
+
+// use 记录 salt 直到超出时间窗口，返回 false 表示 salt 的时间超出窗口或者已经用过。
+func (sc *frameSaltCache) use(salt []byte) bool {
+	t := int64(binary.BigEndian.Uint32(salt))
+	skew := time.Since(time.Unix(t, 0))
+	if skew > frameCryptoSaltMaxSkew || skew < -frameCryptoSaltMaxSkew {
+		return false
+	}
+
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+
+	// 过期的 salt 对应的时间已经超出窗口，不需要再记录
+	now := time.Now().Unix()
+	if now != sc.lastPrune {
+		sc.lastPrune = now
+		for k, expire := range sc.salts {
+			if expire < now {
+				delete(sc.salts, k)
+			}
+		}
+	}
+
+	var key [frameCryptoSaltLen]byte
+	copy(key[:], salt)
+	if _, ok := sc.salts[key]; ok {
+		return false
+	}
+	sc.salts[key] = t + int64(frameCryptoSaltMaxSkew/time.Second)
+	return true
+}
+
+type frameReplayWindow struct {
+	max    uint64
+	bitmap [frameCryptoReplayWin / 64]uint64
+}
+
+func (w *frameReplayWindow) check(counter uint64) bool {
+	if counter == 0 {
+		return false
+	}
+	if counter > w.max {
+		return true
+	}
+	if w.max-counter >= frameCryptoReplayWin {
+		return false
+	}
+	idx := counter % frameCryptoReplayWin
+	return w.bitmap[idx/64]&(1<<(idx%64)) == 0
+}
+
+func (w *frameReplayWindow) accept(counter uint64) {
+	if counter > w.max {
+		if counter-w.max >= frameCryptoReplayWin {
+			w.bitmap = [frameCryptoReplayWin / 64]uint64{}
+		} else {
+			for i := w.max + 1; i < counter; i++ {
+				idx := i % frameCryptoReplayWin
+				w.bitmap[idx/64] &^= 1 << (idx % 64)
+			}
+		}
+		w.max = counter
+	}
+	idx := counter % frameCryptoReplayWin
+	w.bitmap[idx/64] |= 1 << (idx % 64)
+}
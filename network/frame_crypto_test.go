@@ -0,0 +1,175 @@
+package network
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+func TestFrameCryptoSealOpen(t *testing.T) {
+	for _, algo := range []string{"aes-gcm", "chacha20-poly1305"} {
+		sender, err := NewFrameCrypto(algo, []byte("psk"), 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		receiver, _ := NewFrameCrypto(algo, []byte("psk"), 0, 0)
+
+		plain := []byte("hello frame")
+		packet, err := sender.Seal(plain)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(packet) != len(plain)+sender.Overhead() {
+			t.Errorf("%s packet len %d, want %d", algo, len(packet), len(plain)+sender.Overhead())
+		}
+		if bytes.Contains(packet, plain) {
+			t.Errorf("%s packet contains plain text", algo)
+		}
+
+		got, err := receiver.Open(packet)
+		if err != nil || !bytes.Equal(got, plain) {
+			t.Fatalf("%s Open = %q, %v", algo, got, err)
+		}
+
+		// 重放
+		if _, err := receiver.Open(packet); err == nil {
+			t.Errorf("%s replay packet should fail", algo)
+		}
+
+		// 篡改
+		packet, _ = sender.Seal(plain)
+		packet[len(packet)-1] ^= 1
+		if _, err := receiver.Open(packet); err == nil {
+			t.Errorf("%s tampered packet should fail", algo)
+		}
+		packet[len(packet)-1] ^= 1
+		packet[frameCryptoSaltLen+4] ^= 1
+		if _, err := receiver.Open(packet); err == nil {
+			t.Errorf("%s tampered header should fail", algo)
+		}
+
+		// 其他会话的包
+		other, _ := NewFrameCrypto(algo, []byte("psk"), 0, 0)
+		packet, _ = other.Seal(plain)
+		if _, err := receiver.Open(packet); err == nil {
+			t.Errorf("%s packet of other session should fail", algo)
+		}
+
+		// 错误的密钥
+		wrong, _ := NewFrameCrypto(algo, []byte("wrong"), 0, 0)
+		fresh, _ := NewFrameCrypto(algo, []byte("psk"), 0, 0)
+		packet, _ = wrong.Seal(plain)
+		if _, err := fresh.Open(packet); err == nil {
+			t.Errorf("%s packet with wrong key should fail", algo)
+		}
+	}
+
+	if _, err := NewFrameCrypto("rc4", []byte("psk"), 0, 0); err == nil {
+		t.Error("unsupported algo should fail")
+	}
+	if _, err := NewFrameCrypto("aes-gcm", nil, 0, 0); err == nil {
+		t.Error("empty key should fail")
+	}
+}
+
+func TestFrameCryptoRotateAndReorder(t *testing.T) {
+	sender, _ := NewFrameCrypto("aes-gcm", []byte("psk"), 3, 0)
+	receiver, _ := NewFrameCrypto("aes-gcm", []byte("psk"), 0, 0)
+
+	var packets [][]byte
+	for i := 0; i < 10; i++ {
+		packet, err := sender.Seal([]byte{byte(i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		packets = append(packets, packet)
+	}
+	if sender.sendEpoch != 3 {
+		t.Fatalf("sendEpoch = %d, want 3", sender.sendEpoch)
+	}
+
+	// 轮换边界附近乱序到达
+	order := []int{0, 1, 3, 2, 4, 6, 5, 7, 9, 8}
+	for _, i := range order {
+		got, err := receiver.Open(packets[i])
+		if err != nil || len(got) != 1 || got[0] != byte(i) {
+			t.Fatalf("Open packet %d = %v, %v", i, got, err)
+		}
+	}
+
+	// 太旧的 epoch 已经丢弃密钥
+	old, _ := NewFrameCrypto("aes-gcm", []byte("psk"), 0, 0)
+	old.sendSalt = sender.sendSalt
+	old.sendCounter = 100
+	packet, _ := old.Seal([]byte{1})
+	if _, err := receiver.Open(packet); err == nil {
+		t.Error("packet of old epoch should fail")
+	}
+}
+
+func TestFrameCryptoSaltCache(t *testing.T) {
+	salts := newFrameSaltCache()
+	sender, _ := NewFrameCrypto("aes-gcm", []byte("psk"), 0, 0)
+	p1, _ := sender.Seal([]byte("1"))
+	p2, _ := sender.Seal([]byte("2"))
+
+	receiver, _ := NewFrameCrypto("aes-gcm", []byte("psk"), 0, 0)
+	receiver.salts = salts
+	if _, err := receiver.Open(p1); err != nil {
+		t.Fatal(err)
+	}
+
+	// 同一个会话的包重放给 listener 上新建的连接
+	replayed, _ := NewFrameCrypto("aes-gcm", []byte("psk"), 0, 0)
+	replayed.salts = salts
+	if _, err := replayed.Open(p2); err == nil {
+		t.Error("session replayed to a new receiver should fail")
+	}
+
+	other, _ := NewFrameCrypto("aes-gcm", []byte("psk"), 0, 0)
+	packet, _ := other.Seal([]byte("3"))
+	fresh, _ := NewFrameCrypto("aes-gcm", []byte("psk"), 0, 0)
+	fresh.salts = salts
+	if _, err := fresh.Open(packet); err != nil {
+		t.Errorf("new session rejected: %v", err)
+	}
+
+	// salt 的时间超出窗口，缓存里已经没有记录，也不能建立会话
+	old, _ := NewFrameCrypto("aes-gcm", []byte("psk"), 0, 0)
+	binary.BigEndian.PutUint32(old.sendSalt[:], uint32(time.Now().Add(-2*frameCryptoSaltMaxSkew).Unix()))
+	old.sendAead, _ = old.newAead(old.sendSalt[:], 0)
+	packet, _ = old.Seal([]byte("4"))
+	fresh, _ = NewFrameCrypto("aes-gcm", []byte("psk"), 0, 0)
+	fresh.salts = salts
+	if _, err := fresh.Open(packet); err == nil {
+		t.Error("session with expired salt should fail")
+	}
+	// dialer 不检查
+	fresh, _ = NewFrameCrypto("aes-gcm", []byte("psk"), 0, 0)
+	if _, err := fresh.Open(packet); err != nil {
+		t.Errorf("dialer rejected old salt: %v", err)
+	}
+}
+
+func TestFrameReplayWindow(t *testing.T) {
+	var w frameReplayWindow
+	if w.check(0) {
+		t.Error("counter 0 should be rejected")
+	}
+	w.accept(1)
+	w.accept(frameCryptoReplayWin + 10)
+	if w.check(frameCryptoReplayWin + 10) {
+		t.Error("accepted counter should be rejected")
+	}
+	if w.check(5) {
+		t.Error("counter out of window should be rejected")
+	}
+	if !w.check(frameCryptoReplayWin + 9) {
+		t.Error("counter in window should be accepted")
+	}
+	w.accept(frameCryptoReplayWin + 9)
+	if w.check(frameCryptoReplayWin + 9) {
+		t.Error("accepted counter should be rejected")
+	}
+}
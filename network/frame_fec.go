@@ -0,0 +1,364 @@
+package network
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+	"time"
+
+	"github.com/klauspost/reedsolomon"
+	"google.golang.org/protobuf/proto"
+)
+
+/*
+FrameFec 为 FrameMgr 提供可选的 Reed-Solomon 前向纠错。
+
+发送端把第一次发送的 DATA 帧按 dataShards 个分为一组，每组额外发送 parityShards 个 FEC 帧，不满一组的最多等待 fecFlushNs 后也会发送。
+接收端同一组内丢失的帧数不超过收到的 FEC 帧数时直接恢复出丢失的帧，不用等 REQ 重传；恢复不了的仍然走原来的 REQ 流程。
+每个数据分片的内容为 4 字节长度加上序列化后的 FrameData，补齐到同组最大长度。
+
+只需要发送端开启。双方在 CONN 和 CONNRSP 中带上 frameFeatureFec 表示能处理 FEC 帧，发送端看到对端支持后才发送，
+和旧版本通信时不发送 FEC 帧，退回到只靠 REQ 重传。
+*/
+
+const (
+	frameFeatureFec = 1 << 4
+
+	fecFlushNs = int64(20 * time.Millisecond) // 不满一组时最多等待的时间
+	fecPruneNs = int64(100 * time.Millisecond)
+	// 已经落后于接收窗口、还没有组引用的数据帧最多保留的时间，等待稍晚到达的 FEC 帧
+	fecKeepNs = int64(200 * time.Millisecond)
+)
+
+type frameFecSend struct {
+	dataShards   int
+	parityShards int
+	encoders     map[int]reedsolomon.Encoder
+	group        []*Frame
+	groupTime    int64
+}
+
+type frameFecGroup struct {
+	ids      []int32
+	parity   [][]byte
+	shardlen int
+	dirty    bool
+}
+
+type frameFecData struct {
+	data *FrameData
+	time int64
+}
+
+type frameFecRecv struct {
+	data      map[int32]*frameFecData
+	groups    map[int32]*frameFecGroup
+	idgroup   map[int32]int32
+	decoders  map[[2]int]reedsolomon.Encoder
+	lastPrune int64
+}
+
+// checkFecConfig 检查分片数是否合法，0 表示关闭。
+func checkFecConfig(dataShards int, parityShards int) error {
+	if dataShards <= 0 || parityShards <= 0 {
+		return nil
+	}
+	_, err := reedsolomon.New(dataShards, parityShards)
+	return err
+}
+
+// SetFec 开启前向纠错，dataShards 或 parityShards 为 0 表示关闭。
+func (fm *FrameMgr) SetFec(dataShards int, parityShards int) error {
+	if dataShards <= 0 || parityShards <= 0 {
+		fm.fecsend = nil
+		return nil
+	}
+	enc, err := reedsolomon.New(dataShards, parityShards)
+	if err != nil {
+		return err
+	}
+	fm.fecsend = &frameFecSend{
+		dataShards:   dataShards,
+		parityShards: parityShards,
+		encoders:     map[int]reedsolomon.Encoder{dataShards: enc},
+	}
+	return nil
+}
+
+func (fm *FrameMgr) useFec() bool {
+	return fm.fecsend != nil && fm.peerFeatures&frameFeatureFec != 0
+}
+
+// FecRecoverNum 返回累计通过 FEC 恢复的帧数。
+func (fm *FrameMgr) FecRecoverNum() int64 {
+	return atomic.LoadInt64(&fm.fecRecovered)
+}
+
+func (fm *FrameMgr) addFecFrame(f *Frame, cur int64) {
+	s := fm.fecsend
+	if len(s.group) <= 0 {
+		s.groupTime = cur
+	}
+	s.group = append(s.group, f)
+	if len(s.group) >= s.dataShards {
+		fm.flushFecGroup()
+	}
+}
+
+func (fm *FrameMgr) checkFecFlush(cur int64) {
+	s := fm.fecsend
+	if s != nil && len(s.group) > 0 && cur-s.groupTime > fecFlushNs {
+		fm.flushFecGroup()
+	}
+}
+
+func (fm *FrameMgr) flushFecGroup() {
+	s := fm.fecsend
+	n := len(s.group)
+	defer func() {
+		s.group = s.group[:0]
+	}()
+
+	enc, ok := s.encoders[n]
+	if !ok {
+		var err error
+		enc, err = reedsolomon.New(n, s.parityShards)
+		if err != nil {
+			return
+		}
+		s.encoders[n] = enc
+	}
+
+	shards := make([][]byte, n+s.parityShards)
+	ids := make([]int32, n)
+	shardlen := 0
+	for i, f := range s.group {
+		b, err := proto.Marshal(f.Data)
+		if err != nil {
+			return
+		}
+		shards[i] = b
+		ids[i] = f.Id
+		if len(b)+4 > shardlen {
+			shardlen = len(b) + 4
+		}
+	}
+	for i := 0; i < n; i++ {
+		shard := make([]byte, shardlen)
+		binary.BigEndian.PutUint32(shard, uint32(len(shards[i])))
+		copy(shard[4:], shards[i])
+		shards[i] = shard
+	}
+	for i := n; i < len(shards); i++ {
+		shards[i] = make([]byte, shardlen)
+	}
+	if err := enc.Encode(shards); err != nil {
+		return
+	}
+
+	for i := 0; i < s.parityShards; i++ {
+		f := &Frame{Type: (int32)(Frame_FEC),
+			Id:     int32(i),
+			Dataid: ids,
+			Fecnum: int32(s.parityShards),
+			Data:   &FrameData{Data: shards[n+i]}}
+		fm.sendFrame(f)
+		fm.total.SendFecNum++
+		if fm.openstat > 0 {
+			fm.fs.sendFecNum++
+		}
+	}
+}
+
+func (fm *FrameMgr) processFec(f *Frame) {
+	if len(f.Dataid) <= 0 || f.Fecnum <= 0 || f.Id < 0 || f.Id >= f.Fecnum || f.Data == nil || len(f.Data.Data) <= 4 {
+		return
+	}
+	if fm.fecrecv == nil {
+		fm.fecrecv = &frameFecRecv{
+			data:     make(map[int32]*frameFecData),
+			groups:   make(map[int32]*frameFecGroup),
+			idgroup:  make(map[int32]int32),
+			decoders: make(map[[2]int]reedsolomon.Encoder),
+		}
+	}
+	r := fm.fecrecv
+
+	fm.total.RecvFecNum++
+	if fm.openstat > 0 {
+		fm.fs.recvFecNum++
+	}
+
+	key := f.Dataid[0]
+	g, ok := r.groups[key]
+	if !ok {
+		g = &frameFecGroup{
+			ids:      append([]int32(nil), f.Dataid...),
+			parity:   make([][]byte, f.Fecnum),
+			shardlen: len(f.Data.Data),
+		}
+		r.groups[key] = g
+		for _, id := range g.ids {
+			r.idgroup[id] = key
+		}
+	}
+	if len(g.ids) != len(f.Dataid) || len(g.parity) != int(f.Fecnum) || g.shardlen != len(f.Data.Data) {
+		return
+	}
+	g.parity[f.Id] = f.Data.Data
+	g.dirty = true
+}
+
+// recoverFec 缓存收到的数据帧，并把能恢复的帧加入 tmpackto，和正常收到的帧一样回 ACK。
+func (fm *FrameMgr) recoverFec(cur int64, tmpackto map[int32]*Frame) {
+	r := fm.fecrecv
+	if r == nil {
+		return
+	}
+
+	for id, f := range tmpackto {
+		if f.Data == nil {
+			continue
+		}
+		r.data[id] = &frameFecData{data: f.Data, time: cur}
+		if key, ok := r.idgroup[id]; ok {
+			if g, ok := r.groups[key]; ok {
+				g.dirty = true
+			}
+		}
+	}
+
+	for key, g := range r.groups {
+		if g.dirty {
+			g.dirty = false
+			fm.recoverFecGroup(key, g, tmpackto)
+		}
+	}
+
+	if cur-r.lastPrune > fecPruneNs {
+		r.lastPrune = cur
+		fm.pruneFec(cur)
+	}
+}
+
+func (fm *FrameMgr) recoverFecGroup(key int32, g *frameFecGroup, tmpackto map[int32]*Frame) {
+	r := fm.fecrecv
+
+	missing := 0
+	for _, id := range g.ids {
+		if r.data[id] == nil {
+			missing++
+		}
+	}
+	if missing <= 0 {
+		fm.deleteFecGroup(key, g)
+		return
+	}
+	have := 0
+	for _, p := range g.parity {
+		if p != nil {
+			have++
+		}
+	}
+	if missing > have {
+		return
+	}
+
+	d := len(g.ids)
+	p := len(g.parity)
+	dec, ok := r.decoders[[2]int{d, p}]
+	if !ok {
+		var err error
+		dec, err = reedsolomon.New(d, p)
+		if err != nil {
+			fm.deleteFecGroup(key, g)
+			return
+		}
+		r.decoders[[2]int{d, p}] = dec
+	}
+
+	shards := make([][]byte, d+p)
+	for i, id := range g.ids {
+		fd := r.data[id]
+		if fd == nil {
+			continue
+		}
+		b, err := proto.Marshal(fd.data)
+		if err != nil || len(b)+4 > g.shardlen {
+			fm.deleteFecGroup(key, g)
+			return
+		}
+		shard := make([]byte, g.shardlen)
+		binary.BigEndian.PutUint32(shard, uint32(len(b)))
+		copy(shard[4:], b)
+		shards[i] = shard
+	}
+	copy(shards[d:], g.parity)
+
+	if err := dec.ReconstructData(shards); err != nil {
+		fm.deleteFecGroup(key, g)
+		return
+	}
+
+	for i, id := range g.ids {
+		if r.data[id] != nil {
+			continue
+		}
+		shard := shards[i]
+		l := int(binary.BigEndian.Uint32(shard))
+		if l+4 > len(shard) {
+			continue
+		}
+		fd := &FrameData{}
+		if err := proto.Unmarshal(shard[4:4+l], fd); err != nil {
+			continue
+		}
+		tmpackto[id] = &Frame{Type: (int32)(Frame_DATA), Id: id, Data: fd}
+		atomic.AddInt64(&fm.fecRecovered, 1)
+		if fm.openstat > 0 {
+			fm.fs.fecRecoverNum++
+		}
+		//loggo.Debug("debugid %v fec recover frame %v", fm.debugid, id)
+	}
+	fm.deleteFecGroup(key, g)
+}
+
+// deleteFecGroup 删除组和组内缓存的数据帧，组已经恢复或者不可能恢复，数据帧不再需要。
+func (fm *FrameMgr) deleteFecGroup(key int32, g *frameFecGroup) {
+	r := fm.fecrecv
+	for _, id := range g.ids {
+		if r.idgroup[id] == key {
+			delete(r.idgroup, id)
+			delete(r.data, id)
+		}
+	}
+	delete(r.groups, key)
+}
+
+// pruneFec 删除不再需要的数据。组内没有一个帧还在接收窗口里时整组删除，连同 idgroup 和缓存的数据帧；
+// 没有组引用的数据帧在窗口内保留，落后于窗口的只短暂保留，等待稍晚到达的 FEC 帧。id 回绕后不会和旧数据混在一起。
+func (fm *FrameMgr) pruneFec(cur int64) {
+	r := fm.fecrecv
+	for key, g := range r.groups {
+		live := false
+		for _, id := range g.ids {
+			if fm.isIdInRange(id, fm.frame_max_id) {
+				live = true
+				break
+			}
+		}
+		if !live {
+			fm.deleteFecGroup(key, g)
+		}
+	}
+	for id, fd := range r.data {
+		if fm.isIdInRange(id, fm.frame_max_id) {
+			continue
+		}
+		if _, ok := r.idgroup[id]; ok {
+			continue
+		}
+		if !fm.isIdOld(id, fm.frame_max_id) || cur-fd.time > fecKeepNs {
+			delete(r.data, id)
+		}
+	}
+}
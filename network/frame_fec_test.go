@@ -0,0 +1,146 @@
+package network
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// 发送端每 4 个 DATA 帧丢 1 个，重传超时设得很长，只能靠 FEC 恢复
+func TestFrameFecRecover(t *testing.T) {
+	sender := NewFrameMgr(800, 100000, 1024*1024, 1000, 60000, 0, 0)
+	receiver := NewFrameMgr(800, 100000, 1024*1024, 1000, 60000, 0, 0)
+	if err := sender.SetFec(4, 2); err != nil {
+		t.Fatal(err)
+	}
+	// 跳过握手，直接认为对端支持 FEC
+	sender.peerFeatures = receiver.features
+
+	send := make([]byte, 100*1024)
+	for i := range send {
+		send[i] = byte(i * 7)
+	}
+	sender.WriteSendBuffer(send)
+
+	var recv []byte
+	datanum := 0
+	step := func() {
+		sender.Update()
+		for e := sender.GetSendList().Front(); e != nil; e = e.Next() {
+			f := e.Value.(*Frame)
+			b, _ := sender.MarshalFrame(f)
+			if f.Type == (int32)(Frame_DATA) {
+				datanum++
+				if datanum%4 == 0 {
+					continue
+				}
+			}
+			rf, err := receiver.UnmarshalFrame(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			receiver.OnRecvFrame(rf)
+		}
+
+		receiver.Update()
+		for e := receiver.GetSendList().Front(); e != nil; e = e.Next() {
+			b, _ := receiver.MarshalFrame(e.Value.(*Frame))
+			rf, _ := sender.UnmarshalFrame(b)
+			sender.OnRecvFrame(rf)
+		}
+
+		if n := receiver.GetRecvBufferSize(); n > 0 {
+			recv = append(recv, receiver.GetRecvReadLineBuffer()[:n]...)
+			receiver.SkipRecvBuffer(n)
+		}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(recv) < len(send) && time.Now().Before(deadline) {
+		step()
+		time.Sleep(time.Millisecond)
+	}
+
+	if !bytes.Equal(recv, send) {
+		t.Fatalf("recv %d bytes, want %d", len(recv), len(send))
+	}
+	if receiver.FecRecoverNum() <= 0 {
+		t.Error("no frame recovered by fec")
+	}
+
+	// 交付完成后不再缓存数据帧
+	for i := 0; i < 5; i++ {
+		time.Sleep(time.Duration(fecKeepNs))
+		step()
+	}
+	if r := receiver.fecrecv; len(r.data) > 0 || len(r.groups) > 0 {
+		t.Errorf("fec cache data %d groups %d", len(r.data), len(r.groups))
+	}
+}
+
+// 落后于接收窗口和超出窗口的 FEC 帧凑不成能恢复的组，缓存也不能一直留着
+func TestFrameFecPrune(t *testing.T) {
+	receiver := NewFrameMgr(800, 100000, 1024*1024, 1000, 60000, 0, 0)
+	receiver.recvid = 5000
+
+	for i := 0; i < 200; i++ {
+		base := int32(4000 + i*4)
+		if i >= 100 {
+			base = int32(50000 + i*4)
+		}
+		receiver.OnRecvFrame(&Frame{Type: (int32)(Frame_FEC),
+			Id:     0,
+			Dataid: []int32{base, base + 1, base + 2, base + 3},
+			Fecnum: 2,
+			Data:   &FrameData{Data: make([]byte, 64)}})
+	}
+	receiver.preProcessRecvList()
+	r := receiver.fecrecv
+	if r == nil || len(r.groups) != 200 {
+		t.Fatal("fec frames not processed")
+	}
+
+	for i := 0; i < 3; i++ {
+		time.Sleep(time.Duration(fecPruneNs))
+		receiver.Update()
+	}
+	if len(r.data) > 0 || len(r.groups) > 0 || len(r.idgroup) > 0 {
+		t.Errorf("fec cache data %d groups %d idgroup %d", len(r.data), len(r.groups), len(r.idgroup))
+	}
+}
+
+// 对端没有在 CONN 或 CONNRSP 中带上 FEC 特性时不发送 FEC 帧，旧版本收到会报未知帧类型
+func TestFrameFecNotNegotiated(t *testing.T) {
+	sender := NewFrameMgr(800, 100000, 1024*1024, 1000, 60000, 0, 0)
+	if err := sender.SetFec(4, 2); err != nil {
+		t.Fatal(err)
+	}
+	sender.peerFeatures = frameFeatureSack
+
+	sender.WriteSendBuffer(make([]byte, 10*1024))
+	for i := 0; i < 3; i++ {
+		sender.Update()
+		for e := sender.GetSendList().Front(); e != nil; e = e.Next() {
+			if e.Value.(*Frame).Type == (int32)(Frame_FEC) {
+				t.Fatal("fec frame sent to peer without fec feature")
+			}
+		}
+		time.Sleep(time.Duration(fecFlushNs))
+	}
+}
+
+func TestFrameFecConfig(t *testing.T) {
+	if err := checkFecConfig(0, 0); err != nil {
+		t.Error(err)
+	}
+	if err := checkFecConfig(70000, 1); err == nil {
+		t.Error("too many shards should fail")
+	}
+	fm := NewFrameMgr(800, 100000, 1024, 100, 400, 0, 0)
+	if err := fm.SetFec(10, 3); err != nil || fm.fecsend == nil {
+		t.Fatal("SetFec fail", err)
+	}
+	fm.SetFec(0, 0)
+	if fm.fecsend != nil {
+		t.Error("SetFec(0, 0) should disable fec")
+	}
+}
@@ -0,0 +1,168 @@
+package network
+
+import (
+	"errors"
+	"syscall"
+	"time"
+)
+
+/*
+FramePmtu 为 FrameMgr 提供路径 MTU 探测，按连接调整帧切分大小。
+
+连接建立后，如果对端支持，发送端在 [初始切分大小, maxSize] 之间二分查找：发送填充到探测大小的 PMTU_PROBE 帧，
+收到对端的 PMTU_ACK 说明这个大小可以通过，立即把切分大小调大；连续 pmtuProbeRetry 次超时没有回应说明太大。
+区间小于 pmtuProbeStep 时结束，之后每隔 interval 重新探测一次，先确认当前大小仍然可用，不可用时退回初始大小重新查找。
+
+探测包需要设置 DF 位才有意义，否则会被分片后照样到达，设置 DF 位由 Conn 在创建 socket 时完成，见 setDontFragment。
+没有设置 DF 位的平台上，探测只能发现超过对端接收缓冲或者被中间设备丢弃的大小。
+*/
+
+const (
+	frameFeaturePmtu = 1 << 1
+
+	pmtuProbeStep      = 16
+	pmtuProbeRetry     = 3
+	pmtuProbeTimeoutNs = int64(200 * time.Millisecond)
+)
+
+type framePmtu struct {
+	minSize   int
+	maxSize   int
+	interval  int64
+	low       int // 已经确认可用的大小
+	high      int // 还没有确认不可用的最大值
+	probeSize int
+	probeTime int64
+	probeNum  int
+	verify    bool // 周期探测时先确认当前大小
+	done      bool
+	doneTime  int64
+}
+
+// SetPmtu 开启路径 MTU 探测，切分大小最大调到 maxsize，之后每隔 intervalms 重新探测，maxsize 不大于当前切分大小时不开启。
+func (fm *FrameMgr) SetPmtu(maxsize int, intervalms int) {
+	if maxsize <= fm.frame_max_size {
+		fm.pmtu = nil
+		return
+	}
+	fm.pmtu = &framePmtu{
+		minSize:  fm.frame_max_size,
+		maxSize:  maxsize,
+		interval: int64(intervalms) * int64(time.Millisecond),
+		low:      fm.frame_max_size,
+		high:     maxsize,
+	}
+}
+
+// GetCutSize 返回当前的帧切分大小。
+func (fm *FrameMgr) GetCutSize() int {
+	return fm.frame_max_size
+}
+
+func (fm *FrameMgr) checkPmtu(cur int64) {
+	p := fm.pmtu
+	if p == nil || !fm.connected || fm.peerFeatures&frameFeaturePmtu == 0 {
+		return
+	}
+
+	if p.probeSize > 0 {
+		timeout := 2 * fm.rttns
+		if timeout < pmtuProbeTimeoutNs {
+			timeout = pmtuProbeTimeoutNs
+		}
+		if cur-p.probeTime < timeout {
+			return
+		}
+		p.probeNum++
+		if p.probeNum < pmtuProbeRetry {
+			fm.sendPmtuProbe(cur)
+			return
+		}
+		fm.onPmtuFail()
+	}
+
+	if p.done {
+		if p.interval <= 0 || cur-p.doneTime < p.interval {
+			return
+		}
+		p.done = false
+		p.verify = p.low > p.minSize
+		p.high = p.maxSize
+	}
+
+	if p.verify {
+		p.probeSize = p.low
+	} else if p.high-p.low >= pmtuProbeStep {
+		p.probeSize = (p.low + p.high + 1) / 2
+	} else {
+		p.done = true
+		p.doneTime = cur
+		return
+	}
+	p.probeNum = 0
+	fm.sendPmtuProbe(cur)
+}
+
+func (fm *FrameMgr) sendPmtuProbe(cur int64) {
+	p := fm.pmtu
+	p.probeTime = cur
+	// 和 DATA 帧携带相同的字段，保证同样大小的数据序列化后长度一致
+	f := &Frame{Type: (int32)(Frame_PMTU_PROBE), Resend: false, Sendtime: cur,
+		Id:   int32(p.probeSize),
+		Data: &FrameData{Type: (int32)(FrameData_USER_DATA), Data: make([]byte, p.probeSize)}}
+	fm.sendFrame(f)
+	//loggo.Debug("debugid %v send pmtu probe %v", fm.debugid, p.probeSize)
+}
+
+func (fm *FrameMgr) onPmtuFail() {
+	p := fm.pmtu
+	if p.verify {
+		// 路径变差了，退回初始大小重新查找
+		p.verify = false
+		p.low = p.minSize
+		fm.frame_max_size = p.minSize
+	} else {
+		p.high = p.probeSize - 1
+	}
+	p.probeSize = 0
+}
+
+func (fm *FrameMgr) processPmtuProbe(f *Frame) {
+	rf := &Frame{Type: (int32)(Frame_PMTU_ACK), Resend: false, Sendtime: 0,
+		Id: f.Id}
+	fm.sendFrame(rf)
+}
+
+func (fm *FrameMgr) processPmtuAck(f *Frame) {
+	p := fm.pmtu
+	if p == nil || p.probeSize <= 0 || int(f.Id) != p.probeSize {
+		return
+	}
+	if p.verify {
+		p.verify = false
+	} else {
+		p.low = p.probeSize
+		fm.frame_max_size = p.low
+	}
+	p.probeSize = 0
+}
+
+// isMsgSizeError 判断是不是设置了 DF 位后发送超过 MTU 的包导致的错误，这种错误只是丢包，不应该关闭连接。
+func isMsgSizeError(err error) bool {
+	return errors.Is(err, syscall.EMSGSIZE)
+}
+
+// pmtuControl 返回创建 socket 时的控制函数，开启路径 MTU 探测时设置 DF 位，并调用 RegisterDialerController 注册的函数。
+func pmtuControl(pmtu bool) func(network, address string, c syscall.RawConn) error {
+	if !pmtu {
+		return gControlOnConnSetup
+	}
+	return func(network, address string, c syscall.RawConn) error {
+		if gControlOnConnSetup != nil {
+			if err := gControlOnConnSetup(network, address, c); err != nil {
+				return err
+			}
+		}
+		return setDontFragment(network, c)
+	}
+}
@@ -0,0 +1,27 @@
+package network
+
+import (
+	"strings"
+	"syscall"
+)
+
+// setDontFragment 设置 DF 位，使用 PMTUDISC_PROBE 而不是 PMTUDISC_DO，忽略内核缓存的路径 MTU，探测包超过时才能真正发出去。
+func setDontFragment(network string, c syscall.RawConn) error {
+	var serr error
+	err := c.Control(func(fd uintptr) {
+		if strings.Contains(network, "6") {
+			serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_MTU_DISCOVER, syscall.IPV6_PMTUDISC_PROBE)
+			if serr != nil {
+				return
+			}
+			// 双栈 socket 上的 ipv4 流量使用 ipv4 的选项，失败不影响
+			syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, syscall.IP_PMTUDISC_PROBE)
+		} else {
+			serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, syscall.IP_PMTUDISC_PROBE)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
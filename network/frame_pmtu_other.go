@@ -0,0 +1,12 @@
+//go:build !linux
+
+package network
+
+import (
+	"syscall"
+)
+
+// setDontFragment 其他平台不设置 DF 位，探测退化为只发现被丢弃的大小。
+func setDontFragment(network string, c syscall.RawConn) error {
+	return nil
+}
@@ -0,0 +1,122 @@
+package network
+
+import (
+	"sort"
+	"time"
+)
+
+/*
+FrameSack 为 FrameMgr 提供选择确认，替代逐个列出 id 的 ACK 帧，减少大窗口下的确认开销。
+
+SACK 帧的 id 为累计确认，即接收端下一个需要的 id，之前的帧都已经收到；ranges 每两个数为一个区间的起始 id 和个数，
+表示累计确认之后已经收到的帧。接收端不再每次 Update 都回复确认，而是攒够 frameSackDelayPkgs 个帧或者距离上次确认超过
+frameSackDelayNs 后才发送一个 SACK。开启后 REQ 也使用区间编码。
+
+双方在 CONN 和 CONNRSP 中携带各自支持的特性，只有双方都支持时才使用 SACK，和旧版本通信时退回到原来的 ACK。
+*/
+
+const (
+	frameFeatureSack = 1 << 0
+
+	frameSackDelayPkgs = 32
+	frameSackDelayNs   = int64(10 * time.Millisecond)
+)
+
+func (fm *FrameMgr) useSack() bool {
+	return fm.features&frameFeatureSack != 0 && fm.peerFeatures&frameFeatureSack != 0
+}
+
+func (fm *FrameMgr) idDistance(from int32, to int32) int32 {
+	return (to - from + fm.frame_max_id) % fm.frame_max_id
+}
+
+// idsToRanges 把 id 按距离 base 的远近排序，连续的合并为一个区间。
+func (fm *FrameMgr) idsToRanges(base int32, ids []int32) []int32 {
+	sort.Slice(ids, func(i, j int) bool {
+		return fm.idDistance(base, ids[i]) < fm.idDistance(base, ids[j])
+	})
+	var ranges []int32
+	for _, id := range ids {
+		n := len(ranges)
+		if n > 0 && (ranges[n-2]+ranges[n-1])%fm.frame_max_id == id {
+			ranges[n-1]++
+		} else {
+			ranges = append(ranges, id, 1)
+		}
+	}
+	return ranges
+}
+
+func (fm *FrameMgr) rangesToIds(ranges []int32, ids map[int32]int) {
+	for i := 0; i+1 < len(ranges); i += 2 {
+		start, count := ranges[i], ranges[i+1]
+		if start < 0 || start >= fm.frame_max_id || count <= 0 || count > fm.windowsize {
+			continue
+		}
+		for j := int32(0); j < count; j++ {
+			ids[(start+j)%fm.frame_max_id]++
+		}
+	}
+}
+
+// processSack 把 SACK 展开成逐个的 id，交给原来的 ACK 流程处理。
+func (fm *FrameMgr) processSack(f *Frame, tmpack map[int32]int) {
+	fm.total.RecvSackNum++
+
+	err, value := fm.sendwin.Front()
+	if err == nil && value != nil {
+		front := value.(*Frame).Id
+		n := fm.idDistance(front, f.Id)
+		// 过期的 SACK 累计确认会落在发送窗口之前，忽略
+		if f.Id >= 0 && f.Id < fm.frame_max_id && n <= fm.idDistance(front, fm.sendid) {
+			for e := fm.sendwin.FrontInter(); e != nil; e = e.Next() {
+				rf := e.Value.(*Frame)
+				if fm.idDistance(front, rf.Id) >= n {
+					break
+				}
+				tmpack[rf.Id]++
+			}
+		}
+	}
+
+	fm.rangesToIds(f.Ranges, tmpack)
+}
+
+func (fm *FrameMgr) checkSendSack(cur int64) {
+	if !fm.useSack() || fm.ackPending <= 0 {
+		return
+	}
+	if fm.ackPending < frameSackDelayPkgs && cur-fm.lastSackTime < frameSackDelayNs {
+		return
+	}
+
+	maxranges := fm.frame_max_size / 2 / 4
+	var ranges []int32
+	var start, count int32
+	for e := fm.recvwin.FrontInter(); e != nil && len(ranges)+2 <= maxranges; e = e.Next() {
+		id := e.Value.(*Frame).Id
+		if count > 0 && (start+count)%fm.frame_max_id == id {
+			count++
+			continue
+		}
+		if count > 0 {
+			ranges = append(ranges, start, count)
+		}
+		start, count = id, 1
+	}
+	if count > 0 && len(ranges)+2 <= maxranges {
+		ranges = append(ranges, start, count)
+	}
+
+	f := &Frame{Type: (int32)(Frame_SACK), Resend: false, Sendtime: 0,
+		Id:     fm.recvid,
+		Ranges: ranges}
+	fm.sendFrame(f)
+	fm.total.SendSackNum++
+	if fm.openstat > 0 {
+		fm.fs.sendSackNum++
+	}
+	fm.ackPending = 0
+	fm.lastSackTime = cur
+	//loggo.Debug("debugid %v send sack %v %v", fm.debugid, f.Id, common.Int32ArrayToString(f.Ranges, ","))
+}
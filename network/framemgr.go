@@ -2,12 +2,14 @@ package network
 
 import (
 	"container/list"
+	"errors"
 	"github.com/esrrhs/gohome/common"
 	glist "github.com/esrrhs/gohome/list"
 	"github.com/esrrhs/gohome/loggo"
 	"google.golang.org/protobuf/proto"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -56,11 +58,245 @@ type FrameStat struct {
 	recvpong        int
 	recvOldNum      int
 	recvOutWinNum   int
+	sendFecNum      int
+	recvFecNum      int
+	fecRecoverNum   int
+	sendSackNum     int
+	recvSackNum     int
 }
 
-const (
-	hbTimeoutSecond = 10 // 心跳超时时间
-)
+// FrameMgrStats 是 FrameMgr 统计信息的快照，不依赖 openstat，计数都是从创建开始累计的。
+type FrameMgrStats struct {
+	Rtt       time.Duration // 最近一次 ping 测得的 rtt
+	SRtt      time.Duration // 平滑后的 rtt，用于判断重传
+	Connected bool
+
+	SendDataNum   int64 // 发送的 DATA 帧数，包括重传
+	RecvDataNum   int64
+	SendDataBytes int64 // 首次发送的 DATA 帧的数据字节数
+	RecvDataBytes int64
+	Retransmits   int64 // 重传的 DATA 帧数
+	SendReqNum    int64
+	RecvReqNum    int64
+	SendAckNum    int64
+	RecvAckNum    int64
+	RecvOldNum    int64 // 收到的已经处理过的帧数
+	RecvOutWinNum int64 // 收到的超出接收窗口的帧数
+	SendFecNum    int64
+	RecvFecNum    int64
+	FecRecoverNum int64
+	SendSackNum   int64
+	RecvSackNum   int64
+
+	WindowSize     int   // 窗口大小
+	CutSize        int   // 当前的帧切分大小，开启路径 MTU 探测后会变化
+	SendWinSize    int   // 发送窗口中的帧数
+	RecvWinSize    int   // 接收窗口中的帧数
+	BytesInFlight  int64 // 已发送未确认的数据字节数
+	SendBufferSize int
+	RecvBufferSize int
+
+	Congestion string // 拥塞控制的状态，没有设置拥塞控制时为空
+
+	PacingRate int   // 当前的发送速率限制，字节每秒，0 表示不限速
+	PacedNum   int64 // 因为发送节奏限制推迟发送的次数
+}
+
+// FrameMgrConfig 是 FrameMgr 的配置，时间的单位都是毫秒。
+type FrameMgrConfig struct {
+	FrameMaxSize int // 帧切分大小
+	FrameMaxId   int // 帧 id 的上限，需要至少是窗口的两倍
+	BufferSize   int // 发送和接收缓冲区大小
+	WindowSize   int
+	ResendTimems int
+	// 压缩算法 zlib、flate，为空不压缩，只压缩超过 CompressMinSize 的帧
+	Compress        string
+	CompressMinSize int
+	Stat            int
+	PingIntervalMs  int
+	HBIntervalMs    int
+	HBTimeoutMs     int // 超过这个时间没有收到心跳和数据认为连接断开
+	IdleTimeoutMs   int // 超过这个时间没有收发用户数据认为连接空闲，为 0 不检查
+}
+
+func DefaultFrameMgrConfig() *FrameMgrConfig {
+	return &FrameMgrConfig{
+		FrameMaxSize:    800,
+		FrameMaxId:      100000,
+		BufferSize:      1024 * 1024,
+		WindowSize:      10000,
+		ResendTimems:    200,
+		Compress:        "",
+		CompressMinSize: 0,
+		Stat:            0,
+		PingIntervalMs:  1000,
+		HBIntervalMs:    1000,
+		HBTimeoutMs:     10000,
+		IdleTimeoutMs:   0,
+	}
+}
+
+func checkFrameMgrConfig(config *FrameMgrConfig) error {
+	if config.FrameMaxSize <= 0 {
+		return errors.New("frame max size must be positive")
+	}
+	if config.WindowSize <= 0 || config.FrameMaxId < 2*config.WindowSize {
+		return errors.New("frame max id must be at least twice the window size")
+	}
+	if config.BufferSize < config.FrameMaxSize {
+		return errors.New("buffer size smaller than frame max size")
+	}
+	if config.ResendTimems <= 0 {
+		return errors.New("resend time must be positive")
+	}
+	if config.Compress != "" {
+		if _, err := getFrameCompressor(config.Compress); err != nil {
+			return err
+		}
+	}
+	if config.CompressMinSize < 0 {
+		return errors.New("compress min size must not be negative")
+	}
+	if config.PingIntervalMs <= 0 || config.HBIntervalMs <= 0 {
+		return errors.New("ping and heartbeat interval must be positive")
+	}
+	if config.HBTimeoutMs <= config.HBIntervalMs {
+		return errors.New("heartbeat timeout must be greater than heartbeat interval")
+	}
+	if config.IdleTimeoutMs < 0 {
+		return errors.New("idle timeout must not be negative")
+	}
+	return nil
+}
+
+// FrameMgrOptions 是 RudpConfig 和 RicmpConfig 共用的 FrameMgr 选项，两者都内嵌这个结构。
+type FrameMgrOptions struct {
+	// 拥塞控制算法 bb、bbr、cubic、reno，为空不开启
+	Congestion string
+	// 加密算法 aes-gcm 或 chacha20-poly1305，为空不加密，两端需要配置相同的算法和密钥
+	Crypto           string
+	CryptoKey        string
+	CryptoRotatePkgs int
+	CryptoRotateMs   int
+	// FEC 数据分片和校验分片数，为 0 不开启，只需要发送端开启
+	FecDataShards   int
+	FecParityShards int
+	// 发送节奏控制，PacingRate 为固定速率字节每秒，为 0 时跟随拥塞控制估算的速率，PacingBurst 为最多连续发送的字节数
+	Pacing      bool
+	PacingRate  int
+	PacingBurst int
+	// 路径 MTU 探测，默认关闭，CutSize 为初始切分大小，最大调到 PmtuMaxSize，每隔 PmtuIntervalMs 重新探测，开启时 MaxPacketSize 需要能容纳最大的帧
+	Pmtu           bool
+	PmtuMaxSize    int
+	PmtuIntervalMs int
+	// Compress 大于 0 时压缩超过这个大小的帧，CompressAlg 为压缩算法 zlib、flate
+	CompressAlg string
+	// 心跳和 ping 的间隔，HBTimeoutMs 没有收到心跳和数据时断开，IdleTimeoutMs 没有收发用户数据时断开，为 0 不检查
+	PingIntervalMs int
+	HBIntervalMs   int
+	HBTimeoutMs    int
+	IdleTimeoutMs  int
+}
+
+func DefaultFrameMgrOptions() FrameMgrOptions {
+	return FrameMgrOptions{
+		Congestion:       "bb",
+		Crypto:           "",
+		CryptoKey:        "",
+		CryptoRotatePkgs: 1024 * 1024,
+		CryptoRotateMs:   600000,
+		FecDataShards:    0,
+		FecParityShards:  0,
+		Pacing:           false,
+		PacingRate:       0,
+		PacingBurst:      16 * 1024,
+		Pmtu:             false,
+		PmtuMaxSize:      1400,
+		PmtuIntervalMs:   600000,
+		CompressAlg:      "zlib",
+		PingIntervalMs:   1000,
+		HBIntervalMs:     1000,
+		HBTimeoutMs:      10000,
+		IdleTimeoutMs:    0,
+	}
+}
+
+// frameMgrConfig 用 rudp、ricmp 原有的配置项加上选项生成 FrameMgrConfig，参数和 NewFrameMgr 相同
+func (o *FrameMgrOptions) frameMgrConfig(frame_max_size int, frame_max_id int, buffersize int, windowsize int, resend_timems int, compress int, openstat int) *FrameMgrConfig {
+	config := DefaultFrameMgrConfig()
+	config.FrameMaxSize = frame_max_size
+	config.FrameMaxId = frame_max_id
+	config.BufferSize = buffersize
+	config.WindowSize = windowsize
+	config.ResendTimems = resend_timems
+	config.Stat = openstat
+	config.IdleTimeoutMs = o.IdleTimeoutMs
+	// 没有设置的新字段保持默认值，兼容直接构造的旧配置
+	if o.PingIntervalMs > 0 {
+		config.PingIntervalMs = o.PingIntervalMs
+	}
+	if o.HBIntervalMs > 0 {
+		config.HBIntervalMs = o.HBIntervalMs
+	}
+	if o.HBTimeoutMs > 0 {
+		config.HBTimeoutMs = o.HBTimeoutMs
+	}
+	if compress > 0 {
+		config.Compress = o.CompressAlg
+		if config.Compress == "" {
+			config.Compress = "zlib"
+		}
+		config.CompressMinSize = compress
+	}
+	return config
+}
+
+// checkFrameMgrOptions 在 Listen 时检查配置，避免等到有连接进来才失败
+func checkFrameMgrOptions(o *FrameMgrOptions, config *FrameMgrConfig) error {
+	if _, err := o.newFrameCrypto(); err != nil {
+		return err
+	}
+	if err := checkFrameMgrConfig(config); err != nil {
+		return err
+	}
+	if err := checkFecConfig(o.FecDataShards, o.FecParityShards); err != nil {
+		return err
+	}
+	if _, err := NewCongestion(o.Congestion); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (o *FrameMgrOptions) newFrameCrypto() (*FrameCrypto, error) {
+	return newFrameCryptoByConfig(o.Crypto, o.CryptoKey, o.CryptoRotatePkgs, o.CryptoRotateMs)
+}
+
+func (o *FrameMgrOptions) newFrameMgr(config *FrameMgrConfig, debugid string, fc *FrameCrypto) (*FrameMgr, error) {
+	fm, err := NewFrameMgrWithConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	fm.SetDebugid(debugid)
+	ct, err := NewCongestion(o.Congestion)
+	if err != nil {
+		return nil, err
+	}
+	if ct != nil {
+		fm.SetCongestion(ct)
+	}
+	fm.SetCrypto(fc)
+	if o.Pacing {
+		fm.SetPacing(o.PacingRate, o.PacingBurst)
+	}
+	if err := fm.SetFec(o.FecDataShards, o.FecParityShards); err != nil {
+		return nil, err
+	}
+	if o.Pmtu {
+		fm.SetPmtu(o.PmtuMaxSize, o.PmtuIntervalMs)
+	}
+	return fm, nil
+}
 
 type FrameMgr struct {
 	frame_max_size int
@@ -75,7 +311,8 @@ type FrameMgr struct {
 	sendlock      sync.Locker
 	windowsize    int32
 	resend_timems int
-	compress      int
+	config        FrameMgrConfig
+	compressor    *frameCompressor
 
 	sendwin  *glist.ROBuffergo
 	sendlist *list.List
@@ -96,6 +333,7 @@ type FrameMgr struct {
 	lastSendHBTime   int64
 	lastRecvHBTime   int64
 	lastRecvDataTime int64
+	lastSendDataTime int64
 
 	reqmap map[int32]int64
 
@@ -108,7 +346,31 @@ type FrameMgr struct {
 	debugid string
 
 	ct           Congestion
+	ctev         CongestionEvent
+	ctResent     map[int32]bool // 重传过的帧的 ack 不能用来计算 rtt
 	ctLastSendId int32
+
+	pacer       *Pacer
+	pacingFixed bool
+	paced       bool
+
+	crypto *FrameCrypto
+
+	fecsend      *frameFecSend
+	fecrecv      *frameFecRecv
+	fecRecovered int64
+
+	features     int32 // 本端支持的特性
+	peerFeatures int32 // 对端在 CONN 或 CONNRSP 中携带的特性
+	ackPending   int   // 开启 SACK 后还没有确认的帧数
+	lastSackTime int64
+
+	pmtu *framePmtu
+
+	lastrttns int64
+	total     FrameMgrStats // 只在 Update 中修改
+	statslock sync.Mutex
+	stats     FrameMgrStats
 }
 
 func (fm *FrameMgr) SetDebugid(debugid string) {
@@ -118,19 +380,69 @@ func (fm *FrameMgr) SetDebugid(debugid string) {
 func (fm *FrameMgr) SetCongestion(ct Congestion) {
 	fm.ct = ct
 	fm.ct.Init()
+	fm.ctev, _ = ct.(CongestionEvent)
+	fm.ctResent = make(map[int32]bool)
+}
+
+// SetPacing 开启发送节奏控制，rate 为字节每秒，为 0 时跟随拥塞控制估算的速率，burst 为最多连续发送的字节数。
+func (fm *FrameMgr) SetPacing(rate int, burst int) {
+	fm.pacer = NewPacer(rate, burst)
+	fm.pacingFixed = rate > 0
+}
+
+// IsPaced 返回上次 Update 是否因为发送节奏限制还有帧没有发送。
+func (fm *FrameMgr) IsPaced() bool {
+	return fm.paced
 }
 
+// SetCrypto 设置包加密，MarshalFrame 和 UnmarshalFrame 会自动加解密。
+func (fm *FrameMgr) SetCrypto(fc *FrameCrypto) {
+	fm.crypto = fc
+}
+
+// NewFrameMgr 使用位置参数创建，compress 大于 0 时用 zlib 压缩超过这个大小的帧，新代码使用 NewFrameMgrWithConfig。
 func NewFrameMgr(frame_max_size int, frame_max_id int, buffersize int, windowsize int, resend_timems int, compress int, openstat int) *FrameMgr {
+	config := DefaultFrameMgrConfig()
+	config.FrameMaxSize = frame_max_size
+	config.FrameMaxId = frame_max_id
+	config.BufferSize = buffersize
+	config.WindowSize = windowsize
+	config.ResendTimems = resend_timems
+	if compress > 0 {
+		config.Compress = "zlib"
+		config.CompressMinSize = compress
+	}
+	config.Stat = openstat
+	return newFrameMgr(config)
+}
 
-	sendb := glist.NewRBuffergo(buffersize, false)
-	recvb := glist.NewRBuffergo(buffersize, false)
+// NewFrameMgrWithConfig 检查配置后创建，config 为 nil 时使用默认配置。
+func NewFrameMgrWithConfig(config *FrameMgrConfig) (*FrameMgr, error) {
+	if config == nil {
+		config = DefaultFrameMgrConfig()
+	}
+	if err := checkFrameMgrConfig(config); err != nil {
+		return nil, err
+	}
+	return newFrameMgr(config), nil
+}
+
+func newFrameMgr(config *FrameMgrConfig) *FrameMgr {
+	frame_max_size := config.FrameMaxSize
+	frame_max_id := config.FrameMaxId
+	windowsize := config.WindowSize
+	resend_timems := config.ResendTimems
+	openstat := config.Stat
+
+	sendb := glist.NewRBuffergo(config.BufferSize, false)
+	recvb := glist.NewRBuffergo(config.BufferSize, false)
 
 	fm := &FrameMgr{
 		frame_max_size: frame_max_size, frame_max_id: int32(frame_max_id),
 		sendb: sendb, recvb: recvb,
 		sendblock: &sync.Mutex{}, recvblock: &sync.Mutex{},
 		recvlock: &sync.Mutex{}, sendlock: &sync.Mutex{},
-		windowsize: int32(windowsize), resend_timems: resend_timems, compress: compress,
+		windowsize: int32(windowsize), resend_timems: resend_timems, config: *config,
 		sendwin:  glist.NewROBuffer(windowsize, 0, frame_max_id),
 		sendlist: list.New(), sendid: 0,
 		recvwin:  glist.NewROBuffer(windowsize, 0, frame_max_id),
@@ -138,9 +450,18 @@ func NewFrameMgr(frame_max_size int, frame_max_id int, buffersize int, windowsiz
 		close: false, remoteclosed: false, closesend: false,
 		lastPingTime: time.Now().UnixNano(), lastPongTime: time.Now().UnixNano(),
 		lastSendHBTime: time.Now().UnixNano(), lastRecvHBTime: time.Now().UnixNano(), lastRecvDataTime: time.Now().UnixNano(),
-		rttns:     (int64)(resend_timems * 1000),
-		reqmap:    make(map[int32]int64),
-		connected: false, openstat: openstat, lastPrintStat: time.Now().UnixNano(),
+		lastSendDataTime: time.Now().UnixNano(),
+		rttns:            (int64)(resend_timems * 1000),
+		reqmap:           make(map[int32]int64),
+		connected:        false, openstat: openstat, lastPrintStat: time.Now().UnixNano(),
+		features: frameFeatureSack | frameFeaturePmtu | frameFeatureBinary | frameFeatureFec,
+	}
+
+	if config.Compress != "" {
+		fm.compressor, _ = getFrameCompressor(config.Compress)
+	}
+	if fm.compressor != nil {
+		fm.features |= frameFeatureCompress
 	}
 
 	if openstat > 0 {
@@ -156,6 +477,12 @@ func (fm *FrameMgr) GetSendBufferLeft() int {
 	return left
 }
 
+func (fm *FrameMgr) GetSendBufferSize() int {
+	fm.sendblock.Lock()
+	defer fm.sendblock.Unlock()
+	return fm.sendb.Size()
+}
+
 func (fm *FrameMgr) WriteSendBuffer(data []byte) {
 	fm.sendblock.Lock()
 	defer fm.sendblock.Unlock()
@@ -170,17 +497,22 @@ func (fm *FrameMgr) Update() bool {
 
 	tmpreq, tmpack, tmpackto := fm.preProcessRecvList()
 	avtive := len(tmpreq) + len(tmpack) + len(tmpackto)
-	fm.processRecvList(tmpreq, tmpack, tmpackto)
+	fm.processRecvList(cur, tmpreq, tmpack, tmpackto)
 
 	fm.combineWindowToRecvBuffer(cur)
+	fm.checkSendSack(cur)
+	fm.checkPmtu(cur)
 
 	fm.calSendList(cur)
+	fm.checkFecFlush(cur)
 
 	fm.ping()
 	fm.hb()
 
 	fm.second(cur)
 
+	fm.refreshStats()
+
 	return avtive > 0
 }
 
@@ -200,13 +532,8 @@ func (fm *FrameMgr) cutSendBufferToWindow(cur int64) {
 			Data: make([]byte, fm.frame_max_size)}
 		fm.sendb.Read(fd.Data)
 
-		if fm.compress > 0 && len(fd.Data) > fm.compress {
-			newb := common.CompressData(fd.Data)
-			if len(newb) < len(fd.Data) {
-				fd.Data = newb
-				fd.Compress = true
-			}
-		}
+		fm.lastSendDataTime = cur
+		fm.compressFrameData(fd)
 
 		f := &Frame{Type: (int32)(Frame_DATA),
 			Id:   fm.sendid,
@@ -229,13 +556,8 @@ func (fm *FrameMgr) cutSendBufferToWindow(cur int64) {
 			Data: make([]byte, fm.sendb.Size())}
 		fm.sendb.Read(fd.Data)
 
-		if fm.compress > 0 && len(fd.Data) > fm.compress {
-			newb := common.CompressData(fd.Data)
-			if len(newb) < len(fd.Data) {
-				fd.Data = newb
-				fd.Compress = true
-			}
-		}
+		fm.lastSendDataTime = cur
+		fm.compressFrameData(fd)
 
 		f := &Frame{Type: (int32)(Frame_DATA),
 			Id:   fm.sendid,
@@ -276,20 +598,55 @@ func (fm *FrameMgr) cutSendBufferToWindow(cur int64) {
 
 func (fm *FrameMgr) calSendList(cur int64) {
 
+	fm.paced = false
+	if fm.pacer != nil && !fm.pacingFixed {
+		if cp, ok := fm.ct.(CongestionPacing); ok {
+			fm.pacer.SetRate(cp.PacingRate())
+		}
+	}
+
 	for e := fm.sendwin.FrontInter(); e != nil; e = e.Next() {
 		f := e.Value.(*Frame)
-		if fm.ct != nil && f.Id < fm.ctLastSendId {
+		// 已经发送过的帧可能需要重传，不能跳过
+		if fm.ct != nil && f.Id < fm.ctLastSendId && f.Sendtime == 0 {
 			continue
 		}
 		if !f.Acked && (f.Resend || cur-f.Sendtime > int64(fm.resend_timems*(int)(time.Millisecond))) &&
 			cur-f.Sendtime > fm.rttns {
+			if fm.pacer != nil && f.Data != nil && len(f.Data.Data) > 0 && !fm.pacer.CanSend(cur) {
+				fm.paced = true
+				fm.total.PacedNum++
+				return
+			}
 			if fm.ct != nil && f.Data != nil && len(f.Data.Data) > 0 && !fm.ct.CanSend(int(f.Id), len(f.Data.Data)) {
 				fm.ctLastSendId = f.Id
 				return
 			}
+			if fm.pacer != nil && f.Data != nil {
+				fm.pacer.OnSend(len(f.Data.Data))
+			}
+			first := f.Sendtime == 0
 			f.Sendtime = cur
 			fm.sendFrame(f)
 			f.Resend = false
+			fm.total.SendDataNum++
+			if first {
+				if f.Data != nil {
+					fm.total.SendDataBytes += int64(len(f.Data.Data))
+					fm.total.BytesInFlight += int64(len(f.Data.Data))
+				}
+			} else {
+				fm.total.Retransmits++
+				if fm.ctev != nil {
+					fm.ctResent[f.Id] = true
+					if f.Data != nil {
+						fm.ctev.OnLoss(int(f.Id), len(f.Data.Data))
+					}
+				}
+			}
+			if first && fm.useFec() {
+				fm.addFecFrame(f, cur)
+			}
 			if fm.openstat > 0 {
 				fm.fs.sendDataNum++
 				fm.fs.sendDataNumsMap[f.Id]++
@@ -338,13 +695,23 @@ func (fm *FrameMgr) preProcessRecvList() (map[int32]int, map[int32]int, map[int3
 				tmpreq[id]++
 				//loggo.Debug("debugid %v recv req %v %v", fm.debugid, f.Id, common.Int32ArrayToString(f.Dataid, ","))
 			}
+			fm.rangesToIds(f.Ranges, tmpreq)
 		} else if f.Type == (int32)(Frame_ACK) {
 			for _, id := range f.Dataid {
 				tmpack[id]++
 				//loggo.Debug("debugid %v recv ack %v %v", fm.debugid, f.Id, common.Int32ArrayToString(f.Dataid, ","))
 			}
+		} else if f.Type == (int32)(Frame_SACK) {
+			fm.processSack(f, tmpack)
+			if fm.openstat > 0 {
+				fm.fs.recvSackNum++
+			}
 		} else if f.Type == (int32)(Frame_DATA) {
 			tmpackto[f.Id] = f
+			fm.total.RecvDataNum++
+			if f.Data != nil {
+				fm.total.RecvDataBytes += int64(len(f.Data.Data))
+			}
 			if fm.openstat > 0 {
 				fm.fs.recvDataNum++
 				fm.fs.recvDataNumsMap[f.Id]++
@@ -354,6 +721,12 @@ func (fm *FrameMgr) preProcessRecvList() (map[int32]int, map[int32]int, map[int3
 			fm.processPing(f)
 		} else if f.Type == (int32)(Frame_PONG) {
 			fm.processPong(f)
+		} else if f.Type == (int32)(Frame_FEC) {
+			fm.processFec(f)
+		} else if f.Type == (int32)(Frame_PMTU_PROBE) {
+			fm.processPmtuProbe(f)
+		} else if f.Type == (int32)(Frame_PMTU_ACK) {
+			fm.processPmtuAck(f)
 		} else {
 			loggo.Error("error frame type %v", f.Type)
 		}
@@ -362,7 +735,7 @@ func (fm *FrameMgr) preProcessRecvList() (map[int32]int, map[int32]int, map[int3
 	return tmpreq, tmpack, tmpackto
 }
 
-func (fm *FrameMgr) processRecvList(tmpreq map[int32]int, tmpack map[int32]int, tmpackto map[int32]*Frame) {
+func (fm *FrameMgr) processRecvList(cur int64, tmpreq map[int32]int, tmpack map[int32]int, tmpackto map[int32]*Frame) {
 
 	for id, num := range tmpreq {
 		err, value := fm.sendwin.Get(int(id))
@@ -381,6 +754,7 @@ func (fm *FrameMgr) processRecvList(tmpreq map[int32]int, tmpack map[int32]int,
 			loggo.Error("sendwin get id diff %v %v", id, f.Id)
 			continue
 		}
+		fm.total.RecvReqNum += int64(num)
 		if fm.openstat > 0 {
 			fm.fs.recvReqNum += num
 			fm.fs.recvReqNumsMap[id] += num
@@ -397,12 +771,25 @@ func (fm *FrameMgr) processRecvList(tmpreq map[int32]int, tmpack map[int32]int,
 		}
 		f := value.(*Frame)
 		if f.Id == id {
+			if !f.Acked && f.Sendtime != 0 {
+				if f.Data != nil {
+					fm.total.BytesInFlight -= int64(len(f.Data.Data))
+				}
+				if fm.ctev != nil {
+					if fm.ctResent[id] {
+						delete(fm.ctResent, id)
+					} else if cur > f.Sendtime {
+						fm.ctev.OnRtt(time.Duration(cur - f.Sendtime))
+					}
+				}
+			}
 			f.Acked = true
 			//loggo.Debug("debugid %v remove send win %v %v", fm.debugid, f.Id, len(f.Data.Data))
 		} else {
 			loggo.Error("sendwin get id diff %v %v", id, f.Id)
 			continue
 		}
+		fm.total.RecvAckNum += int64(num)
 		if fm.openstat > 0 {
 			fm.fs.recvAckNum += num
 			fm.fs.recvAckNumsMap[id] += num
@@ -433,7 +820,21 @@ func (fm *FrameMgr) processRecvList(tmpreq map[int32]int, tmpack map[int32]int,
 		}
 	}
 
-	if len(tmpackto) > 0 {
+	fm.recoverFec(cur, tmpackto)
+
+	if len(tmpackto) > 0 && fm.useSack() {
+		// 只记录数量，由 checkSendSack 合并发送
+		for id, rf := range tmpackto {
+			if fm.addToRecvWin(rf) {
+				fm.ackPending++
+				fm.total.SendAckNum++
+				if fm.openstat > 0 {
+					fm.fs.sendAckNum++
+					fm.fs.sendAckNumsMap[id]++
+				}
+			}
+		}
+	} else if len(tmpackto) > 0 {
 		tmpsize := common.MinOfInt(len(tmpackto), fm.frame_max_size/2/4)
 		tmp := make([]int32, len(tmpackto))
 		index := 0
@@ -441,6 +842,7 @@ func (fm *FrameMgr) processRecvList(tmpreq map[int32]int, tmpack map[int32]int,
 			if fm.addToRecvWin(rf) {
 				tmp[index] = id
 				index++
+				fm.total.SendAckNum++
 				if fm.openstat > 0 {
 					fm.fs.sendAckNum++
 					fm.fs.sendAckNumsMap[id]++
@@ -472,11 +874,13 @@ func (fm *FrameMgr) addToRecvWin(rf *Frame) bool {
 	if !fm.isIdInRange(rf.Id, fm.frame_max_id) {
 		//loggo.Debug("debugid %v recv frame not in range %v %v", fm.debugid, rf.Id, fm.recvid)
 		if fm.isIdOld(rf.Id, fm.frame_max_id) {
+			fm.total.RecvOldNum++
 			if fm.openstat > 0 {
 				fm.fs.recvOldNum++
 			}
 			return true
 		}
+		fm.total.RecvOutWinNum++
 		if fm.openstat > 0 {
 			fm.fs.recvOutWinNum++
 		}
@@ -500,7 +904,7 @@ func (fm *FrameMgr) processRecvFrame(f *Frame) bool {
 		if left >= len(f.Data.Data) {
 			src := f.Data.Data
 			if f.Data.Compress {
-				old, err := common.DeCompressData(src)
+				old, err := fm.decompressFrameData(f.Data)
 				if err != nil {
 					loggo.Error("recv frame deCompressData error %v", f.Id)
 					return false
@@ -524,12 +928,14 @@ func (fm *FrameMgr) processRecvFrame(f *Frame) bool {
 		//loggo.Debug("debugid %v recv remote close frame %v", fm.debugid, f.Id)
 		return true
 	} else if f.Data.Type == (int32)(FrameData_CONN) {
+		fm.peerFeatures = f.Data.Features
 		fm.sendConnectRsp()
-		fm.connected = true
+		fm.setConnected()
 		//loggo.Debug("debugid %v recv remote conn frame %v", fm.debugid, f.Id)
 		return true
 	} else if f.Data.Type == (int32)(FrameData_CONNRSP) {
-		fm.connected = true
+		fm.peerFeatures = f.Data.Features
+		fm.setConnected()
 		//loggo.Debug("debugid %v recv remote conn rsp frame %v", fm.debugid, f.Id)
 		return true
 	} else if f.Data.Type == (int32)(FrameData_HB) {
@@ -604,11 +1010,16 @@ func (fm *FrameMgr) combineWindowToRecvBuffer(cur int64) {
 		for id := range reqtmp {
 			f.Dataid[index] = id
 			index++
+			fm.total.SendReqNum++
 			if fm.openstat > 0 {
 				fm.fs.sendReqNum++
 				fm.fs.sendReqNumsMap[id]++
 			}
 		}
+		if fm.useSack() {
+			f.Ranges = fm.idsToRanges(fm.recvid, f.Dataid)
+			f.Dataid = nil
+		}
 		fm.sendFrame(f)
 		//loggo.Debug("debugid %v send req %v %v", fm.debugid, f.Id, common.Int32ArrayToString(f.Dataid, ","))
 	}
@@ -648,7 +1059,7 @@ func (fm *FrameMgr) IsRemoteClosed() bool {
 
 func (fm *FrameMgr) ping() {
 	cur := time.Now().UnixNano()
-	if cur-fm.lastPingTime > (int64)(time.Second) {
+	if cur-fm.lastPingTime > int64(fm.config.PingIntervalMs)*int64(time.Millisecond) {
 		fm.lastPingTime = cur
 		f := &Frame{Type: (int32)(Frame_PING), Resend: false, Sendtime: cur,
 			Id: 0}
@@ -662,7 +1073,7 @@ func (fm *FrameMgr) ping() {
 
 func (fm *FrameMgr) hb() {
 	cur := time.Now().UnixNano()
-	if cur-fm.lastSendHBTime > (int64)(time.Second) && fm.sendwin.Size() < int(fm.windowsize) {
+	if cur-fm.lastSendHBTime > int64(fm.config.HBIntervalMs)*int64(time.Millisecond) && fm.sendwin.Size() < int(fm.windowsize) {
 		fm.lastSendHBTime = cur
 
 		fd := &FrameData{Type: (int32)(FrameData_HB)}
@@ -699,6 +1110,7 @@ func (fm *FrameMgr) processPong(f *Frame) {
 	cur := time.Now().UnixNano()
 	if cur > f.Sendtime {
 		rtt := cur - f.Sendtime
+		fm.lastrttns = rtt
 		fm.rttns = (fm.rttns + rtt) / 2
 		if fm.openstat > 0 {
 			fm.fs.recvpong++
@@ -741,9 +1153,17 @@ func (fm *FrameMgr) IsConnected() bool {
 	return fm.connected
 }
 
+// setConnected 空闲时间从连接建立开始算，握手的时间不算在内
+func (fm *FrameMgr) setConnected() {
+	if !fm.connected {
+		fm.lastRecvDataTime = time.Now().UnixNano()
+		fm.connected = true
+	}
+}
+
 func (fm *FrameMgr) Connect() {
 	if fm.sendwin.Size() < int(fm.windowsize) {
-		fd := &FrameData{Type: (int32)(FrameData_CONN)}
+		fd := &FrameData{Type: (int32)(FrameData_CONN), Features: fm.features}
 
 		f := &Frame{Type: (int32)(Frame_DATA),
 			Id:   fm.sendid,
@@ -766,7 +1186,7 @@ func (fm *FrameMgr) Connect() {
 
 func (fm *FrameMgr) sendConnectRsp() {
 	if fm.sendwin.Size() < int(fm.windowsize) {
-		fd := &FrameData{Type: (int32)(FrameData_CONNRSP)}
+		fd := &FrameData{Type: (int32)(FrameData_CONNRSP), Features: fm.features}
 
 		f := &Frame{Type: (int32)(Frame_DATA),
 			Id:   fm.sendid,
@@ -813,6 +1233,8 @@ func (fm *FrameMgr) second(cur int64) {
 				"sendping %v\nrecvping %v\nsendpong %v\nrecvpong %v\n"+
 				"sendwin %v\nrecvwin %v\n"+
 				"recvOldNum %v\nrecvOutWinNum %v\n"+
+				"sendFecNum %v\nrecvFecNum %v\nfecRecoverNum %v\n"+
+				"sendSackNum %v\nrecvSackNum %v\n"+
 				"rtt %v\n"+
 				"ct %v\n",
 				fs.sendDataNum, fs.recvDataNum,
@@ -825,6 +1247,8 @@ func (fm *FrameMgr) second(cur int64) {
 				fs.sendpong, fs.recvpong,
 				fm.sendwin.Size(), fm.recvwin.Size(),
 				fs.recvOldNum, fs.recvOutWinNum,
+				fs.sendFecNum, fs.recvFecNum, fs.fecRecoverNum,
+				fs.sendSackNum, fs.recvSackNum,
 				time.Duration(fm.rttns).String(),
 				ctinfo)
 			fm.resetStat()
@@ -832,11 +1256,40 @@ func (fm *FrameMgr) second(cur int64) {
 
 		if fm.ct != nil {
 			fm.ct.Update()
+			fm.total.Congestion = fm.ct.Info()
 		}
 
 	}
 }
 
+func (fm *FrameMgr) refreshStats() {
+	st := fm.total
+	st.Rtt = time.Duration(fm.lastrttns)
+	st.SRtt = time.Duration(fm.rttns)
+	st.Connected = fm.connected
+	st.FecRecoverNum = atomic.LoadInt64(&fm.fecRecovered)
+	st.WindowSize = int(fm.windowsize)
+	st.CutSize = fm.frame_max_size
+	st.SendWinSize = fm.sendwin.Size()
+	st.RecvWinSize = fm.recvwin.Size()
+	st.SendBufferSize = fm.GetSendBufferSize()
+	st.RecvBufferSize = fm.GetRecvBufferSize()
+	if fm.pacer != nil {
+		st.PacingRate = fm.pacer.Rate()
+	}
+
+	fm.statslock.Lock()
+	fm.stats = st
+	fm.statslock.Unlock()
+}
+
+// Stats 返回最近一次 Update 时的统计信息快照，可以在任意协程调用。
+func (fm *FrameMgr) Stats() FrameMgrStats {
+	fm.statslock.Lock()
+	defer fm.statslock.Unlock()
+	return fm.stats
+}
+
 func (fm *FrameMgr) printStatMap(m *map[int32]int) string {
 	tmp := make(map[int]int)
 	for _, v := range *m {
@@ -859,18 +1312,70 @@ func (fm *FrameMgr) printStatMap(m *map[int32]int) string {
 }
 
 func (fm *FrameMgr) MarshalFrame(f *Frame) ([]byte, error) {
+	return fm.MarshalFrameTo(nil, f)
+}
+
+// MarshalFrameTo 把编码后的帧追加到 dst 并返回，对端支持时使用二进制编码，没有加密时不分配内存。
+func (fm *FrameMgr) MarshalFrameTo(dst []byte, f *Frame) ([]byte, error) {
+	if fm.crypto == nil {
+		return fm.encodeFrame(dst, f)
+	}
+	bp := GetFrameBuffer()
+	defer PutFrameBuffer(bp)
+	plain, err := fm.encodeFrame(*bp, f)
+	if err != nil {
+		return dst, err
+	}
+	*bp = plain
+	return fm.crypto.SealTo(dst, plain)
+}
+
+func (fm *FrameMgr) encodeFrame(dst []byte, f *Frame) ([]byte, error) {
+	if fm.useBinary() && frameCodecSupported(f) {
+		return encodeFrame(dst, f), nil
+	}
 	resend := f.Resend
 	sendtime := f.Sendtime
-	mb, err := proto.Marshal(f)
+	mb, err := proto.MarshalOptions{}.MarshalAppend(dst, f)
 	f.Resend = resend
 	f.Sendtime = sendtime
 	return mb, err
 }
 
+func (fm *FrameMgr) UnmarshalFrame(b []byte) (*Frame, error) {
+	if fm.crypto != nil {
+		plain, err := fm.crypto.Open(b)
+		if err != nil {
+			return nil, err
+		}
+		b = plain
+	}
+	if isBinaryFrame(b) {
+		return decodeFrame(b)
+	}
+	f := &Frame{}
+	err := proto.Unmarshal(b, f)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
 func (fm *FrameMgr) IsHBTimeout() bool {
 	now := time.Now().UnixNano()
-	if now-fm.lastRecvHBTime > int64(time.Second)*hbTimeoutSecond && now-fm.lastRecvDataTime > int64(time.Second)*hbTimeoutSecond {
+	timeout := int64(fm.config.HBTimeoutMs) * int64(time.Millisecond)
+	if now-fm.lastRecvHBTime > timeout && now-fm.lastRecvDataTime > timeout {
 		return true
 	}
 	return false
 }
+
+// IsIdleTimeout 超过 IdleTimeoutMs 没有收发用户数据时返回 true，IdleTimeoutMs 为 0 时总是返回 false。
+func (fm *FrameMgr) IsIdleTimeout() bool {
+	if fm.config.IdleTimeoutMs <= 0 {
+		return false
+	}
+	now := time.Now().UnixNano()
+	timeout := int64(fm.config.IdleTimeoutMs) * int64(time.Millisecond)
+	return now-fm.lastRecvDataTime > timeout && now-fm.lastSendDataTime > timeout
+}
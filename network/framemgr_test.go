@@ -5,6 +5,7 @@ import (
 	"github.com/esrrhs/gohome/common"
 	"github.com/esrrhs/gohome/list"
 	"testing"
+	"time"
 )
 
 func Test0001(t *testing.T) {
@@ -98,3 +99,340 @@ func Test0001(t *testing.T) {
 	fm.recvwin = list.NewROBuffer(100, 0, 10000)
 	//fm.printStat(time.Now().UnixNano())
 }
+
+func TestFrameMgrStats(t *testing.T) {
+	sender := NewFrameMgr(800, 100000, 1024*1024, 1000, 50, 0, 0)
+	receiver := NewFrameMgr(800, 100000, 1024*1024, 1000, 50, 0, 0)
+
+	if st := sender.Stats(); st.SendDataNum != 0 || st.Connected {
+		t.Fatalf("stats before Update %+v", st)
+	}
+
+	send := make([]byte, 50*1024)
+	sender.WriteSendBuffer(send)
+
+	// 每个 DATA 帧第一次发送都丢掉，只能靠重传
+	sent := make(map[int32]bool)
+	recv := 0
+	deadline := time.Now().Add(5 * time.Second)
+	for recv < len(send) && time.Now().Before(deadline) {
+		sender.Update()
+		for e := sender.GetSendList().Front(); e != nil; e = e.Next() {
+			f := e.Value.(*Frame)
+			if f.Type == (int32)(Frame_DATA) && !sent[f.Id] {
+				sent[f.Id] = true
+				continue
+			}
+			receiver.OnRecvFrame(f)
+		}
+		receiver.Update()
+		for e := receiver.GetSendList().Front(); e != nil; e = e.Next() {
+			sender.OnRecvFrame(e.Value.(*Frame))
+		}
+		if n := receiver.GetRecvBufferSize(); n > 0 {
+			recv += n
+			receiver.SkipRecvBuffer(n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if recv != len(send) {
+		t.Fatalf("recv %d bytes, want %d", recv, len(send))
+	}
+	for i := 0; i < 10; i++ {
+		sender.Update()
+		for e := receiver.GetSendList().Front(); e != nil; e = e.Next() {
+			sender.OnRecvFrame(e.Value.(*Frame))
+		}
+		receiver.Update()
+	}
+	sender.Update()
+
+	ss := sender.Stats()
+	rs := receiver.Stats()
+	if ss.SendDataBytes != int64(len(send)) || rs.RecvDataBytes < int64(len(send)) {
+		t.Errorf("data bytes send %d recv %d, want %d", ss.SendDataBytes, rs.RecvDataBytes, len(send))
+	}
+	if ss.Retransmits < int64(len(sent)) || ss.SendDataNum != ss.Retransmits+int64(len(sent)) {
+		t.Errorf("retransmits %d send %d, frames %d", ss.Retransmits, ss.SendDataNum, len(sent))
+	}
+	if ss.RecvAckNum != int64(len(sent)) || rs.SendAckNum != int64(len(sent)) {
+		t.Errorf("ack stats %+v %+v", ss, rs)
+	}
+	if ss.BytesInFlight != 0 || ss.SendWinSize != 0 || ss.WindowSize != 1000 {
+		t.Errorf("window stats %+v", ss)
+	}
+}
+
+// runFrameMgrPair 建立连接后传输 size 字节，drop 返回 true 的 DATA 帧第一次发送时丢掉，返回双方发送的各类型帧数。
+func runFrameMgrPair(t *testing.T, client *FrameMgr, server *FrameMgr, size int, drop func(id int32) bool) (map[int32]int, map[int32]int) {
+	clientFrames := make(map[int32]int)
+	serverFrames := make(map[int32]int)
+	sent := make(map[int32]bool)
+
+	client.Connect()
+	send := make([]byte, size)
+	for i := range send {
+		send[i] = byte(i)
+	}
+	var recv []byte
+	written := false
+	deadline := time.Now().Add(10 * time.Second)
+	for len(recv) < len(send) && time.Now().Before(deadline) {
+		if client.IsConnected() && !written {
+			client.WriteSendBuffer(send)
+			written = true
+		}
+		client.Update()
+		for e := client.GetSendList().Front(); e != nil; e = e.Next() {
+			f := e.Value.(*Frame)
+			clientFrames[f.Type]++
+			if f.Type == (int32)(Frame_DATA) && f.Data != nil && f.Data.Type == (int32)(FrameData_USER_DATA) &&
+				!sent[f.Id] && drop(f.Id) {
+				sent[f.Id] = true
+				continue
+			}
+			server.OnRecvFrame(f)
+		}
+		server.Update()
+		for e := server.GetSendList().Front(); e != nil; e = e.Next() {
+			f := e.Value.(*Frame)
+			serverFrames[f.Type]++
+			client.OnRecvFrame(f)
+		}
+		if n := server.GetRecvBufferSize(); n > 0 {
+			recv = append(recv, server.GetRecvReadLineBuffer()[:n]...)
+			server.SkipRecvBuffer(n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if len(recv) != len(send) {
+		t.Fatalf("recv %d bytes, want %d", len(recv), len(send))
+	}
+	for i := range recv {
+		if recv[i] != send[i] {
+			t.Fatalf("recv data diff at %d", i)
+		}
+	}
+	return clientFrames, serverFrames
+}
+
+func TestFrameMgrSack(t *testing.T) {
+	client := NewFrameMgr(800, 100000, 1024*1024, 1000, 50, 0, 0)
+	server := NewFrameMgr(800, 100000, 1024*1024, 1000, 50, 0, 0)
+
+	clientFrames, serverFrames := runFrameMgrPair(t, client, server, 200*1024, func(id int32) bool {
+		return id%10 == 3
+	})
+	if !client.useSack() || !server.useSack() {
+		t.Fatalf("sack not negotiated %v %v", client.peerFeatures, server.peerFeatures)
+	}
+	data := clientFrames[(int32)(Frame_DATA)]
+	acks := serverFrames[(int32)(Frame_ACK)] + serverFrames[(int32)(Frame_SACK)]
+	if serverFrames[(int32)(Frame_SACK)] == 0 || acks*4 > data {
+		t.Errorf("data %d ack %d sack %d", data, serverFrames[(int32)(Frame_ACK)], serverFrames[(int32)(Frame_SACK)])
+	}
+	cs := client.Stats()
+	if cs.RecvSackNum == 0 || cs.Retransmits == 0 {
+		t.Errorf("client stats %+v", cs)
+	}
+}
+
+func TestFrameMgrSackCompat(t *testing.T) {
+	client := NewFrameMgr(800, 100000, 1024*1024, 1000, 50, 0, 0)
+	server := NewFrameMgr(800, 100000, 1024*1024, 1000, 50, 0, 0)
+	// 模拟不支持 SACK 的旧版本
+	server.features = 0
+
+	_, serverFrames := runFrameMgrPair(t, client, server, 100*1024, func(id int32) bool {
+		return id%10 == 3
+	})
+	if client.useSack() || server.useSack() {
+		t.Fatalf("sack negotiated with old peer")
+	}
+	if serverFrames[(int32)(Frame_SACK)] != 0 || serverFrames[(int32)(Frame_ACK)] == 0 {
+		t.Errorf("server frames %v", serverFrames)
+	}
+	if st := client.Stats(); st.SendSackNum != 0 {
+		t.Errorf("client stats %+v", st)
+	}
+}
+
+func TestFrameMgrSackRanges(t *testing.T) {
+	fm := NewFrameMgr(800, 100, 1024, 50, 50, 0, 0)
+	ranges := fm.idsToRanges(95, []int32{2, 96, 0, 97, 99, 1, 5})
+	want := []int32{96, 2, 99, 4, 5, 1}
+	if fmt.Sprint(ranges) != fmt.Sprint(want) {
+		t.Fatalf("ranges %v, want %v", ranges, want)
+	}
+	ids := make(map[int32]int)
+	fm.rangesToIds(ranges, ids)
+	if len(ids) != 7 || ids[99] != 1 || ids[0] != 1 || ids[2] != 1 {
+		t.Fatalf("ids %v", ids)
+	}
+}
+
+// runPmtuLink 模拟一条路径，序列化后超过 mtu 的帧都丢掉，一直运行到 done 返回 true 或者超时。
+func runPmtuLink(client *FrameMgr, server *FrameMgr, mtu *int, timeout time.Duration, done func() bool) {
+	deadline := time.Now().Add(timeout)
+	for !done() && time.Now().Before(deadline) {
+		client.Update()
+		for e := client.GetSendList().Front(); e != nil; e = e.Next() {
+			f := e.Value.(*Frame)
+			if mb, _ := client.MarshalFrame(f); len(mb) <= *mtu {
+				server.OnRecvFrame(f)
+			}
+		}
+		server.Update()
+		for e := server.GetSendList().Front(); e != nil; e = e.Next() {
+			client.OnRecvFrame(e.Value.(*Frame))
+		}
+		if n := server.GetRecvBufferSize(); n > 0 {
+			server.SkipRecvBuffer(n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestFrameMgrPmtu(t *testing.T) {
+	client := NewFrameMgr(500, 100000, 1024*1024, 1000, 50, 0, 0)
+	server := NewFrameMgr(500, 100000, 1024*1024, 1000, 50, 0, 0)
+	client.SetPmtu(1400, 300)
+
+	mtu := 1000
+	client.Connect()
+	runPmtuLink(client, server, &mtu, 10*time.Second, func() bool {
+		return client.pmtu.done
+	})
+	cut := client.GetCutSize()
+	if cut <= 500 || cut > 1000 || client.Stats().CutSize != cut {
+		t.Fatalf("cut size %d, stats %d", cut, client.Stats().CutSize)
+	}
+	// 探测到的大小应该接近路径的上限
+	probe := &Frame{Type: (int32)(Frame_DATA), Sendtime: time.Now().UnixNano(), Id: 99999,
+		Data: &FrameData{Type: (int32)(FrameData_USER_DATA), Data: make([]byte, cut+pmtuProbeStep)}}
+	if mb, _ := client.MarshalFrame(probe); len(mb) <= mtu {
+		t.Errorf("cut size %d too small for mtu %d", cut, mtu)
+	}
+	if server.GetCutSize() != 500 {
+		t.Errorf("server cut size %d", server.GetCutSize())
+	}
+
+	// 路径变差后周期探测退回初始大小重新查找
+	mtu = 700
+	runPmtuLink(client, server, &mtu, 10*time.Second, func() bool {
+		return client.pmtu.done && client.GetCutSize() <= 700
+	})
+	if cut := client.GetCutSize(); cut <= 500 || cut > 700 {
+		t.Fatalf("cut size after shrink %d", cut)
+	}
+
+	// 数据帧按新的切分大小发送，都能通过
+	send := make([]byte, 100*1024)
+	client.WriteSendBuffer(send)
+	runPmtuLink(client, server, &mtu, 10*time.Second, func() bool {
+		return client.Stats().SendDataBytes >= int64(len(send)) && client.Stats().SendWinSize == 0
+	})
+	if st := client.Stats(); st.SendWinSize != 0 || st.Retransmits != 0 {
+		t.Errorf("stats %+v", st)
+	}
+}
+
+func TestFrameMgrPmtuCompat(t *testing.T) {
+	client := NewFrameMgr(500, 100000, 1024*1024, 1000, 50, 0, 0)
+	server := NewFrameMgr(500, 100000, 1024*1024, 1000, 50, 0, 0)
+	server.features = 0
+	client.SetPmtu(1400, 0)
+
+	mtu := 2000
+	client.Connect()
+	runPmtuLink(client, server, &mtu, 500*time.Millisecond, func() bool {
+		return false
+	})
+	if !client.IsConnected() || client.pmtu.probeSize != 0 || client.GetCutSize() != 500 {
+		t.Fatalf("probe with old peer, cut size %d", client.GetCutSize())
+	}
+}
+
+func TestFrameMgrConfig(t *testing.T) {
+	fm, err := NewFrameMgrWithConfig(nil)
+	if err != nil || fm.GetCutSize() != DefaultFrameMgrConfig().FrameMaxSize {
+		t.Fatalf("default config %v", err)
+	}
+
+	bad := []func(c *FrameMgrConfig){
+		func(c *FrameMgrConfig) { c.FrameMaxSize = 0 },
+		func(c *FrameMgrConfig) { c.FrameMaxId = c.WindowSize },
+		func(c *FrameMgrConfig) { c.BufferSize = c.FrameMaxSize - 1 },
+		func(c *FrameMgrConfig) { c.ResendTimems = 0 },
+		func(c *FrameMgrConfig) { c.Compress = "lz4" },
+		func(c *FrameMgrConfig) { c.CompressMinSize = -1 },
+		func(c *FrameMgrConfig) { c.PingIntervalMs = 0 },
+		func(c *FrameMgrConfig) { c.HBTimeoutMs = c.HBIntervalMs },
+		func(c *FrameMgrConfig) { c.IdleTimeoutMs = -1 },
+	}
+	for i, fn := range bad {
+		config := DefaultFrameMgrConfig()
+		fn(config)
+		if _, err := NewFrameMgrWithConfig(config); err == nil {
+			t.Errorf("bad config %d accepted", i)
+		}
+	}
+
+	config := DefaultFrameMgrConfig()
+	config.HBIntervalMs = 50
+	config.HBTimeoutMs = 200
+	config.IdleTimeoutMs = 100
+	fm, err = NewFrameMgrWithConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fm.IsHBTimeout() || fm.IsIdleTimeout() {
+		t.Fatal("timeout at start")
+	}
+	time.Sleep(250 * time.Millisecond)
+	if !fm.IsHBTimeout() || !fm.IsIdleTimeout() {
+		t.Fatal("no timeout")
+	}
+	// 握手慢不算空闲，从连接建立开始重新计时
+	fm.setConnected()
+	if fm.IsIdleTimeout() {
+		t.Fatal("idle timeout right after connected")
+	}
+	if fm, _ := NewFrameMgrWithConfig(nil); fm.IsIdleTimeout() {
+		t.Fatal("idle timeout without config")
+	}
+}
+
+func TestFrameMgrCompress(t *testing.T) {
+	for _, name := range []string{"zlib", "flate"} {
+		config := DefaultFrameMgrConfig()
+		config.Compress = name
+		config.CompressMinSize = 100
+		client, err := NewFrameMgrWithConfig(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		server, _ := NewFrameMgrWithConfig(DefaultFrameMgrConfig())
+		runFrameMgrPair(t, client, server, 100*1024, func(id int32) bool {
+			return false
+		})
+		if st := client.Stats(); st.SendDataBytes >= 100*1024/2 {
+			t.Errorf("%s send %d bytes", name, st.SendDataBytes)
+		}
+	}
+
+	// 旧版本只能解压 zlib
+	config := DefaultFrameMgrConfig()
+	config.Compress = "flate"
+	client, _ := NewFrameMgrWithConfig(config)
+	server, _ := NewFrameMgrWithConfig(DefaultFrameMgrConfig())
+	server.features = 0
+	runFrameMgrPair(t, client, server, 100*1024, func(id int32) bool {
+		return false
+	})
+	fd := &FrameData{Data: make([]byte, 1000)}
+	client.compressFrameData(fd)
+	if !fd.Compress || fd.Compresstype != frameCompressZlib {
+		t.Errorf("compress with old peer %v %v", fd.Compress, fd.Compresstype)
+	}
+}
@@ -0,0 +1,392 @@
+package network
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+/*
+HttpProxy 提供 HTTP 代理的服务端 HttpProxyServer 和客户端 HttpProxyDialer，和 Socks5Server、Socks5Dialer 使用相同的 Relay 和 Dialer。
+
+  - CONNECT 请求通过 Dialer 连接目标，回复 200 后用 Relay 双向转发，连接失败回复 502，超时回复 504。
+  - 其他请求按普通的正向代理处理，只支持 http 的绝对地址，去掉逐跳的头后转发给目标，支持 keep-alive。
+  - 配置了 Username 或 Password 时使用 Basic 认证，认证失败回复 407。
+
+ServeMixedProxy 在同一个 listener 上同时提供 SOCKS5 和 HTTP 代理，按第一个字节区分，SOCKS5 的第一个字节总是版本号 5。
+*/
+
+var errHttpProxyAuth = errors.New("http proxy authentication failed")
+
+// 逐跳的头，不转发给下一跳
+var httpProxyHopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+func removeHttpProxyHopHeaders(header http.Header) {
+	for _, v := range header["Connection"] {
+		for _, k := range strings.Split(v, ",") {
+			if k = strings.TrimSpace(k); k != "" {
+				header.Del(k)
+			}
+		}
+	}
+	for _, k := range httpProxyHopHeaders {
+		header.Del(k)
+	}
+}
+
+func httpProxyBasicAuth(username string, password string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))
+}
+
+type HttpProxyServerConfig struct {
+	// 用户名和密码都为空时不需要认证
+	Username string
+	Password string
+	// 读取请求的超时，也是 keep-alive 连接的空闲超时，0 表示不超时
+	HandshakeTimeoutMs int
+	// 连接目标的超时，0 表示不超时
+	DialTimeoutMs int
+	// 连接目标使用的函数，为 nil 时使用 tcp 直连
+	Dialer func(ctx context.Context, addr string) (Conn, error)
+}
+
+func DefaultHttpProxyServerConfig() *HttpProxyServerConfig {
+	return &HttpProxyServerConfig{
+		HandshakeTimeoutMs: 10000,
+		DialTimeoutMs:      10000,
+	}
+}
+
+func checkHttpProxyServerConfig(config *HttpProxyServerConfig) error {
+	if config.HandshakeTimeoutMs < 0 || config.DialTimeoutMs < 0 {
+		return errors.New("invalid http proxy timeout")
+	}
+	return nil
+}
+
+type HttpProxyServer struct {
+	config    *HttpProxyServerConfig
+	transport *http.Transport
+}
+
+// NewHttpProxyServer 创建 HttpProxyServer，config 为 nil 时使用默认配置。
+func NewHttpProxyServer(config *HttpProxyServerConfig) (*HttpProxyServer, error) {
+	if config == nil {
+		config = DefaultHttpProxyServerConfig()
+	}
+	if err := checkHttpProxyServerConfig(config); err != nil {
+		return nil, err
+	}
+	s := &HttpProxyServer{config: config}
+	s.transport = &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := s.dial(ctx, addr)
+			if err != nil {
+				return nil, err
+			}
+			return NewNetConn(conn), nil
+		},
+		DisableCompression: true,
+		IdleConnTimeout:    time.Minute,
+	}
+	return s, nil
+}
+
+// Serve 从 listener 接受连接并处理，直到 Accept 出错，listener 可以是任意协议 Listen 返回的 Conn。
+func (s *HttpProxyServer) Serve(listener Conn) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go s.ServeConn(conn)
+	}
+}
+
+// ServeConn 处理一个客户端连接，返回时连接已经关闭。
+func (s *HttpProxyServer) ServeConn(conn Conn) error {
+	defer conn.Close()
+
+	br := bufio.NewReader(conn)
+	for {
+		if s.config.HandshakeTimeoutMs > 0 {
+			conn.SetReadDeadline(time.Now().Add(time.Millisecond * time.Duration(s.config.HandshakeTimeoutMs)))
+		}
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		conn.SetReadDeadline(time.Time{})
+
+		if !s.checkAuth(req) {
+			header := http.Header{}
+			header.Set("Proxy-Authenticate", `Basic realm="proxy"`)
+			writeHttpProxyResponse(conn, req, http.StatusProxyAuthRequired, header)
+			return errHttpProxyAuth
+		}
+
+		if req.Method == http.MethodConnect {
+			return s.handleConnect(&bufferedConn{Conn: conn, r: br}, req)
+		}
+		keep, err := s.handleForward(conn, req)
+		if err != nil || !keep {
+			return err
+		}
+	}
+}
+
+func (s *HttpProxyServer) checkAuth(req *http.Request) bool {
+	if s.config.Username == "" && s.config.Password == "" {
+		return true
+	}
+	auth := req.Header.Get("Proxy-Authorization")
+	const prefix = "Basic "
+	if len(auth) < len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		return false
+	}
+	b, err := base64.StdEncoding.DecodeString(auth[len(prefix):])
+	if err != nil {
+		return false
+	}
+	username, password, ok := strings.Cut(string(b), ":")
+	if !ok {
+		return false
+	}
+	return authEqual(username, password, s.config.Username, s.config.Password)
+}
+
+func (s *HttpProxyServer) dial(ctx context.Context, addr string) (Conn, error) {
+	if s.config.DialTimeoutMs > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Millisecond*time.Duration(s.config.DialTimeoutMs))
+		defer cancel()
+	}
+	return dialProxyConn(ctx, s.config.Dialer, addr)
+}
+
+func writeHttpProxyResponse(w io.Writer, req *http.Request, code int, header http.Header) error {
+	if header == nil {
+		header = http.Header{}
+	}
+	resp := &http.Response{
+		StatusCode: code,
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Request:    req,
+		Header:     header,
+		Close:      true,
+	}
+	return resp.Write(w)
+}
+
+// httpProxyErrorCode 把连接目标的错误转换为回复的状态码。
+func httpProxyErrorCode(err error) int {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return http.StatusGatewayTimeout
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
+func (s *HttpProxyServer) handleConnect(conn *bufferedConn, req *http.Request) error {
+	if _, _, err := net.SplitHostPort(req.Host); err != nil {
+		writeHttpProxyResponse(conn, req, http.StatusBadRequest, nil)
+		return err
+	}
+	out, err := s.dial(context.Background(), req.Host)
+	if err != nil {
+		//loggo.Debug("http proxy connect fail %s %s", req.Host, err)
+		writeHttpProxyResponse(conn, req, httpProxyErrorCode(err), nil)
+		return err
+	}
+	if _, err := conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n")); err != nil {
+		out.Close()
+		return err
+	}
+	_, _, err = Relay(conn, out)
+	return err
+}
+
+// handleForward 转发一个普通请求，返回连接是否可以继续读下一个请求。
+func (s *HttpProxyServer) handleForward(conn Conn, req *http.Request) (bool, error) {
+	if req.URL.Scheme != "http" || req.URL.Host == "" {
+		writeHttpProxyResponse(conn, req, http.StatusBadRequest, nil)
+		return false, errors.New("http proxy bad request " + req.RequestURI)
+	}
+	req.RequestURI = ""
+	removeHttpProxyHopHeaders(req.Header)
+
+	resp, err := s.transport.RoundTrip(req)
+	if err != nil {
+		writeHttpProxyResponse(conn, req, httpProxyErrorCode(err), nil)
+		return false, err
+	}
+	defer resp.Body.Close()
+	removeHttpProxyHopHeaders(resp.Header)
+
+	// 长度未知又不是分块编码时，只能用关闭连接来表示结束
+	keep := !req.Close
+	if resp.ContentLength < 0 && (len(resp.TransferEncoding) == 0 || resp.TransferEncoding[0] != "chunked") {
+		keep = false
+	}
+	resp.Close = !keep
+	if err := resp.Write(conn); err != nil {
+		return false, err
+	}
+	return keep, nil
+}
+
+type HttpProxyDialerConfig struct {
+	// 代理地址
+	Addr string
+	// 用户名和密码都为空时不认证
+	Username string
+	Password string
+	// 连接代理和 CONNECT 的超时，0 表示不超时
+	TimeoutMs int
+	// 连接代理使用的函数，为 nil 时使用 tcp 直连
+	Dialer func(ctx context.Context, addr string) (Conn, error)
+}
+
+func DefaultHttpProxyDialerConfig() *HttpProxyDialerConfig {
+	return &HttpProxyDialerConfig{
+		TimeoutMs: 10000,
+	}
+}
+
+func checkHttpProxyDialerConfig(config *HttpProxyDialerConfig) error {
+	if _, _, err := net.SplitHostPort(config.Addr); err != nil {
+		return errors.New("invalid http proxy " + config.Addr)
+	}
+	if config.TimeoutMs < 0 {
+		return errors.New("invalid http proxy timeout")
+	}
+	return nil
+}
+
+type HttpProxyDialer struct {
+	config *HttpProxyDialerConfig
+}
+
+// NewHttpProxyDialer 创建 HttpProxyDialer，config 中必须有代理地址。
+func NewHttpProxyDialer(config *HttpProxyDialerConfig) (*HttpProxyDialer, error) {
+	if config == nil {
+		config = DefaultHttpProxyDialerConfig()
+	}
+	if err := checkHttpProxyDialerConfig(config); err != nil {
+		return nil, err
+	}
+	return &HttpProxyDialer{config: config}, nil
+}
+
+func (d *HttpProxyDialer) Dial(addr string) (Conn, error) {
+	return d.DialContext(context.Background(), addr)
+}
+
+// DialContext 通过代理 CONNECT 到 addr，addr 可以是域名，由代理解析。
+func (d *HttpProxyDialer) DialContext(ctx context.Context, addr string) (Conn, error) {
+	if d.config.TimeoutMs > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Millisecond*time.Duration(d.config.TimeoutMs))
+		defer cancel()
+	}
+
+	conn, err := dialProxyConn(ctx, d.config.Dialer, d.config.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	stop := watchContext(ctx, func() {
+		conn.SetDeadline(aLongTimeAgo)
+	})
+	br := bufio.NewReader(conn)
+	err = d.connect(conn, br, addr)
+	stop()
+
+	if ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &bufferedConn{Conn: conn, r: br}, nil
+}
+
+func (d *HttpProxyDialer) connect(conn Conn, br *bufio.Reader, addr string) error {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+	if d.config.Username != "" || d.config.Password != "" {
+		req.Header.Set("Proxy-Authorization", httpProxyBasicAuth(d.config.Username, d.config.Password))
+	}
+	if err := req.Write(conn); err != nil {
+		return err
+	}
+
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("http proxy " + d.config.Addr + " connect fail: " + resp.Status)
+	}
+	return nil
+}
+
+// ServeMixedProxy 从 listener 接受连接，按第一个字节交给 s5 或者 hp 处理，直到 Accept 出错。
+func ServeMixedProxy(listener Conn, s5 *Socks5Server, hp *HttpProxyServer) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go ServeMixedProxyConn(conn, s5, hp)
+	}
+}
+
+// ServeMixedProxyConn 处理一个客户端连接，第一个字节为 SOCKS5 版本号时交给 s5，否则交给 hp，返回时连接已经关闭。
+func ServeMixedProxyConn(conn Conn, s5 *Socks5Server, hp *HttpProxyServer) error {
+	if hp.config.HandshakeTimeoutMs > 0 {
+		conn.SetReadDeadline(time.Now().Add(time.Millisecond * time.Duration(hp.config.HandshakeTimeoutMs)))
+	}
+	br := bufio.NewReader(conn)
+	b, err := br.Peek(1)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	c := &bufferedConn{Conn: conn, r: br}
+	if b[0] == socksVer5 {
+		return s5.ServeConn(c)
+	}
+	return hp.ServeConn(c)
+}
@@ -0,0 +1,249 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func startTestHttpProxyServer(t *testing.T, config *HttpProxyServerConfig) (string, func()) {
+	s, err := NewHttpProxyServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewConn("tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := c.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(listener)
+	return listener.LocalAddr().String(), func() {
+		listener.Close()
+	}
+}
+
+func testHttpProxyEcho(t *testing.T, conn Conn) {
+	defer conn.Close()
+	data := bytes.Repeat([]byte("http proxy"), 10000)
+	go conn.Write(data)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	ret := make([]byte, len(data))
+	if _, err := io.ReadFull(conn, ret); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(ret, data) {
+		t.Fatal("echo diff")
+	}
+}
+
+func TestHttpProxyConnect(t *testing.T) {
+	echo, closeEcho := startTestEchoServer(t)
+	defer closeEcho()
+	config := DefaultHttpProxyServerConfig()
+	config.Username = "user"
+	config.Password = "pass"
+	proxy, closeProxy := startTestHttpProxyServer(t, config)
+	defer closeProxy()
+
+	dconfig := DefaultHttpProxyDialerConfig()
+	dconfig.Addr = proxy
+	dconfig.Username = "user"
+	dconfig.Password = "pass"
+	d, err := NewHttpProxyDialer(dconfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := d.Dial(echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testHttpProxyEcho(t, conn)
+
+	dconfig.Password = "wrong"
+	if _, err := d.Dial(echo); err == nil || !strings.Contains(err.Error(), "407") {
+		t.Fatalf("expected 407, got %v", err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := listener.Addr().String()
+	listener.Close()
+	dconfig.Password = "pass"
+	if _, err := d.Dial(closed); err == nil || !strings.Contains(err.Error(), "502") {
+		t.Fatalf("expected 502, got %v", err)
+	}
+}
+
+func TestHttpProxyForward(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Proxy-Authorization") != "" {
+			t.Errorf("proxy header forwarded")
+		}
+		body, _ := io.ReadAll(r.Body)
+		w.Write([]byte(r.Method + " " + r.URL.Path + " " + string(body)))
+	}))
+	defer backend.Close()
+
+	config := DefaultHttpProxyServerConfig()
+	config.Username = "user"
+	config.Password = "pass"
+	proxy, closeProxy := startTestHttpProxyServer(t, config)
+	defer closeProxy()
+
+	proxyurl, _ := url.Parse("http://user:pass@" + proxy)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyurl)}}
+	defer client.CloseIdleConnections()
+
+	for i := 0; i < 3; i++ {
+		resp, err := client.Get(backend.URL + "/get")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "GET /get " {
+			t.Fatalf("body %q", body)
+		}
+	}
+
+	resp, err := client.Post(backend.URL+"/post", "text/plain", strings.NewReader("data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "POST /post data" {
+		t.Fatalf("body %q", body)
+	}
+
+	proxyurl, _ = url.Parse("http://" + proxy)
+	noauth := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyurl)}}
+	resp, err = noauth.Get(backend.URL + "/get")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusProxyAuthRequired {
+		t.Fatalf("status %v", resp.StatusCode)
+	}
+}
+
+func TestHttpProxyDialerOverSocks5(t *testing.T) {
+	echo, closeEcho := startTestEchoServer(t)
+	defer closeEcho()
+	s5proxy, closeS5 := startTestSocks5Server(t, nil)
+	defer closeS5()
+	hproxy, closeHttp := startTestHttpProxyServer(t, nil)
+	defer closeHttp()
+
+	// 先经过 socks5 代理，再经过 http 代理
+	s5config := DefaultSocks5DialerConfig()
+	s5config.Hops = []Socks5Hop{{Addr: s5proxy}}
+	s5, err := NewSocks5Dialer(s5config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dconfig := DefaultHttpProxyDialerConfig()
+	dconfig.Addr = hproxy
+	dconfig.Dialer = s5.DialContext
+	d, err := NewHttpProxyDialer(dconfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := d.DialContext(context.Background(), echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testHttpProxyEcho(t, conn)
+}
+
+func TestMixedProxy(t *testing.T) {
+	echo, closeEcho := startTestEchoServer(t)
+	defer closeEcho()
+
+	s5, err := NewSocks5Server(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hp, err := NewHttpProxyServer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewConn("tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := c.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go ServeMixedProxy(listener, s5, hp)
+	proxy := listener.LocalAddr().String()
+
+	s5config := DefaultSocks5DialerConfig()
+	s5config.Hops = []Socks5Hop{{Addr: proxy}}
+	s5d, err := NewSocks5Dialer(s5config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := s5d.Dial(echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testHttpProxyEcho(t, conn)
+
+	hconfig := DefaultHttpProxyDialerConfig()
+	hconfig.Addr = proxy
+	hd, err := NewHttpProxyDialer(hconfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err = hd.Dial(echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testHttpProxyEcho(t, conn)
+}
+
+func TestHttpProxyCheckAuth(t *testing.T) {
+	config := DefaultHttpProxyServerConfig()
+	config.Username = "user"
+	config.Password = "pa:ss"
+	s, err := NewHttpProxyServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b64 := func(v string) string {
+		return base64.StdEncoding.EncodeToString([]byte(v))
+	}
+	for auth, expect := range map[string]bool{
+		httpProxyBasicAuth("user", "pa:ss"): true,
+		"basic " + b64("user:pa:ss"):        true,
+		httpProxyBasicAuth("user", "pa:s"):  false,
+		httpProxyBasicAuth("usr", "pa:ss"):  false,
+		"Basic " + b64("user"):              false,
+		"Basic !!!":                         false,
+		"Bearer " + b64("user:pa:ss"):       false,
+		"":                                  false,
+	} {
+		req := &http.Request{Header: http.Header{}}
+		req.Header.Set("Proxy-Authorization", auth)
+		if s.checkAuth(req) != expect {
+			t.Errorf("checkAuth(%q) != %v", auth, expect)
+		}
+	}
+}
@@ -26,6 +26,8 @@ type IcmpMsg_TYPE int32
 const (
 	IcmpMsg_PONG_PROTO       IcmpMsg_TYPE = 0
 	IcmpMsg_PING_PROTO       IcmpMsg_TYPE = 8
+	IcmpMsg_PING6_PROTO      IcmpMsg_TYPE = 128
+	IcmpMsg_PONG6_PROTO      IcmpMsg_TYPE = 129
 	IcmpMsg_CLIENT_SEND_FLAG IcmpMsg_TYPE = 1
 	IcmpMsg_SERVER_SEND_FLAG IcmpMsg_TYPE = 2
 	IcmpMsg_MAGIC            IcmpMsg_TYPE = 47837
@@ -36,6 +38,8 @@ var (
 	IcmpMsg_TYPE_name = map[int32]string{
 		0:     "PONG_PROTO",
 		8:     "PING_PROTO",
+		128:   "PING6_PROTO",
+		129:   "PONG6_PROTO",
 		1:     "CLIENT_SEND_FLAG",
 		2:     "SERVER_SEND_FLAG",
 		47837: "MAGIC",
@@ -43,6 +47,8 @@ var (
 	IcmpMsg_TYPE_value = map[string]int32{
 		"PONG_PROTO":       0,
 		"PING_PROTO":       8,
+		"PING6_PROTO":      128,
+		"PONG6_PROTO":      129,
 		"CLIENT_SEND_FLAG": 1,
 		"SERVER_SEND_FLAG": 2,
 		"MAGIC":            47837,
@@ -148,17 +154,19 @@ var File_icmpmsg_proto protoreflect.FileDescriptor
 
 const file_icmpmsg_proto_rawDesc = "" +
 	"\n" +
-	"\ricmpmsg.proto\"\xd6\x01\n" +
+	"\ricmpmsg.proto\"\xfb\x01\n" +
 	"\aIcmpMsg\x12\x0e\n" +
 	"\x02id\x18\x01 \x01(\tR\x02id\x12\x12\n" +
 	"\x04data\x18\x02 \x01(\fR\x04data\x12#\n" +
 	"\x05magic\x18\x03 \x01(\x0e2\r.IcmpMsg.TYPER\x05magic\x12!\n" +
-	"\x04flag\x18\x04 \x01(\x0e2\r.IcmpMsg.TYPER\x04flag\"_\n" +
+	"\x04flag\x18\x04 \x01(\x0e2\r.IcmpMsg.TYPER\x04flag\"\x83\x01\n" +
 	"\x04TYPE\x12\x0e\n" +
 	"\n" +
 	"PONG_PROTO\x10\x00\x12\x0e\n" +
 	"\n" +
-	"PING_PROTO\x10\b\x12\x14\n" +
+	"PING_PROTO\x10\b\x12\x10\n" +
+	"\vPING6_PROTO\x10\x80\x01\x12\x10\n" +
+	"\vPONG6_PROTO\x10\x81\x01\x12\x14\n" +
 	"\x10CLIENT_SEND_FLAG\x10\x01\x12\x14\n" +
 	"\x10SERVER_SEND_FLAG\x10\x02\x12\v\n" +
 	"\x05MAGIC\x10\xdd\xf5\x02B\fZ\n" +
@@ -6,6 +6,7 @@ import (
 	"github.com/xtaci/kcp-go"
 	"github.com/xtaci/smux"
 	"net"
+	"time"
 )
 
 /*
@@ -19,6 +20,15 @@ type KcpConn struct {
 	info     string
 }
 
+func init() {
+	mustRegisterProto("kcp", func(config interface{}) (Conn, error) {
+		if config != nil {
+			return nil, errProtoConfig("kcp", config)
+		}
+		return &KcpConn{}, nil
+	}, true)
+}
+
 func (c *KcpConn) Name() string {
 	return "kcp"
 }
@@ -60,20 +70,68 @@ func (c *KcpConn) Info() string {
 	return c.info
 }
 
+func (c *KcpConn) LocalAddr() net.Addr {
+	if c.session != nil {
+		return c.session.LocalAddr()
+	} else if c.listener != nil {
+		return c.listener.Addr()
+	}
+	return nil
+}
+
+func (c *KcpConn) RemoteAddr() net.Addr {
+	if c.session != nil {
+		return c.session.RemoteAddr()
+	}
+	return nil
+}
+
+func (c *KcpConn) SetDeadline(t time.Time) error {
+	if c.stream != nil {
+		return c.stream.SetDeadline(t)
+	} else if c.listener != nil {
+		return errListenerDeadline
+	}
+	return errors.New("empty conn")
+}
+
+func (c *KcpConn) SetReadDeadline(t time.Time) error {
+	if c.stream != nil {
+		return c.stream.SetReadDeadline(t)
+	} else if c.listener != nil {
+		return errListenerDeadline
+	}
+	return errors.New("empty conn")
+}
+
+func (c *KcpConn) SetWriteDeadline(t time.Time) error {
+	if c.stream != nil {
+		return c.stream.SetWriteDeadline(t)
+	} else if c.listener != nil {
+		return errListenerDeadline
+	}
+	return errors.New("empty conn")
+}
+
 func (c *KcpConn) Dial(dst string) (Conn, error) {
+	return c.DialContext(context.Background(), dst)
+}
+
+func (c *KcpConn) DialContext(ctx context.Context, dst string) (Conn, error) {
 	var lc net.ListenConfig
 	if gControlOnConnSetup != nil {
 		lc.Control = gControlOnConnSetup
 	}
 
 	laddr := &net.UDPAddr{}
-	pconn, err := lc.ListenPacket(context.Background(), "udp", laddr.String())
+	pconn, err := lc.ListenPacket(ctx, "udp", laddr.String())
 	if err != nil {
 		return nil, err
 	}
 
 	conn, err := kcp.NewConn(dst, nil, 0, 0, pconn.(*net.UDPConn))
 	if err != nil {
+		pconn.Close()
 		return nil, err
 	}
 
@@ -81,14 +139,21 @@ func (c *KcpConn) Dial(dst string) (Conn, error) {
 
 	session, err := smux.Client(conn, nil)
 	if err != nil {
+		conn.Close()
 		return nil, err
 	}
 
 	stream, err := session.OpenStream()
 	if err != nil {
+		session.Close()
 		return nil, err
 	}
 
+	if ctx.Err() != nil {
+		session.Close()
+		return nil, ctx.Err()
+	}
+
 	return &KcpConn{session: session, stream: stream}, nil
 }
 
@@ -106,7 +171,26 @@ func (c *KcpConn) Listen(dst string) (Conn, error) {
 }
 
 func (c *KcpConn) Accept() (Conn, error) {
+	return c.AcceptContext(context.Background())
+}
+
+func (c *KcpConn) AcceptContext(ctx context.Context) (Conn, error) {
+	if c.listener == nil {
+		return nil, errors.New("not listen")
+	}
+
+	stop := watchContext(ctx, func() {
+		c.listener.SetDeadline(aLongTimeAgo)
+	})
 	conn, err := c.listener.Accept()
+	stop()
+	if ctx.Err() != nil {
+		c.listener.SetDeadline(time.Time{})
+		if conn != nil {
+			conn.Close()
+		}
+		return nil, ctx.Err()
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -115,11 +199,21 @@ func (c *KcpConn) Accept() (Conn, error) {
 
 	session, err := smux.Server(conn, nil)
 	if err != nil {
+		conn.Close()
 		return nil, err
 	}
 
+	stop = watchContext(ctx, func() {
+		session.SetDeadline(aLongTimeAgo)
+	})
 	stream, err := session.AcceptStream()
+	stop()
+	if ctx.Err() != nil {
+		session.Close()
+		return nil, ctx.Err()
+	}
 	if err != nil {
+		session.Close()
 		return nil, err
 	}
 
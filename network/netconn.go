@@ -0,0 +1,82 @@
+package network
+
+import (
+	"net"
+)
+
+/*
+NetConn 把 Conn 适配成标准库的 net.Conn 和 net.Listener。
+
+适配之后可以直接把任意协议的连接交给 http.Serve、tls.Server、gRPC 等只认识标准库接口的组件使用。
+*/
+
+// connAddr 在 Conn 拿不到真实地址时作为占位地址，避免使用方拿到 nil。
+type connAddr struct {
+	network string
+	addr    string
+}
+
+func (a *connAddr) Network() string {
+	return a.network
+}
+
+func (a *connAddr) String() string {
+	return a.addr
+}
+
+type netConn struct {
+	Conn
+}
+
+// NewNetConn 把 Conn 包装成 net.Conn。
+func NewNetConn(c Conn) net.Conn {
+	if nc, ok := c.(*netConn); ok {
+		return nc
+	}
+	return &netConn{Conn: c}
+}
+
+func (c *netConn) LocalAddr() net.Addr {
+	addr := c.Conn.LocalAddr()
+	if addr == nil {
+		return &connAddr{network: c.Conn.Name(), addr: c.Conn.Info()}
+	}
+	return addr
+}
+
+func (c *netConn) RemoteAddr() net.Addr {
+	addr := c.Conn.RemoteAddr()
+	if addr == nil {
+		return &connAddr{network: c.Conn.Name(), addr: c.Conn.Info()}
+	}
+	return addr
+}
+
+type netListener struct {
+	listener Conn
+}
+
+// NewNetListener 把 Listen 返回的 Conn 包装成 net.Listener。
+func NewNetListener(listener Conn) net.Listener {
+	return &netListener{listener: listener}
+}
+
+func (l *netListener) Accept() (net.Conn, error) {
+	c, err := l.listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return NewNetConn(c), nil
+}
+
+func (l *netListener) Close() error {
+	return l.listener.Close()
+}
+
+func (l *netListener) Addr() net.Addr {
+	addr := l.listener.LocalAddr()
+	if addr == nil {
+		return &connAddr{network: l.listener.Name(), addr: l.listener.Info()}
+	}
+	return addr
+}
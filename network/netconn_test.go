@@ -0,0 +1,113 @@
+package network
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestNetConnAddr(t *testing.T) {
+	c, err := NewConn("rudp")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cc, err := c.Listen("127.0.0.1:58091")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+
+	if cc.LocalAddr() == nil || cc.LocalAddr().String() != "127.0.0.1:58091" {
+		t.Fatalf("listener LocalAddr = %v", cc.LocalAddr())
+	}
+	if cc.RemoteAddr() != nil {
+		t.Fatalf("listener RemoteAddr = %v, want nil", cc.RemoteAddr())
+	}
+
+	ch := make(chan Conn, 1)
+	go func() {
+		conn, err := cc.Accept()
+		if err == nil {
+			ch <- conn
+		}
+	}()
+
+	ccc, err := c.Dial("127.0.0.1:58091")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ccc.Close()
+
+	var sonny Conn
+	select {
+	case sonny = <-ch:
+	case <-time.After(time.Second * 5):
+		t.Fatal("accept timeout")
+	}
+	defer sonny.Close()
+
+	if sonny.RemoteAddr().String() != ccc.LocalAddr().String() {
+		t.Errorf("sonny RemoteAddr %v != dialer LocalAddr %v", sonny.RemoteAddr(), ccc.LocalAddr())
+	}
+	if ccc.RemoteAddr().String() != "127.0.0.1:58091" {
+		t.Errorf("dialer RemoteAddr = %v", ccc.RemoteAddr())
+	}
+
+	nc := NewNetConn(sonny)
+	if nc.RemoteAddr().String() != sonny.RemoteAddr().String() {
+		t.Errorf("NetConn RemoteAddr = %v", nc.RemoteAddr())
+	}
+}
+
+func TestNetListenerHttpServe(t *testing.T) {
+	for _, proto := range []string{"tcp", "rudp"} {
+		c, err := NewConn(proto)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		cc, err := c.Listen("127.0.0.1:58092")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		mux := http.NewServeMux()
+		mux.HandleFunc("/hello", func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("hello " + r.RemoteAddr))
+		})
+		go http.Serve(NewNetListener(cc), mux)
+
+		client := &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+					conn, err := c.DialContext(ctx, addr)
+					if err != nil {
+						return nil, err
+					}
+					return NewNetConn(conn), nil
+				},
+			},
+			Timeout: time.Second * 10,
+		}
+
+		resp, err := client.Get("http://127.0.0.1:58092/hello")
+		if err != nil {
+			t.Fatalf("%s Get fail %v", proto, err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("%s ReadAll fail %v", proto, err)
+		}
+		if len(body) <= len("hello ") || string(body[:6]) != "hello " {
+			t.Errorf("%s unexpected body %q", proto, body)
+		}
+
+		client.CloseIdleConnections()
+		cc.Close()
+	}
+}
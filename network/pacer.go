@@ -0,0 +1,83 @@
+package network
+
+import (
+	"time"
+)
+
+/*
+Pacer 是一个令牌桶，用于把 FrameMgr 的发送均匀地分散到时间上，避免一次发出整个窗口造成突发，在限速的链路上自己把自己的包挤丢。
+
+令牌按速率持续增加，最多积攒 burst 字节，令牌不为负数时就可以发送，发送后扣除相应字节数，允许暂时欠账，
+所以大于 burst 的帧也不会被一直卡住。速率为 0 表示不限速。
+
+速率可以固定配置，也可以跟随拥塞控制估算的速率，拥塞控制实现 CongestionPacing 即可。
+*/
+
+// CongestionPacing 是 Congestion 的可选扩展，返回估算的发送速率，单位字节每秒，返回 0 表示还没有估算出来，不限速。
+type CongestionPacing interface {
+	PacingRate() int
+}
+
+type Pacer struct {
+	rate   int
+	burst  int
+	tokens float64
+	last   int64
+}
+
+// NewPacer 创建一个令牌桶，rate 为字节每秒，为 0 不限速，burst 为最多积攒的字节数。
+func NewPacer(rate int, burst int) *Pacer {
+	return &Pacer{
+		rate:   rate,
+		burst:  burst,
+		tokens: float64(burst),
+		last:   time.Now().UnixNano(),
+	}
+}
+
+func (p *Pacer) SetRate(rate int) {
+	p.rate = rate
+}
+
+func (p *Pacer) Rate() int {
+	return p.rate
+}
+
+func (p *Pacer) refill(cur int64) {
+	if cur > p.last {
+		p.tokens += float64(cur-p.last) * float64(p.rate) / float64(time.Second)
+		if p.tokens > float64(p.burst) {
+			p.tokens = float64(p.burst)
+		}
+	}
+	p.last = cur
+}
+
+// CanSend 检查当前是否可以发送，不扣除令牌。
+func (p *Pacer) CanSend(cur int64) bool {
+	if p.rate <= 0 {
+		return true
+	}
+	p.refill(cur)
+	return p.tokens >= 0
+}
+
+// OnSend 发送后扣除令牌。
+func (p *Pacer) OnSend(size int) {
+	if p.rate <= 0 {
+		return
+	}
+	p.tokens -= float64(size)
+}
+
+// Delay 返回还需要等待多久才能发送。
+func (p *Pacer) Delay(cur int64) time.Duration {
+	if p.rate <= 0 {
+		return 0
+	}
+	p.refill(cur)
+	if p.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-p.tokens * float64(time.Second) / float64(p.rate))
+}
@@ -0,0 +1,35 @@
+package network
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPacer(t *testing.T) {
+	p := NewPacer(100*1024, 10*1024)
+
+	begin := time.Now()
+	sent := 0
+	for time.Since(begin) < 500*time.Millisecond {
+		cur := time.Now().UnixNano()
+		if p.CanSend(cur) {
+			p.OnSend(1000)
+			sent += 1000
+			continue
+		}
+		if p.Delay(cur) <= 0 {
+			t.Fatal("Delay should be positive when can not send")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// 0.5 秒的速率加上初始的 burst，再加一个包的欠账
+	if sent < 50*1024 || sent > 61*1024+1000 {
+		t.Errorf("sent %d bytes in 500ms", sent)
+	}
+
+	p.SetRate(0)
+	if !p.CanSend(time.Now().UnixNano()) || p.Delay(time.Now().UnixNano()) != 0 {
+		t.Error("rate 0 should not limit")
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"crypto/tls"
 	"errors"
 	"net"
+	"time"
 
 	"github.com/esrrhs/gohome/common"
 	"github.com/quic-go/quic-go"
@@ -21,9 +22,24 @@ type QuicConn struct {
 	qsteam   *quic.Stream
 	stream   *smux.Stream
 	listener *quic.Listener
+	tls      *TlsConfig
 	info     string
 }
 
+func init() {
+	mustRegisterProto("quic", func(config interface{}) (Conn, error) {
+		c := &QuicConn{}
+		if config != nil {
+			cfg, ok := config.(*TlsConfig)
+			if !ok {
+				return nil, errProtoConfig("quic", config)
+			}
+			c.SetTlsConfig(cfg)
+		}
+		return c, nil
+	}, true)
+}
+
 func (c *QuicConn) Name() string {
 	return "quic"
 }
@@ -65,10 +81,57 @@ func (c *QuicConn) Info() string {
 	return c.info
 }
 
+func (c *QuicConn) LocalAddr() net.Addr {
+	if c.qsession != nil {
+		return c.qsession.LocalAddr()
+	} else if c.listener != nil {
+		return c.listener.Addr()
+	}
+	return nil
+}
+
+func (c *QuicConn) RemoteAddr() net.Addr {
+	if c.qsession != nil {
+		return c.qsession.RemoteAddr()
+	}
+	return nil
+}
+
+func (c *QuicConn) SetDeadline(t time.Time) error {
+	if c.stream != nil {
+		return c.stream.SetDeadline(t)
+	} else if c.listener != nil {
+		return errListenerDeadline
+	}
+	return errors.New("empty conn")
+}
+
+func (c *QuicConn) SetReadDeadline(t time.Time) error {
+	if c.stream != nil {
+		return c.stream.SetReadDeadline(t)
+	} else if c.listener != nil {
+		return errListenerDeadline
+	}
+	return errors.New("empty conn")
+}
+
+func (c *QuicConn) SetWriteDeadline(t time.Time) error {
+	if c.stream != nil {
+		return c.stream.SetWriteDeadline(t)
+	} else if c.listener != nil {
+		return errListenerDeadline
+	}
+	return errors.New("empty conn")
+}
+
 func (c *QuicConn) Dial(dst string) (Conn, error) {
-	tlsConf := &tls.Config{
-		InsecureSkipVerify: true,
-		NextProtos:         []string{"QuicConn"},
+	return c.DialContext(context.Background(), dst)
+}
+
+func (c *QuicConn) DialContext(ctx context.Context, dst string) (Conn, error) {
+	tlsConf, err := c.clientTlsConfig(dst)
+	if err != nil {
+		return nil, err
 	}
 
 	var lc net.ListenConfig
@@ -77,33 +140,39 @@ func (c *QuicConn) Dial(dst string) (Conn, error) {
 	}
 
 	laddr := &net.UDPAddr{}
-	pconn, err := lc.ListenPacket(context.Background(), "udp", laddr.String())
+	pconn, err := lc.ListenPacket(ctx, "udp", laddr.String())
 	if err != nil {
 		return nil, err
 	}
 
 	udpAddr, err := net.ResolveUDPAddr("udp", dst)
 	if err != nil {
+		pconn.Close()
 		return nil, err
 	}
 
-	session, err := quic.Dial(context.Background(), pconn, udpAddr, tlsConf, nil)
+	session, err := quic.Dial(ctx, pconn, udpAddr, tlsConf, nil)
 	if err != nil {
+		pconn.Close()
 		return nil, err
 	}
 
-	stream, err := session.OpenStreamSync(context.Background())
+	stream, err := session.OpenStreamSync(ctx)
 	if err != nil {
+		session.CloseWithError(0, "")
 		return nil, err
 	}
 
 	ss, err := smux.Client(stream, nil)
 	if err != nil {
+		session.CloseWithError(0, "")
 		return nil, err
 	}
 
 	st, err := ss.OpenStream()
 	if err != nil {
+		ss.Close()
+		session.CloseWithError(0, "")
 		return nil, err
 	}
 
@@ -111,7 +180,7 @@ func (c *QuicConn) Dial(dst string) (Conn, error) {
 }
 
 func (c *QuicConn) Listen(dst string) (Conn, error) {
-	config, err := common.GenerateTLSConfig("QuicConn")
+	config, err := c.serverTlsConfig()
 	if err != nil {
 		return nil, err
 	}
@@ -125,25 +194,86 @@ func (c *QuicConn) Listen(dst string) (Conn, error) {
 }
 
 func (c *QuicConn) Accept() (Conn, error) {
-	session, err := c.listener.Accept(context.Background())
+	return c.AcceptContext(context.Background())
+}
+
+func (c *QuicConn) AcceptContext(ctx context.Context) (Conn, error) {
+	if c.listener == nil {
+		return nil, errors.New("not listen")
+	}
+
+	session, err := c.listener.Accept(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	stream, err := session.AcceptStream(context.Background())
+	stream, err := session.AcceptStream(ctx)
 	if err != nil {
+		session.CloseWithError(0, "")
 		return nil, err
 	}
 
 	ss, err := smux.Server(stream, nil)
 	if err != nil {
+		session.CloseWithError(0, "")
 		return nil, err
 	}
 
+	stop := watchContext(ctx, func() {
+		ss.SetDeadline(aLongTimeAgo)
+	})
 	st, err := ss.AcceptStream()
+	stop()
+	if ctx.Err() != nil {
+		ss.Close()
+		session.CloseWithError(0, "")
+		return nil, ctx.Err()
+	}
 	if err != nil {
+		ss.Close()
+		session.CloseWithError(0, "")
 		return nil, err
 	}
 
 	return &QuicConn{qsession: session, session: ss, qsteam: stream, stream: st}, nil
 }
+
+// SetTlsConfig 设置证书配置，nil 表示使用自签名证书且不校验对端，ALPN 为空时默认 QuicConn。
+func (c *QuicConn) SetTlsConfig(config *TlsConfig) {
+	c.tls = config
+}
+
+func (c *QuicConn) GetTlsConfig() *TlsConfig {
+	return c.tls
+}
+
+func (c *QuicConn) clientTlsConfig(dst string) (*tls.Config, error) {
+	if c.tls == nil {
+		return &tls.Config{
+			InsecureSkipVerify: true,
+			NextProtos:         []string{"QuicConn"},
+		}, nil
+	}
+	config, err := c.tls.clientConfigFor(dst)
+	if err != nil {
+		return nil, err
+	}
+	if len(config.NextProtos) <= 0 {
+		config.NextProtos = []string{"QuicConn"}
+	}
+	return config, nil
+}
+
+func (c *QuicConn) serverTlsConfig() (*tls.Config, error) {
+	if c.tls == nil {
+		return common.GenerateTLSConfig("QuicConn")
+	}
+	config, err := c.tls.ServerConfig()
+	if err != nil {
+		return nil, err
+	}
+	if len(config.NextProtos) <= 0 {
+		config.NextProtos = []string{"QuicConn"}
+	}
+	return config, nil
+}
@@ -0,0 +1,100 @@
+package network
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"errors"
+	"io"
+)
+
+/*
+Relay 在两个连接之间双向转发数据，供 Socks5Server、HttpProxyServer 等代理使用。
+
+一个方向读到 EOF 后，如果对端支持 CloseWrite（如 TcpConn）只关闭对端的写，另一个方向继续转发，实现半关闭；
+不支持时直接关闭两个连接。两个方向都结束后关闭两个连接。
+
+代理的服务端和客户端都通过 Dialer 函数连接下一跳，为 nil 时使用 tcp 直连，所以可以互相串联，也可以经过任意协议转发。
+*/
+
+const relayBufferSize = 32 * 1024
+
+// authEqual 比较代理的用户名和密码，两个都比较完再返回，避免通过时间差猜测。
+func authEqual(user string, pass string, wantUser string, wantPass string) bool {
+	u := subtle.ConstantTimeCompare([]byte(user), []byte(wantUser))
+	p := subtle.ConstantTimeCompare([]byte(pass), []byte(wantPass))
+	return u&p == 1
+}
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+type relayResult struct {
+	err    error
+	closed bool
+}
+
+// Relay 在 a 和 b 之间双向转发数据直到两个方向都结束，返回 a 到 b、b 到 a 转发的字节数，以及先结束的方向的错误，EOF 不算错误。
+func Relay(a, b io.ReadWriteCloser) (atob int64, btoa int64, err error) {
+	ret := make(chan relayResult, 2)
+	copyHalf := func(dst io.ReadWriteCloser, src io.ReadWriteCloser, n *int64) {
+		written, err := io.CopyBuffer(dst, src, make([]byte, relayBufferSize))
+		*n = written
+		if err == nil {
+			if cw, ok := dst.(closeWriter); ok && cw.CloseWrite() == nil {
+				ret <- relayResult{}
+				return
+			}
+		}
+		a.Close()
+		b.Close()
+		ret <- relayResult{err: err, closed: true}
+	}
+
+	go copyHalf(b, a, &atob)
+	go copyHalf(a, b, &btoa)
+
+	first := <-ret
+	second := <-ret
+	a.Close()
+	b.Close()
+
+	if first.err != nil {
+		return atob, btoa, first.err
+	}
+	// 先结束的方向已经关闭了连接，另一个方向的错误是关闭造成的
+	if first.closed {
+		return atob, btoa, nil
+	}
+	return atob, btoa, second.err
+}
+
+// dialProxyConn 使用 dialer 连接 addr，dialer 为 nil 时使用 tcp 直连。
+func dialProxyConn(ctx context.Context, dialer func(ctx context.Context, addr string) (Conn, error), addr string) (Conn, error) {
+	if dialer != nil {
+		return dialer(ctx, addr)
+	}
+	c, err := NewConn("tcp")
+	if err != nil {
+		return nil, err
+	}
+	return c.DialContext(ctx, addr)
+}
+
+// bufferedConn 先读出 bufio.Reader 中已经缓存的数据，用于握手时多读了数据的连接。
+type bufferedConn struct {
+	Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *bufferedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return errors.New("not support close write")
+}
@@ -0,0 +1,97 @@
+package network
+
+import (
+	"fmt"
+	"time"
+)
+
+/*
+RenoCongestion 实现了 NewReno 拥塞控制算法，按字节维护拥塞窗口。
+
+算法原理：
+
+1. 慢启动：窗口小于慢启动阈值时，每确认一个字节窗口增加一个字节，每个 rtt 窗口翻倍。
+
+2. 拥塞避免：窗口达到阈值后，每个 rtt 窗口增加一个包的大小。
+
+3. 丢包：阈值设为当前窗口的一半，窗口降到阈值。同一个恢复期内（发生丢包后的一个 srtt 内）的多次丢包只减一次窗口，
+   对应 NewReno 在快速恢复期间对部分确认不再重复降窗的处理。
+
+FrameMgr 的重传不区分超时和 REQ 触发，所以这里不单独处理超时把窗口降到最小的情况。
+*/
+
+type RenoCongestion struct {
+	flight       congestionFlight
+	cwnd         int
+	ssthresh     int
+	srtt         time.Duration
+	recoverStart time.Time
+	lossNum      int
+}
+
+func (r *RenoCongestion) Init() {
+	r.flight.init()
+	r.cwnd = congestionInitSegs * r.flight.mss
+	r.ssthresh = 1 << 30
+	r.srtt = 0
+	r.recoverStart = time.Time{}
+	r.lossNum = 0
+}
+
+func (r *RenoCongestion) RecvAck(id int, size int) {
+	acked := r.flight.ack(id)
+	if acked <= 0 || r.inRecovery() {
+		return
+	}
+	if r.cwnd < r.ssthresh {
+		r.cwnd += acked
+	} else {
+		r.cwnd += r.flight.mss * acked / r.cwnd
+	}
+}
+
+// PacingRate 和 CubicCongestion 相同。
+func (r *RenoCongestion) PacingRate() int {
+	return congestionPacingRate(r.cwnd, r.ssthresh, r.srtt)
+}
+
+func (r *RenoCongestion) CanSend(id int, size int) bool {
+	return r.flight.canSend(id, size, r.cwnd)
+}
+
+func (r *RenoCongestion) Update() {
+}
+
+func (r *RenoCongestion) Info() string {
+	return fmt.Sprintf("reno cwnd %v ssthresh %v inflight %v srtt %v loss %v", r.cwnd, r.ssthresh, r.flight.inflight,
+		r.srtt, r.lossNum)
+}
+
+func (r *RenoCongestion) OnRtt(rtt time.Duration) {
+	if r.srtt <= 0 {
+		r.srtt = rtt
+	} else {
+		r.srtt = (7*r.srtt + rtt) / 8
+	}
+}
+
+func (r *RenoCongestion) OnLoss(id int, size int) {
+	r.lossNum++
+	if r.inRecovery() {
+		return
+	}
+	r.recoverStart = time.Now()
+	r.ssthresh = r.cwnd / 2
+	if r.ssthresh < congestionMinSegs*r.flight.mss {
+		r.ssthresh = congestionMinSegs * r.flight.mss
+	}
+	r.cwnd = r.ssthresh
+}
+
+func (r *RenoCongestion) inRecovery() bool {
+	srtt := r.srtt
+	if srtt <= 0 {
+		srtt = congestionDefaultRtt
+	}
+	return !r.recoverStart.IsZero() && time.Since(r.recoverStart) < srtt
+}
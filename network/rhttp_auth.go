@@ -0,0 +1,152 @@
+package network
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"github.com/esrrhs/gohome/common"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+RhttpAuth 为 RhttpConn 提供 https、请求签名和反向代理需要的路径前缀、自定义头。
+
+  - rhttps 使用 https 监听和拨号，证书配置见 Tls，nil 时监听使用自签名证书，拨号不校验证书。
+  - 配置了 Secret 时，客户端的每个请求都带上时间戳、随机 nonce 和 HMAC-SHA256 签名，签名覆盖连接 id、请求参数（type、index、offset 等）、
+    时间戳、nonce 和 body，服务端签名不对、时间相差超过 rhttpSignMaxSkew 或者 nonce 已经用过的请求一律返回 ProtoCodeFail，
+    两端需要配置相同的 Secret。服务端记住时间窗口内见过的 nonce，所以截获的请求不能重放。
+    签名只保护请求，服务端的回复没有签名，需要防止回复被篡改时使用 rhttps。
+  - PathPrefix 加在连接 id 前面，服务端只处理这个前缀下的请求；Headers 加到客户端的每个请求上，Host 用来设置请求的 Host。
+*/
+
+const (
+	rhttpHeaderTime  = "X-Rhttp-Time"
+	rhttpHeaderSign  = "X-Rhttp-Sign"
+	rhttpHeaderNonce = "X-Rhttp-Nonce"
+	rhttpSignMaxSkew = 5 * time.Minute
+	rhttpNonceLen    = 16
+)
+
+func rhttpSign(secret string, method string, id string, query string, ts string, nonce string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(method + "\n" + id + "\n" + query + "\n" + ts + "\n" + nonce + "\n"))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// prepareRequest 加上自定义头，配置了 Secret 时签名。
+func (c *RhttpConn) prepareRequest(req *http.Request, id string, body []byte) {
+	for k, v := range c.config.Headers {
+		if strings.EqualFold(k, "Host") {
+			req.Host = v
+		} else {
+			req.Header.Set(k, v)
+		}
+	}
+	if c.config.Secret != "" {
+		ts := strconv.FormatInt(time.Now().Unix(), 10)
+		b := make([]byte, rhttpNonceLen)
+		rand.Read(b)
+		nonce := hex.EncodeToString(b)
+		req.Header.Set(rhttpHeaderTime, ts)
+		req.Header.Set(rhttpHeaderNonce, nonce)
+		req.Header.Set(rhttpHeaderSign, rhttpSign(c.config.Secret, req.Method, id, req.URL.RawQuery, ts, nonce, body))
+	}
+}
+
+// verifyRequest 校验请求的签名和 nonce，没有配置 Secret 时总是通过。
+func (c *RhttpConn) verifyRequest(r *http.Request, id string, body []byte) bool {
+	if c.config.Secret == "" {
+		return true
+	}
+	ts := r.Header.Get(rhttpHeaderTime)
+	t, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return false
+	}
+	skew := time.Since(time.Unix(t, 0))
+	if skew > rhttpSignMaxSkew || skew < -rhttpSignMaxSkew {
+		return false
+	}
+	nonce := r.Header.Get(rhttpHeaderNonce)
+	if len(nonce) != rhttpNonceLen*2 {
+		return false
+	}
+	sign := rhttpSign(c.config.Secret, r.Method, id, r.URL.RawQuery, ts, nonce, body)
+	if !hmac.Equal([]byte(sign), []byte(r.Header.Get(rhttpHeaderSign))) {
+		return false
+	}
+	// 签名通过后才记录 nonce，伪造的请求不会占用缓存
+	return c.listener.useNonce(nonce, time.Unix(t, 0).Add(rhttpSignMaxSkew))
+}
+
+// useNonce 记录 nonce 直到 expire，返回 false 表示已经用过。
+func (l *httpConnListener) useNonce(nonce string, expire time.Time) bool {
+	l.noncelock.Lock()
+	defer l.noncelock.Unlock()
+	if l.nonces == nil {
+		l.nonces = make(map[string]int64)
+	}
+	if _, ok := l.nonces[nonce]; ok {
+		return false
+	}
+	l.nonces[nonce] = expire.Unix()
+	return true
+}
+
+// pruneNonces 删除过期的 nonce，过期后对应的请求时间戳已经超出窗口，不需要再记录。
+func (l *httpConnListener) pruneNonces() {
+	l.noncelock.Lock()
+	defer l.noncelock.Unlock()
+	now := time.Now().Unix()
+	for nonce, expire := range l.nonces {
+		if expire < now {
+			delete(l.nonces, nonce)
+		}
+	}
+}
+
+func (c *RhttpConn) newHttpClient(tlsconfig *tls.Config) *http.Client {
+	tp := http.Transport{}
+	tp.Dial = func(network, addr string) (net.Conn, error) {
+		var d net.Dialer
+		if gControlOnConnSetup != nil {
+			d = net.Dialer{Control: gControlOnConnSetup}
+		}
+		return d.Dial(network, addr)
+	}
+	tp.TLSClientConfig = tlsconfig
+
+	client := &http.Client{}
+	client.Transport = &tp
+	return client
+}
+
+func (c *RhttpConn) clientTlsConfig(dst string) (*tls.Config, error) {
+	if c.config.Tls == nil {
+		host, _, _ := net.SplitHostPort(dst)
+		return &tls.Config{
+			ServerName:         host,
+			InsecureSkipVerify: true,
+		}, nil
+	}
+	return c.config.Tls.clientConfigFor(dst)
+}
+
+func (c *RhttpConn) serverTlsConfig() (*tls.Config, error) {
+	if c.config.Tls == nil {
+		config, err := common.GenerateTLSConfig("")
+		if err != nil {
+			return nil, err
+		}
+		config.NextProtos = nil
+		return config, nil
+	}
+	return c.config.Tls.ServerConfig()
+}
@@ -0,0 +1,204 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"github.com/esrrhs/gohome/common"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+/*
+RhttpDownlink 为 RhttpConn 提供独立的下行通道，服务端有数据时立即发给客户端，不用等客户端的下一个 POST。
+
+  - poll：客户端一直保持一个 GET，服务端有数据时写入回复并结束，没有数据时最多等待 PollTimeoutMs。
+  - stream：客户端一直保持一个 GET，服务端用分块编码持续写入数据，PollTimeoutMs 后或者未确认的数据达到 BufferSize 时结束。
+
+两种模式下 POST 只用于上行，回复为空。下行按字节偏移确认：GET 带上客户端已经收到的总字节数 offset，
+服务端丢掉 offset 之前的数据，先重发还没有确认的部分，所以连接中断时不会丢数据。同一时间只处理一个 GET，新的 GET 会结束旧的。
+
+模式在 connect 时协商，服务端在回复中带上接受的模式，旧版本的服务端回复为空，客户端退回到 POST 回复的方式。
+*/
+
+const (
+	ProtoPoll   = "poll"
+	ProtoStream = "stream"
+)
+
+func checkDownlink(downlink string) error {
+	if downlink != "" && downlink != ProtoPoll && downlink != ProtoStream {
+		return errors.New("unsupported downlink " + downlink)
+	}
+	return nil
+}
+
+func (c *RhttpConn) updateDialerDownlink() error {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-c.dialer.wg.Done()
+		cancel()
+	}()
+
+	buf := make([]byte, c.config.MaxPacketSize)
+	retry := 0
+	for !c.dialer.wg.IsExit() {
+		n, err := c.recvDownlink(ctx, buf)
+		if err != nil && n <= 0 {
+			retry++
+			if retry > c.config.MaxRetryNum {
+				//loggo.Error("downlink retry max %d", retry)
+				return errors.New("downlink retry max")
+			}
+			time.Sleep(time.Millisecond * 100)
+			continue
+		}
+		retry = 0
+	}
+	return nil
+}
+
+// recvDownlink 发起一个下行 GET，把收到的数据写入 recvb，返回收到的字节数。
+func (c *RhttpConn) recvDownlink(ctx context.Context, buf []byte) (int, error) {
+	timeout := time.Millisecond * time.Duration(c.config.PollTimeoutMs+c.config.HBTimeoutMs)
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	url := c.dialer.url + "?type=" + c.dialer.downlink + "&offset=" + strconv.FormatInt(c.dialer.downoffset, 10)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Close = true
+	c.prepareRequest(req, c.id, nil)
+
+	resp, err := c.dialer.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != ProtoCodeOK {
+		ret, _ := ioutil.ReadAll(resp.Body)
+		return 0, errors.New("downlink fail " + string(ret))
+	}
+
+	total := 0
+	for {
+		n, err := resp.Body.Read(buf)
+		if n > 0 {
+			for !c.recvb.Write(buf[0:n]) {
+				if c.dialer.wg.IsExit() {
+					return total, errors.New("closed")
+				}
+				time.Sleep(time.Microsecond * 100)
+			}
+			c.dialer.downoffset += int64(n)
+			total += n
+		}
+		if err == io.EOF {
+			return total, nil
+		}
+		if err != nil {
+			return total, err
+		}
+	}
+}
+
+// serveDownlink 处理下行 GET，ty 为 ProtoPoll 或 ProtoStream。
+func (c *RhttpConn) serveDownlink(w http.ResponseWriter, r *http.Request, u *RhttpConn, ty string, offsets []string) {
+	s := u.listenersonny
+	if s.downlink == "" || len(offsets) == 0 {
+		w.WriteHeader(ProtoCodeFail)
+		w.Write([]byte("no downlink"))
+		return
+	}
+	offset, err := strconv.ParseInt(offsets[0], 10, 64)
+	if err != nil {
+		w.WriteHeader(ProtoCodeFail)
+		w.Write([]byte("offset fail"))
+		return
+	}
+
+	gen := atomic.AddInt32(&s.downgen, 1)
+	s.downlock.Lock()
+	defer s.downlock.Unlock()
+
+	// 确认 offset 之前的数据
+	if offset < s.downbase || offset > s.downbase+int64(len(s.downbuf)) {
+		//loggo.Error("offset diff %v %v", r.RequestURI, s.downbase)
+		w.WriteHeader(ProtoCodeFail)
+		w.Write([]byte("offset diff"))
+		return
+	}
+	s.downbuf = s.downbuf[offset-s.downbase:]
+	s.downbase = offset
+	if len(s.downbuf) == 0 {
+		s.downbuf = nil
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.WriteHeader(ProtoCodeOK)
+	flusher, _ := w.(http.Flusher)
+	flush := func() {
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+
+	// 先重发没有确认的数据
+	if len(s.downbuf) > 0 {
+		if _, err := w.Write(s.downbuf); err != nil {
+			return
+		}
+		flush()
+		if ty == ProtoPoll {
+			return
+		}
+	}
+
+	end := time.NewTimer(time.Millisecond * time.Duration(c.config.PollTimeoutMs))
+	defer end.Stop()
+	// 关闭、被新的 GET 取代等状态没有通知，定时检查
+	check := time.NewTicker(time.Millisecond * 100)
+	defer check.Stop()
+	for atomic.LoadInt32(&s.downgen) == gen && !u.isclose && !s.fwg.IsExit() && r.Context().Err() == nil {
+		if _, ok := c.listener.sonny.Load(u.id); !ok {
+			return
+		}
+		s.touch()
+
+		if len(s.downbuf) >= c.config.BufferSize {
+			return
+		}
+
+		sendn := common.MinOfInt(c.config.MaxPacketSize, u.sendb.Size())
+		if sendn > 0 {
+			buff := make([]byte, sendn)
+			u.sendb.Read(buff)
+			s.downbuf = append(s.downbuf, buff...)
+			if _, err := w.Write(buff); err != nil {
+				return
+			}
+			flush()
+			if ty == ProtoPoll {
+				return
+			}
+			continue
+		}
+
+		select {
+		case <-s.downnotify:
+		case <-check.C:
+		case <-end.C:
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
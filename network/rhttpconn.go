@@ -3,6 +3,7 @@ package network
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
 	"errors"
 	"github.com/esrrhs/gohome/common"
 	"github.com/esrrhs/gohome/list"
@@ -10,15 +11,20 @@ import (
 	"io/ioutil"
 	"net"
 	"net/http"
-	"net/url"
+	"net/http/httptrace"
+	"os"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 /*
-RhttpConn 实现了基于 可靠http 协议的Conn。
+RhttpConn 实现了基于 可靠http 协议的Conn，支持 rhttp 及 rhttps。
+
+除了 Listen 自己监听端口，也可以通过 ListenHandler 得到 http.Handler 挂到已有的 http 服务的任意路径下，
+这时不检查 PathPrefix，请求路径的最后一段就是连接 id，https 由已有的服务负责。
 */
 
 type HttpConfig struct {
@@ -31,6 +37,16 @@ type HttpConfig struct {
 	CloseWaitTimeoutMs  int
 	HBTimeoutMs         int
 	MaxMsgIndex         int
+	// 下行模式，为空时数据放在 POST 的回复中，poll 为长轮询 GET，stream 为流式 GET，PollTimeoutMs 为一个 GET 最长保持的时间
+	Downlink      string
+	PollTimeoutMs int
+	// rhttps 的证书配置，nil 表示监听使用自签名证书，拨号不校验证书
+	Tls *TlsConfig
+	// 请求签名的共享密钥，为空不签名
+	Secret string
+	// 连接 id 前的路径前缀，例如 /tunnel，Headers 为客户端请求额外带上的头
+	PathPrefix string
+	Headers    map[string]string
 }
 
 func DefaultHttpConfig() *HttpConfig {
@@ -44,6 +60,8 @@ func DefaultHttpConfig() *HttpConfig {
 		CloseWaitTimeoutMs:  5000,
 		HBTimeoutMs:         10000,
 		MaxMsgIndex:         100,
+		Downlink:            "",
+		PollTimeoutMs:       30000,
 	}
 }
 
@@ -58,6 +76,7 @@ const (
 )
 
 type RhttpConn struct {
+	secure        bool
 	id            string
 	isclose       bool
 	info          string
@@ -69,22 +88,52 @@ type RhttpConn struct {
 	sendb         *list.RBuffergo
 	recvb         *list.RBuffergo
 	closelock     sync.Mutex
+	deadline      connDeadline
 }
 
 type httpConnDialer struct {
-	wg    *thread.Group
-	addr  string
-	url   string
-	index int
-	retry int
+	wg         *thread.Group
+	addr       string
+	url        string
+	index      int
+	retry      int
+	client     *http.Client
+	downlink   string
+	downoffset int64 // 下行已经收到的字节数
+	localaddr  net.Addr
+	remoteaddr net.Addr
 }
 
 type httpConnListenerSonny struct {
 	fwg          *thread.Group
 	addr         string
 	expectIndex  int
-	lastRecvTime time.Time
+	lastRecvTime int64 // UnixNano，下行 GET 和 checkSonnyClose 在不同的协程中访问，用 atomic 读写
 	lastSend     []byte
+	localaddr    net.Addr
+	remoteaddr   net.Addr
+	downlink     string
+	downlock     sync.Mutex
+	downgen      int32
+	downnotify   chan struct{} // Write 写入新数据时唤醒下行 GET
+	downbase     int64         // downbuf 第一个字节的偏移
+	downbuf      []byte        // 已经发出还没有确认的下行数据
+}
+
+func (s *httpConnListenerSonny) touch() {
+	atomic.StoreInt64(&s.lastRecvTime, time.Now().UnixNano())
+}
+
+func (s *httpConnListenerSonny) idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&s.lastRecvTime)))
+}
+
+// notifyDown 通知下行 GET 有新数据，不阻塞，已经有通知没处理时直接返回。
+func (s *httpConnListenerSonny) notifyDown() {
+	select {
+	case s.downnotify <- struct{}{}:
+	default:
+	}
 }
 
 type httpConnListener struct {
@@ -93,9 +142,35 @@ type httpConnListener struct {
 	listenerconn *net.TCPListener
 	sonny        sync.Map
 	accept       *common.Channel
+	noncelock    sync.Mutex
+	nonces       map[string]int64 // 签名用过的 nonce 和过期时间
+}
+
+func init() {
+	for _, secure := range []bool{false, true} {
+		secure := secure
+		name := "rhttp"
+		if secure {
+			name = "rhttps"
+		}
+		mustRegisterProto(name, func(config interface{}) (Conn, error) {
+			c := &RhttpConn{secure: secure}
+			if config != nil {
+				cfg, ok := config.(*HttpConfig)
+				if !ok {
+					return nil, errProtoConfig(name, config)
+				}
+				c.SetConfig(cfg)
+			}
+			return c, nil
+		}, true)
+	}
 }
 
 func (c *RhttpConn) Name() string {
+	if c.secure {
+		return "https"
+	}
 	return "http"
 }
 
@@ -126,7 +201,10 @@ func (c *RhttpConn) Read(p []byte) (n int, err error) {
 			if wg != nil && wg.IsExit() {
 				return 0, errors.New("closed conn")
 			}
-			time.Sleep(time.Millisecond * 100)
+			if c.deadline.readTimeout() {
+				return 0, os.ErrDeadlineExceeded
+			}
+			pollSleep(c.deadline.readDeadline())
 			continue
 		}
 
@@ -164,6 +242,10 @@ func (c *RhttpConn) Write(p []byte) (n int, err error) {
 	cur := 0
 
 	for !c.isclose {
+		if c.deadline.writeTimeout() {
+			return cur, os.ErrDeadlineExceeded
+		}
+
 		size := totalsize - cur
 		svleft := c.sendb.Capacity() - c.sendb.Size()
 		if size > svleft {
@@ -174,18 +256,21 @@ func (c *RhttpConn) Write(p []byte) (n int, err error) {
 			if wg != nil && wg.IsExit() {
 				return 0, errors.New("closed conn")
 			}
-			time.Sleep(time.Millisecond * 100)
+			pollSleep(c.deadline.writeDeadline())
 			continue
 		}
 
 		c.sendb.Write(p[cur : cur+size])
 		cur += size
+		if c.listenersonny != nil {
+			c.listenersonny.notifyDown()
+		}
 
 		if cur >= totalsize {
 			return totalsize, nil
 		}
 
-		time.Sleep(time.Millisecond * 100)
+		pollSleep(c.deadline.writeDeadline())
 	}
 
 	return 0, errors.New("write closed conn")
@@ -254,27 +339,64 @@ func (c *RhttpConn) Info() string {
 	return c.info
 }
 
-func (c *RhttpConn) postData(url string, d []byte) (int, []byte, error) {
+func (c *RhttpConn) LocalAddr() net.Addr {
+	if c.dialer != nil {
+		return c.dialer.localaddr
+	} else if c.listener != nil && c.listener.listenerconn != nil {
+		return c.listener.listenerconn.Addr()
+	} else if c.listenersonny != nil {
+		return c.listenersonny.localaddr
+	}
+	return nil
+}
+
+func (c *RhttpConn) RemoteAddr() net.Addr {
+	if c.dialer != nil {
+		return c.dialer.remoteaddr
+	} else if c.listenersonny != nil {
+		return c.listenersonny.remoteaddr
+	}
+	return nil
+}
+
+func (c *RhttpConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+func (c *RhttpConn) SetReadDeadline(t time.Time) error {
+	if c.listener != nil {
+		return errListenerDeadline
+	} else if c.dialer == nil && c.listenersonny == nil {
+		return errors.New("empty conn")
+	}
+	c.deadline.setRead(t)
+	return nil
+}
+
+func (c *RhttpConn) SetWriteDeadline(t time.Time) error {
+	if c.listener != nil {
+		return errListenerDeadline
+	} else if c.dialer == nil && c.listenersonny == nil {
+		return errors.New("empty conn")
+	}
+	c.deadline.setWrite(t)
+	return nil
+}
+
+func (c *RhttpConn) postData(ctx context.Context, client *http.Client, id string, url string, d []byte) (int, []byte, error) {
 
 	data := bytes.NewReader(d)
-	req, err := http.NewRequest("POST", url, data)
+	req, err := http.NewRequestWithContext(ctx, "POST", url, data)
 	if err != nil {
 		return 0, nil, err
 	}
 	req.Header.Set("Content-Type", "application/octet-stream")
 	req.Close = true
+	c.prepareRequest(req, id, d)
 
-	tp := http.Transport{}
-	tp.Dial = func(network, addr string) (net.Conn, error) {
-		var d net.Dialer
-		if gControlOnConnSetup != nil {
-			d = net.Dialer{Control: gControlOnConnSetup}
-		}
-		return d.Dial(network, addr)
-	}
-
-	client := &http.Client{}
-	client.Transport = &tp
 	resp, err := client.Do(req)
 	if err != nil {
 		return 0, nil, err
@@ -290,17 +412,56 @@ func (c *RhttpConn) postData(url string, d []byte) (int, []byte, error) {
 }
 
 func (c *RhttpConn) Dial(dst string) (Conn, error) {
+	return c.DialContext(context.Background(), dst)
+}
+
+func (c *RhttpConn) DialContext(ctx context.Context, dst string) (Conn, error) {
 	c.checkConfig()
 
+	if err := checkDownlink(c.config.Downlink); err != nil {
+		return nil, err
+	}
+
 	id := common.UniqueId()
 
-	url := dst + "/" + id
+	host := dst
+	secure := c.secure
+	if strings.HasPrefix(host, "https://") {
+		host = strings.TrimPrefix(host, "https://")
+		secure = true
+	} else {
+		host = strings.TrimPrefix(host, "http://")
+	}
 
-	if !strings.HasPrefix(url, "http://") {
-		url = "http://" + url
+	var tlsconfig *tls.Config
+	url := "http://" + host + c.config.PathPrefix + "/" + id
+	if secure {
+		config, err := c.clientTlsConfig(host)
+		if err != nil {
+			return nil, err
+		}
+		tlsconfig = config
+		url = "https://" + host + c.config.PathPrefix + "/" + id
 	}
+	client := c.newHttpClient(tlsconfig)
 
-	code, ret, err := c.postData(url+"?type="+ProtoConnnect, []byte{})
+	var localaddr, remoteaddr net.Addr
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			localaddr = info.Conn.LocalAddr()
+			remoteaddr = info.Conn.RemoteAddr()
+		},
+	})
+
+	ctx, cancel := context.WithCancel(ctx)
+	c.cancel = cancel
+	connurl := url + "?type=" + ProtoConnnect
+	if c.config.Downlink != "" {
+		connurl += "&downlink=" + c.config.Downlink
+	}
+	code, ret, err := c.postData(ctx, client, id, connurl, []byte{})
+	c.cancel = nil
+	cancel()
 	if err != nil {
 		return nil, err
 	}
@@ -314,13 +475,25 @@ func (c *RhttpConn) Dial(dst string) (Conn, error) {
 	sendb := list.NewRBuffergo(c.config.BufferSize, true)
 	recvb := list.NewRBuffergo(c.config.BufferSize, true)
 
-	dialer := &httpConnDialer{wg: wg, url: url, index: 0, retry: 0, addr: dst}
+	// 旧版本的服务端不回复下行模式
+	downlink := ""
+	if c.config.Downlink != "" && string(ret) == c.config.Downlink {
+		downlink = c.config.Downlink
+	}
+
+	dialer := &httpConnDialer{wg: wg, url: url, index: 0, retry: 0, addr: dst, client: client, downlink: downlink,
+		localaddr: localaddr, remoteaddr: remoteaddr}
 
 	u := &RhttpConn{id: id, config: c.config, dialer: dialer, sendb: sendb, recvb: recvb}
 
 	wg.Go("RhttpConn updateDialerSonny"+" "+u.Info(), func() error {
 		return u.updateDialerSonny()
 	})
+	if downlink != "" {
+		wg.Go("RhttpConn updateDialerDownlink"+" "+u.Info(), func() error {
+			return u.updateDialerDownlink()
+		})
+	}
 
 	return u, nil
 }
@@ -362,7 +535,13 @@ func (c *RhttpConn) updateDialerSonny() error {
 			active = true
 		}
 
-		code, ret, err := c.postData(c.dialer.url+"?type="+ProtoData+"&index="+strconv.Itoa(c.dialer.index), send)
+		// 有独立的下行通道时只在有数据时发送
+		if c.dialer.downlink != "" && len(send) <= 0 {
+			time.Sleep(time.Microsecond * 100)
+			continue
+		}
+
+		code, ret, err := c.postData(context.Background(), c.dialer.client, c.id, c.dialer.url+"?type="+ProtoData+"&index="+strconv.Itoa(c.dialer.index), send)
 		if err != nil || code != ProtoCodeOK {
 			if code != ProtoCodeFull {
 				c.dialer.retry++
@@ -417,7 +596,7 @@ func (c *RhttpConn) updateDialerSonny() error {
 
 	//loggo.Debug("close http conn %s", c.Info())
 
-	c.postData(c.dialer.url+"?type="+ProtoClose, []byte{})
+	c.postData(context.Background(), c.dialer.client, c.id, c.dialer.url+"?type="+ProtoClose, []byte{})
 
 	return errors.New("closed")
 }
@@ -434,39 +613,73 @@ func (c *RhttpConn) Listen(dst string) (Conn, error) {
 		return nil, err
 	}
 
+	var ln net.Listener = listenerconn
+	if c.secure {
+		config, err := c.serverTlsConfig()
+		if err != nil {
+			listenerconn.Close()
+			return nil, err
+		}
+		ln = tls.NewListener(listenerconn, config)
+	}
+
+	u := c.newListener(listenerconn, dst)
+	u.listener.wg.Go("RhttpConn Listen loopRecv"+" "+dst, func() error {
+		return u.loopRecv(ln)
+	})
+
+	return u, nil
+}
+
+// ListenHandler 创建一个不监听端口的 listener，返回的 http.Handler 可以挂到已有的 http 服务上，Accept 得到新的连接。
+func (c *RhttpConn) ListenHandler() (Conn, http.Handler) {
+	c.checkConfig()
+
+	u := c.newListener(nil, "handler")
+	return u, u
+}
+
+func (c *RhttpConn) newListener(listenerconn *net.TCPListener, addr string) *RhttpConn {
 	ch := common.NewChannel(c.config.AcceptChanLen)
 
-	wg := thread.NewGroup("RhttpConn Listen"+" "+dst, nil, func() {
-		listenerconn.Close()
+	wg := thread.NewGroup("RhttpConn Listen"+" "+addr, nil, func() {
+		if listenerconn != nil {
+			listenerconn.Close()
+		}
 		ch.Close()
 	})
 
 	listener := &httpConnListener{
-		addr:         dst,
+		addr:         addr,
 		listenerconn: listenerconn,
 		wg:           wg,
 		accept:       ch,
 	}
 
-	u := &RhttpConn{id: common.UniqueId(), config: c.config, listener: listener}
-	wg.Go("RhttpConn Listen loopRecv"+" "+dst, func() error {
-		return u.loopRecv()
-	})
-	wg.Go("RhttpConn Listen checkSonnyClose"+" "+dst, func() error {
+	u := &RhttpConn{secure: c.secure, id: common.UniqueId(), config: c.config, listener: listener}
+	wg.Go("RhttpConn Listen checkSonnyClose"+" "+addr, func() error {
 		return u.checkSonnyClose()
 	})
-
-	return u, nil
+	return u
 }
 
 func (c *RhttpConn) Accept() (Conn, error) {
+	return c.AcceptContext(context.Background())
+}
+
+func (c *RhttpConn) AcceptContext(ctx context.Context) (Conn, error) {
 	c.checkConfig()
 
-	if c.listener.wg == nil {
+	if c.listener == nil || c.listener.wg == nil {
 		return nil, errors.New("not listen")
 	}
 	for !c.listener.wg.IsExit() {
-		s := <-c.listener.accept.Ch()
+		var s interface{}
+		select {
+		case s = <-c.listener.accept.Ch():
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
 		if s == nil {
 			break
 		}
@@ -485,17 +698,31 @@ func (c *RhttpConn) Accept() (Conn, error) {
 
 func (c *RhttpConn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	//loggo.Debug("ServeHTTP %v %v", r.Method, r.RequestURI)
+	c.checkConfig()
 
-	u, err := url.Parse(r.RequestURI)
-	if err != nil {
-		//loggo.Error("Parse fail %v", r.RequestURI)
+	if c.listener == nil || c.listener.wg.IsExit() {
+		http.Error(w, "listener closed", http.StatusServiceUnavailable)
+		return
+	}
+
+	var id string
+	if c.listener.listenerconn != nil {
+		if !strings.HasPrefix(r.URL.Path, c.config.PathPrefix+"/") {
+			w.WriteHeader(ProtoCodeFail)
+			w.Write([]byte("path fail"))
+			return
+		}
+		id = strings.TrimPrefix(r.URL.Path, c.config.PathPrefix+"/")
+	} else {
+		id = r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+	}
+	if id == "" {
 		w.WriteHeader(ProtoCodeFail)
-		w.Write([]byte("url Parse fail"))
+		w.Write([]byte("no id"))
 		return
 	}
 
-	id := u.Path
-	param := u.Query()
+	param := r.URL.Query()
 	types, ok := param["type"]
 	if !ok || len(types) == 0 {
 		//loggo.Error("no params type %v", r.RequestURI)
@@ -505,6 +732,25 @@ func (c *RhttpConn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 	ty := types[0]
 
+	var body []byte
+	if r.Method == "POST" {
+		var err error
+		body, err = ioutil.ReadAll(http.MaxBytesReader(w, r.Body, int64(c.config.MaxPacketSize)))
+		if err != nil {
+			//loggo.Error("read body fail %v", r.RequestURI)
+			w.WriteHeader(ProtoCodeFail)
+			w.Write([]byte("read body fail"))
+			return
+		}
+	}
+
+	if !c.verifyRequest(r, id, body) {
+		//loggo.Error("sign fail %v", r.RequestURI)
+		w.WriteHeader(ProtoCodeFail)
+		w.Write([]byte("sign fail"))
+		return
+	}
+
 	v, ok := c.listener.sonny.Load(id)
 	if !ok {
 		if ty != ProtoConnnect {
@@ -514,7 +760,18 @@ func (c *RhttpConn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		sonny := &httpConnListenerSonny{fwg: c.listener.wg, expectIndex: 0, lastRecvTime: time.Now(), addr: c.listener.addr}
+		sonny := &httpConnListenerSonny{fwg: c.listener.wg, expectIndex: 0, addr: c.listener.addr,
+			localaddr: c.LocalAddr(), downnotify: make(chan struct{}, 1)}
+		sonny.touch()
+		if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+			sonny.localaddr = addr
+		}
+		if addr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr); err == nil {
+			sonny.remoteaddr = addr
+		}
+		if downlinks, ok := param["downlink"]; ok && len(downlinks) > 0 && downlinks[0] != "" && checkDownlink(downlinks[0]) == nil {
+			sonny.downlink = downlinks[0]
+		}
 
 		sendb := list.NewRBuffergo(c.config.BufferSize, true)
 		recvb := list.NewRBuffergo(c.config.BufferSize, true)
@@ -526,10 +783,16 @@ func (c *RhttpConn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		c.listener.accept.Write(u)
 
 		w.WriteHeader(ProtoCodeOK)
+		w.Write([]byte(sonny.downlink))
 
 	} else {
 		u := v.(*RhttpConn)
-		u.listenersonny.lastRecvTime = time.Now()
+		u.listenersonny.touch()
+
+		if ty == ProtoPoll || ty == ProtoStream {
+			c.serveDownlink(w, r, u, ty, param["offset"])
+			return
+		}
 
 		if ty != ProtoData && ty != ProtoClose {
 			//loggo.Error("wrong type %v %v", id, ty)
@@ -576,14 +839,6 @@ func (c *RhttpConn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 
 		if newrecv {
-			body, err := ioutil.ReadAll(r.Body)
-			if err != nil {
-				//loggo.Error("read body fail %v", r.RequestURI)
-				w.WriteHeader(ProtoCodeFail)
-				w.Write([]byte("read body fail"))
-				return
-			}
-
 			if !u.recvb.Write(body) {
 				//loggo.Debug("body write fail %v %v", r.RequestURI, len(body))
 				w.WriteHeader(ProtoCodeFull)
@@ -596,7 +851,11 @@ func (c *RhttpConn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 				u.listenersonny.expectIndex = 0
 			}
 
-			sendn := common.MinOfInt(u.config.MaxPacketSize, u.sendb.Size())
+			// 有独立的下行通道时数据从 GET 发送
+			sendn := 0
+			if u.listenersonny.downlink == "" {
+				sendn = common.MinOfInt(u.config.MaxPacketSize, u.sendb.Size())
+			}
 			buff := make([]byte, sendn)
 			u.sendb.Read(buff)
 
@@ -611,9 +870,9 @@ func (c *RhttpConn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func (c *RhttpConn) loopRecv() error {
+func (c *RhttpConn) loopRecv(ln net.Listener) error {
 	c.checkConfig()
-	http.Serve(c.listener.listenerconn, c)
+	http.Serve(ln, c)
 	return nil
 }
 
@@ -622,11 +881,12 @@ func (c *RhttpConn) checkSonnyClose() error {
 	for !c.listener.wg.IsExit() {
 		c.listener.sonny.Range(func(key, value interface{}) bool {
 			u := value.(*RhttpConn)
-			if u.isclose || time.Now().Sub(u.listenersonny.lastRecvTime) > time.Second*time.Duration(c.config.HBTimeoutMs) {
+			if u.isclose || u.listenersonny.idle() > time.Second*time.Duration(c.config.HBTimeoutMs) {
 				c.listener.sonny.Delete(key)
 			}
 			return true
 		})
+		c.listener.pruneNonces()
 		time.Sleep(time.Second)
 	}
 	return nil
@@ -1,9 +1,14 @@
 package network
 
 import (
+	"bytes"
 	"fmt"
 	"github.com/esrrhs/gohome/loggo"
+	"io"
+	"net/http"
+	"net/http/httptest"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 )
@@ -540,3 +545,293 @@ func Test0009RHTTP(t *testing.T) {
 
 	time.Sleep(time.Second)
 }
+
+func testRHTTPDownlink(t *testing.T, downlink string, port string) {
+	config := DefaultHttpConfig()
+	config.Downlink = downlink
+	config.PollTimeoutMs = 2000
+	c, err := NewConnWithConfig("rhttp", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cc, err := c.Listen(":" + port)
+	if err != nil {
+		t.Skip(err)
+	}
+	defer cc.Close()
+
+	go func() {
+		conn, err := cc.Accept()
+		if err != nil {
+			return
+		}
+		io.Copy(conn, conn)
+	}()
+
+	ccc, err := c.Dial("127.0.0.1:" + port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ccc.Close()
+	if ccc.(*RhttpConn).dialer.downlink != downlink {
+		t.Fatalf("downlink %v", ccc.(*RhttpConn).dialer.downlink)
+	}
+
+	// 等一次轮询超时，回复仍然要马上送达，不能等到下一次轮询超时
+	time.Sleep(time.Millisecond * 2500)
+	buf := make([]byte, 5)
+	for i := 0; i < 10; i++ {
+		start := time.Now()
+		ccc.Write([]byte("hello"))
+		ccc.SetReadDeadline(time.Now().Add(time.Second * 5))
+		if _, err := io.ReadFull(ccc, buf); err != nil || string(buf) != "hello" {
+			t.Fatalf("ReadFull %q %v", buf, err)
+		}
+		if time.Since(start) > time.Second {
+			t.Errorf("echo %v", time.Since(start))
+		}
+	}
+
+	data := make([]byte, 3*1024*1024)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	go ccc.Write(data)
+	recv := make([]byte, len(data))
+	ccc.SetReadDeadline(time.Now().Add(time.Second * 20))
+	if _, err := io.ReadFull(ccc, recv); err != nil || !bytes.Equal(recv, data) {
+		t.Fatalf("ReadFull %v", err)
+	}
+}
+
+func TestRHTTPDownlinkPoll(t *testing.T) {
+	testRHTTPDownlink(t, ProtoPoll, "58108")
+}
+
+func TestRHTTPDownlinkStream(t *testing.T) {
+	testRHTTPDownlink(t, ProtoStream, "58109")
+}
+
+func TestRHTTPDownlinkConfig(t *testing.T) {
+	config := DefaultHttpConfig()
+	config.Downlink = "push"
+	c, err := NewConnWithConfig("rhttp", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Dial("127.0.0.1:58109"); err == nil {
+		t.Fatal("Dial with unsupported downlink")
+	}
+}
+
+func testRHTTPEcho(t *testing.T, ccc Conn) {
+	buf := make([]byte, 5)
+	ccc.Write([]byte("hello"))
+	ccc.SetReadDeadline(time.Now().Add(time.Second * 5))
+	if _, err := io.ReadFull(ccc, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("ReadFull %q %v", buf, err)
+	}
+}
+
+func TestRHTTPS(t *testing.T) {
+	config := DefaultHttpConfig()
+	config.Secret = "rhttp secret"
+	config.PathPrefix = "/tunnel"
+	config.Headers = map[string]string{"Host": "example.com", "X-Test": "1"}
+	config.Downlink = ProtoPoll
+	c, err := NewConnWithConfig("rhttps", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cc, err := c.Listen(":58110")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer cc.Close()
+
+	go func() {
+		for {
+			conn, err := cc.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(conn, conn)
+		}
+	}()
+
+	ccc, err := c.Dial("127.0.0.1:58110")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ccc.Close()
+	if !strings.HasPrefix(ccc.(*RhttpConn).dialer.url, "https://127.0.0.1:58110/tunnel/") {
+		t.Fatalf("url %v", ccc.(*RhttpConn).dialer.url)
+	}
+	testRHTTPEcho(t, ccc)
+
+	// 普通 http 客户端也可以用 https:// 前缀拨号
+	plain, err := NewConnWithConfig("rhttp", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ccc2, err := plain.Dial("https://127.0.0.1:58110")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ccc2.Close()
+	testRHTTPEcho(t, ccc2)
+}
+
+func TestRHTTPSign(t *testing.T) {
+	config := DefaultHttpConfig()
+	config.Secret = "rhttp secret"
+	config.PathPrefix = "/tunnel"
+	c, err := NewConnWithConfig("rhttp", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cc, err := c.Listen(":58111")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer cc.Close()
+
+	recv := make(chan []byte, 16)
+	go func() {
+		conn, err := cc.Accept()
+		if err != nil {
+			return
+		}
+		buf := make([]byte, 1024)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return
+			}
+			recv <- append([]byte(nil), buf[:n]...)
+		}
+	}()
+
+	for _, secret := range []string{"", "wrong secret"} {
+		bad := DefaultHttpConfig()
+		bad.Secret = secret
+		bad.PathPrefix = "/tunnel"
+		badc, _ := NewConnWithConfig("rhttp", bad)
+		if _, err := badc.Dial("127.0.0.1:58111"); err == nil {
+			t.Fatalf("Dial with secret %q", secret)
+		}
+	}
+	nopath := DefaultHttpConfig()
+	nopath.Secret = config.Secret
+	nopathc, _ := NewConnWithConfig("rhttp", nopath)
+	if _, err := nopathc.Dial("127.0.0.1:58111"); err == nil {
+		t.Fatal("Dial without path prefix")
+	}
+
+	ccc, err := c.Dial("127.0.0.1:58111")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ccc.Close()
+
+	// 知道 id 也不能注入数据
+	resp, err := http.Post(ccc.(*RhttpConn).dialer.url+"?type="+ProtoData+"&index=0", "application/octet-stream",
+		strings.NewReader("inject"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != ProtoCodeFail {
+		t.Fatalf("inject status %v", resp.StatusCode)
+	}
+
+	// 截获的签名请求不能重放
+	url := "http://127.0.0.1:58111/tunnel/replay?type=" + ProtoConnnect
+	req, _ := http.NewRequest("POST", url, nil)
+	c.(*RhttpConn).prepareRequest(req, "replay", nil)
+	for i, expect := range []int{ProtoCodeOK, ProtoCodeFail} {
+		replay, _ := http.NewRequest("POST", url, nil)
+		replay.Header = req.Header.Clone()
+		resp, err := http.DefaultClient.Do(replay)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != expect || (i > 0 && string(body) != "sign fail") {
+			t.Fatalf("replay %d status %v %q", i, resp.StatusCode, body)
+		}
+	}
+
+	ccc.Write([]byte("hello"))
+	select {
+	case b := <-recv:
+		if string(b) != "hello" {
+			t.Fatalf("recv %q", b)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("recv timeout")
+	}
+}
+
+func TestRHTTPListenHandler(t *testing.T) {
+	config := DefaultHttpConfig()
+	config.PathPrefix = "/tunnel"
+	config.Secret = "rhttp secret"
+	config.Downlink = ProtoStream
+	c, err := NewConnWithConfig("rhttp", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cc, handler := c.(*RhttpConn).ListenHandler()
+	defer cc.Close()
+
+	mux := http.NewServeMux()
+	mux.Handle("/tunnel/", handler)
+	mux.HandleFunc("/api", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("api"))
+	})
+	server := httptest.NewTLSServer(mux)
+	defer server.Close()
+
+	go func() {
+		for {
+			conn, err := cc.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(conn, conn)
+		}
+	}()
+
+	ccc, err := c.Dial(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ccc.Close()
+	testRHTTPEcho(t, ccc)
+
+	resp, err := server.Client().Get(server.URL + "/api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "api" {
+		t.Fatalf("api %q", body)
+	}
+
+	cc.Close()
+	resp, err = server.Client().Post(server.URL+"/tunnel/x?type="+ProtoConnnect, "application/octet-stream", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("closed listener status %v", resp.StatusCode)
+	}
+}
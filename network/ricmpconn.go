@@ -1,22 +1,34 @@
 package network
 
 import (
+	"context"
 	"encoding/binary"
 	"errors"
 	"github.com/esrrhs/gohome/common"
 	"github.com/esrrhs/gohome/thread"
 	"golang.org/x/net/icmp"
 	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
 	"google.golang.org/protobuf/proto"
 	"math"
 	"math/rand"
 	"net"
+	"os"
+	"runtime"
 	"sync"
 	"time"
 )
 
 /*
 RicmpConn 实现了基于 可靠icmp 协议的Conn。
+
+支持 ipv4 和 ipv6，Dial 按解析出的目标地址选择 icmp 或 icmpv6，Listen 按监听地址选择，为空时使用 ipv4。
+icmpv6 的 echo 请求和回复类型为 128、129，校验和由内核计算，socket 上设置了过滤，只接收 echo 消息。
+
+原始 socket 需要 root 或 CAP_NET_RAW，开启 Unprivileged 后 Dial 使用 linux 的 icmp 数据报 socket（ping socket），
+用户组在 net.ipv4.ping_group_range 范围内即可。内核会把 echo 的 identifier 改写成 socket 的本地端口，
+并且只把 identifier 相同的回复交给这个 socket，所以 dialer 直接使用本地端口作为 icmpId。
+ping socket 收不到 echo 请求，Listen 仍然使用原始 socket；也拿不到底层 socket 设置 DF 位，路径 MTU 探测只能发现被丢弃的大小。
 */
 
 type RicmpConfig struct {
@@ -32,7 +44,9 @@ type RicmpConfig struct {
 	CloseTimeoutMs     int
 	CloseWaitTimeoutMs int
 	AcceptChanLen      int
-	Congestion         string
+	// Dial 使用 icmp 数据报 socket，不需要 root，Listen 不受影响
+	Unprivileged bool
+	FrameMgrOptions
 }
 
 func DefaultRicmpConfig() *RicmpConfig {
@@ -49,7 +63,7 @@ func DefaultRicmpConfig() *RicmpConfig {
 		CloseTimeoutMs:     5000,
 		CloseWaitTimeoutMs: 5000,
 		AcceptChanLen:      128,
-		Congestion:         "bb",
+		FrameMgrOptions:    DefaultFrameMgrOptions(),
 	}
 }
 
@@ -62,11 +76,13 @@ type RicmpConn struct {
 	listener      *ricmpConnListener
 	isclose       bool
 	closelock     sync.Mutex
+	deadline      connDeadline
 }
 
 type ricmpConnDialer struct {
 	serveraddr *net.IPAddr
-	conn       *icmp.PacketConn
+	sendaddr   net.Addr // ping socket 需要 UDPAddr
+	conn       net.PacketConn
 	fm         *FrameMgr
 	wg         *thread.Group
 	icmpId     int
@@ -77,7 +93,7 @@ type ricmpConnDialer struct {
 
 type ricmpConnListenerSonny struct {
 	dstaddr    net.Addr
-	fatherconn *icmp.PacketConn
+	fatherconn net.PacketConn
 	fm         *FrameMgr
 	wg         *thread.Group
 	icmpId     int
@@ -87,10 +103,25 @@ type ricmpConnListenerSonny struct {
 }
 
 type ricmpConnListener struct {
-	listenerconn *icmp.PacketConn
+	listenerconn net.PacketConn
 	wg           *thread.Group
 	sonny        sync.Map
 	accept       *common.Channel
+	salts        *frameSaltCache // 所有连接共用，拒绝重放的会话
+}
+
+func init() {
+	mustRegisterProto("ricmp", func(config interface{}) (Conn, error) {
+		c := &RicmpConn{id: common.UniqueId()}
+		if config != nil {
+			cfg, ok := config.(*RicmpConfig)
+			if !ok {
+				return nil, errProtoConfig("ricmp", config)
+			}
+			c.SetConfig(cfg)
+		}
+		return c, nil
+	}, true)
 }
 
 func (c *RicmpConn) Name() string {
@@ -127,7 +158,10 @@ func (c *RicmpConn) Read(p []byte) (n int, err error) {
 			if wg != nil && wg.IsExit() {
 				return 0, errors.New("closed conn")
 			}
-			time.Sleep(time.Millisecond * 100)
+			if c.deadline.readTimeout() {
+				return 0, os.ErrDeadlineExceeded
+			}
+			pollSleep(c.deadline.readDeadline())
 			continue
 		}
 
@@ -168,6 +202,10 @@ func (c *RicmpConn) Write(p []byte) (n int, err error) {
 	cur := 0
 
 	for !c.isclose {
+		if c.deadline.writeTimeout() {
+			return cur, os.ErrDeadlineExceeded
+		}
+
 		size := totalsize - cur
 		svleft := fm.GetSendBufferLeft()
 		if size > svleft {
@@ -178,7 +216,7 @@ func (c *RicmpConn) Write(p []byte) (n int, err error) {
 			if wg != nil && wg.IsExit() {
 				return 0, errors.New("closed conn")
 			}
-			time.Sleep(time.Millisecond * 100)
+			pollSleep(c.deadline.writeDeadline())
 			continue
 		}
 
@@ -189,7 +227,7 @@ func (c *RicmpConn) Write(p []byte) (n int, err error) {
 			return totalsize, nil
 		}
 
-		time.Sleep(time.Millisecond * 100)
+		pollSleep(c.deadline.writeDeadline())
 	}
 
 	return 0, errors.New("write closed conn")
@@ -262,28 +300,105 @@ func (c *RicmpConn) Info() string {
 	return c.info
 }
 
+func (c *RicmpConn) LocalAddr() net.Addr {
+	if c.dialer != nil {
+		return c.dialer.conn.LocalAddr()
+	} else if c.listener != nil {
+		return c.listener.listenerconn.LocalAddr()
+	} else if c.listenersonny != nil {
+		return c.listenersonny.fatherconn.LocalAddr()
+	}
+	return nil
+}
+
+func (c *RicmpConn) RemoteAddr() net.Addr {
+	if c.dialer != nil {
+		return c.dialer.serveraddr
+	} else if c.listenersonny != nil {
+		return c.listenersonny.dstaddr
+	}
+	return nil
+}
+
+func (c *RicmpConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+func (c *RicmpConn) SetReadDeadline(t time.Time) error {
+	if c.listener != nil {
+		return errListenerDeadline
+	} else if c.dialer == nil && c.listenersonny == nil {
+		return errors.New("empty conn")
+	}
+	c.deadline.setRead(t)
+	return nil
+}
+
+func (c *RicmpConn) SetWriteDeadline(t time.Time) error {
+	if c.listener != nil {
+		return errListenerDeadline
+	} else if c.dialer == nil && c.listenersonny == nil {
+		return errors.New("empty conn")
+	}
+	c.deadline.setWrite(t)
+	return nil
+}
+
 func (c *RicmpConn) Dial(dst string) (Conn, error) {
+	return c.DialContext(context.Background(), dst)
+}
+
+func (c *RicmpConn) DialContext(ctx context.Context, dst string) (Conn, error) {
 	c.checkConfig()
 
+	fc, err := c.config.newFrameCrypto()
+	if err != nil {
+		return nil, err
+	}
+
 	addr, err := net.ResolveIPAddr("ip", dst)
 	if err != nil {
 		return nil, err
 	}
 
-	conn, err := icmp.ListenPacket("ip4:icmp", "")
+	network := icmpNetwork(addr.IP)
+	icmpProto := IcmpMsg_PING_PROTO
+	if network == icmpNetworkV6 {
+		icmpProto = IcmpMsg_PING6_PROTO
+	}
+	var sendaddr net.Addr = addr
+	if c.config.Unprivileged {
+		if network == icmpNetworkV6 {
+			network = icmpNetworkUdpV6
+		} else {
+			network = icmpNetworkUdpV4
+		}
+		sendaddr = &net.UDPAddr{IP: addr.IP, Zone: addr.Zone}
+	}
+
+	conn, err := c.listenIcmp(network, "")
 	if err != nil {
 		return nil, err
 	}
 
+	icmpId := rand.Intn(math.MaxInt16)
+	if a, ok := conn.LocalAddr().(*net.UDPAddr); ok && a.Port != 0 {
+		// 内核会把 identifier 改写成本地端口
+		icmpId = a.Port
+	}
+
 	id := common.Guid()
-	fm := NewFrameMgr(c.config.CutSize, c.config.MaxId, c.config.BufferSize, c.config.MaxWin, c.config.ResendTimems, c.config.Compress, c.config.Stat)
-	fm.SetDebugid(id + "-dialer")
-	if c.config.Congestion == "bb" {
-		fm.SetCongestion(&BBCongestion{})
+	fm, err := c.config.newFrameMgr(c.frameMgrConfig(), id+"-dialer", fc)
+	if err != nil {
+		conn.Close()
+		return nil, err
 	}
 
-	dialer := &ricmpConnDialer{serveraddr: addr, conn: conn, fm: fm,
-		icmpId: rand.Intn(math.MaxInt16), icmpSeq: 0, icmpProto: int(IcmpMsg_PING_PROTO), icmpFlag: IcmpMsg_CLIENT_SEND_FLAG}
+	dialer := &ricmpConnDialer{serveraddr: addr, sendaddr: sendaddr, conn: conn, fm: fm,
+		icmpId: icmpId, icmpSeq: 0, icmpProto: int(icmpProto), icmpFlag: IcmpMsg_CLIENT_SEND_FLAG}
 
 	u := &RicmpConn{id: id, config: c.config, dialer: dialer}
 
@@ -306,7 +421,7 @@ func (c *RicmpConn) Dial(dst string) (Conn, error) {
 			f := e.Value.(*Frame)
 			mb, _ := u.dialer.fm.MarshalFrame(f)
 			u.dialer.conn.SetReadDeadline(time.Now().Add(time.Millisecond * 100))
-			u.send_icmp(u.dialer.conn, mb, u.dialer.serveraddr,
+			u.send_icmp(u.dialer.conn, mb, u.dialer.sendaddr,
 				u.id, u.dialer.icmpId, u.dialer.icmpSeq, u.dialer.icmpProto, u.dialer.icmpFlag)
 			u.dialer.icmpSeq++
 		}
@@ -315,17 +430,16 @@ func (c *RicmpConn) Dial(dst string) (Conn, error) {
 		u.dialer.conn.SetReadDeadline(time.Now().Add(time.Millisecond * 100))
 		n, _, _, id, echoId, _, echoFlag := u.recv_icmp(u.dialer.conn, buf)
 		if n > 0 && id == u.id && echoId == u.dialer.icmpId && echoFlag == int(IcmpMsg_SERVER_SEND_FLAG) {
-			f := &Frame{}
-			err := proto.Unmarshal(buf[0:n], f)
+			f, err := u.dialer.fm.UnmarshalFrame(buf[0:n])
 			if err == nil {
 				u.dialer.fm.OnRecvFrame(f)
-			} else {
+			} else if u.dialer.fm.crypto == nil {
 				//loggo.Error("%s %s Unmarshal fail %s", c.Info(), u.Info(), err)
 				break
 			}
 		}
 
-		if c.isclose {
+		if c.isclose || ctx.Err() != nil {
 			//loggo.Debug("can not connect remote ricmp %s", u.Info())
 			break
 		}
@@ -346,6 +460,11 @@ func (c *RicmpConn) Dial(dst string) (Conn, error) {
 		return nil, errors.New("closed conn")
 	}
 
+	if ctx.Err() != nil {
+		u.Close()
+		return nil, ctx.Err()
+	}
+
 	if u.isclose {
 		return nil, errors.New("closed conn")
 	}
@@ -370,7 +489,17 @@ func (c *RicmpConn) Dial(dst string) (Conn, error) {
 func (c *RicmpConn) Listen(dst string) (Conn, error) {
 	c.checkConfig()
 
-	conn, err := icmp.ListenPacket("ip4:icmp", dst)
+	if err := checkFrameMgrOptions(&c.config.FrameMgrOptions, c.frameMgrConfig()); err != nil {
+		return nil, err
+	}
+
+	network := icmpNetworkV4
+	if dst != "" {
+		if addr, err := net.ResolveIPAddr("ip", dst); err == nil {
+			network = icmpNetwork(addr.IP)
+		}
+	}
+	conn, err := c.listenIcmp(network, dst)
 	if err != nil {
 		return nil, err
 	}
@@ -383,6 +512,7 @@ func (c *RicmpConn) Listen(dst string) (Conn, error) {
 		listenerconn: conn,
 		wg:           wg,
 		accept:       ch,
+		salts:        newFrameSaltCache(),
 	}
 
 	u := &RicmpConn{id: common.UniqueId(), config: c.config, listener: listener}
@@ -394,13 +524,22 @@ func (c *RicmpConn) Listen(dst string) (Conn, error) {
 }
 
 func (c *RicmpConn) Accept() (Conn, error) {
+	return c.AcceptContext(context.Background())
+}
+
+func (c *RicmpConn) AcceptContext(ctx context.Context) (Conn, error) {
 	c.checkConfig()
 
-	if c.listener.wg == nil {
+	if c.listener == nil || c.listener.wg == nil {
 		return nil, errors.New("not listen")
 	}
 	for !c.listener.wg.IsExit() {
-		s := <-c.listener.accept.Ch()
+		var s interface{}
+		select {
+		case s = <-c.listener.accept.Ch():
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
 		if s == nil {
 			break
 		}
@@ -417,6 +556,18 @@ func (c *RicmpConn) Accept() (Conn, error) {
 	return nil, errors.New("listener close")
 }
 
+// Stats 返回连接的统计信息快照，listener 没有统计信息。
+func (c *RicmpConn) Stats() (FrameMgrStats, error) {
+	if c.dialer != nil {
+		return c.dialer.fm.Stats(), nil
+	} else if c.listener != nil {
+		return FrameMgrStats{}, errors.New("listener has no stats")
+	} else if c.listenersonny != nil {
+		return c.listenersonny.fm.Stats(), nil
+	}
+	return FrameMgrStats{}, errors.New("empty conn")
+}
+
 func (c *RicmpConn) checkConfig() {
 	if c.config == nil {
 		c.config = DefaultRicmpConfig()
@@ -432,6 +583,66 @@ func (c *RicmpConn) GetConfig() *RicmpConfig {
 	return c.config
 }
 
+func (c *RicmpConn) frameMgrConfig() *FrameMgrConfig {
+	return c.config.frameMgrConfig(c.config.CutSize, c.config.MaxId, c.config.BufferSize, c.config.MaxWin, c.config.ResendTimems, c.config.Compress, c.config.Stat)
+}
+
+const (
+	icmpNetworkV4    = "ip4:icmp"
+	icmpNetworkV6    = "ip6:ipv6-icmp"
+	icmpNetworkUdpV4 = "udp4"
+	icmpNetworkUdpV6 = "udp6"
+)
+
+func icmpNetwork(ip net.IP) string {
+	if ip != nil && ip.To4() == nil {
+		return icmpNetworkV6
+	}
+	return icmpNetworkV4
+}
+
+// listenIcmp 开启路径 MTU 探测时需要在 socket 上设置 DF 位，icmp.ListenPacket 拿不到 socket，linux 上直接创建原始 socket，
+// 读写的内容和 icmp.PacketConn 相同，其他平台和 ping socket 不设置 DF 位，仍然使用 icmp.ListenPacket。
+func (c *RicmpConn) listenIcmp(network string, address string) (net.PacketConn, error) {
+	var conn net.PacketConn
+	var err error
+	raw := network == icmpNetworkV4 || network == icmpNetworkV6
+	if c.config.Pmtu && raw && runtime.GOOS == "linux" {
+		lc := net.ListenConfig{Control: pmtuControl(true)}
+		conn, err = lc.ListenPacket(context.Background(), network, address)
+	} else {
+		conn, err = icmp.ListenPacket(network, address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if network == icmpNetworkV6 {
+		// icmpv6 socket 会收到邻居发现等消息，只接收 echo，设置失败不影响收发
+		var f ipv6.ICMPFilter
+		f.SetAll(true)
+		f.Accept(ipv6.ICMPTypeEchoRequest)
+		f.Accept(ipv6.ICMPTypeEchoReply)
+		switch pc := conn.(type) {
+		case *icmp.PacketConn:
+			pc.IPv6PacketConn().SetICMPFilter(&f)
+		case *net.IPConn:
+			ipv6.NewPacketConn(pc).SetICMPFilter(&f)
+		}
+	}
+	return conn, nil
+}
+
+// icmpEchoType 把 IcmpMsg 中的协议号转换成 icmp 消息类型。
+func icmpEchoType(icmpProto int) icmp.Type {
+	switch IcmpMsg_TYPE(icmpProto) {
+	case IcmpMsg_PING6_PROTO:
+		return ipv6.ICMPTypeEchoRequest
+	case IcmpMsg_PONG6_PROTO:
+		return ipv6.ICMPTypeEchoReply
+	}
+	return ipv4.ICMPType(icmpProto)
+}
+
 func (c *RicmpConn) loopListenerRecv() error {
 	c.checkConfig()
 
@@ -445,14 +656,27 @@ func (c *RicmpConn) loopListenerRecv() error {
 
 		v, ok := c.listener.sonny.Load(cid)
 		if !ok {
-			fm := NewFrameMgr(c.config.CutSize, c.config.MaxId, c.config.BufferSize, c.config.MaxWin, c.config.ResendTimems, c.config.Compress, c.config.Stat)
-			fm.SetDebugid(cid + "-listenersonny")
-			if c.config.Congestion == "bb" {
-				fm.SetCongestion(&BBCongestion{})
+			fc, _ := c.config.newFrameCrypto()
+			if fc != nil {
+				fc.salts = c.listener.salts
+				// 第一个包认证通过才创建连接，避免伪造的包占用资源
+				if _, err := fc.Open(buf[0:n]); err != nil {
+					continue
+				}
+			}
+
+			fm, err := c.config.newFrameMgr(c.frameMgrConfig(), cid+"-listenersonny", fc)
+			if err != nil {
+				continue
+			}
+
+			icmpProto := IcmpMsg_PONG_PROTO
+			if a, ok := srcaddr.(*net.IPAddr); ok && icmpNetwork(a.IP) == icmpNetworkV6 {
+				icmpProto = IcmpMsg_PONG6_PROTO
 			}
 
 			sonny := &ricmpConnListenerSonny{dstaddr: srcaddr, fatherconn: c.listener.listenerconn, fm: fm,
-				icmpId: echoId, icmpSeq: echoSeq, icmpProto: int(IcmpMsg_PONG_PROTO), icmpFlag: IcmpMsg_SERVER_SEND_FLAG}
+				icmpId: echoId, icmpSeq: echoSeq, icmpProto: int(icmpProto), icmpFlag: IcmpMsg_SERVER_SEND_FLAG}
 
 			u := &RicmpConn{id: cid, config: c.config, listenersonny: sonny}
 			c.listener.sonny.Store(cid, u)
@@ -466,8 +690,7 @@ func (c *RicmpConn) loopListenerRecv() error {
 			u := v.(*RicmpConn)
 			u.listenersonny.icmpSeq = echoSeq
 
-			f := &Frame{}
-			err := proto.Unmarshal(buf[0:n], f)
+			f, err := u.listenersonny.fm.UnmarshalFrame(buf[0:n])
 			if err == nil {
 				u.listenersonny.fm.OnRecvFrame(f)
 				//loggo.Debug("%s recv frame %d %v", u.Info(), f.Id, f.String())
@@ -562,13 +785,13 @@ func (c *RicmpConn) updateListenerSonny() error {
 }
 
 func (c *RicmpConn) updateDialerSonny() error {
-	return c.update_ricmp(c.dialer.wg, c.dialer.fm, c.dialer.conn, c.dialer.serveraddr, true,
+	return c.update_ricmp(c.dialer.wg, c.dialer.fm, c.dialer.conn, c.dialer.sendaddr, true,
 		c.dialer.icmpId, int(IcmpMsg_SERVER_SEND_FLAG),
 		c.id, c.dialer.icmpId, &c.dialer.icmpSeq, c.dialer.icmpProto, c.dialer.icmpFlag,
 		true)
 }
 
-func (c *RicmpConn) update_ricmp(wg *thread.Group, fm *FrameMgr, conn *icmp.PacketConn, dstaddr net.Addr, readconn bool,
+func (c *RicmpConn) update_ricmp(wg *thread.Group, fm *FrameMgr, conn net.PacketConn, dstaddr net.Addr, readconn bool,
 	recvCheckEchoId int, recvCheckEchoFlag int, id string, icmpId int, icmpSeq *int, icmpProto int, icmpFlag IcmpMsg_TYPE, addIcmpSeq bool) error {
 
 	//loggo.Debug("start ricmp conn %s", c.Info())
@@ -583,8 +806,7 @@ func (c *RicmpConn) update_ricmp(wg *thread.Group, fm *FrameMgr, conn *icmp.Pack
 				conn.SetReadDeadline(time.Now().Add(time.Millisecond * 100))
 				n, _, _, id, echoId, _, echoFlag := c.recv_icmp(conn, bytes)
 				if n > 0 && id == c.id && echoId == recvCheckEchoId && echoFlag == recvCheckEchoFlag {
-					f := &Frame{}
-					err := proto.Unmarshal(bytes[0:n], f)
+					f, err := fm.UnmarshalFrame(bytes[0:n])
 					if err == nil {
 						fm.OnRecvFrame(f)
 						//loggo.Debug("%s recv frame %d %v", c.Info(), f.Id, f.String())
@@ -628,6 +850,11 @@ func (c *RicmpConn) update_ricmp(wg *thread.Group, fm *FrameMgr, conn *icmp.Pack
 			break
 		}
 
+		if fm.IsIdleTimeout() {
+			reason = "IdleTimeout"
+			break
+		}
+
 		if fm.IsRemoteClosed() {
 			reason = "RemoteClose"
 			//loggo.Debug("closed by remote conn %s", c.Info())
@@ -635,7 +862,11 @@ func (c *RicmpConn) update_ricmp(wg *thread.Group, fm *FrameMgr, conn *icmp.Pack
 		}
 
 		if !avctive && sendlist.Len() <= 0 {
-			time.Sleep(time.Millisecond * 10)
+			if fm.IsPaced() {
+				time.Sleep(time.Millisecond)
+			} else {
+				time.Sleep(time.Millisecond * 10)
+			}
 		}
 	}
 
@@ -707,7 +938,7 @@ func (c *RicmpConn) update_ricmp(wg *thread.Group, fm *FrameMgr, conn *icmp.Pack
 	return errors.New("closed " + reason)
 }
 
-func (c *RicmpConn) send_icmp(conn *icmp.PacketConn, data []byte, dst net.Addr, id string, icmpId int, icmpSeq int, icmpProto int, icmpFlag IcmpMsg_TYPE) {
+func (c *RicmpConn) send_icmp(conn net.PacketConn, data []byte, dst net.Addr, id string, icmpId int, icmpSeq int, icmpProto int, icmpFlag IcmpMsg_TYPE) {
 
 	m := &IcmpMsg{
 		Id:    id,
@@ -729,7 +960,7 @@ func (c *RicmpConn) send_icmp(conn *icmp.PacketConn, data []byte, dst net.Addr,
 	}
 
 	msg := &icmp.Message{
-		Type: (ipv4.ICMPType)(icmpProto),
+		Type: icmpEchoType(icmpProto),
 		Code: 0,
 		Body: body,
 	}
@@ -743,15 +974,15 @@ func (c *RicmpConn) send_icmp(conn *icmp.PacketConn, data []byte, dst net.Addr,
 	conn.WriteTo(bytes, dst)
 }
 
-func (c *RicmpConn) recv_icmp(conn *icmp.PacketConn, bytes []byte) (int, net.Addr, error, string, int, int, int) {
+func (c *RicmpConn) recv_icmp(conn net.PacketConn, bytes []byte) (int, net.Addr, error, string, int, int, int) {
 	n, srcaddr, err := conn.ReadFrom(bytes)
 
 	if err != nil {
 		return 0, srcaddr, err, "", 0, 0, 0
 	}
 
-	if n <= 0 {
-		return 0, srcaddr, errors.New("n <= 0"), "", 0, 0, 0
+	if n < 8 {
+		return 0, srcaddr, errors.New("n < 8"), "", 0, 0, 0
 	}
 
 	echoId := int(binary.BigEndian.Uint16(bytes[4:6]))
@@ -1,8 +1,14 @@
 package network
 
 import (
+	"bytes"
 	"fmt"
 	"github.com/esrrhs/gohome/loggo"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"io"
+	"net"
 	"strconv"
 	"testing"
 	"time"
@@ -540,3 +546,166 @@ func Test0009RICMP(t *testing.T) {
 
 	time.Sleep(time.Second)
 }
+
+func TestRICMPCrypto(t *testing.T) {
+	config := DefaultRicmpConfig()
+	config.Crypto = "aes-gcm"
+	config.CryptoKey = "ricmp psk"
+	c, err := NewConnWithConfig("ricmp", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cc, err := c.Listen("127.0.0.1")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer cc.Close()
+
+	go func() {
+		conn, err := cc.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+
+	ccc, err := c.Dial("127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ccc.Close()
+
+	ccc.Write([]byte("secret"))
+	ccc.SetReadDeadline(time.Now().Add(time.Second * 5))
+	buf := make([]byte, 6)
+	if _, err := io.ReadFull(ccc, buf); err != nil || string(buf) != "secret" {
+		t.Fatalf("ReadFull = %q, %v", buf, err)
+	}
+}
+
+func testRICMPv6(t *testing.T, config *RicmpConfig) {
+	c, err := NewConnWithConfig("ricmp", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cc, err := c.Listen("::1")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer cc.Close()
+
+	go func() {
+		conn, err := cc.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+
+	ccc, err := c.Dial("::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ccc.Close()
+
+	if ccc.RemoteAddr().(*net.IPAddr).IP.To4() != nil {
+		t.Fatalf("remote addr %v", ccc.RemoteAddr())
+	}
+
+	data := make([]byte, 64*1024)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	go ccc.Write(data)
+	ccc.SetReadDeadline(time.Now().Add(time.Second * 10))
+	buf := make([]byte, len(data))
+	if _, err := io.ReadFull(ccc, buf); err != nil || !bytes.Equal(buf, data) {
+		t.Fatalf("ReadFull %v", err)
+	}
+}
+
+func TestRICMPv6(t *testing.T) {
+	testRICMPv6(t, DefaultRicmpConfig())
+}
+
+func TestRICMPv6Pmtu(t *testing.T) {
+	config := DefaultRicmpConfig()
+	config.Pmtu = true
+	testRICMPv6(t, config)
+}
+
+func testRICMPUnprivileged(t *testing.T, network string, addr string) {
+	// ping socket 需要 net.ipv4.ping_group_range 包含当前用户组
+	pc, err := icmp.ListenPacket(network, "")
+	if err != nil {
+		t.Skip(err)
+	}
+	pc.Close()
+
+	config := DefaultRicmpConfig()
+	config.Unprivileged = true
+	c, err := NewConnWithConfig("ricmp", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cc, err := c.Listen(addr)
+	if err != nil {
+		t.Skip(err)
+	}
+	defer cc.Close()
+
+	go func() {
+		conn, err := cc.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+
+	ccc, err := c.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ccc.Close()
+
+	rc := ccc.(*RicmpConn)
+	if rc.dialer.icmpId != rc.dialer.conn.LocalAddr().(*net.UDPAddr).Port {
+		t.Fatalf("icmp id %v %v", rc.dialer.icmpId, rc.dialer.conn.LocalAddr())
+	}
+
+	data := make([]byte, 64*1024)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	go ccc.Write(data)
+	ccc.SetReadDeadline(time.Now().Add(time.Second * 10))
+	buf := make([]byte, len(data))
+	if _, err := io.ReadFull(ccc, buf); err != nil || !bytes.Equal(buf, data) {
+		t.Fatalf("ReadFull %v", err)
+	}
+}
+
+func TestRICMPUnprivileged(t *testing.T) {
+	testRICMPUnprivileged(t, "udp4", "127.0.0.1")
+}
+
+func TestRICMPUnprivilegedV6(t *testing.T) {
+	testRICMPUnprivileged(t, "udp6", "::1")
+}
+
+func TestRICMPEchoType(t *testing.T) {
+	if icmpNetwork(net.ParseIP("::1")) != icmpNetworkV6 || icmpNetwork(net.ParseIP("127.0.0.1")) != icmpNetworkV4 ||
+		icmpNetwork(nil) != icmpNetworkV4 {
+		t.Fatal("icmpNetwork")
+	}
+	if icmpEchoType(int(IcmpMsg_PING_PROTO)) != ipv4.ICMPTypeEcho || icmpEchoType(int(IcmpMsg_PONG_PROTO)) != ipv4.ICMPTypeEchoReply ||
+		icmpEchoType(int(IcmpMsg_PING6_PROTO)) != ipv6.ICMPTypeEchoRequest || icmpEchoType(int(IcmpMsg_PONG6_PROTO)) != ipv6.ICMPTypeEchoReply {
+		t.Fatal("icmpEchoType")
+	}
+}
@@ -4,14 +4,12 @@ import (
 	"context"
 	"errors"
 	"net"
-	"runtime"
+	"os"
 	"sync"
 	"time"
 
 	"github.com/esrrhs/gohome/common"
 	"github.com/esrrhs/gohome/thread"
-	"golang.org/x/net/ipv4"
-	"google.golang.org/protobuf/proto"
 )
 
 /*
@@ -31,8 +29,12 @@ type RudpConfig struct {
 	CloseTimeoutMs     int
 	CloseWaitTimeoutMs int
 	AcceptChanLen      int
-	Congestion         string
-	BatchSendPkgs      int
+	// 一次系统调用最多发送、读取的包数，Gso 为发送时是否尝试使用 GSO，Gro 为 listener 是否尝试开启 GRO，默认关闭，内核不支持时忽略
+	BatchSendPkgs int
+	BatchRecvPkgs int
+	Gso           bool
+	Gro           bool
+	FrameMgrOptions
 }
 
 func DefaultRudpConfig() *RudpConfig {
@@ -49,8 +51,11 @@ func DefaultRudpConfig() *RudpConfig {
 		CloseTimeoutMs:     5000,
 		CloseWaitTimeoutMs: 5000,
 		AcceptChanLen:      128,
-		Congestion:         "bb",
 		BatchSendPkgs:      64,
+		BatchRecvPkgs:      32,
+		Gso:                false,
+		Gro:                false,
+		FrameMgrOptions:    DefaultFrameMgrOptions(),
 	}
 }
 
@@ -63,6 +68,7 @@ type RudpConn struct {
 	cancel        context.CancelFunc
 	isclose       bool
 	closelock     sync.Mutex
+	deadline      connDeadline
 }
 
 type rudpConnDialer struct {
@@ -83,6 +89,21 @@ type rudpConnListener struct {
 	wg           *thread.Group
 	sonny        sync.Map
 	accept       *common.Channel
+	salts        *frameSaltCache // 所有连接共用，拒绝重放的会话
+}
+
+func init() {
+	mustRegisterProto("rudp", func(config interface{}) (Conn, error) {
+		c := &RudpConn{}
+		if config != nil {
+			cfg, ok := config.(*RudpConfig)
+			if !ok {
+				return nil, errProtoConfig("rudp", config)
+			}
+			c.SetConfig(cfg)
+		}
+		return c, nil
+	}, true)
 }
 
 func (c *RudpConn) Name() string {
@@ -119,7 +140,10 @@ func (c *RudpConn) Read(p []byte) (n int, err error) {
 			if wg != nil && wg.IsExit() {
 				return 0, errors.New("closed conn")
 			}
-			time.Sleep(time.Millisecond * 100)
+			if c.deadline.readTimeout() {
+				return 0, os.ErrDeadlineExceeded
+			}
+			pollSleep(c.deadline.readDeadline())
 			continue
 		}
 
@@ -160,6 +184,10 @@ func (c *RudpConn) Write(p []byte) (n int, err error) {
 	cur := 0
 
 	for !c.isclose {
+		if c.deadline.writeTimeout() {
+			return cur, os.ErrDeadlineExceeded
+		}
+
 		size := totalsize - cur
 		svleft := fm.GetSendBufferLeft()
 		if size > svleft {
@@ -170,7 +198,7 @@ func (c *RudpConn) Write(p []byte) (n int, err error) {
 			if wg != nil && wg.IsExit() {
 				return 0, errors.New("closed conn")
 			}
-			time.Sleep(time.Millisecond * 100)
+			pollSleep(c.deadline.writeDeadline())
 			continue
 		}
 
@@ -181,7 +209,7 @@ func (c *RudpConn) Write(p []byte) (n int, err error) {
 			return totalsize, nil
 		}
 
-		time.Sleep(time.Millisecond * 100)
+		pollSleep(c.deadline.writeDeadline())
 	}
 
 	return 0, errors.New("write closed conn")
@@ -257,30 +285,84 @@ func (c *RudpConn) Info() string {
 	return c.info
 }
 
+func (c *RudpConn) LocalAddr() net.Addr {
+	if c.dialer != nil {
+		return c.dialer.conn.LocalAddr()
+	} else if c.listener != nil {
+		return c.listener.listenerconn.LocalAddr()
+	} else if c.listenersonny != nil {
+		return c.listenersonny.fatherconn.LocalAddr()
+	}
+	return nil
+}
+
+func (c *RudpConn) RemoteAddr() net.Addr {
+	if c.dialer != nil {
+		return c.dialer.conn.RemoteAddr()
+	} else if c.listenersonny != nil {
+		return c.listenersonny.dstaddr
+	}
+	return nil
+}
+
+func (c *RudpConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+func (c *RudpConn) SetReadDeadline(t time.Time) error {
+	if c.listener != nil {
+		return errListenerDeadline
+	} else if c.dialer == nil && c.listenersonny == nil {
+		return errors.New("empty conn")
+	}
+	c.deadline.setRead(t)
+	return nil
+}
+
+func (c *RudpConn) SetWriteDeadline(t time.Time) error {
+	if c.listener != nil {
+		return errListenerDeadline
+	} else if c.dialer == nil && c.listenersonny == nil {
+		return errors.New("empty conn")
+	}
+	c.deadline.setWrite(t)
+	return nil
+}
+
 func (c *RudpConn) Dial(dst string) (Conn, error) {
+	return c.DialContext(context.Background(), dst)
+}
+
+func (c *RudpConn) DialContext(ctx context.Context, dst string) (Conn, error) {
 	c.checkConfig()
 
+	fc, err := c.config.newFrameCrypto()
+	if err != nil {
+		return nil, err
+	}
+
 	addr, err := net.ResolveUDPAddr("udp", dst)
 	if err != nil {
 		return nil, err
 	}
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx, cancel := context.WithCancel(ctx)
 	c.cancel = cancel
-	var d net.Dialer
-	if gControlOnConnSetup != nil {
-		d = net.Dialer{Control: gControlOnConnSetup}
-	}
+	d := net.Dialer{Control: pmtuControl(c.config.Pmtu)}
 	conn, err := d.DialContext(ctx, "udp", addr.String())
 	if err != nil {
 		return nil, err
 	}
 	c.cancel = nil
+	defer cancel()
 
 	id := common.Guid()
-	fm := NewFrameMgr(c.config.CutSize, c.config.MaxId, c.config.BufferSize, c.config.MaxWin, c.config.ResendTimems, c.config.Compress, c.config.Stat)
-	fm.SetDebugid(id)
-	if c.config.Congestion == "bb" {
-		fm.SetCongestion(&BBCongestion{})
+	fm, err := c.config.newFrameMgr(c.frameMgrConfig(), id, fc)
+	if err != nil {
+		conn.Close()
+		return nil, err
 	}
 
 	dialer := &rudpConnDialer{conn: conn.(*net.UDPConn), fm: fm}
@@ -313,17 +395,16 @@ func (c *RudpConn) Dial(dst string) (Conn, error) {
 		u.dialer.conn.SetReadDeadline(time.Now().Add(time.Millisecond * 100))
 		n, _ := u.dialer.conn.Read(buf)
 		if n > 0 {
-			f := &Frame{}
-			err := proto.Unmarshal(buf[0:n], f)
+			f, err := u.dialer.fm.UnmarshalFrame(buf[0:n])
 			if err == nil {
 				u.dialer.fm.OnRecvFrame(f)
-			} else {
+			} else if u.dialer.fm.crypto == nil {
 				//loggo.Error("%s %s Unmarshal fail %s", c.Info(), u.Info(), err)
 				break
 			}
 		}
 
-		if c.isclose {
+		if c.isclose || ctx.Err() != nil {
 			//loggo.Debug("can not connect remote rudp %s", u.Info())
 			break
 		}
@@ -344,6 +425,11 @@ func (c *RudpConn) Dial(dst string) (Conn, error) {
 		return nil, errors.New("closed conn")
 	}
 
+	if ctx.Err() != nil {
+		u.Close()
+		return nil, ctx.Err()
+	}
+
 	if u.isclose {
 		return nil, errors.New("closed conn")
 	}
@@ -368,15 +454,21 @@ func (c *RudpConn) Dial(dst string) (Conn, error) {
 func (c *RudpConn) Listen(dst string) (Conn, error) {
 	c.checkConfig()
 
+	if err := checkFrameMgrOptions(&c.config.FrameMgrOptions, c.frameMgrConfig()); err != nil {
+		return nil, err
+	}
+
 	ipaddr, err := net.ResolveUDPAddr("udp", dst)
 	if err != nil {
 		return nil, err
 	}
 
-	listenerconn, err := net.ListenUDP("udp", ipaddr)
+	lc := net.ListenConfig{Control: pmtuControl(c.config.Pmtu)}
+	pc, err := lc.ListenPacket(context.Background(), "udp", ipaddr.String())
 	if err != nil {
 		return nil, err
 	}
+	listenerconn := pc.(*net.UDPConn)
 
 	ch := common.NewChannel(c.config.AcceptChanLen)
 
@@ -386,6 +478,7 @@ func (c *RudpConn) Listen(dst string) (Conn, error) {
 		listenerconn: listenerconn,
 		wg:           wg,
 		accept:       ch,
+		salts:        newFrameSaltCache(),
 	}
 
 	u := &RudpConn{config: c.config, listener: listener}
@@ -397,13 +490,22 @@ func (c *RudpConn) Listen(dst string) (Conn, error) {
 }
 
 func (c *RudpConn) Accept() (Conn, error) {
+	return c.AcceptContext(context.Background())
+}
+
+func (c *RudpConn) AcceptContext(ctx context.Context) (Conn, error) {
 	c.checkConfig()
 
-	if c.listener.wg == nil {
+	if c.listener == nil || c.listener.wg == nil {
 		return nil, errors.New("not listen")
 	}
 	for !c.listener.wg.IsExit() {
-		s := <-c.listener.accept.Ch()
+		var s interface{}
+		select {
+		case s = <-c.listener.accept.Ch():
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
 		if s == nil {
 			break
 		}
@@ -420,6 +522,18 @@ func (c *RudpConn) Accept() (Conn, error) {
 	return nil, errors.New("listener close")
 }
 
+// Stats 返回连接的统计信息快照，listener 没有统计信息。
+func (c *RudpConn) Stats() (FrameMgrStats, error) {
+	if c.dialer != nil {
+		return c.dialer.fm.Stats(), nil
+	} else if c.listener != nil {
+		return FrameMgrStats{}, errors.New("listener has no stats")
+	} else if c.listenersonny != nil {
+		return c.listenersonny.fm.Stats(), nil
+	}
+	return FrameMgrStats{}, errors.New("empty conn")
+}
+
 func (c *RudpConn) checkConfig() {
 	if c.config == nil {
 		c.config = DefaultRudpConfig()
@@ -435,55 +549,21 @@ func (c *RudpConn) GetConfig() *RudpConfig {
 	return c.config
 }
 
+func (c *RudpConn) frameMgrConfig() *FrameMgrConfig {
+	return c.config.frameMgrConfig(c.config.CutSize, c.config.MaxId, c.config.BufferSize, c.config.MaxWin, c.config.ResendTimems, c.config.Compress, c.config.Stat)
+}
+
 func (c *RudpConn) loopListenerRecv() error {
 	c.checkConfig()
 
-	buf := make([]byte, c.config.MaxPacketSize)
+	reader := newUdpBatchReader(c.listener.listenerconn, c.config.BatchRecvPkgs, c.config.MaxPacketSize, c.config.Gro)
 	for !c.listener.wg.IsExit() {
 		c.listener.listenerconn.SetReadDeadline(time.Now().Add(time.Millisecond * 100))
-		n, srcaddr, err := c.listener.listenerconn.ReadFromUDP(buf)
+		err := reader.Read(c.onListenerRecv)
 		if err != nil {
 			continue
 		}
 
-		srcaddrstr := srcaddr.String()
-
-		v, ok := c.listener.sonny.Load(srcaddrstr)
-		if !ok {
-			id := common.Guid()
-			fm := NewFrameMgr(c.config.CutSize, c.config.MaxId, c.config.BufferSize, c.config.MaxWin, c.config.ResendTimems, c.config.Compress, c.config.Stat)
-			fm.SetDebugid(id)
-			if c.config.Congestion == "bb" {
-				fm.SetCongestion(&BBCongestion{})
-			}
-
-			sonny := &rudpConnListenerSonny{
-				dstaddr:    srcaddr,
-				fatherconn: c.listener.listenerconn,
-				fm:         fm,
-			}
-
-			u := &RudpConn{config: c.config, listenersonny: sonny}
-			c.listener.sonny.Store(srcaddrstr, u)
-
-			c.listener.wg.Go("RudpConn accept"+" "+u.Info(), func() error {
-				return c.accept(u)
-			})
-
-			//loggo.Debug("start accept remote rudp %s %s", u.Info(), id)
-		} else {
-			u := v.(*RudpConn)
-
-			f := &Frame{}
-			err := proto.Unmarshal(buf[0:n], f)
-			if err == nil {
-				u.listenersonny.fm.OnRecvFrame(f)
-				//loggo.Debug("%s recv frame %d", u.Info(), f.Id)
-			} else {
-				//loggo.Error("%s %s Unmarshal fail %s", c.Info(), u.Info(), err)
-			}
-		}
-
 		c.listener.sonny.Range(func(key, value interface{}) bool {
 			u := value.(*RudpConn)
 			if u.isclose {
@@ -565,6 +645,56 @@ func (c *RudpConn) updateListenerSonny() error {
 	return c.update_rudp(c.listenersonny.wg, c.listenersonny.fm, c.listenersonny.fatherconn, c.listenersonny.dstaddr, false)
 }
 
+func (c *RudpConn) onListenerRecv(buf []byte, srcaddr *net.UDPAddr) {
+	if srcaddr == nil {
+		return
+	}
+	srcaddrstr := srcaddr.String()
+
+	v, ok := c.listener.sonny.Load(srcaddrstr)
+	if !ok {
+		fc, _ := c.config.newFrameCrypto()
+		if fc != nil {
+			fc.salts = c.listener.salts
+			// 第一个包认证通过才创建连接，避免伪造的包占用资源
+			if _, err := fc.Open(buf); err != nil {
+				return
+			}
+		}
+
+		id := common.Guid()
+		fm, err := c.config.newFrameMgr(c.frameMgrConfig(), id, fc)
+		if err != nil {
+			return
+		}
+
+		sonny := &rudpConnListenerSonny{
+			dstaddr:    srcaddr,
+			fatherconn: c.listener.listenerconn,
+			fm:         fm,
+		}
+
+		u := &RudpConn{config: c.config, listenersonny: sonny}
+		c.listener.sonny.Store(srcaddrstr, u)
+
+		c.listener.wg.Go("RudpConn accept"+" "+u.Info(), func() error {
+			return c.accept(u)
+		})
+
+		//loggo.Debug("start accept remote rudp %s %s", u.Info(), id)
+	} else {
+		u := v.(*RudpConn)
+
+		f, err := u.listenersonny.fm.UnmarshalFrame(buf)
+		if err == nil {
+			u.listenersonny.fm.OnRecvFrame(f)
+			//loggo.Debug("%s recv frame %d", u.Info(), f.Id)
+		} else {
+			//loggo.Error("%s %s Unmarshal fail %s", c.Info(), u.Info(), err)
+		}
+	}
+}
+
 func (c *RudpConn) updateDialerSonny() error {
 	return c.update_rudp(c.dialer.wg, c.dialer.fm, c.dialer.conn, nil, true)
 }
@@ -577,21 +707,19 @@ func (c *RudpConn) update_rudp(wg *thread.Group, fm *FrameMgr, conn *net.UDPConn
 
 	if readconn {
 		wg.Go("RudpConn update_rudp recv"+" "+c.Info(), func() error {
-			bytes := make([]byte, c.config.MaxPacketSize)
+			reader := newUdpBatchReader(conn, c.config.BatchRecvPkgs, c.config.MaxPacketSize, false)
 			for !wg.IsExit() && stage != "closewait" {
 				// recv udp
 				conn.SetReadDeadline(time.Now().Add(time.Millisecond * 100))
-				n, _ := conn.Read(bytes)
-				if n > 0 {
-					f := &Frame{}
-					err := proto.Unmarshal(bytes[0:n], f)
+				reader.Read(func(data []byte, _ *net.UDPAddr) {
+					f, err := fm.UnmarshalFrame(data)
 					if err == nil {
 						fm.OnRecvFrame(f)
 						//loggo.Debug("%s recv frame %d", c.Info(), f.Id)
 					} else {
 						//loggo.Error("Unmarshal fail from %s %s", c.Info(), err)
 					}
-				}
+				})
 			}
 
 			return nil
@@ -600,10 +728,8 @@ func (c *RudpConn) update_rudp(wg *thread.Group, fm *FrameMgr, conn *net.UDPConn
 
 	reason := ""
 
-	pconn := ipv4.NewPacketConn(conn)
-	// 预分配消息数组，避免循环内分配
-	msgs := make([]ipv4.Message, 0, c.config.BatchSendPkgs)
-	count := 0
+	// 攒够一批用 sendmmsg 发送，同一个目标地址的包可以用 GSO 合并
+	writer := newUdpBatchWriter(conn, c.config.BatchSendPkgs, c.config.Gso)
 
 	for !wg.IsExit() {
 
@@ -611,51 +737,29 @@ func (c *RudpConn) update_rudp(wg *thread.Group, fm *FrameMgr, conn *net.UDPConn
 
 		// send udp
 		sendlist := fm.GetSendList()
+		if sendlist.Len() > 0 {
+			conn.SetWriteDeadline(time.Now().Add(time.Millisecond * 100))
+		}
 		for e := sendlist.Front(); e != nil; e = e.Next() {
 			f := e.Value.(*Frame)
-			mb, err := fm.MarshalFrame(f)
+			bp := GetFrameBuffer()
+			mb, err := fm.MarshalFrameTo(*bp, f)
 			if err != nil {
 				//loggo.Error("MarshalFrame fail %s", err)
+				PutFrameBuffer(bp)
+				writer.Flush()
 				return err
 			}
+			*bp = mb
 
-			if runtime.GOOS != "linux" {
-				conn.SetWriteDeadline(time.Now().Add(time.Millisecond * 100))
-				if dstaddr != nil {
-					conn.WriteToUDP(mb, dstaddr)
-					//loggo.Debug("%s send frame to %s %d", c.Info(), dstaddr, f.Id)
-				} else {
-					conn.Write(mb)
-					//loggo.Debug("%s send frame %d", c.Info(), f.Id)
-				}
-			} else {
-				// 构造批量消息
-				msg := ipv4.Message{
-					Buffers: [][]byte{mb}, // 这里直接引用 mb，没有拷贝
-				}
-				if dstaddr != nil {
-					msg.Addr = dstaddr
-				}
-				msgs = append(msgs, msg)
-				count++
-
-				// 如果积攒够了一批，或者列表到头了，就发送
-				if count >= c.config.BatchSendPkgs || e.Next() == nil {
-					conn.SetWriteDeadline(time.Now().Add(time.Millisecond * 100))
-
-					// WriteBatch 会调用底层的 sendmmsg
-					_, err := pconn.WriteBatch(msgs, 0)
-					if err != nil {
-						// 处理错误
-						return err
-					}
-
-					// 重置 slice 长度以便复用 (保留容量)
-					msgs = msgs[:0]
-					count = 0
-				}
+			// 这里直接引用 mb，没有拷贝，发送后 writer 放回池中
+			if err := writer.Write(bp, dstaddr); err != nil {
+				return err
 			}
 		}
+		if err := writer.Flush(); err != nil {
+			return err
+		}
 
 		// timeout
 		if fm.IsHBTimeout() {
@@ -664,6 +768,11 @@ func (c *RudpConn) update_rudp(wg *thread.Group, fm *FrameMgr, conn *net.UDPConn
 			break
 		}
 
+		if fm.IsIdleTimeout() {
+			reason = "IdleTimeout"
+			break
+		}
+
 		if fm.IsRemoteClosed() {
 			reason = "RemoteClose"
 			//loggo.Debug("closed by remote conn %s", c.Info())
@@ -671,7 +780,11 @@ func (c *RudpConn) update_rudp(wg *thread.Group, fm *FrameMgr, conn *net.UDPConn
 		}
 
 		if !avctive && sendlist.Len() <= 0 {
-			time.Sleep(time.Millisecond * 10)
+			if fm.IsPaced() {
+				time.Sleep(time.Millisecond)
+			} else {
+				time.Sleep(time.Millisecond * 10)
+			}
 		}
 	}
 
@@ -1,9 +1,16 @@
 package network
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"github.com/esrrhs/gohome/loggo"
+	"io"
+	"net"
+	"os"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -455,3 +462,529 @@ func Test0008RUDP(t *testing.T) {
 
 	time.Sleep(time.Second)
 }
+
+func TestRUDPReadDeadline(t *testing.T) {
+	c, err := NewConn("rudp")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cc, err := c.Listen(":58088")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+
+	go func() {
+		conn, err := cc.Accept()
+		if err == nil {
+			time.Sleep(time.Second * 2)
+			conn.Close()
+		}
+	}()
+
+	ccc, err := c.Dial("127.0.0.1:58088")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ccc.Close()
+
+	ccc.SetReadDeadline(time.Now().Add(time.Millisecond * 200))
+	begin := time.Now()
+	buf := make([]byte, 100)
+	_, err = ccc.Read(buf)
+	if err != os.ErrDeadlineExceeded {
+		t.Fatalf("Read returned %v, want %v", err, os.ErrDeadlineExceeded)
+	}
+	if time.Since(begin) > time.Second {
+		t.Fatalf("Read timeout too late %v", time.Since(begin))
+	}
+
+	ccc.SetReadDeadline(time.Time{})
+	if err := cc.SetDeadline(time.Now()); err == nil {
+		t.Fatal("listener SetDeadline should fail")
+	}
+}
+
+func TestRUDPDialContext(t *testing.T) {
+	c, err := NewConn("rudp")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*300)
+	defer cancel()
+	begin := time.Now()
+	_, err = c.DialContext(ctx, "127.0.0.1:58089")
+	if err != context.DeadlineExceeded {
+		t.Fatalf("DialContext returned %v, want %v", err, context.DeadlineExceeded)
+	}
+	if time.Since(begin) > time.Second*2 {
+		t.Fatalf("DialContext cancel too late %v", time.Since(begin))
+	}
+
+	cc, err := c.Listen(":58089")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+
+	actx, acancel := context.WithTimeout(context.Background(), time.Millisecond*200)
+	defer acancel()
+	_, err = cc.AcceptContext(actx)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("AcceptContext returned %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestRUDPCrypto(t *testing.T) {
+	config := DefaultRudpConfig()
+	config.Crypto = "chacha20-poly1305"
+	config.CryptoKey = "rudp psk"
+	config.CryptoRotatePkgs = 16
+	c, err := NewConnWithConfig("rudp", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cc, err := c.Listen("127.0.0.1:58098")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+
+	go func() {
+		for {
+			conn, err := cc.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	ccc, err := c.Dial("127.0.0.1:58098")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ccc.Close()
+
+	data := bytes.Repeat([]byte("secret"), 10000)
+	go ccc.Write(data)
+	ccc.SetReadDeadline(time.Now().Add(time.Second * 10))
+	buf := make([]byte, len(data))
+	if _, err := io.ReadFull(ccc, buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, data) {
+		t.Fatal("echo data mismatch")
+	}
+
+	// 密钥不一致无法建立连接
+	wrong := *config
+	wrong.CryptoKey = "wrong psk"
+	wrong.ConnectTimeoutMs = 1000
+	c, _ = NewConnWithConfig("rudp", &wrong)
+	if conn, err := c.Dial("127.0.0.1:58098"); err == nil {
+		conn.Close()
+		t.Fatal("dial with wrong key should fail")
+	}
+
+	// 没有密钥
+	bad := *config
+	bad.CryptoKey = ""
+	c, _ = NewConnWithConfig("rudp", &bad)
+	if _, err := c.Dial("127.0.0.1:58098"); err == nil {
+		t.Fatal("dial with empty key should fail")
+	}
+}
+
+// 中间转发并记录客户端发出的包，连接关闭后从另一个 socket 重放整个会话，listener 不能再接受连接
+func TestRUDPCryptoReplay(t *testing.T) {
+	config := DefaultRudpConfig()
+	config.Crypto = "aes-gcm"
+	config.CryptoKey = "rudp psk"
+	config.ConnectTimeoutMs = 1000
+	c, _ := NewConnWithConfig("rudp", config)
+	cc, err := c.Listen("127.0.0.1:58114")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+
+	var accepted int32
+	go func() {
+		for {
+			conn, err := cc.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&accepted, 1)
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	server, _ := net.ResolveUDPAddr("udp", "127.0.0.1:58114")
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer relay.Close()
+	upstream, err := net.DialUDP("udp", nil, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+
+	var lock sync.Mutex
+	var captured [][]byte
+	var client *net.UDPAddr
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := relay.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			lock.Lock()
+			client = addr
+			captured = append(captured, append([]byte(nil), buf[:n]...))
+			lock.Unlock()
+			upstream.Write(buf[:n])
+		}
+	}()
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, err := upstream.Read(buf)
+			if err != nil {
+				return
+			}
+			lock.Lock()
+			addr := client
+			lock.Unlock()
+			relay.WriteToUDP(buf[:n], addr)
+		}
+	}()
+
+	ccc, err := c.Dial(relay.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := bytes.Repeat([]byte("replay"), 1000)
+	go ccc.Write(data)
+	ccc.SetReadDeadline(time.Now().Add(time.Second * 5))
+	buf := make([]byte, len(data))
+	if _, err := io.ReadFull(ccc, buf); err != nil || !bytes.Equal(buf, data) {
+		t.Fatalf("echo fail %v", err)
+	}
+	ccc.Close()
+	if atomic.LoadInt32(&accepted) != 1 {
+		t.Fatalf("accepted %d", accepted)
+	}
+
+	attacker, err := net.DialUDP("udp", nil, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer attacker.Close()
+	lock.Lock()
+	packets := captured
+	lock.Unlock()
+	for _, p := range packets {
+		attacker.Write(p)
+		time.Sleep(time.Millisecond)
+	}
+
+	time.Sleep(time.Duration(config.ConnectTimeoutMs) * time.Millisecond)
+	if n := atomic.LoadInt32(&accepted); n != 1 {
+		t.Fatalf("replayed session accepted, accepted %d", n)
+	}
+}
+
+func TestRUDPFec(t *testing.T) {
+	config := DefaultRudpConfig()
+	config.FecDataShards = 8
+	config.FecParityShards = 2
+	c, err := NewConnWithConfig("rudp", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cc, err := c.Listen("127.0.0.1:58099")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+
+	go func() {
+		for {
+			conn, err := cc.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	ccc, err := c.Dial("127.0.0.1:58099")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ccc.Close()
+
+	data := bytes.Repeat([]byte("fec"), 100000)
+	go ccc.Write(data)
+	ccc.SetReadDeadline(time.Now().Add(time.Second * 10))
+	buf := make([]byte, len(data))
+	if _, err := io.ReadFull(ccc, buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, data) {
+		t.Fatal("echo data mismatch")
+	}
+	// 两端都支持 FEC，握手后应该发送了 FEC 帧
+	if st, _ := ccc.(*RudpConn).Stats(); st.SendFecNum <= 0 {
+		t.Fatal("no fec frame sent")
+	}
+
+	bad := *config
+	bad.FecDataShards = 70000
+	c, _ = NewConnWithConfig("rudp", &bad)
+	if _, err := c.Listen("127.0.0.1:58099"); err == nil {
+		t.Fatal("listen with bad fec config should fail")
+	}
+}
+
+func TestRUDPStats(t *testing.T) {
+	c, _ := NewConn("rudp")
+	cc, err := c.Listen("127.0.0.1:58104")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+
+	if _, err := cc.(*RudpConn).Stats(); err == nil {
+		t.Error("listener Stats should fail")
+	}
+
+	go func() {
+		conn, err := cc.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+
+	ccc, err := c.Dial("127.0.0.1:58104")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ccc.Close()
+
+	data := bytes.Repeat([]byte("stats"), 10000)
+	go ccc.Write(data)
+	ccc.SetReadDeadline(time.Now().Add(time.Second * 10))
+	if _, err := io.ReadFull(ccc, make([]byte, len(data))); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(time.Millisecond * 100)
+	st, err := ccc.(*RudpConn).Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !st.Connected || st.SendDataBytes < int64(len(data)) || st.RecvDataBytes < int64(len(data)) || st.SRtt <= 0 {
+		t.Errorf("stats %+v", st)
+	}
+}
+
+func TestRUDPCongestion(t *testing.T) {
+	for _, name := range []string{"bbr", "cubic", "reno"} {
+		config := DefaultRudpConfig()
+		config.Congestion = name
+		config.Pacing = true
+		c, _ := NewConnWithConfig("rudp", config)
+		cc, err := c.Listen("127.0.0.1:58105")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		go func() {
+			conn, err := cc.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			io.Copy(conn, conn)
+		}()
+
+		ccc, err := c.Dial("127.0.0.1:58105")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		data := bytes.Repeat([]byte(name), 100000)
+		go ccc.Write(data)
+		ccc.SetReadDeadline(time.Now().Add(time.Second * 10))
+		buf := make([]byte, len(data))
+		if _, err := io.ReadFull(ccc, buf); err != nil || !bytes.Equal(buf, data) {
+			t.Fatalf("%s echo fail %v", name, err)
+		}
+		if st, _ := ccc.(*RudpConn).Stats(); st.PacingRate <= 0 {
+			t.Errorf("%s pacing rate %d", name, st.PacingRate)
+		}
+		ccc.Close()
+		cc.Close()
+	}
+
+	config := DefaultRudpConfig()
+	config.Congestion = "vegas"
+	c, _ := NewConnWithConfig("rudp", config)
+	if _, err := c.Listen("127.0.0.1:58105"); err == nil {
+		t.Fatal("listen with unknown congestion should fail")
+	}
+}
+
+func TestRUDPPmtu(t *testing.T) {
+	config := DefaultRudpConfig()
+	config.Pmtu = true
+	config.PmtuMaxSize = 1200
+	config.MaxPacketSize = 2048
+	c, _ := NewConnWithConfig("rudp", config)
+	cc, err := c.Listen("127.0.0.1:58106")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+
+	go func() {
+		conn, err := cc.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+
+	ccc, err := c.Dial("127.0.0.1:58106")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ccc.Close()
+
+	// 回环地址的 MTU 很大，应该能调到配置的最大值附近
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if st, _ := ccc.(*RudpConn).Stats(); st.CutSize > config.PmtuMaxSize-pmtuProbeStep {
+			break
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+	st, _ := ccc.(*RudpConn).Stats()
+	if st.CutSize <= config.PmtuMaxSize-pmtuProbeStep || st.CutSize > config.PmtuMaxSize {
+		t.Fatalf("cut size %d", st.CutSize)
+	}
+
+	data := bytes.Repeat([]byte("pmtu"), 100000)
+	go ccc.Write(data)
+	ccc.SetReadDeadline(time.Now().Add(time.Second * 10))
+	buf := make([]byte, len(data))
+	if _, err := io.ReadFull(ccc, buf); err != nil || !bytes.Equal(buf, data) {
+		t.Fatalf("echo fail %v", err)
+	}
+}
+
+func TestRUDPIdleTimeout(t *testing.T) {
+	config := DefaultRudpConfig()
+	config.IdleTimeoutMs = 300
+	config.Compress = 100
+	config.CompressAlg = "flate"
+	c, _ := NewConnWithConfig("rudp", config)
+	cc, err := c.Listen("127.0.0.1:58107")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+
+	go func() {
+		conn, err := cc.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+
+	ccc, err := c.Dial("127.0.0.1:58107")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ccc.Close()
+
+	data := bytes.Repeat([]byte("idle"), 10000)
+	go ccc.Write(data)
+	ccc.SetReadDeadline(time.Now().Add(time.Second * 5))
+	buf := make([]byte, len(data))
+	if _, err := io.ReadFull(ccc, buf); err != nil || !bytes.Equal(buf, data) {
+		t.Fatalf("echo fail %v", err)
+	}
+
+	// 没有数据后连接因为空闲被关闭，早于读超时返回
+	start := time.Now()
+	if _, err := ccc.Read(buf); err == nil || time.Since(start) > time.Second*3 {
+		t.Fatalf("read after idle %v %v", err, time.Since(start))
+	}
+
+	config = DefaultRudpConfig()
+	config.HBTimeoutMs = config.HBIntervalMs
+	c, _ = NewConnWithConfig("rudp", config)
+	if _, err := c.Listen("127.0.0.1:58107"); err == nil {
+		t.Fatal("listen with bad config should fail")
+	}
+}
+
+func TestRUDPGsoGro(t *testing.T) {
+	config := DefaultRudpConfig()
+	config.Gso = true
+	config.Gro = true
+	c, _ := NewConnWithConfig("rudp", config)
+	cc, err := c.Listen("127.0.0.1:58113")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+
+	go func() {
+		conn, err := cc.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+
+	ccc, err := c.Dial("127.0.0.1:58113")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ccc.Close()
+
+	data := bytes.Repeat([]byte("gso"), 100000)
+	go ccc.Write(data)
+	ccc.SetReadDeadline(time.Now().Add(time.Second * 10))
+	buf := make([]byte, len(data))
+	if _, err := io.ReadFull(ccc, buf); err != nil || !bytes.Equal(buf, data) {
+		t.Fatalf("echo fail %v", err)
+	}
+}
@@ -0,0 +1,627 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+Session 在一个可靠的 Conn（如 RudpConn、RicmpConn）上复用多个逻辑流，每个流都实现了 Conn，省去每条流单独握手和维护窗口的开销。
+
+帧格式为 cmd(1) | sid(4) | len(2) | 数据，cmd 包括：
+  - SETTINGS 建立 Session 时双方各发一次，数据为 4 字节的流接收窗口大小
+  - SYN 打开一个流
+  - DATA 流数据
+  - FIN 本端关闭，对端读完缓存的数据后返回 io.EOF
+  - RST 立即重置流，双方之后的读写都返回错误
+  - UPD 窗口更新，数据为 4 字节的累计已读字节数
+
+每个流有独立的接收窗口，发送端未确认的字节数达到对端窗口后 Write 阻塞，直到对端读走数据发来 UPD，所以一个流读得慢不会影响其他流。
+客户端打开的流使用奇数 id，服务端使用偶数 id，双方都可以打开流。
+*/
+
+const (
+	sessionCmdSettings = iota
+	sessionCmdSyn
+	sessionCmdData
+	sessionCmdFin
+	sessionCmdRst
+	sessionCmdUpd
+)
+
+const sessionHeaderLen = 1 + 4 + 2
+
+var (
+	errSessionClosed = errors.New("session closed")
+	errStreamReset   = errors.New("stream reset")
+)
+
+type SessionConfig struct {
+	// 每个流的接收窗口大小
+	StreamWindow int
+	// 单个 DATA 帧的最大长度，不能超过 65535
+	MaxFrameSize int
+	// 等待 AcceptStream 的流的最大个数，超过后对端新打开的流会被 RST
+	AcceptBacklog int
+	// 同时存在的最大流个数
+	MaxStreams int
+}
+
+func DefaultSessionConfig() *SessionConfig {
+	return &SessionConfig{
+		StreamWindow:  256 * 1024,
+		MaxFrameSize:  16 * 1024,
+		AcceptBacklog: 64,
+		MaxStreams:    1024,
+	}
+}
+
+type Session struct {
+	conn   Conn
+	config *SessionConfig
+	client bool
+
+	lock       sync.Mutex
+	streams    map[uint32]*SessionStream
+	nextid     uint32
+	peerWindow uint32
+
+	wlock sync.Mutex
+
+	accept chan *SessionStream
+	die    chan struct{}
+	once   sync.Once
+	err    error
+}
+
+// NewSession 在 conn 上建立 Session，两端必须一端 client 为 true，另一端为 false，config 为 nil 时使用默认配置。
+func NewSession(conn Conn, client bool, config *SessionConfig) (*Session, error) {
+	if config == nil {
+		config = DefaultSessionConfig()
+	}
+	if config.StreamWindow <= 0 || config.MaxFrameSize <= 0 || config.MaxFrameSize > 65535 ||
+		config.AcceptBacklog <= 0 || config.MaxStreams <= 0 {
+		return nil, errors.New("invalid session config")
+	}
+
+	s := &Session{
+		conn:    conn,
+		config:  config,
+		client:  client,
+		streams: make(map[uint32]*SessionStream),
+		accept:  make(chan *SessionStream, config.AcceptBacklog),
+		die:     make(chan struct{}),
+	}
+	if client {
+		s.nextid = 1
+	} else {
+		s.nextid = 2
+	}
+
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], uint32(config.StreamWindow))
+	if err := s.writeFrame(sessionCmdSettings, 0, b[:]); err != nil {
+		return nil, err
+	}
+
+	go s.loopRecv()
+
+	return s, nil
+}
+
+// OpenStream 打开一个新的流，不需要等待对端确认。
+func (s *Session) OpenStream() (Conn, error) {
+	if s.IsClosed() {
+		return nil, errSessionClosed
+	}
+
+	s.lock.Lock()
+	if len(s.streams) >= s.config.MaxStreams {
+		s.lock.Unlock()
+		return nil, errors.New("too many streams")
+	}
+	id := s.nextid
+	s.nextid += 2
+	st := s.newStream(id)
+	s.streams[id] = st
+	s.lock.Unlock()
+
+	if err := s.writeFrame(sessionCmdSyn, id, nil); err != nil {
+		s.removeStream(id)
+		return nil, err
+	}
+	return st, nil
+}
+
+func (s *Session) AcceptStream() (Conn, error) {
+	return s.AcceptStreamContext(context.Background())
+}
+
+func (s *Session) AcceptStreamContext(ctx context.Context) (Conn, error) {
+	select {
+	case st := <-s.accept:
+		return st, nil
+	case <-s.die:
+		return nil, s.closeErr()
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Close 关闭 Session 和底层的 Conn，所有流之后的读写都返回错误。
+func (s *Session) Close() error {
+	return s.closeWithErr(errSessionClosed)
+}
+
+func (s *Session) IsClosed() bool {
+	select {
+	case <-s.die:
+		return true
+	default:
+		return false
+	}
+}
+
+// NumStreams 返回当前存在的流个数。
+func (s *Session) NumStreams() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.streams)
+}
+
+func (s *Session) LocalAddr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+func (s *Session) RemoteAddr() net.Addr {
+	return s.conn.RemoteAddr()
+}
+
+func (s *Session) closeWithErr(err error) error {
+	var ret error
+	s.once.Do(func() {
+		s.lock.Lock()
+		s.err = err
+		s.lock.Unlock()
+		close(s.die)
+		ret = s.conn.Close()
+	})
+	return ret
+}
+
+func (s *Session) closeErr() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.err
+}
+
+func (s *Session) writeFrame(cmd byte, id uint32, data []byte) error {
+	b := make([]byte, sessionHeaderLen+len(data))
+	b[0] = cmd
+	binary.BigEndian.PutUint32(b[1:], id)
+	binary.BigEndian.PutUint16(b[5:], uint16(len(data)))
+	copy(b[sessionHeaderLen:], data)
+
+	s.wlock.Lock()
+	defer s.wlock.Unlock()
+
+	if s.IsClosed() {
+		return s.closeErr()
+	}
+	_, err := s.conn.Write(b)
+	if err != nil {
+		s.closeWithErr(err)
+	}
+	return err
+}
+
+// writeFrameAsync 用于接收协程发送控制帧，避免两端同时写满时互相等待。
+func (s *Session) writeFrameAsync(cmd byte, id uint32, data []byte) {
+	go s.writeFrame(cmd, id, data)
+}
+
+func (s *Session) newStream(id uint32) *SessionStream {
+	return &SessionStream{
+		id:      id,
+		sess:    s,
+		rnotify: make(chan struct{}, 1),
+		wnotify: make(chan struct{}, 1),
+	}
+}
+
+func (s *Session) getStream(id uint32) *SessionStream {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.streams[id]
+}
+
+func (s *Session) removeStream(id uint32) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.streams, id)
+}
+
+func (s *Session) getPeerWindow() uint32 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.peerWindow
+}
+
+func (s *Session) loopRecv() {
+	var hdr [sessionHeaderLen]byte
+	for {
+		if _, err := io.ReadFull(s.conn, hdr[:]); err != nil {
+			s.closeWithErr(err)
+			return
+		}
+		cmd := hdr[0]
+		id := binary.BigEndian.Uint32(hdr[1:])
+		var data []byte
+		if l := binary.BigEndian.Uint16(hdr[5:]); l > 0 {
+			data = make([]byte, l)
+			if _, err := io.ReadFull(s.conn, data); err != nil {
+				s.closeWithErr(err)
+				return
+			}
+		}
+
+		switch cmd {
+		case sessionCmdSettings:
+			if len(data) < 4 {
+				s.closeWithErr(errors.New("session bad settings frame"))
+				return
+			}
+			s.lock.Lock()
+			s.peerWindow = binary.BigEndian.Uint32(data)
+			for _, st := range s.streams {
+				st.wake()
+			}
+			s.lock.Unlock()
+		case sessionCmdSyn:
+			s.processSyn(id)
+		case sessionCmdData:
+			if st := s.getStream(id); st != nil {
+				st.processData(data)
+			}
+		case sessionCmdFin:
+			if st := s.getStream(id); st != nil {
+				st.processFin()
+			}
+		case sessionCmdRst:
+			if st := s.getStream(id); st != nil {
+				st.processRst()
+			}
+		case sessionCmdUpd:
+			if st := s.getStream(id); st != nil && len(data) >= 4 {
+				st.processUpd(binary.BigEndian.Uint32(data))
+			}
+		default:
+			s.closeWithErr(errors.New("session unknown cmd " + strconv.Itoa(int(cmd))))
+			return
+		}
+	}
+}
+
+func (s *Session) processSyn(id uint32) {
+	// 对端只能使用另一种奇偶的 id
+	if (id%2 == 1) == s.client {
+		s.writeFrameAsync(sessionCmdRst, id, nil)
+		return
+	}
+
+	s.lock.Lock()
+	if _, ok := s.streams[id]; ok || len(s.streams) >= s.config.MaxStreams {
+		s.lock.Unlock()
+		s.writeFrameAsync(sessionCmdRst, id, nil)
+		return
+	}
+	st := s.newStream(id)
+	s.streams[id] = st
+	s.lock.Unlock()
+
+	select {
+	case s.accept <- st:
+	default:
+		s.removeStream(id)
+		s.writeFrameAsync(sessionCmdRst, id, nil)
+	}
+}
+
+// SessionStream 是 Session 中的一个流。
+type SessionStream struct {
+	id   uint32
+	sess *Session
+
+	lock        sync.Mutex
+	recvbuf     bytes.Buffer
+	recvTotal   uint32 // 累计收到的字节数
+	recvRead    uint32 // 累计读走的字节数
+	recvUpdated uint32 // 上次通知对端的已读字节数
+	sendTotal   uint32 // 累计发送的字节数
+	sendAcked   uint32 // 对端累计读走的字节数
+	finRecv     bool
+	rst         bool
+	closed      bool
+
+	wlock    sync.Mutex
+	rnotify  chan struct{} // 读写分开通知，避免一方把另一方的通知取走
+	wnotify  chan struct{}
+	deadline connDeadline
+	info     string
+}
+
+func (st *SessionStream) wake() {
+	select {
+	case st.rnotify <- struct{}{}:
+	default:
+	}
+	select {
+	case st.wnotify <- struct{}{}:
+	default:
+	}
+}
+
+func (st *SessionStream) wait(notify chan struct{}, deadline time.Time) {
+	timer, stop := deadlineTimer(deadline)
+	defer stop()
+	select {
+	case <-notify:
+	case <-st.sess.die:
+	case <-timer:
+	}
+}
+
+func (st *SessionStream) processData(data []byte) {
+	st.lock.Lock()
+	if st.closed || st.rst {
+		st.lock.Unlock()
+		// 本端已经关闭，不会再读了
+		st.sess.writeFrameAsync(sessionCmdRst, st.id, nil)
+		return
+	}
+	if int(st.recvTotal-st.recvRead)+len(data) > st.sess.config.StreamWindow {
+		st.rst = true
+		st.lock.Unlock()
+		st.sess.removeStream(st.id)
+		st.sess.writeFrameAsync(sessionCmdRst, st.id, nil)
+		st.wake()
+		return
+	}
+	st.recvbuf.Write(data)
+	st.recvTotal += uint32(len(data))
+	st.lock.Unlock()
+	st.wake()
+}
+
+func (st *SessionStream) processFin() {
+	st.lock.Lock()
+	st.finRecv = true
+	remove := st.closed
+	st.lock.Unlock()
+	if remove {
+		st.sess.removeStream(st.id)
+	}
+	st.wake()
+}
+
+func (st *SessionStream) processRst() {
+	st.lock.Lock()
+	st.rst = true
+	st.lock.Unlock()
+	st.sess.removeStream(st.id)
+	st.wake()
+}
+
+func (st *SessionStream) processUpd(read uint32) {
+	st.lock.Lock()
+	st.sendAcked = read
+	st.lock.Unlock()
+	st.wake()
+}
+
+func (st *SessionStream) Name() string {
+	return st.sess.conn.Name() + "-stream"
+}
+
+func (st *SessionStream) Read(p []byte) (n int, err error) {
+	if len(p) <= 0 {
+		return 0, errors.New("read empty buffer")
+	}
+
+	for {
+		st.lock.Lock()
+		if st.closed {
+			st.lock.Unlock()
+			return 0, errors.New("read closed conn")
+		}
+		if st.recvbuf.Len() > 0 {
+			n, _ = st.recvbuf.Read(p)
+			st.recvRead += uint32(n)
+			var upd []byte
+			if int(st.recvRead-st.recvUpdated) >= st.sess.config.StreamWindow/2 {
+				st.recvUpdated = st.recvRead
+				upd = make([]byte, 4)
+				binary.BigEndian.PutUint32(upd, st.recvRead)
+			}
+			st.lock.Unlock()
+			if upd != nil {
+				st.sess.writeFrame(sessionCmdUpd, st.id, upd)
+			}
+			return n, nil
+		}
+		rst := st.rst
+		fin := st.finRecv
+		st.lock.Unlock()
+
+		if rst {
+			return 0, errStreamReset
+		}
+		if fin {
+			return 0, io.EOF
+		}
+		if st.sess.IsClosed() {
+			return 0, st.sess.closeErr()
+		}
+		if st.deadline.readTimeout() {
+			return 0, os.ErrDeadlineExceeded
+		}
+		st.wait(st.rnotify, st.deadline.readDeadline())
+	}
+}
+
+func (st *SessionStream) Write(p []byte) (n int, err error) {
+	st.wlock.Lock()
+	defer st.wlock.Unlock()
+
+	for len(p) > 0 {
+		st.lock.Lock()
+		if st.closed {
+			st.lock.Unlock()
+			return n, errors.New("write closed conn")
+		}
+		if st.rst {
+			st.lock.Unlock()
+			return n, errStreamReset
+		}
+		window := st.sess.getPeerWindow()
+		inflight := st.sendTotal - st.sendAcked
+		if inflight < window {
+			size := len(p)
+			if size > int(window-inflight) {
+				size = int(window - inflight)
+			}
+			if size > st.sess.config.MaxFrameSize {
+				size = st.sess.config.MaxFrameSize
+			}
+			st.sendTotal += uint32(size)
+			st.lock.Unlock()
+
+			if err := st.sess.writeFrame(sessionCmdData, st.id, p[:size]); err != nil {
+				return n, err
+			}
+			n += size
+			p = p[size:]
+			continue
+		}
+		st.lock.Unlock()
+
+		if st.sess.IsClosed() {
+			return n, st.sess.closeErr()
+		}
+		if st.deadline.writeTimeout() {
+			return n, os.ErrDeadlineExceeded
+		}
+		st.wait(st.wnotify, st.deadline.writeDeadline())
+	}
+	return n, nil
+}
+
+// Close 发送 FIN 关闭流，对端读完已收到的数据后返回 io.EOF。
+func (st *SessionStream) Close() error {
+	st.lock.Lock()
+	if st.closed {
+		st.lock.Unlock()
+		return nil
+	}
+	st.closed = true
+	st.recvbuf.Reset()
+	rst := st.rst
+	remove := st.finRecv || st.rst
+	st.lock.Unlock()
+
+	if remove {
+		st.sess.removeStream(st.id)
+	}
+	st.wake()
+	if rst || st.sess.IsClosed() {
+		return nil
+	}
+	return st.sess.writeFrame(sessionCmdFin, st.id, nil)
+}
+
+// Reset 立即重置流，未发送和未读取的数据都会丢弃，对端之后的读写返回错误。
+func (st *SessionStream) Reset() error {
+	st.lock.Lock()
+	if st.closed || st.rst {
+		st.lock.Unlock()
+		return nil
+	}
+	st.closed = true
+	st.rst = true
+	st.recvbuf.Reset()
+	st.lock.Unlock()
+
+	st.sess.removeStream(st.id)
+	st.wake()
+	if st.sess.IsClosed() {
+		return nil
+	}
+	return st.sess.writeFrame(sessionCmdRst, st.id, nil)
+}
+
+// Id 返回流的 id。
+func (st *SessionStream) Id() uint32 {
+	return st.id
+}
+
+func (st *SessionStream) Info() string {
+	if st.info == "" {
+		st.info = st.sess.conn.Info() + "#" + strconv.Itoa(int(st.id))
+	}
+	return st.info
+}
+
+func (st *SessionStream) Dial(dst string) (Conn, error) {
+	return nil, errors.New("stream can not dial, use Session.OpenStream")
+}
+
+func (st *SessionStream) DialContext(ctx context.Context, dst string) (Conn, error) {
+	return st.Dial(dst)
+}
+
+func (st *SessionStream) Listen(dst string) (Conn, error) {
+	return nil, errors.New("stream can not listen")
+}
+
+func (st *SessionStream) Accept() (Conn, error) {
+	return nil, errors.New("stream can not accept, use Session.AcceptStream")
+}
+
+func (st *SessionStream) AcceptContext(ctx context.Context) (Conn, error) {
+	return st.Accept()
+}
+
+func (st *SessionStream) LocalAddr() net.Addr {
+	return st.sess.conn.LocalAddr()
+}
+
+func (st *SessionStream) RemoteAddr() net.Addr {
+	return st.sess.conn.RemoteAddr()
+}
+
+func (st *SessionStream) SetDeadline(t time.Time) error {
+	st.deadline.setRead(t)
+	st.deadline.setWrite(t)
+	st.wake()
+	return nil
+}
+
+func (st *SessionStream) SetReadDeadline(t time.Time) error {
+	st.deadline.setRead(t)
+	st.wake()
+	return nil
+}
+
+func (st *SessionStream) SetWriteDeadline(t time.Time) error {
+	st.deadline.setWrite(t)
+	st.wake()
+	return nil
+}
@@ -0,0 +1,181 @@
+package network
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestSessionPair(t *testing.T, proto string, addr string, config *SessionConfig) (*Session, *Session) {
+	c, err := NewConn(proto)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc, err := c.Listen(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { cc.Close() })
+
+	type result struct {
+		s   *Session
+		err error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		conn, err := cc.Accept()
+		if err != nil {
+			ch <- result{nil, err}
+			return
+		}
+		s, err := NewSession(conn, false, config)
+		ch <- result{s, err}
+	}()
+
+	conn, err := c.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewSession(conn, true, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := <-ch
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	t.Cleanup(func() {
+		client.Close()
+		r.s.Close()
+	})
+	return client, r.s
+}
+
+func sessionEchoServer(s *Session) {
+	for {
+		st, err := s.AcceptStream()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer st.Close()
+			io.Copy(st, st)
+		}()
+	}
+}
+
+func TestSessionStreams(t *testing.T) {
+	for _, tc := range []struct {
+		proto string
+		addr  string
+	}{{"tcp", "127.0.0.1:58100"}, {"rudp", "127.0.0.1:58101"}} {
+		client, server := newTestSessionPair(t, tc.proto, tc.addr, nil)
+		go sessionEchoServer(server)
+
+		var wg sync.WaitGroup
+		errs := make(chan error, 10)
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				st, err := client.OpenStream()
+				if err != nil {
+					errs <- err
+					return
+				}
+				defer st.Close()
+				data := bytes.Repeat([]byte{byte(i)}, 100*1024+i)
+				go st.Write(data)
+				st.SetReadDeadline(time.Now().Add(time.Second * 10))
+				buf := make([]byte, len(data))
+				if _, err := io.ReadFull(st, buf); err != nil {
+					errs <- err
+					return
+				}
+				if !bytes.Equal(buf, data) {
+					errs <- io.ErrUnexpectedEOF
+				}
+			}(i)
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			t.Errorf("%s stream fail %v", tc.proto, err)
+		}
+	}
+}
+
+// 一个流没人读，写满窗口后只阻塞自己，不影响其他流
+func TestSessionFlowControl(t *testing.T) {
+	config := DefaultSessionConfig()
+	config.StreamWindow = 64 * 1024
+	client, server := newTestSessionPair(t, "tcp", "127.0.0.1:58102", config)
+
+	slow, _ := client.OpenStream()
+	slowpeer, err := server.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	slow.SetWriteDeadline(time.Now().Add(time.Millisecond * 500))
+	n, err := slow.Write(make([]byte, 1024*1024))
+	if err == nil || n != config.StreamWindow {
+		t.Fatalf("write blocked stream = %d, %v, want %d and timeout", n, err, config.StreamWindow)
+	}
+
+	go sessionEchoServer(server)
+	st, _ := client.OpenStream()
+	st.SetDeadline(time.Now().Add(time.Second * 5))
+	st.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(st, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("other stream ReadFull = %q, %v", buf, err)
+	}
+
+	// 读走数据后可以继续写
+	go io.Copy(io.Discard, slowpeer)
+	slow.SetWriteDeadline(time.Now().Add(time.Second * 5))
+	if _, err := slow.Write(make([]byte, 256*1024)); err != nil {
+		t.Fatalf("write after window update fail %v", err)
+	}
+}
+
+func TestSessionCloseAndReset(t *testing.T) {
+	client, server := newTestSessionPair(t, "tcp", "127.0.0.1:58103", nil)
+
+	st, _ := client.OpenStream()
+	st.Write([]byte("bye"))
+	st.Close()
+	peer, err := server.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer.SetReadDeadline(time.Now().Add(time.Second * 5))
+	data, err := io.ReadAll(peer)
+	if err != nil || string(data) != "bye" {
+		t.Fatalf("read after fin = %q, %v", data, err)
+	}
+	peer.Close()
+
+	st, _ = client.OpenStream()
+	peer, _ = server.AcceptStream()
+	st.(*SessionStream).Reset()
+	peer.SetReadDeadline(time.Now().Add(time.Second * 5))
+	if _, err := peer.Read(make([]byte, 10)); err != errStreamReset {
+		t.Fatalf("read after reset = %v, want %v", err, errStreamReset)
+	}
+	if _, err := peer.Write([]byte("x")); err != errStreamReset {
+		t.Fatalf("write after reset = %v, want %v", err, errStreamReset)
+	}
+
+	time.Sleep(time.Millisecond * 100)
+	if client.NumStreams() != 0 || server.NumStreams() != 0 {
+		t.Errorf("streams not removed, client %d server %d", client.NumStreams(), server.NumStreams())
+	}
+
+	client.Close()
+	if _, err := server.AcceptStream(); err == nil {
+		t.Error("AcceptStream after close should fail")
+	}
+}
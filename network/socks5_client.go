@@ -2,16 +2,25 @@ package network
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"strconv"
+	"sync"
 	"time"
 )
 
 /*
-socks5_client 封装了 SOCKS5 协议的客户端功能
+socks5_client 封装了 SOCKS5 协议的客户端功能，以及可以在任意 Conn 上工作、支持代理链的 Socks5Dialer。
+
+Socks5Dialer 依次经过 Hops 中的代理：用 Dialer 连接第一个代理，之后每个代理都通过前一个代理的 CONNECT 连接，
+最后向最后一个代理发出真正的请求，所有握手都在同一个 Conn 上完成。
+  - DialContext 发出 CONNECT，返回的 Socks5Conn 带有代理回复的绑定地址，可以直接作为 Socks5ServerConfig.Dialer 使用。
+  - DialUdp 发出 UDP ASSOCIATE，返回实现了 net.PacketConn 的 Socks5UdpConn，数据包从本机直接发往最后一个代理的中继地址，
+    控制连接关闭后 Socks5UdpConn 也随之关闭。
 */
 
 const (
@@ -116,7 +125,7 @@ func Sock5Handshake(conn *net.TCPConn, timeoutms int, username string, password
 		if _, err := io.ReadFull(conn, buf[:2]); err != nil {
 			return errors.New("proxy: failed to read Authentication from SOCKS5 proxy at " + conn.RemoteAddr().String() + ": " + err.Error())
 		}
-		if bytes.Equal(buf, []byte{0x01, 0x00}) != true {
+		if !bytes.Equal(buf[:2], []byte{0x01, 0x00}) {
 			return errors.New("proxy: SOCKS5 proxy at " + conn.RemoteAddr().String() + " fail authentication")
 		}
 
@@ -267,3 +276,330 @@ func readSocksPort(r io.Reader) (port uint16, err error) {
 	port = ntohs(buf)
 	return
 }
+
+// socks5Handshake 在任意 io.ReadWriter 上完成客户端的握手和认证。
+func socks5Handshake(rw io.ReadWriter, username string, password string) error {
+	method := byte(socks5AuthNone)
+	if username != "" || password != "" {
+		method = socks5UserPassAuth
+	}
+	if _, err := rw.Write([]byte{socksVer5, 1, method}); err != nil {
+		return err
+	}
+	var buf [2]byte
+	if _, err := io.ReadFull(rw, buf[:]); err != nil {
+		return err
+	}
+	if buf[0] != socksVer5 {
+		return errVer
+	}
+	if buf[1] != method {
+		return errors.New("socks auth method not accepted")
+	}
+	if method != socks5UserPassAuth {
+		return nil
+	}
+
+	auth := make([]byte, 0, 3+len(username)+len(password))
+	auth = append(auth, userAuthVersion, byte(len(username)))
+	auth = append(auth, username...)
+	auth = append(auth, byte(len(password)))
+	auth = append(auth, password...)
+	if _, err := rw.Write(auth); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(rw, buf[:]); err != nil {
+		return err
+	}
+	if buf[1] != authSuccess {
+		return errAuth
+	}
+	return nil
+}
+
+// socks5Request 发出 cmd 请求，返回代理回复的绑定地址。
+func socks5Request(rw io.ReadWriter, cmd byte, addr string) (string, error) {
+	buf, err := appendSocks5Addr([]byte{socksVer5, cmd, 0}, addr)
+	if err != nil {
+		return "", err
+	}
+	if _, err := rw.Write(buf); err != nil {
+		return "", err
+	}
+	return readSocks5Reply(rw)
+}
+
+// readSocks5Reply 读取完整的回复，回复码不为成功时返回对应的错误。
+func readSocks5Reply(r io.Reader) (string, error) {
+	var buf [4]byte
+	if _, err := io.ReadFull(r, buf[:]); err != nil {
+		return "", err
+	}
+	if buf[0] != socksVer5 {
+		return "", errVer
+	}
+	if buf[1] != socks5RepSuccess {
+		failure := "unknown error"
+		if int(buf[1]) < len(socks5Errors) {
+			failure = socks5Errors[buf[1]]
+		}
+		return "", errors.New("socks reply fail: " + failure)
+	}
+	return readSocks5Addr(r, buf[3])
+}
+
+// Socks5Hop 为代理链中的一个代理。
+type Socks5Hop struct {
+	Addr     string
+	Username string
+	Password string
+}
+
+type Socks5DialerConfig struct {
+	// 依次经过的代理，至少一个
+	Hops []Socks5Hop
+	// 连接代理链和发出请求的超时，0 表示不超时
+	TimeoutMs int
+	// 连接第一个代理使用的函数，为 nil 时使用 tcp 直连，可以替换成 RUDP、KCP 等协议
+	Dialer func(ctx context.Context, addr string) (Conn, error)
+}
+
+func DefaultSocks5DialerConfig() *Socks5DialerConfig {
+	return &Socks5DialerConfig{
+		TimeoutMs: 10000,
+	}
+}
+
+func checkSocks5DialerConfig(config *Socks5DialerConfig) error {
+	if len(config.Hops) == 0 {
+		return errors.New("socks5 no proxy")
+	}
+	for _, hop := range config.Hops {
+		if _, _, err := net.SplitHostPort(hop.Addr); err != nil {
+			return errors.New("invalid socks5 proxy " + hop.Addr)
+		}
+		if len(hop.Username) > 255 || len(hop.Password) > 255 {
+			return errors.New("socks5 username or password too long " + hop.Addr)
+		}
+	}
+	if config.TimeoutMs < 0 {
+		return errors.New("invalid socks5 timeout")
+	}
+	return nil
+}
+
+type Socks5Dialer struct {
+	config *Socks5DialerConfig
+}
+
+// NewSocks5Dialer 创建 Socks5Dialer，config 中必须有代理。
+func NewSocks5Dialer(config *Socks5DialerConfig) (*Socks5Dialer, error) {
+	if config == nil {
+		config = DefaultSocks5DialerConfig()
+	}
+	if err := checkSocks5DialerConfig(config); err != nil {
+		return nil, err
+	}
+	return &Socks5Dialer{config: config}, nil
+}
+
+// Socks5Conn 是经过代理建立的连接。
+type Socks5Conn struct {
+	Conn
+	bound string
+}
+
+// BoundAddr 返回最后一个代理回复的绑定地址，即代理连接目标使用的本地地址。
+func (c *Socks5Conn) BoundAddr() string {
+	return c.bound
+}
+
+func (d *Socks5Dialer) Dial(addr string) (Conn, error) {
+	return d.DialContext(context.Background(), addr)
+}
+
+// DialContext 经过代理链 CONNECT 到 addr，addr 可以是域名，由最后一个代理解析。
+func (d *Socks5Dialer) DialContext(ctx context.Context, addr string) (Conn, error) {
+	conn, bound, err := d.dialChain(ctx, socksCmdConnect, addr)
+	if err != nil {
+		return nil, err
+	}
+	return &Socks5Conn{Conn: conn, bound: bound}, nil
+}
+
+// dialChain 连接第一个代理，经过前面的代理 CONNECT 到最后一个代理，再向最后一个代理发出 cmd 请求。
+func (d *Socks5Dialer) dialChain(ctx context.Context, cmd byte, addr string) (Conn, string, error) {
+	if d.config.TimeoutMs > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Millisecond*time.Duration(d.config.TimeoutMs))
+		defer cancel()
+	}
+
+	conn, err := dialProxyConn(ctx, d.config.Dialer, d.config.Hops[0].Addr)
+	if err != nil {
+		return nil, "", err
+	}
+
+	stop := watchContext(ctx, func() {
+		conn.SetDeadline(aLongTimeAgo)
+	})
+	var bound string
+	for i, hop := range d.config.Hops {
+		if err = socks5Handshake(conn, hop.Username, hop.Password); err != nil {
+			err = errors.New("socks5 proxy " + hop.Addr + " handshake fail: " + err.Error())
+			break
+		}
+		if i+1 < len(d.config.Hops) {
+			_, err = socks5Request(conn, socksCmdConnect, d.config.Hops[i+1].Addr)
+		} else {
+			bound, err = socks5Request(conn, cmd, addr)
+		}
+		if err != nil {
+			err = errors.New("socks5 proxy " + hop.Addr + " request fail: " + err.Error())
+			break
+		}
+	}
+	stop()
+
+	if ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, "", err
+	}
+	return conn, bound, nil
+}
+
+// Socks5UdpConn 是经过代理的 UDP ASSOCIATE，实现了 net.PacketConn，WriteTo 的目标可以是域名。
+type Socks5UdpConn struct {
+	ctrl  Conn
+	conn  *net.UDPConn
+	relay *net.UDPAddr
+
+	rlock sync.Mutex
+	rbuf  []byte
+	once  sync.Once
+}
+
+// DialUdp 经过代理链向最后一个代理发出 UDP ASSOCIATE。
+func (d *Socks5Dialer) DialUdp(ctx context.Context) (*Socks5UdpConn, error) {
+	// 找到发往最后一个代理使用的本地 ip
+	var proxyip, localip net.IP
+	last := d.config.Hops[len(d.config.Hops)-1].Addr
+	if proxyaddr, err := net.ResolveUDPAddr("udp", last); err == nil {
+		proxyip = proxyaddr.IP
+		if c, err := net.DialUDP("udp", nil, proxyaddr); err == nil {
+			localip = c.LocalAddr().(*net.UDPAddr).IP
+			c.Close()
+		}
+	}
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: localip})
+	if err != nil {
+		return nil, err
+	}
+
+	// 只有一个代理时代理看到的控制连接 ip 就是本机，按 RFC 填 0 由代理自己确定，多个代理时需要告诉最后一个代理本机的地址
+	addr := "0.0.0.0:0"
+	if len(d.config.Hops) > 1 && localip != nil {
+		addr = conn.LocalAddr().String()
+	}
+	ctrl, bound, err := d.dialChain(ctx, socksCmdUdp, addr)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	relay, err := net.ResolveUDPAddr("udp", bound)
+	if err != nil {
+		ctrl.Close()
+		conn.Close()
+		return nil, err
+	}
+	if relay.IP.IsUnspecified() && proxyip != nil {
+		relay.IP = proxyip
+	}
+
+	u := &Socks5UdpConn{
+		ctrl:  ctrl,
+		conn:  conn,
+		relay: relay,
+		rbuf:  make([]byte, 65536),
+	}
+	// 控制连接关闭后 UDP ASSOCIATE 也结束
+	go func() {
+		io.Copy(ioutil.Discard, ctrl)
+		u.Close()
+	}()
+	return u, nil
+}
+
+// RelayAddr 返回代理的中继地址。
+func (c *Socks5UdpConn) RelayAddr() net.Addr {
+	return c.relay
+}
+
+func (c *Socks5UdpConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	pkt, err := appendSocks5Addr(make([]byte, 3, 3+1+1+255+2+len(p)), addr.String())
+	if err != nil {
+		return 0, err
+	}
+	pkt = append(pkt, p...)
+	if _, err := c.conn.WriteToUDP(pkt, c.relay); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *Socks5UdpConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	c.rlock.Lock()
+	defer c.rlock.Unlock()
+	for {
+		n, from, err := c.conn.ReadFromUDP(c.rbuf)
+		if err != nil {
+			return 0, nil, err
+		}
+		if !from.IP.Equal(c.relay.IP) || from.Port != c.relay.Port {
+			continue
+		}
+		// RSV(2) | FRAG(1) | ATYP | DST.ADDR | DST.PORT | DATA，不支持分片
+		if n < 4 || c.rbuf[2] != 0 {
+			continue
+		}
+		r := bytes.NewReader(c.rbuf[4:n])
+		src, err := readSocks5Addr(r, c.rbuf[3])
+		if err != nil {
+			continue
+		}
+		var addr net.Addr = &connAddr{network: "udp", addr: src}
+		if udpaddr, err := net.ResolveUDPAddr("udp", src); err == nil && socks5AddrIp(addr) != nil {
+			addr = udpaddr
+		}
+		return copy(p, c.rbuf[n-r.Len():n]), addr, nil
+	}
+}
+
+// Close 关闭 UDP socket 和控制连接。
+func (c *Socks5UdpConn) Close() error {
+	var err error
+	c.once.Do(func() {
+		err = c.conn.Close()
+		c.ctrl.Close()
+	})
+	return err
+}
+
+func (c *Socks5UdpConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *Socks5UdpConn) SetDeadline(t time.Time) error {
+	return c.conn.SetDeadline(t)
+}
+
+func (c *Socks5UdpConn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c *Socks5UdpConn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
@@ -1,16 +1,30 @@
 package network
 
 import (
+	"bytes"
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"strconv"
+	"sync"
+	"syscall"
+	"time"
 )
 
 /*
-socks5_server 封装了 SOCKS5 协议的握手和请求处理
+socks5_server 封装了 SOCKS5 协议的握手和请求处理，以及完整的 Socks5Server。
+
+Socks5Server 可以在任意协议 Listen 返回的 Conn 上接受连接，支持用户名密码认证和 CONNECT、BIND、UDP ASSOCIATE 三种命令：
+  - CONNECT 通过 Dialer 连接目标，默认 tcp 直连，可以替换成经过 RUDP、KCP 等协议转发，之后用 Relay 双向转发。
+  - BIND 在 BindIp 上监听一个 tcp 端口，第一个回复带上监听地址，目标连入后第二个回复带上目标地址，之后双向转发。
+  - UDP ASSOCIATE 在 BindIp 上监听一个 udp 端口接收客户端的包，解开 SOCKS5 UDP 头后直接发给目标，目标的回包加上头发回客户端，
+    控制连接关闭后结束，不支持分片。
+
+BIND 和 UDP ASSOCIATE 不经过 Dialer，总是直接使用本机网络。
 */
 
 var (
@@ -20,10 +34,13 @@ var (
 	errAuthExtraData = errors.New("socks authentication get extra data")
 	errReqExtraData  = errors.New("socks request get extra data")
 	errCmd           = errors.New("socks command not supported")
+	errAuth          = errors.New("socks authentication failed")
 )
 
 const (
 	socksCmdConnect = 1
+	socksCmdBind    = 2
+	socksCmdUdp     = 3
 	NoAuth          = uint8(0)
 	userAuthVersion = uint8(1)
 	UserPassAuth    = uint8(2)
@@ -31,6 +48,8 @@ const (
 	authFailure     = uint8(1)
 )
 
+// Sock5HandshakeBy 完成服务端的 SOCKS5 握手，username 和 password 都为空时不认证。
+// 认证失败时先回复客户端失败，再返回 errAuth，调用方需要关闭连接，不能继续处理请求。
 func Sock5HandshakeBy(conn io.ReadWriter, username string, password string) (err error) {
 	const (
 		idVer     = 0
@@ -103,7 +122,7 @@ func Sock5HandshakeBy(conn io.ReadWriter, username string, password string) (err
 		}
 
 		// Verify the password
-		if username == string(user) && password == string(pass) {
+		if authEqual(string(user), string(pass), username, password) {
 			if _, err := conn.Write([]byte{userAuthVersion, authSuccess}); err != nil {
 				return err
 			}
@@ -111,6 +130,7 @@ func Sock5HandshakeBy(conn io.ReadWriter, username string, password string) (err
 			if _, err := conn.Write([]byte{userAuthVersion, authFailure}); err != nil {
 				return err
 			}
+			return errAuth
 		}
 	}
 	return
@@ -189,3 +209,431 @@ func Sock5GetRequest(conn io.ReadWriter) (rawaddr []byte, host string, err error
 
 	return
 }
+
+// SOCKS5 回复码
+const (
+	socks5RepSuccess          = 0
+	socks5RepFailure          = 1
+	socks5RepNotAllowed       = 2
+	socks5RepNetUnreachable   = 3
+	socks5RepHostUnreachable  = 4
+	socks5RepRefused          = 5
+	socks5RepTTLExpired       = 6
+	socks5RepCmdNotSupported  = 7
+	socks5RepAddrNotSupported = 8
+)
+
+// readSocks5Addr 读取 atyp 之后的地址和端口，返回 host:port。
+func readSocks5Addr(r io.Reader, atyp byte) (string, error) {
+	if atyp != Socks5AtypIP4 && atyp != Socks5AtypIP6 && atyp != Socks5AtypDomain {
+		return "", errAddrType
+	}
+	host, err := readSocksHost(r, atyp)
+	if err != nil {
+		return "", err
+	}
+	port, err := readSocksPort(r)
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(port))), nil
+}
+
+// appendSocks5Addr 把 host:port 编码为 atyp | 地址 | 端口 追加到 buf。
+func appendSocks5Addr(buf []byte, addr string) ([]byte, error) {
+	host, portstr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portstr)
+	if err != nil || port < 0 || port > 65535 {
+		return nil, errors.New("socks invalid port " + portstr)
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			buf = append(buf, Socks5AtypIP4)
+			buf = append(buf, ip4...)
+		} else {
+			buf = append(buf, Socks5AtypIP6)
+			buf = append(buf, ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return nil, errors.New("socks host too long " + host)
+		}
+		buf = append(buf, Socks5AtypDomain, byte(len(host)))
+		buf = append(buf, host...)
+	}
+	return append(buf, byte(port>>8), byte(port)), nil
+}
+
+// readSocks5Request 读取完整的请求，不会多读后面的数据。
+func readSocks5Request(r io.Reader) (cmd byte, addr string, err error) {
+	var buf [4]byte
+	if _, err = io.ReadFull(r, buf[:]); err != nil {
+		return
+	}
+	if buf[0] != socksVer5 {
+		err = errVer
+		return
+	}
+	cmd = buf[1]
+	addr, err = readSocks5Addr(r, buf[3])
+	return
+}
+
+func writeSocks5Reply(w io.Writer, rep byte, addr net.Addr) error {
+	buf := []byte{socksVer5, rep, 0}
+	var err error
+	if addr != nil {
+		buf, err = appendSocks5Addr(buf, addr.String())
+	}
+	if addr == nil || err != nil {
+		buf = append(buf[:3], Socks5AtypIP4, 0, 0, 0, 0, 0, 0)
+	}
+	_, err = w.Write(buf)
+	return err
+}
+
+// socks5ReplyCode 把连接目标的错误转换为回复码。
+func socks5ReplyCode(err error) byte {
+	var dnserr *net.DNSError
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return socks5RepRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return socks5RepNetUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.As(err, &dnserr):
+		return socks5RepHostUnreachable
+	case errors.Is(err, context.DeadlineExceeded):
+		return socks5RepTTLExpired
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return socks5RepTTLExpired
+	}
+	return socks5RepFailure
+}
+
+type Socks5ServerConfig struct {
+	// 用户名和密码都为空时不需要认证
+	Username string
+	Password string
+	// 握手和读取请求的超时，0 表示不超时
+	HandshakeTimeoutMs int
+	// 连接目标的超时，0 表示不超时
+	DialTimeoutMs int
+	// BIND 等待目标连入的超时，0 表示不超时
+	BindTimeoutMs int
+	// BIND 和 UDP ASSOCIATE 监听的 ip，为空时使用客户端连入的本地 ip
+	BindIp string
+	// 禁用 BIND 和 UDP ASSOCIATE，禁用后回复 command not supported
+	DisableBind bool
+	DisableUdp  bool
+	// CONNECT 连接目标使用的函数，为 nil 时使用 tcp 直连
+	Dialer func(ctx context.Context, addr string) (Conn, error)
+}
+
+func DefaultSocks5ServerConfig() *Socks5ServerConfig {
+	return &Socks5ServerConfig{
+		HandshakeTimeoutMs: 10000,
+		DialTimeoutMs:      10000,
+		BindTimeoutMs:      60000,
+	}
+}
+
+func checkSocks5ServerConfig(config *Socks5ServerConfig) error {
+	if config.HandshakeTimeoutMs < 0 || config.DialTimeoutMs < 0 || config.BindTimeoutMs < 0 {
+		return errors.New("invalid socks5 timeout")
+	}
+	if config.BindIp != "" && net.ParseIP(config.BindIp) == nil {
+		return errors.New("invalid socks5 bind ip " + config.BindIp)
+	}
+	return nil
+}
+
+type Socks5Server struct {
+	config *Socks5ServerConfig
+}
+
+// NewSocks5Server 创建 Socks5Server，config 为 nil 时使用默认配置。
+func NewSocks5Server(config *Socks5ServerConfig) (*Socks5Server, error) {
+	if config == nil {
+		config = DefaultSocks5ServerConfig()
+	}
+	if err := checkSocks5ServerConfig(config); err != nil {
+		return nil, err
+	}
+	return &Socks5Server{config: config}, nil
+}
+
+// Serve 从 listener 接受连接并处理，直到 Accept 出错，listener 可以是任意协议 Listen 返回的 Conn。
+func (s *Socks5Server) Serve(listener Conn) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go s.ServeConn(conn)
+	}
+}
+
+// ServeConn 处理一个客户端连接，返回时连接已经关闭。
+func (s *Socks5Server) ServeConn(conn Conn) error {
+	defer conn.Close()
+
+	if s.config.HandshakeTimeoutMs > 0 {
+		conn.SetDeadline(time.Now().Add(time.Millisecond * time.Duration(s.config.HandshakeTimeoutMs)))
+	}
+	if err := Sock5HandshakeBy(conn, s.config.Username, s.config.Password); err != nil {
+		return err
+	}
+	cmd, addr, err := readSocks5Request(conn)
+	if err != nil {
+		if err == errAddrType {
+			writeSocks5Reply(conn, socks5RepAddrNotSupported, nil)
+		}
+		return err
+	}
+	conn.SetDeadline(time.Time{})
+
+	switch {
+	case cmd == socksCmdConnect:
+		return s.handleConnect(conn, addr)
+	case cmd == socksCmdBind && !s.config.DisableBind:
+		return s.handleBind(conn, addr)
+	case cmd == socksCmdUdp && !s.config.DisableUdp:
+		return s.handleUdp(conn, addr)
+	}
+	writeSocks5Reply(conn, socks5RepCmdNotSupported, nil)
+	return errCmd
+}
+
+func (s *Socks5Server) dial(addr string) (Conn, error) {
+	ctx := context.Background()
+	if s.config.DialTimeoutMs > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Millisecond*time.Duration(s.config.DialTimeoutMs))
+		defer cancel()
+	}
+	return dialProxyConn(ctx, s.config.Dialer, addr)
+}
+
+// bindIp 返回 BIND 和 UDP ASSOCIATE 监听的 ip，拿不到时返回空表示监听所有地址。
+func (s *Socks5Server) bindIp(conn Conn) string {
+	if s.config.BindIp != "" {
+		return s.config.BindIp
+	}
+	if ip := socks5AddrIp(conn.LocalAddr()); ip != nil {
+		return ip.String()
+	}
+	return ""
+}
+
+func socks5AddrIp(addr net.Addr) net.IP {
+	if addr == nil {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+func (s *Socks5Server) handleConnect(conn Conn, addr string) error {
+	out, err := s.dial(addr)
+	if err != nil {
+		//loggo.Debug("socks5 connect fail %s %s", addr, err)
+		writeSocks5Reply(conn, socks5ReplyCode(err), nil)
+		return err
+	}
+	if err := writeSocks5Reply(conn, socks5RepSuccess, out.LocalAddr()); err != nil {
+		out.Close()
+		return err
+	}
+	_, _, err = Relay(conn, out)
+	return err
+}
+
+func (s *Socks5Server) handleBind(conn Conn, addr string) error {
+	c, err := NewConn("tcp")
+	if err != nil {
+		writeSocks5Reply(conn, socks5RepFailure, nil)
+		return err
+	}
+	listener, err := c.Listen(net.JoinHostPort(s.bindIp(conn), "0"))
+	if err != nil {
+		writeSocks5Reply(conn, socks5RepFailure, nil)
+		return err
+	}
+	defer listener.Close()
+	if err := writeSocks5Reply(conn, socks5RepSuccess, listener.LocalAddr()); err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	if s.config.BindTimeoutMs > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Millisecond*time.Duration(s.config.BindTimeoutMs))
+		defer cancel()
+	}
+	peer, err := listener.AcceptContext(ctx)
+	listener.Close()
+	if err != nil {
+		writeSocks5Reply(conn, socks5ReplyCode(err), nil)
+		return err
+	}
+
+	// 请求中带了目标 ip 时，只接受这个 ip 连入
+	if ip := socks5AddrIp(&connAddr{addr: addr}); ip != nil && !ip.IsUnspecified() {
+		if pip := socks5AddrIp(peer.RemoteAddr()); pip == nil || !pip.Equal(ip) {
+			peer.Close()
+			writeSocks5Reply(conn, socks5RepNotAllowed, nil)
+			return errors.New("socks bind peer not allowed")
+		}
+	}
+
+	if err := writeSocks5Reply(conn, socks5RepSuccess, peer.RemoteAddr()); err != nil {
+		peer.Close()
+		return err
+	}
+	_, _, err = Relay(conn, peer)
+	return err
+}
+
+func (s *Socks5Server) handleUdp(conn Conn, addr string) error {
+	var ip net.IP
+	if bindip := s.bindIp(conn); bindip != "" {
+		ip = net.ParseIP(bindip)
+	}
+	lconn, err := net.ListenUDP("udp", &net.UDPAddr{IP: ip})
+	if err != nil {
+		writeSocks5Reply(conn, socks5RepFailure, nil)
+		return err
+	}
+	defer lconn.Close()
+	out, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		writeSocks5Reply(conn, socks5RepFailure, nil)
+		return err
+	}
+	defer out.Close()
+	if err := writeSocks5Reply(conn, socks5RepSuccess, lconn.LocalAddr()); err != nil {
+		return err
+	}
+
+	u := &socks5UdpAssociate{
+		lconn:    lconn,
+		out:      out,
+		expectip: socks5AddrIp(&connAddr{addr: addr}),
+		ctrlip:   socks5AddrIp(conn.RemoteAddr()),
+	}
+	if _, port, err := net.SplitHostPort(addr); err == nil {
+		u.expectport, _ = strconv.Atoi(port)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		u.loopClient()
+	}()
+	go func() {
+		defer wg.Done()
+		u.loopRemote()
+	}()
+
+	// 控制连接关闭后结束
+	io.Copy(ioutil.Discard, conn)
+	lconn.Close()
+	out.Close()
+	wg.Wait()
+	return nil
+}
+
+// socks5UdpAssociate 记录一个 UDP ASSOCIATE 的状态，lconn 收发客户端的包，out 收发目标的包。
+type socks5UdpAssociate struct {
+	lconn      *net.UDPConn
+	out        *net.UDPConn
+	expectip   net.IP
+	expectport int
+	ctrlip     net.IP
+
+	lock   sync.Mutex
+	client *net.UDPAddr
+}
+
+// acceptClient 判断包是否来自客户端，第一个符合请求的包确定客户端地址。
+func (u *socks5UdpAssociate) acceptClient(addr *net.UDPAddr) bool {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	if u.client != nil {
+		return u.client.IP.Equal(addr.IP) && u.client.Port == addr.Port
+	}
+	if u.expectport != 0 && u.expectport != addr.Port {
+		return false
+	}
+	if u.expectip != nil && !u.expectip.IsUnspecified() {
+		if !u.expectip.Equal(addr.IP) {
+			return false
+		}
+	} else if u.ctrlip != nil && !u.ctrlip.Equal(addr.IP) {
+		return false
+	}
+	u.client = addr
+	return true
+}
+
+func (u *socks5UdpAssociate) clientAddr() *net.UDPAddr {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	return u.client
+}
+
+func (u *socks5UdpAssociate) loopClient() {
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := u.lconn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if !u.acceptClient(addr) {
+			continue
+		}
+		// RSV(2) | FRAG(1) | ATYP | DST.ADDR | DST.PORT | DATA
+		if n < 4 || buf[0] != 0 || buf[1] != 0 || buf[2] != 0 {
+			continue
+		}
+		r := bytes.NewReader(buf[4:n])
+		dst, err := readSocks5Addr(r, buf[3])
+		if err != nil {
+			continue
+		}
+		dstaddr, err := net.ResolveUDPAddr("udp", dst)
+		if err != nil {
+			//loggo.Debug("socks5 udp resolve fail %s %s", dst, err)
+			continue
+		}
+		u.out.WriteToUDP(buf[n-r.Len():n], dstaddr)
+	}
+}
+
+func (u *socks5UdpAssociate) loopRemote() {
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := u.out.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		client := u.clientAddr()
+		if client == nil {
+			continue
+		}
+		pkt, err := appendSocks5Addr([]byte{0, 0, 0}, addr.String())
+		if err != nil {
+			continue
+		}
+		pkt = append(pkt, buf[:n]...)
+		u.lconn.WriteToUDP(pkt, client)
+	}
+}
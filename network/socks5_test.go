@@ -1,10 +1,15 @@
 package network
 
 import (
+	"bytes"
+	"context"
 	"io"
 	"net"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestSock5HandshakeByNoAuth(t *testing.T) {
@@ -91,6 +96,78 @@ func TestSock5HandshakeByUserPassAuth(t *testing.T) {
 	}
 }
 
+func TestSock5HandshakeByWrongPass(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- Sock5HandshakeBy(server, "admin", "secret")
+	}()
+
+	client.Write([]byte{socksVer5, 1, socks5UserPassAuth})
+	resp := make([]byte, 2)
+	if _, err := io.ReadFull(client, resp); err != nil {
+		t.Fatal(err)
+	}
+	authMsg := []byte{userAuthVersion, 5}
+	authMsg = append(authMsg, "admin"...)
+	authMsg = append(authMsg, 5)
+	authMsg = append(authMsg, "wrong"...)
+	client.Write(authMsg)
+	if _, err := io.ReadFull(client, resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp[0] != userAuthVersion || resp[1] != authFailure {
+		t.Errorf("unexpected auth response: %v", resp)
+	}
+	if err := <-errCh; err != errAuth {
+		t.Fatalf("Sock5HandshakeBy returned %v, want errAuth", err)
+	}
+}
+
+func TestSock5HandshakeUserPass(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				Sock5HandshakeBy(conn, "admin", "secret")
+			}()
+		}
+	}()
+
+	dial := func() *net.TCPConn {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn.(*net.TCPConn)
+	}
+
+	conn := dial()
+	defer conn.Close()
+	if err := Sock5Handshake(conn, 1000, "admin", "secret"); err != nil {
+		t.Fatalf("handshake with right credentials failed: %v", err)
+	}
+
+	bad := dial()
+	defer bad.Close()
+	if err := Sock5Handshake(bad, 1000, "admin", "wrong"); err == nil {
+		t.Fatal("expected error for wrong password")
+	}
+}
+
 func TestSock5HandshakeByBadVersion(t *testing.T) {
 	server, client := net.Pipe()
 	defer server.Close()
@@ -283,3 +360,473 @@ func TestSock5GetRequestBadCmd(t *testing.T) {
 		t.Fatal("expected error for unsupported command")
 	}
 }
+
+func startTestSocks5Server(t *testing.T, config *Socks5ServerConfig) (string, func()) {
+	s, err := NewSocks5Server(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewConn("tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := c.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(listener)
+	return listener.LocalAddr().String(), func() {
+		listener.Close()
+	}
+}
+
+func startTestEchoServer(t *testing.T) (string, func()) {
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.AcceptTCP()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+				conn.CloseWrite()
+			}()
+		}
+	}()
+	return listener.Addr().String(), func() {
+		listener.Close()
+	}
+}
+
+func dialTestSocks5(t *testing.T, proxy string, username string, password string) *net.TCPConn {
+	conn, err := net.Dial("tcp", proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Sock5Handshake(conn.(*net.TCPConn), 1000, username, password); err != nil {
+		conn.Close()
+		t.Fatal(err)
+	}
+	return conn.(*net.TCPConn)
+}
+
+func testSocks5Connect(t *testing.T, proxy string, username string, password string, dst string) {
+	conn := dialTestSocks5(t, proxy, username, password)
+	defer conn.Close()
+
+	host, port, _ := net.SplitHostPort(dst)
+	p, _ := strconv.Atoi(port)
+	if err := Sock5SetRequest(conn, host, p, 1000); err != nil {
+		t.Fatal(err)
+	}
+
+	// 写完后半关闭，echo 服务读到 EOF 后回完数据再关闭
+	data := bytes.Repeat([]byte("socks5"), 10000)
+	go func() {
+		conn.Write(data)
+		conn.CloseWrite()
+	}()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	ret, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(ret, data) {
+		t.Fatalf("echo diff %d %d", len(ret), len(data))
+	}
+}
+
+func TestSocks5ServerConnect(t *testing.T) {
+	echo, closeEcho := startTestEchoServer(t)
+	defer closeEcho()
+	proxy, closeProxy := startTestSocks5Server(t, nil)
+	defer closeProxy()
+
+	testSocks5Connect(t, proxy, "", "", echo)
+}
+
+func TestSocks5ServerAuth(t *testing.T) {
+	echo, closeEcho := startTestEchoServer(t)
+	defer closeEcho()
+	config := DefaultSocks5ServerConfig()
+	config.Username = "user"
+	config.Password = "pass"
+	proxy, closeProxy := startTestSocks5Server(t, config)
+	defer closeProxy()
+
+	testSocks5Connect(t, proxy, "user", "pass", echo)
+
+	conn, err := net.Dial("tcp", proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := Sock5Handshake(conn.(*net.TCPConn), 1000, "user", "wrong"); err == nil {
+		t.Fatal("expected auth fail")
+	}
+}
+
+func TestSocks5ServerDialer(t *testing.T) {
+	echo, closeEcho := startTestEchoServer(t)
+	defer closeEcho()
+
+	// 所有请求都转到 echo 服务
+	var lock sync.Mutex
+	var dialed []string
+	config := DefaultSocks5ServerConfig()
+	config.Dialer = func(ctx context.Context, addr string) (Conn, error) {
+		lock.Lock()
+		dialed = append(dialed, addr)
+		lock.Unlock()
+		c, err := NewConn("tcp")
+		if err != nil {
+			return nil, err
+		}
+		return c.DialContext(ctx, echo)
+	}
+	proxy, closeProxy := startTestSocks5Server(t, config)
+	defer closeProxy()
+
+	testSocks5Connect(t, proxy, "", "", "example.com:80")
+	lock.Lock()
+	defer lock.Unlock()
+	if len(dialed) != 1 || dialed[0] != "example.com:80" {
+		t.Fatalf("dialed %v", dialed)
+	}
+}
+
+func TestSocks5ServerConnectRefused(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst := listener.Addr().(*net.TCPAddr)
+	listener.Close()
+
+	proxy, closeProxy := startTestSocks5Server(t, nil)
+	defer closeProxy()
+
+	conn := dialTestSocks5(t, proxy, "", "")
+	defer conn.Close()
+	err = Sock5SetRequest(conn, "127.0.0.1", dst.Port, 1000)
+	if err == nil || !strings.Contains(err.Error(), "connection refused") {
+		t.Fatalf("expected refused, got %v", err)
+	}
+}
+
+func writeTestSocks5Request(t *testing.T, conn net.Conn, cmd byte, addr string) {
+	buf, err := appendSocks5Addr([]byte{socksVer5, cmd, 0}, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readTestSocks5Reply(t *testing.T, conn net.Conn) (byte, string) {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var buf [4]byte
+	if _, err := io.ReadFull(conn, buf[:]); err != nil {
+		t.Fatal(err)
+	}
+	addr, err := readSocks5Addr(conn, buf[3])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf[1], addr
+}
+
+func TestSocks5ServerCmdNotSupported(t *testing.T) {
+	config := DefaultSocks5ServerConfig()
+	config.DisableBind = true
+	proxy, closeProxy := startTestSocks5Server(t, config)
+	defer closeProxy()
+
+	conn := dialTestSocks5(t, proxy, "", "")
+	defer conn.Close()
+	writeTestSocks5Request(t, conn, socksCmdBind, "127.0.0.1:0")
+	if rep, _ := readTestSocks5Reply(t, conn); rep != socks5RepCmdNotSupported {
+		t.Fatalf("rep %d", rep)
+	}
+}
+
+func TestSocks5ServerBind(t *testing.T) {
+	proxy, closeProxy := startTestSocks5Server(t, nil)
+	defer closeProxy()
+
+	conn := dialTestSocks5(t, proxy, "", "")
+	defer conn.Close()
+	writeTestSocks5Request(t, conn, socksCmdBind, "127.0.0.1:0")
+	rep, bindaddr := readTestSocks5Reply(t, conn)
+	if rep != socks5RepSuccess {
+		t.Fatalf("rep %d", rep)
+	}
+
+	peer, err := net.Dial("tcp", bindaddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	rep, peeraddr := readTestSocks5Reply(t, conn)
+	if rep != socks5RepSuccess || peeraddr != peer.LocalAddr().String() {
+		t.Fatalf("rep %d %s %s", rep, peeraddr, peer.LocalAddr())
+	}
+
+	peer.Write([]byte("from peer"))
+	buf := make([]byte, 9)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "from peer" {
+		t.Fatalf("read %q %v", buf, err)
+	}
+	conn.Write([]byte("to peer"))
+	peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf = make([]byte, 7)
+	if _, err := io.ReadFull(peer, buf); err != nil || string(buf) != "to peer" {
+		t.Fatalf("read %q %v", buf, err)
+	}
+}
+
+func TestSocks5ServerUdp(t *testing.T) {
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := echo.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteToUDP(buf[:n], addr)
+		}
+	}()
+
+	proxy, closeProxy := startTestSocks5Server(t, nil)
+	defer closeProxy()
+
+	conn := dialTestSocks5(t, proxy, "", "")
+	defer conn.Close()
+
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	writeTestSocks5Request(t, conn, socksCmdUdp, client.LocalAddr().String())
+	rep, relayaddr := readTestSocks5Reply(t, conn)
+	if rep != socks5RepSuccess {
+		t.Fatalf("rep %d", rep)
+	}
+	relay, err := net.ResolveUDPAddr("udp", relayaddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 10; i++ {
+		pkt, _ := appendSocks5Addr([]byte{0, 0, 0}, echo.LocalAddr().String())
+		pkt = append(pkt, []byte("udp "+strconv.Itoa(i))...)
+		if _, err := client.WriteToUDP(pkt, relay); err != nil {
+			t.Fatal(err)
+		}
+
+		client.SetReadDeadline(time.Now().Add(5 * time.Second))
+		buf := make([]byte, 2048)
+		n, _, err := client.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := bytes.NewReader(buf[4:n])
+		from, err := readSocks5Addr(r, buf[3])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if from != echo.LocalAddr().String() || string(buf[n-r.Len():n]) != "udp "+strconv.Itoa(i) {
+			t.Fatalf("recv %s %q", from, buf[n-r.Len():n])
+		}
+	}
+}
+
+func testSocks5DialerEcho(t *testing.T, d *Socks5Dialer, dst string) {
+	conn, err := d.Dial(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if conn.(*Socks5Conn).BoundAddr() == "" {
+		t.Fatal("no bound addr")
+	}
+
+	data := bytes.Repeat([]byte("chain"), 10000)
+	go conn.Write(data)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	ret := make([]byte, len(data))
+	if _, err := io.ReadFull(conn, ret); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(ret, data) {
+		t.Fatal("echo diff")
+	}
+}
+
+func TestSocks5DialerChain(t *testing.T) {
+	echo, closeEcho := startTestEchoServer(t)
+	defer closeEcho()
+	config := DefaultSocks5ServerConfig()
+	config.Username = "user"
+	config.Password = "pass"
+	proxy1, closeProxy1 := startTestSocks5Server(t, config)
+	defer closeProxy1()
+	proxy2, closeProxy2 := startTestSocks5Server(t, nil)
+	defer closeProxy2()
+
+	dconfig := DefaultSocks5DialerConfig()
+	dconfig.Hops = []Socks5Hop{{Addr: proxy1, Username: "user", Password: "pass"}, {Addr: proxy2}}
+	d, err := NewSocks5Dialer(dconfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testSocks5DialerEcho(t, d, echo)
+
+	dconfig.Hops[0].Password = "wrong"
+	if _, err := d.Dial(echo); err == nil || !strings.Contains(err.Error(), proxy1) {
+		t.Fatalf("expected auth fail, got %v", err)
+	}
+
+	if _, err := NewSocks5Dialer(DefaultSocks5DialerConfig()); err == nil {
+		t.Fatal("expected no proxy fail")
+	}
+}
+
+func TestSocks5DialerRefused(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst := listener.Addr().String()
+	listener.Close()
+
+	proxy1, closeProxy1 := startTestSocks5Server(t, nil)
+	defer closeProxy1()
+	proxy2, closeProxy2 := startTestSocks5Server(t, nil)
+	defer closeProxy2()
+
+	dconfig := DefaultSocks5DialerConfig()
+	dconfig.Hops = []Socks5Hop{{Addr: proxy1}, {Addr: proxy2}}
+	d, err := NewSocks5Dialer(dconfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = d.Dial(dst)
+	if err == nil || !strings.Contains(err.Error(), "connection refused") || !strings.Contains(err.Error(), proxy2) {
+		t.Fatalf("expected refused, got %v", err)
+	}
+}
+
+func TestSocks5DialerRudp(t *testing.T) {
+	echo, closeEcho := startTestEchoServer(t)
+	defer closeEcho()
+
+	s, err := NewSocks5Server(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewConn("rudp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := c.Listen("127.0.0.1:58112")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go s.Serve(listener)
+
+	dconfig := DefaultSocks5DialerConfig()
+	dconfig.Hops = []Socks5Hop{{Addr: "127.0.0.1:58112"}}
+	dconfig.Dialer = func(ctx context.Context, addr string) (Conn, error) {
+		c, err := NewConn("rudp")
+		if err != nil {
+			return nil, err
+		}
+		return c.DialContext(ctx, addr)
+	}
+	d, err := NewSocks5Dialer(dconfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testSocks5DialerEcho(t, d, echo)
+}
+
+func testSocks5DialerUdp(t *testing.T, hops int) {
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := echo.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteToUDP(buf[:n], addr)
+		}
+	}()
+
+	dconfig := DefaultSocks5DialerConfig()
+	for i := 0; i < hops; i++ {
+		proxy, closeProxy := startTestSocks5Server(t, nil)
+		defer closeProxy()
+		dconfig.Hops = append(dconfig.Hops, Socks5Hop{Addr: proxy})
+	}
+	d, err := NewSocks5Dialer(dconfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := d.DialUdp(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	var pc net.PacketConn = conn
+
+	for i := 0; i < 10; i++ {
+		data := []byte("udp " + strconv.Itoa(i))
+		if _, err := pc.WriteTo(data, echo.LocalAddr()); err != nil {
+			t.Fatal(err)
+		}
+		pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+		buf := make([]byte, 2048)
+		n, from, err := pc.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if from.String() != echo.LocalAddr().String() || string(buf[:n]) != string(data) {
+			t.Fatalf("recv %s %q", from, buf[:n])
+		}
+	}
+
+	// 控制连接关闭后 UDP ASSOCIATE 结束
+	conn.ctrl.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err := conn.ReadFrom(make([]byte, 10)); err == nil {
+		t.Fatal("expected closed")
+	}
+}
+
+func TestSocks5DialerUdp(t *testing.T) {
+	testSocks5DialerUdp(t, 1)
+}
+
+func TestSocks5DialerUdpChain(t *testing.T) {
+	testSocks5DialerUdp(t, 2)
+}
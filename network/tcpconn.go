@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"net"
+	"time"
 )
 
 /*
@@ -17,6 +18,15 @@ type TcpConn struct {
 	info     string
 }
 
+func init() {
+	mustRegisterProto("tcp", func(config interface{}) (Conn, error) {
+		if config != nil {
+			return nil, errProtoConfig("tcp", config)
+		}
+		return &TcpConn{}, nil
+	}, true)
+}
+
 func (c *TcpConn) Name() string {
 	return "tcp"
 }
@@ -47,6 +57,14 @@ func (c *TcpConn) Close() error {
 	return nil
 }
 
+// CloseWrite 关闭写方向，对端读到 EOF 后仍然可以继续发送数据，listener 不支持。
+func (c *TcpConn) CloseWrite() error {
+	if c.conn != nil {
+		return c.conn.CloseWrite()
+	}
+	return errors.New("empty conn")
+}
+
 func (c *TcpConn) Info() string {
 	if c.info != "" {
 		return c.info
@@ -61,12 +79,59 @@ func (c *TcpConn) Info() string {
 	return c.info
 }
 
+func (c *TcpConn) LocalAddr() net.Addr {
+	if c.conn != nil {
+		return c.conn.LocalAddr()
+	} else if c.listener != nil {
+		return c.listener.Addr()
+	}
+	return nil
+}
+
+func (c *TcpConn) RemoteAddr() net.Addr {
+	if c.conn != nil {
+		return c.conn.RemoteAddr()
+	}
+	return nil
+}
+
+func (c *TcpConn) SetDeadline(t time.Time) error {
+	if c.conn != nil {
+		return c.conn.SetDeadline(t)
+	} else if c.listener != nil {
+		return errListenerDeadline
+	}
+	return errors.New("empty conn")
+}
+
+func (c *TcpConn) SetReadDeadline(t time.Time) error {
+	if c.conn != nil {
+		return c.conn.SetReadDeadline(t)
+	} else if c.listener != nil {
+		return errListenerDeadline
+	}
+	return errors.New("empty conn")
+}
+
+func (c *TcpConn) SetWriteDeadline(t time.Time) error {
+	if c.conn != nil {
+		return c.conn.SetWriteDeadline(t)
+	} else if c.listener != nil {
+		return errListenerDeadline
+	}
+	return errors.New("empty conn")
+}
+
 func (c *TcpConn) Dial(dst string) (Conn, error) {
+	return c.DialContext(context.Background(), dst)
+}
+
+func (c *TcpConn) DialContext(ctx context.Context, dst string) (Conn, error) {
 	addr, err := net.ResolveTCPAddr("tcp", dst)
 	if err != nil {
 		return nil, err
 	}
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx, cancel := context.WithCancel(ctx)
 	c.cancel = cancel
 	var d net.Dialer
 	if gControlOnConnSetup != nil {
@@ -93,7 +158,25 @@ func (c *TcpConn) Listen(dst string) (Conn, error) {
 }
 
 func (c *TcpConn) Accept() (Conn, error) {
+	return c.AcceptContext(context.Background())
+}
+
+func (c *TcpConn) AcceptContext(ctx context.Context) (Conn, error) {
+	if c.listener == nil {
+		return nil, errors.New("not listen")
+	}
+	stop := watchContext(ctx, func() {
+		c.listener.SetDeadline(aLongTimeAgo)
+	})
 	conn, err := c.listener.Accept()
+	stop()
+	if ctx.Err() != nil {
+		c.listener.SetDeadline(time.Time{})
+		if conn != nil {
+			conn.Close()
+		}
+		return nil, ctx.Err()
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -1,8 +1,10 @@
 package network
 
 import (
+	"context"
 	"fmt"
 	"github.com/esrrhs/gohome/loggo"
+	"net"
 	"strconv"
 	"testing"
 	"time"
@@ -398,3 +400,78 @@ func Test0008TCP(t *testing.T) {
 
 	time.Sleep(time.Second)
 }
+
+func TestTCPReadDeadline(t *testing.T) {
+	c, err := NewConn("tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cc, err := c.Listen(":58087")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+
+	go func() {
+		conn, err := cc.Accept()
+		if err == nil {
+			time.Sleep(time.Second * 2)
+			conn.Close()
+		}
+	}()
+
+	ccc, err := c.Dial("127.0.0.1:58087")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ccc.Close()
+
+	ccc.SetReadDeadline(time.Now().Add(time.Millisecond * 200))
+	begin := time.Now()
+	buf := make([]byte, 100)
+	_, err = ccc.Read(buf)
+	if err == nil {
+		t.Fatal("Read should timeout")
+	}
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatalf("Read returned %v, want timeout", err)
+	}
+	if time.Since(begin) > time.Second {
+		t.Fatalf("Read timeout too late %v", time.Since(begin))
+	}
+}
+
+func TestTCPAcceptContext(t *testing.T) {
+	c, err := NewConn("tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cc, err := c.Listen(":58087")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*200)
+	defer cancel()
+	_, err = cc.AcceptContext(ctx)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("AcceptContext returned %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	go func() {
+		conn, err := c.Dial("127.0.0.1:58087")
+		if err == nil {
+			time.Sleep(time.Second)
+			conn.Close()
+		}
+	}()
+
+	conn, err := cc.AcceptContext(context.Background())
+	if err != nil {
+		t.Fatalf("AcceptContext after cancel returned %v", err)
+	}
+	conn.Close()
+}
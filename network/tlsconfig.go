@@ -0,0 +1,218 @@
+package network
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/esrrhs/gohome/common"
+)
+
+/*
+TlsConfig 是 tls、quic、wss 等协议共用的证书配置。
+
+证书、CA 都可以用文件路径或者 PEM 内容配置，两者都配置时以 PEM 内容为准。
+服务端没有配置证书时使用自签名证书；客户端默认用系统根证书校验服务端，可以配置 CA 或者证书指纹。
+*/
+
+type TlsConfig struct {
+	// 本端证书，服务端为空时使用自签名证书，客户端配置后用于双向认证
+	CertFile string
+	KeyFile  string
+	CertPEM  []byte
+	KeyPEM   []byte
+
+	// 客户端用来校验服务端证书的 CA，为空使用系统根证书
+	CAFile string
+	CAPEM  []byte
+
+	// 服务端用来校验客户端证书的 CA，配置后要求客户端必须提供证书
+	ClientCAFile string
+	ClientCAPEM  []byte
+
+	// SNI，客户端为空时使用拨号地址的 host
+	ServerName string
+	// ALPN
+	NextProtos []string
+	// 服务端证书公钥（SubjectPublicKeyInfo）的 sha256，hex 编码，匹配任意一个即可。
+	// 只配置指纹没有配置 CA 时不再校验证书链，只匹配服务端自己的证书，适合自签名证书；
+	// 配置了 CA 时匹配校验通过的证书链上的任意证书，可以用来固定中间 CA
+	PinSHA256 []string
+
+	InsecureSkipVerify bool
+}
+
+// CertPinSHA256 计算证书公钥的 sha256 指纹，用于 TlsConfig.PinSHA256。
+func CertPinSHA256(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return hex.EncodeToString(sum[:])
+}
+
+func loadPEM(data []byte, file string) ([]byte, error) {
+	if len(data) > 0 {
+		return data, nil
+	}
+	if file != "" {
+		return os.ReadFile(file)
+	}
+	return nil, nil
+}
+
+func loadCertPool(data []byte, file string) (*x509.CertPool, error) {
+	data, err := loadPEM(data, file)
+	if err != nil || data == nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, errors.New("no valid ca cert found")
+	}
+	return pool, nil
+}
+
+func (c *TlsConfig) loadCert() ([]tls.Certificate, error) {
+	certPEM, err := loadPEM(c.CertPEM, c.CertFile)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := loadPEM(c.KeyPEM, c.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	if certPEM == nil && keyPEM == nil {
+		return nil, nil
+	}
+	if certPEM == nil || keyPEM == nil {
+		return nil, errors.New("cert and key must be set together")
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	return []tls.Certificate{cert}, nil
+}
+
+func (c *TlsConfig) pins() (map[string]bool, error) {
+	if len(c.PinSHA256) <= 0 {
+		return nil, nil
+	}
+	pins := make(map[string]bool)
+	for _, pin := range c.PinSHA256 {
+		pin = strings.ToLower(strings.ReplaceAll(pin, ":", ""))
+		b, err := hex.DecodeString(pin)
+		if err != nil || len(b) != sha256.Size {
+			return nil, errors.New("invalid pin " + pin)
+		}
+		pins[pin] = true
+	}
+	return pins, nil
+}
+
+// ClientConfig 生成拨号端使用的 tls.Config。
+func (c *TlsConfig) ClientConfig() (*tls.Config, error) {
+	certs, err := c.loadCert()
+	if err != nil {
+		return nil, err
+	}
+	roots, err := loadCertPool(c.CAPEM, c.CAFile)
+	if err != nil {
+		return nil, err
+	}
+	pins, err := c.pins()
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		Certificates:       certs,
+		RootCAs:            roots,
+		ServerName:         c.ServerName,
+		NextProtos:         c.NextProtos,
+		InsecureSkipVerify: c.InsecureSkipVerify,
+	}
+
+	if pins != nil {
+		if roots == nil {
+			// 只信任指纹，证书链交给 VerifyPeerCertificate
+			config.InsecureSkipVerify = true
+		}
+		skipverify := config.InsecureSkipVerify
+		config.VerifyPeerCertificate = func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+			// 没有校验证书链时 rawCerts 中除了第一个都可以伪造，只能匹配服务端自己的证书
+			if skipverify {
+				if len(rawCerts) <= 0 {
+					return errors.New("no peer cert")
+				}
+				cert, err := x509.ParseCertificate(rawCerts[0])
+				if err != nil {
+					return err
+				}
+				if pins[CertPinSHA256(cert)] {
+					return nil
+				}
+				return errors.New("no cert match pin")
+			}
+			// 校验过证书链时只匹配链上的证书
+			for _, chain := range verifiedChains {
+				for _, cert := range chain {
+					if pins[CertPinSHA256(cert)] {
+						return nil
+					}
+				}
+			}
+			return errors.New("no cert match pin")
+		}
+	}
+
+	return config, nil
+}
+
+// ServerConfig 生成监听端使用的 tls.Config，没有配置证书时生成自签名证书。
+func (c *TlsConfig) ServerConfig() (*tls.Config, error) {
+	certs, err := c.loadCert()
+	if err != nil {
+		return nil, err
+	}
+	if certs == nil {
+		self, err := common.GenerateTLSConfig("")
+		if err != nil {
+			return nil, err
+		}
+		certs = self.Certificates
+	}
+	clientcas, err := loadCertPool(c.ClientCAPEM, c.ClientCAFile)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		Certificates: certs,
+		NextProtos:   c.NextProtos,
+	}
+	if clientcas != nil {
+		config.ClientCAs = clientcas
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// clientConfigFor 填充默认的 SNI。
+func (c *TlsConfig) clientConfigFor(dst string) (*tls.Config, error) {
+	config, err := c.ClientConfig()
+	if err != nil {
+		return nil, err
+	}
+	if config.ServerName == "" {
+		host := dst
+		if h, _, err := net.SplitHostPort(dst); err == nil {
+			host = h
+		}
+		config.ServerName = host
+	}
+	return config, nil
+}
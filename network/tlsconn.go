@@ -0,0 +1,232 @@
+package network
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"time"
+)
+
+/*
+TlsConn 实现了基于 tls over tcp 的Conn，证书相关配置见 TlsConfig。
+*/
+
+type TlsConn struct {
+	config      *TlsConfig
+	conn        *tls.Conn
+	tcplistener *net.TCPListener
+	listener    net.Listener
+	cancel      context.CancelFunc
+	info        string
+}
+
+func init() {
+	mustRegisterProto("tls", func(config interface{}) (Conn, error) {
+		c := &TlsConn{}
+		if config != nil {
+			cfg, ok := config.(*TlsConfig)
+			if !ok {
+				return nil, errProtoConfig("tls", config)
+			}
+			c.SetConfig(cfg)
+		}
+		return c, nil
+	}, true)
+}
+
+func (c *TlsConn) Name() string {
+	return "tls"
+}
+
+func (c *TlsConn) Read(p []byte) (n int, err error) {
+	if c.conn != nil {
+		return c.conn.Read(p)
+	}
+	return 0, errors.New("empty conn")
+}
+
+func (c *TlsConn) Write(p []byte) (n int, err error) {
+	if c.conn != nil {
+		return c.conn.Write(p)
+	}
+	return 0, errors.New("empty conn")
+}
+
+func (c *TlsConn) Close() error {
+	if c.cancel != nil {
+		c.cancel()
+	}
+	if c.conn != nil {
+		return c.conn.Close()
+	} else if c.listener != nil {
+		return c.listener.Close()
+	}
+	return nil
+}
+
+func (c *TlsConn) Info() string {
+	if c.info != "" {
+		return c.info
+	}
+	if c.conn != nil {
+		c.info = c.conn.LocalAddr().String() + "<--tls-->" + c.conn.RemoteAddr().String()
+	} else if c.listener != nil {
+		c.info = "tls--" + c.listener.Addr().String()
+	} else {
+		c.info = "empty tls conn"
+	}
+	return c.info
+}
+
+func (c *TlsConn) LocalAddr() net.Addr {
+	if c.conn != nil {
+		return c.conn.LocalAddr()
+	} else if c.listener != nil {
+		return c.listener.Addr()
+	}
+	return nil
+}
+
+func (c *TlsConn) RemoteAddr() net.Addr {
+	if c.conn != nil {
+		return c.conn.RemoteAddr()
+	}
+	return nil
+}
+
+func (c *TlsConn) SetDeadline(t time.Time) error {
+	if c.conn != nil {
+		return c.conn.SetDeadline(t)
+	} else if c.listener != nil {
+		return errListenerDeadline
+	}
+	return errors.New("empty conn")
+}
+
+func (c *TlsConn) SetReadDeadline(t time.Time) error {
+	if c.conn != nil {
+		return c.conn.SetReadDeadline(t)
+	} else if c.listener != nil {
+		return errListenerDeadline
+	}
+	return errors.New("empty conn")
+}
+
+func (c *TlsConn) SetWriteDeadline(t time.Time) error {
+	if c.conn != nil {
+		return c.conn.SetWriteDeadline(t)
+	} else if c.listener != nil {
+		return errListenerDeadline
+	}
+	return errors.New("empty conn")
+}
+
+// ConnectionState 返回握手后的 tls 状态，包括协商的 ALPN 和对端证书。
+func (c *TlsConn) ConnectionState() tls.ConnectionState {
+	if c.conn != nil {
+		return c.conn.ConnectionState()
+	}
+	return tls.ConnectionState{}
+}
+
+func (c *TlsConn) Dial(dst string) (Conn, error) {
+	return c.DialContext(context.Background(), dst)
+}
+
+func (c *TlsConn) DialContext(ctx context.Context, dst string) (Conn, error) {
+	c.checkConfig()
+
+	config, err := c.config.clientConfigFor(dst)
+	if err != nil {
+		return nil, err
+	}
+
+	addr, err := net.ResolveTCPAddr("tcp", dst)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	c.cancel = cancel
+	defer func() {
+		c.cancel = nil
+		cancel()
+	}()
+
+	var d net.Dialer
+	if gControlOnConnSetup != nil {
+		d = net.Dialer{Control: gControlOnConnSetup}
+	}
+	conn, err := d.DialContext(ctx, "tcp", addr.String())
+	if err != nil {
+		return nil, err
+	}
+
+	tlsconn := tls.Client(conn, config)
+	if err := tlsconn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &TlsConn{config: c.config, conn: tlsconn}, nil
+}
+
+func (c *TlsConn) Listen(dst string) (Conn, error) {
+	c.checkConfig()
+
+	config, err := c.config.ServerConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	addr, err := net.ResolveTCPAddr("tcp", dst)
+	if err != nil {
+		return nil, err
+	}
+	listener, err := net.ListenTCP("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &TlsConn{config: c.config, tcplistener: listener, listener: tls.NewListener(listener, config)}, nil
+}
+
+func (c *TlsConn) Accept() (Conn, error) {
+	return c.AcceptContext(context.Background())
+}
+
+// AcceptContext 只接受tcp连接，握手在第一次读写时进行，避免慢握手阻塞其他连接。
+func (c *TlsConn) AcceptContext(ctx context.Context) (Conn, error) {
+	if c.listener == nil {
+		return nil, errors.New("not listen")
+	}
+	stop := watchContext(ctx, func() {
+		c.tcplistener.SetDeadline(aLongTimeAgo)
+	})
+	conn, err := c.listener.Accept()
+	stop()
+	if ctx.Err() != nil {
+		c.tcplistener.SetDeadline(time.Time{})
+		if conn != nil {
+			conn.Close()
+		}
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &TlsConn{config: c.config, conn: conn.(*tls.Conn)}, nil
+}
+
+func (c *TlsConn) checkConfig() {
+	if c.config == nil {
+		c.config = &TlsConfig{}
+	}
+}
+
+func (c *TlsConn) SetConfig(config *TlsConfig) {
+	c.config = config
+}
+
+func (c *TlsConn) GetConfig() *TlsConfig {
+	c.checkConfig()
+	return c.config
+}
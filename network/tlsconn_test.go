@@ -0,0 +1,245 @@
+package network
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+func newTestCert(t *testing.T, name string, parent *testCert, isca bool) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{name},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IsCA:         isca,
+
+		BasicConstraintsValid: true,
+	}
+	signer, signkey := template, key
+	if parent != nil {
+		signer, signkey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signkey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyder, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyder}),
+	}
+}
+
+func tlsEchoServer(cc Conn) {
+	go func() {
+		for {
+			conn, err := cc.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+}
+
+func tlsEcho(t *testing.T, dialer Conn, dst string) Conn {
+	ccc, err := dialer.Dial(dst)
+	if err != nil {
+		t.Fatalf("Dial fail %v", err)
+	}
+
+	ccc.SetDeadline(time.Now().Add(time.Second * 5))
+	if _, err := ccc.Write([]byte("hello")); err != nil {
+		t.Fatalf("Write fail %v", err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(ccc, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("ReadFull = %q, %v", buf, err)
+	}
+	return ccc
+}
+
+func TestTLSMutualAuth(t *testing.T) {
+	ca := newTestCert(t, "gohome ca", nil, true)
+	server := newTestCert(t, "server.gohome.test", ca, false)
+	client := newTestCert(t, "client.gohome.test", ca, false)
+
+	s, err := NewConnWithConfig("tls", &TlsConfig{
+		CertPEM:     server.certPEM,
+		KeyPEM:      server.keyPEM,
+		ClientCAPEM: ca.certPEM,
+		NextProtos:  []string{"gohome"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc, err := s.Listen("127.0.0.1:58095")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+	tlsEchoServer(cc)
+
+	c, _ := NewConnWithConfig("tls", &TlsConfig{
+		CertPEM:    client.certPEM,
+		KeyPEM:     client.keyPEM,
+		CAPEM:      ca.certPEM,
+		ServerName: "server.gohome.test",
+		NextProtos: []string{"gohome"},
+	})
+	ccc := tlsEcho(t, c, "127.0.0.1:58095")
+	state := ccc.(*TlsConn).ConnectionState()
+	if state.NegotiatedProtocol != "gohome" {
+		t.Errorf("NegotiatedProtocol = %q", state.NegotiatedProtocol)
+	}
+	ccc.Close()
+
+	// 没有客户端证书，服务端拒绝
+	c, _ = NewConnWithConfig("tls", &TlsConfig{CAPEM: ca.certPEM, ServerName: "server.gohome.test"})
+	ccc, err = c.Dial("127.0.0.1:58095")
+	if err == nil {
+		ccc.SetDeadline(time.Now().Add(time.Second * 5))
+		ccc.Write([]byte("hello"))
+		_, err = ccc.Read(make([]byte, 5))
+		ccc.Close()
+	}
+	if err == nil {
+		t.Fatal("dial without client cert should fail")
+	}
+
+	// 不信任的 CA
+	other := newTestCert(t, "other ca", nil, true)
+	c, _ = NewConnWithConfig("tls", &TlsConfig{CAPEM: other.certPEM, ServerName: "server.gohome.test"})
+	if ccc, err := c.Dial("127.0.0.1:58095"); err == nil {
+		ccc.Close()
+		t.Fatal("dial with untrusted ca should fail")
+	}
+}
+
+func TestTLSPin(t *testing.T) {
+	s, _ := NewConn("tls")
+	cc, err := s.Listen("127.0.0.1:58096")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+	tlsEchoServer(cc)
+
+	// 默认用系统根证书校验，自签名证书不通过
+	c, _ := NewConn("tls")
+	if ccc, err := c.Dial("127.0.0.1:58096"); err == nil {
+		ccc.Close()
+		t.Fatal("self-signed cert should not be trusted by default")
+	}
+
+	c, _ = NewConnWithConfig("tls", &TlsConfig{InsecureSkipVerify: true})
+	ccc := tlsEcho(t, c, "127.0.0.1:58096")
+	pin := CertPinSHA256(ccc.(*TlsConn).ConnectionState().PeerCertificates[0])
+	ccc.Close()
+
+	c, _ = NewConnWithConfig("tls", &TlsConfig{PinSHA256: []string{pin}})
+	tlsEcho(t, c, "127.0.0.1:58096").Close()
+
+	c, _ = NewConnWithConfig("tls", &TlsConfig{PinSHA256: []string{CertPinSHA256(newTestCert(t, "x", nil, false).cert)}})
+	if ccc, err := c.Dial("127.0.0.1:58096"); err == nil {
+		ccc.Close()
+		t.Fatal("dial with wrong pin should fail")
+	}
+}
+
+func TestTLSPinForgedChain(t *testing.T) {
+	ca := newTestCert(t, "gohome ca", nil, true)
+	real := newTestCert(t, "server.gohome.test", ca, false)
+	pin := CertPinSHA256(real.cert)
+
+	testForged := func(forged *testCert, client *TlsConfig) {
+		// 伪造的证书后面附上真正的服务端证书
+		s, err := NewConnWithConfig("tls", &TlsConfig{
+			CertPEM: append(append([]byte(nil), forged.certPEM...), real.certPEM...),
+			KeyPEM:  forged.keyPEM,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		cc, err := s.Listen("127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer cc.Close()
+		tlsEchoServer(cc)
+
+		c, _ := NewConnWithConfig("tls", client)
+		if ccc, err := c.Dial(cc.LocalAddr().String()); err == nil {
+			ccc.Close()
+			t.Fatal("dial with forged leaf should fail")
+		}
+	}
+
+	// 只有指纹，伪造自签名证书
+	testForged(newTestCert(t, "server.gohome.test", nil, false), &TlsConfig{PinSHA256: []string{pin}})
+	// 有 CA，伪造的证书也由 CA 签发，但不是固定的证书
+	testForged(newTestCert(t, "server.gohome.test", ca, false), &TlsConfig{
+		CAPEM:      ca.certPEM,
+		ServerName: "server.gohome.test",
+		PinSHA256:  []string{pin},
+	})
+}
+
+func TestQuicTlsConfig(t *testing.T) {
+	ca := newTestCert(t, "gohome ca", nil, true)
+	server := newTestCert(t, "server.gohome.test", ca, false)
+
+	s, err := NewConnWithConfig("quic", &TlsConfig{CertPEM: server.certPEM, KeyPEM: server.keyPEM})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc, err := s.Listen("127.0.0.1:58097")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+	tlsEchoServer(cc)
+
+	c, _ := NewConnWithConfig("quic", &TlsConfig{CAPEM: ca.certPEM, ServerName: "server.gohome.test"})
+	tlsEcho(t, c, "127.0.0.1:58097").Close()
+
+	c, _ = NewConnWithConfig("quic", &TlsConfig{ServerName: "server.gohome.test"})
+	if ccc, err := c.Dial("127.0.0.1:58097"); err == nil {
+		ccc.Close()
+		t.Fatal("quic dial without ca should fail")
+	}
+}
@@ -0,0 +1,262 @@
+package network
+
+import (
+	"net"
+	"runtime"
+
+	"golang.org/x/net/ipv4"
+)
+
+/*
+udpBatchReader 和 udpBatchWriter 为基于 udp 的 Conn 提供批量收发，减少每个包的系统调用。
+
+linux 上读使用 recvmmsg，写使用 sendmmsg，其他平台退化为每次读写一个包。
+
+内核支持时还会使用：
+  - GSO：发往同一个地址、大小相同的连续包合并成一个消息，由 UDP_SEGMENT 让内核或网卡切分，最后一个包可以更小。
+    发送失败时关闭 GSO 重新发送，之后不再使用。
+  - GRO：内核把同一个流的多个包合并后一次交上来，按控制消息中的 gso size 拆开。
+    每个消息的缓冲区需要 64KB，只在 listener 上开启。
+*/
+
+const (
+	udpGroBufferSize = 65535
+	udpGsoMaxSegs    = 64
+	udpGsoMaxSize    = 65000
+)
+
+type udpBatchReader struct {
+	conn  *net.UDPConn
+	pconn *ipv4.PacketConn
+	msgs  []ipv4.Message
+	buf   []byte
+	batch bool
+	gro   bool
+}
+
+// newUdpBatchReader 创建批量读取器，batch 为一次最多读取的包数，size 为单个包的最大长度，gro 为是否尝试开启 GRO。
+func newUdpBatchReader(conn *net.UDPConn, batch int, size int, gro bool) *udpBatchReader {
+	r := &udpBatchReader{conn: conn}
+	if runtime.GOOS != "linux" || batch <= 1 && !gro {
+		r.buf = make([]byte, size)
+		return r
+	}
+	if batch < 1 {
+		batch = 1
+	}
+	r.batch = true
+	r.gro = gro && enableUdpGro(conn)
+	if r.gro && size < udpGroBufferSize {
+		size = udpGroBufferSize
+	}
+	r.pconn = ipv4.NewPacketConn(conn)
+	r.msgs = make([]ipv4.Message, batch)
+	for i := range r.msgs {
+		r.msgs[i].Buffers = [][]byte{make([]byte, size)}
+		if r.gro {
+			r.msgs[i].OOB = make([]byte, udpGroOobSize())
+		}
+	}
+	return r
+}
+
+// Read 读取一批包，对每个包调用 fn，data 在 fn 返回后会被复用，addr 在已连接的 socket 上可能为空。
+func (r *udpBatchReader) Read(fn func(data []byte, addr *net.UDPAddr)) error {
+	if !r.batch {
+		n, addr, err := r.conn.ReadFromUDP(r.buf)
+		if err != nil {
+			return err
+		}
+		fn(r.buf[:n], addr)
+		return nil
+	}
+
+	n, err := r.pconn.ReadBatch(r.msgs, 0)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < n; i++ {
+		m := &r.msgs[i]
+		addr, _ := m.Addr.(*net.UDPAddr)
+		data := m.Buffers[0][:m.N]
+		seg := 0
+		if r.gro {
+			seg = parseUdpGroSize(m.OOB[:m.NN])
+		}
+		if seg <= 0 || seg >= len(data) {
+			fn(data, addr)
+			continue
+		}
+		for len(data) > 0 {
+			l := seg
+			if l > len(data) {
+				l = len(data)
+			}
+			fn(data[:l], addr)
+			data = data[l:]
+		}
+	}
+	return nil
+}
+
+type udpBatchPacket struct {
+	buf  *[]byte
+	addr *net.UDPAddr
+}
+
+type udpBatchWriter struct {
+	conn    *net.UDPConn
+	pconn   *ipv4.PacketConn
+	batch   int
+	gso     bool
+	pending []udpBatchPacket
+	msgs    []ipv4.Message
+	from    int // msgs 中第一个包在 pending 中的位置
+	iovs    [][]byte
+	oobs    [][]byte
+}
+
+// newUdpBatchWriter 创建批量发送器，攒够 batch 个包时自动发送，gso 为是否尝试使用 GSO。
+func newUdpBatchWriter(conn *net.UDPConn, batch int, gso bool) *udpBatchWriter {
+	if batch < 1 {
+		batch = 1
+	}
+	w := &udpBatchWriter{conn: conn, batch: batch}
+	if runtime.GOOS == "linux" {
+		w.pconn = ipv4.NewPacketConn(conn)
+		w.gso = gso && udpGsoSupported(conn)
+	}
+	w.pending = make([]udpBatchPacket, 0, batch)
+	w.msgs = make([]ipv4.Message, 0, batch)
+	w.iovs = make([][]byte, batch)
+	w.oobs = make([][]byte, batch)
+	for i := range w.oobs {
+		w.oobs[i] = make([]byte, 0, udpGsoOobSize())
+	}
+	return w
+}
+
+// Write 把 GetFrameBuffer 取得的缓冲区加入待发送队列，发送后放回池中，addr 为空时发往已连接的地址。
+func (w *udpBatchWriter) Write(buf *[]byte, addr *net.UDPAddr) error {
+	w.pending = append(w.pending, udpBatchPacket{buf: buf, addr: addr})
+	if len(w.pending) >= w.batch {
+		return w.Flush()
+	}
+	return nil
+}
+
+// Flush 发送所有待发送的包，设置了 DF 位后超过 MTU 的错误会被忽略。
+func (w *udpBatchWriter) Flush() error {
+	if len(w.pending) == 0 {
+		return nil
+	}
+	defer w.release()
+
+	if w.pconn == nil {
+		for _, p := range w.pending {
+			var err error
+			if p.addr != nil {
+				_, err = w.conn.WriteToUDP(*p.buf, p.addr)
+			} else {
+				_, err = w.conn.Write(*p.buf)
+			}
+			if err != nil && !isMsgSizeError(err) {
+				return err
+			}
+		}
+		return nil
+	}
+
+	gso := w.gso
+	w.buildMsgs(0, gso)
+	sent, err := w.sendMsgs()
+	if err != nil && gso && !isMsgSizeError(err) {
+		// 内核或网卡不支持时关闭 GSO，没有发出去的重新发送
+		w.gso = false
+		w.buildMsgs(sent, false)
+		_, err = w.sendMsgs()
+	}
+	if err != nil && !isMsgSizeError(err) {
+		return err
+	}
+	return nil
+}
+
+func (w *udpBatchWriter) release() {
+	for i := range w.pending {
+		PutFrameBuffer(w.pending[i].buf)
+		w.pending[i] = udpBatchPacket{}
+	}
+	w.pending = w.pending[:0]
+	w.msgs = w.msgs[:0]
+}
+
+// buildMsgs 把从 from 开始的待发送的包组成消息，开启 GSO 时至少两个相同大小的包才合并。
+func (w *udpBatchWriter) buildMsgs(from int, gso bool) {
+	w.msgs = w.msgs[:0]
+	w.from = from
+	for i := from; i < len(w.pending); {
+		p := w.pending[i]
+		size := len(*p.buf)
+		j := i + 1
+		if gso && j < len(w.pending) && len(*w.pending[j].buf) == size {
+			total := size
+			for j < len(w.pending) && j-i < udpGsoMaxSegs && sameUdpAddr(w.pending[j].addr, p.addr) {
+				l := len(*w.pending[j].buf)
+				if l > size || total+l > udpGsoMaxSize {
+					break
+				}
+				total += l
+				j++
+				if l < size {
+					break
+				}
+			}
+		}
+		for k := i; k < j; k++ {
+			w.iovs[k] = *w.pending[k].buf
+		}
+		msg := ipv4.Message{Buffers: w.iovs[i:j:j]}
+		if p.addr != nil {
+			msg.Addr = p.addr
+		}
+		if j-i > 1 {
+			msg.OOB = appendUdpGsoSize(w.oobs[len(w.msgs)][:0], size)
+		}
+		w.msgs = append(w.msgs, msg)
+		i = j
+	}
+}
+
+// sendMsgs 发送 buildMsgs 组好的消息，返回已经处理完的包数。
+func (w *udpBatchWriter) sendMsgs() (int, error) {
+	msgs := w.msgs
+	sent := w.from
+	for len(msgs) > 0 {
+		n, err := w.pconn.WriteBatch(msgs, 0)
+		for i := 0; i < n; i++ {
+			sent += len(msgs[i].Buffers)
+		}
+		msgs = msgs[n:]
+		if err != nil {
+			if isMsgSizeError(err) && len(msgs) > 0 {
+				// 跳过超过 MTU 的包继续发送
+				sent += len(msgs[0].Buffers)
+				msgs = msgs[1:]
+				continue
+			}
+			return sent, err
+		}
+		if n <= 0 {
+			break
+		}
+	}
+	return sent, nil
+}
+
+func sameUdpAddr(a *net.UDPAddr, b *net.UDPAddr) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Port == b.Port && a.IP.Equal(b.IP) && a.Zone == b.Zone
+}
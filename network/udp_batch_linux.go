@@ -0,0 +1,73 @@
+package network
+
+import (
+	"encoding/binary"
+	"net"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+func udpSockoptInt(conn *net.UDPConn, fn func(fd int) error) bool {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return false
+	}
+	var serr error
+	if err := rc.Control(func(fd uintptr) {
+		serr = fn(int(fd))
+	}); err != nil {
+		return false
+	}
+	return serr == nil
+}
+
+// enableUdpGro 开启 GRO，内核不支持时返回 false。
+func enableUdpGro(conn *net.UDPConn) bool {
+	return udpSockoptInt(conn, func(fd int) error {
+		return unix.SetsockoptInt(fd, unix.SOL_UDP, unix.UDP_GRO, 1)
+	})
+}
+
+// udpGsoSupported 能读取 UDP_SEGMENT 说明内核支持 GSO。
+func udpGsoSupported(conn *net.UDPConn) bool {
+	return udpSockoptInt(conn, func(fd int) error {
+		_, err := unix.GetsockoptInt(fd, unix.SOL_UDP, unix.UDP_SEGMENT)
+		return err
+	})
+}
+
+func udpGroOobSize() int {
+	return unix.CmsgSpace(4)
+}
+
+func udpGsoOobSize() int {
+	return unix.CmsgSpace(2)
+}
+
+// parseUdpGroSize 从控制消息中取出 GRO 合并的每个包的大小，没有时返回 0。
+func parseUdpGroSize(oob []byte) int {
+	for len(oob) >= unix.CmsgLen(0) {
+		h := (*unix.Cmsghdr)(unsafe.Pointer(&oob[0]))
+		if int(h.Len) < unix.CmsgLen(0) || int(h.Len) > len(oob) {
+			return 0
+		}
+		if h.Level == unix.SOL_UDP && h.Type == unix.UDP_GRO && int(h.Len) >= unix.CmsgLen(4) {
+			return int(binary.NativeEndian.Uint32(oob[unix.CmsgLen(0):]))
+		}
+		oob = oob[unix.CmsgSpace(int(h.Len)-unix.CmsgLen(0)):]
+	}
+	return 0
+}
+
+// appendUdpGsoSize 追加 UDP_SEGMENT 控制消息，内核按 size 切分消息。
+func appendUdpGsoSize(oob []byte, size int) []byte {
+	start := len(oob)
+	oob = append(oob, make([]byte, unix.CmsgSpace(2))...)
+	h := (*unix.Cmsghdr)(unsafe.Pointer(&oob[start]))
+	h.Level = unix.SOL_UDP
+	h.Type = unix.UDP_SEGMENT
+	h.SetLen(unix.CmsgLen(2))
+	binary.NativeEndian.PutUint16(oob[start+unix.CmsgLen(0):], uint16(size))
+	return oob
+}
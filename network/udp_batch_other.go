@@ -0,0 +1,31 @@
+//go:build !linux
+
+package network
+
+import (
+	"net"
+)
+
+func enableUdpGro(conn *net.UDPConn) bool {
+	return false
+}
+
+func udpGsoSupported(conn *net.UDPConn) bool {
+	return false
+}
+
+func udpGroOobSize() int {
+	return 0
+}
+
+func udpGsoOobSize() int {
+	return 0
+}
+
+func parseUdpGroSize(oob []byte) int {
+	return 0
+}
+
+func appendUdpGsoSize(oob []byte, size int) []byte {
+	return oob
+}
@@ -0,0 +1,124 @@
+package network
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func newTestUdpBatchPacket(i int, size int) *[]byte {
+	bp := GetFrameBuffer()
+	for j := 0; j < size; j++ {
+		*bp = append(*bp, byte(i+j))
+	}
+	return bp
+}
+
+func testUdpBatchSizes() []int {
+	var sizes []int
+	for i := 0; i < 40; i++ {
+		sizes = append(sizes, 1000)
+	}
+	sizes = append(sizes, 300, 1000, 1000, 1200, 1200, 1200, 17)
+	for i := 0; i < 30; i++ {
+		sizes = append(sizes, 500)
+	}
+	return sizes
+}
+
+func TestUdpBatchBuildMsgs(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	w := newUdpBatchWriter(conn, 64, false)
+	sizes := []int{1000, 1000, 1000, 300, 500, 1200, 1200, 17, 1200}
+	for i, size := range sizes {
+		w.pending = append(w.pending, udpBatchPacket{buf: newTestUdpBatchPacket(i, size)})
+	}
+	w.buildMsgs(0, true)
+	// 相同大小的连续包合并，更小的包作为最后一段
+	expect := []int{4, 1, 3, 1}
+	if len(w.msgs) != len(expect) {
+		t.Fatalf("msgs %v", len(w.msgs))
+	}
+	for i, m := range w.msgs {
+		if len(m.Buffers) != expect[i] {
+			t.Errorf("msg %d segs %d", i, len(m.Buffers))
+		}
+		if len(m.Buffers) > 1 && len(m.OOB) != udpGsoOobSize() {
+			t.Errorf("msg %d oob %d", i, len(m.OOB))
+		}
+	}
+
+	w.buildMsgs(2, false)
+	if len(w.msgs) != len(sizes)-2 || w.from != 2 {
+		t.Fatalf("msgs %v from %v", len(w.msgs), w.from)
+	}
+	w.release()
+}
+
+func testUdpBatch(t *testing.T, gso bool, gro bool) {
+	lconn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lconn.Close()
+	dconn, err := net.DialUDP("udp", nil, lconn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dconn.Close()
+
+	sizes := testUdpBatchSizes()
+	done := make(chan [][]byte)
+	go func() {
+		var recv [][]byte
+		r := newUdpBatchReader(lconn, 8, 2048, gro)
+		for len(recv) < len(sizes) {
+			lconn.SetReadDeadline(time.Now().Add(time.Second))
+			err := r.Read(func(data []byte, addr *net.UDPAddr) {
+				if addr == nil || addr.Port != dconn.LocalAddr().(*net.UDPAddr).Port {
+					t.Errorf("addr %v", addr)
+				}
+				recv = append(recv, append([]byte(nil), data...))
+			})
+			if err != nil {
+				break
+			}
+		}
+		done <- recv
+	}()
+
+	w := newUdpBatchWriter(dconn, 16, gso)
+	for i, size := range sizes {
+		if err := w.Write(newTestUdpBatchPacket(i, size), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	recv := <-done
+	if len(recv) != len(sizes) {
+		t.Fatalf("recv %d/%d", len(recv), len(sizes))
+	}
+	for i, size := range sizes {
+		bp := newTestUdpBatchPacket(i, size)
+		if !bytes.Equal(recv[i], *bp) {
+			t.Errorf("packet %d diff %d %d", i, len(recv[i]), size)
+		}
+		PutFrameBuffer(bp)
+	}
+}
+
+func TestUdpBatch(t *testing.T) {
+	testUdpBatch(t, false, false)
+}
+
+func TestUdpBatchGsoGro(t *testing.T) {
+	testUdpBatch(t, true, true)
+}
@@ -7,7 +7,9 @@ import (
 	"github.com/esrrhs/gohome/loggo"
 	"github.com/esrrhs/gohome/thread"
 	"net"
+	"os"
 	"sync"
+	"time"
 )
 
 /*
@@ -21,6 +23,7 @@ type UdpConn struct {
 	listenersonny *udpConnListenerSonny
 	listener      *udpConnListener
 	cancel        context.CancelFunc
+	deadline      connDeadline
 }
 
 type udpConnDialer struct {
@@ -46,6 +49,8 @@ type UdpConfig struct {
 	RecvChanLen         int
 	AcceptChanLen       int
 	RecvChanPushTimeout int
+	BatchRecvPkgs       int  // listener 一次系统调用最多读取的包数，linux 上使用 recvmmsg
+	Gro                 bool // listener 是否尝试开启 GRO，默认关闭，内核不支持时忽略
 }
 
 func DefaultUdpConfig() *UdpConfig {
@@ -54,9 +59,25 @@ func DefaultUdpConfig() *UdpConfig {
 		RecvChanLen:         128,
 		AcceptChanLen:       128,
 		RecvChanPushTimeout: 100,
+		BatchRecvPkgs:       32,
+		Gro:                 false,
 	}
 }
 
+func init() {
+	mustRegisterProto("udp", func(config interface{}) (Conn, error) {
+		c := &UdpConn{}
+		if config != nil {
+			cfg, ok := config.(*UdpConfig)
+			if !ok {
+				return nil, errProtoConfig("udp", config)
+			}
+			c.SetConfig(cfg)
+		}
+		return c, nil
+	}, false)
+}
+
 func (c *UdpConn) Name() string {
 	return "udp"
 }
@@ -72,7 +93,17 @@ func (c *UdpConn) Read(p []byte) (n int, err error) {
 		if c.listenersonny.isclose {
 			return 0, errors.New("read closed conn")
 		}
-		b := <-c.listenersonny.recvch.Ch()
+		if c.deadline.readTimeout() {
+			return 0, os.ErrDeadlineExceeded
+		}
+		timeout, stop := deadlineTimer(c.deadline.readDeadline())
+		defer stop()
+		var b interface{}
+		select {
+		case b = <-c.listenersonny.recvch.Ch():
+		case <-timeout:
+			return 0, os.ErrDeadlineExceeded
+		}
 		if b == nil {
 			return 0, errors.New("read closed conn")
 		}
@@ -97,6 +128,9 @@ func (c *UdpConn) Write(p []byte) (n int, err error) {
 		if c.listenersonny.isclose {
 			return 0, errors.New("write closed conn")
 		}
+		if c.deadline.writeTimeout() {
+			return 0, os.ErrDeadlineExceeded
+		}
 		return c.listenersonny.fatherconn.WriteToUDP(p, c.listenersonny.dstaddr)
 	}
 	return 0, errors.New("empty conn")
@@ -143,14 +177,69 @@ func (c *UdpConn) Info() string {
 	return c.info
 }
 
+func (c *UdpConn) LocalAddr() net.Addr {
+	if c.dialer != nil {
+		return c.dialer.conn.LocalAddr()
+	} else if c.listener != nil {
+		return c.listener.listenerconn.LocalAddr()
+	} else if c.listenersonny != nil {
+		return c.listenersonny.fatherconn.LocalAddr()
+	}
+	return nil
+}
+
+func (c *UdpConn) RemoteAddr() net.Addr {
+	if c.dialer != nil {
+		return c.dialer.conn.RemoteAddr()
+	} else if c.listenersonny != nil {
+		return c.listenersonny.dstaddr
+	}
+	return nil
+}
+
+func (c *UdpConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+func (c *UdpConn) SetReadDeadline(t time.Time) error {
+	if c.dialer != nil {
+		return c.dialer.conn.SetReadDeadline(t)
+	} else if c.listener != nil {
+		return errListenerDeadline
+	} else if c.listenersonny != nil {
+		c.deadline.setRead(t)
+		return nil
+	}
+	return errors.New("empty conn")
+}
+
+func (c *UdpConn) SetWriteDeadline(t time.Time) error {
+	if c.dialer != nil {
+		return c.dialer.conn.SetWriteDeadline(t)
+	} else if c.listener != nil {
+		return errListenerDeadline
+	} else if c.listenersonny != nil {
+		c.deadline.setWrite(t)
+		return nil
+	}
+	return errors.New("empty conn")
+}
+
 func (c *UdpConn) Dial(dst string) (Conn, error) {
+	return c.DialContext(context.Background(), dst)
+}
+
+func (c *UdpConn) DialContext(ctx context.Context, dst string) (Conn, error) {
 	c.checkConfig()
 
 	addr, err := net.ResolveUDPAddr("udp", dst)
 	if err != nil {
 		return nil, err
 	}
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx, cancel := context.WithCancel(ctx)
 	c.cancel = cancel
 	var d net.Dialer
 	if gControlOnConnSetup != nil {
@@ -200,13 +289,22 @@ func (c *UdpConn) Listen(dst string) (Conn, error) {
 }
 
 func (c *UdpConn) Accept() (Conn, error) {
+	return c.AcceptContext(context.Background())
+}
+
+func (c *UdpConn) AcceptContext(ctx context.Context) (Conn, error) {
 	c.checkConfig()
 
-	if c.listener.wg == nil {
+	if c.listener == nil || c.listener.wg == nil {
 		return nil, errors.New("not listen")
 	}
 	for !c.listener.wg.IsExit() {
-		s := <-c.listener.accept.Ch()
+		var s interface{}
+		select {
+		case s = <-c.listener.accept.Ch():
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
 		if s == nil {
 			break
 		}
@@ -226,39 +324,13 @@ func (c *UdpConn) Accept() (Conn, error) {
 func (c *UdpConn) loopRecv() error {
 	c.checkConfig()
 
-	buf := make([]byte, c.config.MaxPacketSize)
+	reader := newUdpBatchReader(c.listener.listenerconn, c.config.BatchRecvPkgs, c.config.MaxPacketSize, c.config.Gro)
 	for !c.listener.wg.IsExit() {
-		n, srcaddr, err := c.listener.listenerconn.ReadFromUDP(buf)
+		err := reader.Read(c.onListenerRecv)
 		if err != nil {
 			return err
 		}
 
-		data := make([]byte, n)
-		copy(data, buf[0:n])
-		srcaddrstr := srcaddr.String()
-
-		v, ok := c.listener.sonny.Load(srcaddrstr)
-		if !ok {
-			sonny := &udpConnListenerSonny{
-				dstaddr:    srcaddr,
-				fatherconn: c.listener.listenerconn,
-				recvch:     common.NewChannel(c.config.RecvChanLen),
-			}
-
-			u := &UdpConn{config: c.config, listenersonny: sonny}
-			if !u.listenersonny.recvch.WriteTimeout(data, c.config.RecvChanPushTimeout) {
-				loggo.Debug("udp conn %s push %d data to %s recv channel timeout", c.Info(), len(data), u.Info())
-			}
-			c.listener.sonny.Store(srcaddrstr, u)
-
-			c.listener.accept.Write(u)
-		} else {
-			u := v.(*UdpConn)
-			if !u.listenersonny.recvch.WriteTimeout(data, c.config.RecvChanPushTimeout) {
-				loggo.Debug("udp conn %s push %d data to %s recv channel timeout", c.Info(), len(data), u.Info())
-			}
-		}
-
 		c.listener.sonny.Range(func(key, value interface{}) bool {
 			u := value.(*UdpConn)
 			if u.listenersonny.isclose {
@@ -270,6 +342,37 @@ func (c *UdpConn) loopRecv() error {
 	return nil
 }
 
+func (c *UdpConn) onListenerRecv(buf []byte, srcaddr *net.UDPAddr) {
+	if srcaddr == nil {
+		return
+	}
+	data := make([]byte, len(buf))
+	copy(data, buf)
+	srcaddrstr := srcaddr.String()
+
+	v, ok := c.listener.sonny.Load(srcaddrstr)
+	if !ok {
+		sonny := &udpConnListenerSonny{
+			dstaddr:    srcaddr,
+			fatherconn: c.listener.listenerconn,
+			recvch:     common.NewChannel(c.config.RecvChanLen),
+		}
+
+		u := &UdpConn{config: c.config, listenersonny: sonny}
+		if !u.listenersonny.recvch.WriteTimeout(data, c.config.RecvChanPushTimeout) {
+			loggo.Debug("udp conn %s push %d data to %s recv channel timeout", c.Info(), len(data), u.Info())
+		}
+		c.listener.sonny.Store(srcaddrstr, u)
+
+		c.listener.accept.Write(u)
+	} else {
+		u := v.(*UdpConn)
+		if !u.listenersonny.recvch.WriteTimeout(data, c.config.RecvChanPushTimeout) {
+			loggo.Debug("udp conn %s push %d data to %s recv channel timeout", c.Info(), len(data), u.Info())
+		}
+	}
+}
+
 func (c *UdpConn) checkConfig() {
 	if c.config == nil {
 		c.config = DefaultUdpConfig()
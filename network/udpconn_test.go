@@ -1,8 +1,10 @@
 package network
 
 import (
+	"context"
 	"fmt"
 	"github.com/esrrhs/gohome/loggo"
+	"os"
 	"strconv"
 	"testing"
 	"time"
@@ -361,3 +363,45 @@ func Test0008UDP(t *testing.T) {
 
 	time.Sleep(time.Second)
 }
+
+func TestUDPListenerSonnyReadDeadline(t *testing.T) {
+	c, err := NewConn("udp")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cc, err := c.Listen(":58090")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+
+	ccc, err := c.Dial("127.0.0.1:58090")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ccc.Close()
+
+	if _, err := ccc.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	sonny, err := cc.AcceptContext(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 100)
+	n, err := sonny.Read(buf)
+	if err != nil || string(buf[:n]) != "hello" {
+		t.Fatalf("Read returned %q %v", buf[:n], err)
+	}
+
+	sonny.SetReadDeadline(time.Now().Add(time.Millisecond * 200))
+	_, err = sonny.Read(buf)
+	if err != os.ErrDeadlineExceeded {
+		t.Fatalf("Read returned %v, want %v", err, os.ErrDeadlineExceeded)
+	}
+}
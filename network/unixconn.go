@@ -0,0 +1,294 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+/*
+UnixConn 实现了基于 unix domain socket 的Conn，用于同机进程间通信。
+
+unix 是字节流，注册为可靠协议；unixpacket 保留消息边界，读缓冲小于消息时多余部分会被丢弃，所以注册为不可靠协议。
+Listen 会按配置设置 socket 文件的权限和属主，Close 时删除 socket 文件。
+需要设置权限或属主时，先在同目录下权限为 0700 的临时目录中创建 socket，设置好之后再链接到目标路径，
+所以目标路径上的 socket 从出现开始就是配置的权限，不会有按 umask 创建的窗口。
+*/
+
+type UnixConfig struct {
+	// socket 文件权限，0 表示不修改
+	FileMode os.FileMode
+	// 为 true 时把 socket 文件属主改为 Uid、Gid，其中 -1 表示不修改对应的一项；
+	// 为 false 时不修改属主，直接构造的 UnixConfig{} 不会把属主改成 root
+	Chown bool
+	Uid   int
+	Gid   int
+	// Listen 时如果已存在同名的 socket 文件则先删除，用于清理上次进程异常退出的残留
+	RemoveExisting bool
+}
+
+func DefaultUnixConfig() *UnixConfig {
+	return &UnixConfig{
+		FileMode:       0,
+		Chown:          false,
+		Uid:            -1,
+		Gid:            -1,
+		RemoveExisting: false,
+	}
+}
+
+type UnixConn struct {
+	network  string
+	config   *UnixConfig
+	conn     *net.UnixConn
+	listener *net.UnixListener
+	cancel   context.CancelFunc
+	info     string
+	// listener 关闭时需要删除的 socket 文件
+	unlink string
+}
+
+func init() {
+	for _, network := range []string{"unix", "unixpacket"} {
+		network := network
+		mustRegisterProto(network, func(config interface{}) (Conn, error) {
+			c := &UnixConn{network: network}
+			if config != nil {
+				cfg, ok := config.(*UnixConfig)
+				if !ok {
+					return nil, errProtoConfig(network, config)
+				}
+				c.SetConfig(cfg)
+			}
+			return c, nil
+		}, network == "unix")
+	}
+}
+
+func (c *UnixConn) Name() string {
+	return c.network
+}
+
+func (c *UnixConn) Read(p []byte) (n int, err error) {
+	if c.conn != nil {
+		return c.conn.Read(p)
+	}
+	return 0, errors.New("empty conn")
+}
+
+func (c *UnixConn) Write(p []byte) (n int, err error) {
+	if c.conn != nil {
+		return c.conn.Write(p)
+	}
+	return 0, errors.New("empty conn")
+}
+
+func (c *UnixConn) Close() error {
+	if c.cancel != nil {
+		c.cancel()
+	}
+	if c.conn != nil {
+		return c.conn.Close()
+	} else if c.listener != nil {
+		err := c.listener.Close()
+		if c.unlink != "" {
+			os.Remove(c.unlink)
+		}
+		return err
+	}
+	return nil
+}
+
+func (c *UnixConn) Info() string {
+	if c.info != "" {
+		return c.info
+	}
+	if c.conn != nil {
+		c.info = c.conn.LocalAddr().String() + "<--" + c.network + "-->" + c.conn.RemoteAddr().String()
+	} else if c.listener != nil {
+		c.info = c.network + "--" + c.LocalAddr().String()
+	} else {
+		c.info = "empty " + c.network + " conn"
+	}
+	return c.info
+}
+
+func (c *UnixConn) LocalAddr() net.Addr {
+	if c.conn != nil {
+		return c.conn.LocalAddr()
+	} else if c.listener != nil {
+		if c.unlink != "" {
+			return &net.UnixAddr{Name: c.unlink, Net: c.network}
+		}
+		return c.listener.Addr()
+	}
+	return nil
+}
+
+func (c *UnixConn) RemoteAddr() net.Addr {
+	if c.conn != nil {
+		return c.conn.RemoteAddr()
+	}
+	return nil
+}
+
+func (c *UnixConn) SetDeadline(t time.Time) error {
+	if c.conn != nil {
+		return c.conn.SetDeadline(t)
+	} else if c.listener != nil {
+		return errListenerDeadline
+	}
+	return errors.New("empty conn")
+}
+
+func (c *UnixConn) SetReadDeadline(t time.Time) error {
+	if c.conn != nil {
+		return c.conn.SetReadDeadline(t)
+	} else if c.listener != nil {
+		return errListenerDeadline
+	}
+	return errors.New("empty conn")
+}
+
+func (c *UnixConn) SetWriteDeadline(t time.Time) error {
+	if c.conn != nil {
+		return c.conn.SetWriteDeadline(t)
+	} else if c.listener != nil {
+		return errListenerDeadline
+	}
+	return errors.New("empty conn")
+}
+
+func (c *UnixConn) Dial(dst string) (Conn, error) {
+	return c.DialContext(context.Background(), dst)
+}
+
+func (c *UnixConn) DialContext(ctx context.Context, dst string) (Conn, error) {
+	c.checkConfig()
+
+	ctx, cancel := context.WithCancel(ctx)
+	c.cancel = cancel
+	defer func() {
+		c.cancel = nil
+		cancel()
+	}()
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, c.network, dst)
+	if err != nil {
+		return nil, err
+	}
+	return &UnixConn{network: c.network, config: c.config, conn: conn.(*net.UnixConn)}, nil
+}
+
+func (c *UnixConn) Listen(dst string) (Conn, error) {
+	c.checkConfig()
+
+	// @开头的是 linux 抽象命名空间，没有文件
+	isfile := len(dst) > 0 && dst[0] != '@'
+
+	if isfile && c.config.RemoveExisting {
+		if fi, err := os.Lstat(dst); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			os.Remove(dst)
+		}
+	}
+
+	if isfile && (c.config.FileMode != 0 || c.config.Chown) {
+		return c.listenPrivate(dst)
+	}
+
+	addr, err := net.ResolveUnixAddr(c.network, dst)
+	if err != nil {
+		return nil, err
+	}
+	listener, err := net.ListenUnix(c.network, addr)
+	if err != nil {
+		return nil, err
+	}
+	listener.SetUnlinkOnClose(true)
+
+	return &UnixConn{network: c.network, config: c.config, listener: listener}, nil
+}
+
+// listenPrivate 在私有的临时目录中创建 socket，设置好权限和属主后再链接到 dst，链接在 dst 已存在时失败，不会覆盖别人的 socket。
+func (c *UnixConn) listenPrivate(dst string) (Conn, error) {
+	dir, err := os.MkdirTemp(filepath.Dir(dst), ".unixsock")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	tmp := filepath.Join(dir, "sock")
+	addr, err := net.ResolveUnixAddr(c.network, tmp)
+	if err != nil {
+		return nil, err
+	}
+	listener, err := net.ListenUnix(c.network, addr)
+	if err != nil {
+		return nil, err
+	}
+	listener.SetUnlinkOnClose(false)
+
+	if c.config.FileMode != 0 {
+		if err := os.Chmod(tmp, c.config.FileMode); err != nil {
+			listener.Close()
+			return nil, err
+		}
+	}
+	if c.config.Chown {
+		if err := os.Chown(tmp, c.config.Uid, c.config.Gid); err != nil {
+			listener.Close()
+			return nil, err
+		}
+	}
+	if err := os.Link(tmp, dst); err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	return &UnixConn{network: c.network, config: c.config, listener: listener, unlink: dst}, nil
+}
+
+func (c *UnixConn) Accept() (Conn, error) {
+	return c.AcceptContext(context.Background())
+}
+
+func (c *UnixConn) AcceptContext(ctx context.Context) (Conn, error) {
+	if c.listener == nil {
+		return nil, errors.New("not listen")
+	}
+	stop := watchContext(ctx, func() {
+		c.listener.SetDeadline(aLongTimeAgo)
+	})
+	conn, err := c.listener.AcceptUnix()
+	stop()
+	if ctx.Err() != nil {
+		c.listener.SetDeadline(time.Time{})
+		if conn != nil {
+			conn.Close()
+		}
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &UnixConn{network: c.network, config: c.config, conn: conn}, nil
+}
+
+func (c *UnixConn) checkConfig() {
+	if c.config == nil {
+		c.config = DefaultUnixConfig()
+	}
+}
+
+func (c *UnixConn) SetConfig(config *UnixConfig) {
+	c.config = config
+}
+
+func (c *UnixConn) GetConfig() *UnixConfig {
+	c.checkConfig()
+	return c.config
+}
@@ -0,0 +1,149 @@
+package network
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestUnixEcho(t *testing.T) {
+	for _, proto := range []string{"unix", "unixpacket"} {
+		path := filepath.Join(t.TempDir(), proto+".sock")
+
+		config := DefaultUnixConfig()
+		config.FileMode = 0600
+		c, err := NewConnWithConfig(proto, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		cc, err := c.Listen(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		fi, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode().Perm() != 0600 {
+			t.Errorf("%s socket mode = %v, want 0600", proto, fi.Mode().Perm())
+		}
+
+		go func() {
+			conn, err := cc.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			buf := make([]byte, 1024)
+			for {
+				n, err := conn.Read(buf)
+				if err != nil {
+					return
+				}
+				conn.Write(buf[:n])
+			}
+		}()
+
+		ccc, err := c.Dial(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ccc.SetDeadline(time.Now().Add(time.Second * 5))
+		ccc.Write([]byte("hello"))
+		buf := make([]byte, 5)
+		if _, err := io.ReadFull(ccc, buf); err != nil || string(buf) != "hello" {
+			t.Fatalf("%s ReadFull = %q, %v", proto, buf, err)
+		}
+		ccc.Close()
+
+		cc.Close()
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s socket file not removed after Close, err %v", proto, err)
+		}
+	}
+}
+
+func TestUnixRemoveExisting(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "stale.sock")
+
+	// 模拟进程异常退出留下的 socket 文件
+	c, _ := NewConn("unix")
+	cc, err := c.Listen(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc.(*UnixConn).listener.SetUnlinkOnClose(false)
+	cc.Close()
+
+	if _, err := c.Listen(path); err == nil {
+		t.Fatal("Listen on stale socket should fail without RemoveExisting")
+	}
+
+	config := DefaultUnixConfig()
+	config.RemoveExisting = true
+	c, _ = NewConnWithConfig("unix", config)
+	cc, err = c.Listen(path)
+	if err != nil {
+		t.Fatalf("Listen with RemoveExisting fail %v", err)
+	}
+	cc.Close()
+
+	// 不是 socket 的文件不删除
+	if err := os.WriteFile(path, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Listen(path); err == nil {
+		t.Fatal("Listen should not remove regular file")
+	}
+}
+
+func TestUnixPrivateListen(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "private.sock")
+
+	// 直接构造的配置不修改属主
+	c, _ := NewConnWithConfig("unix", &UnixConfig{})
+	cc, err := c.Listen(path)
+	if err != nil {
+		t.Fatalf("Listen with zero config fail %v", err)
+	}
+	cc.Close()
+
+	c, _ = NewConnWithConfig("unix", &UnixConfig{FileMode: 0600, Chown: true, Uid: os.Getuid(), Gid: -1})
+	cc, err = c.Listen(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cc.LocalAddr().String() != path {
+		t.Errorf("LocalAddr = %v, want %v", cc.LocalAddr(), path)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 || fi.Mode()&os.ModeSocket == 0 {
+		t.Errorf("socket mode = %v", fi.Mode())
+	}
+	// 临时目录已经删除
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("dir entries = %v", entries)
+	}
+
+	// 已经有 socket 时失败，不会覆盖
+	if ccc, err := c.Listen(path); err == nil {
+		ccc.Close()
+		t.Fatal("Listen on existing socket should fail")
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("existing socket removed %v", err)
+	}
+
+	cc.Close()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("socket file not removed after Close, err %v", err)
+	}
+}
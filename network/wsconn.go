@@ -0,0 +1,765 @@
+package network
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/esrrhs/gohome/common"
+	"github.com/esrrhs/gohome/thread"
+)
+
+/*
+WsConn 实现了基于 websocket 协议的Conn，支持 ws 及 wss。
+
+数据以二进制帧传输，双方定时发送 ping，收到任意帧都视为对端存活，超过 HBTimeoutMs 没有收到数据则断开。
+除了 Listen 自己监听端口，也可以通过 ListenHandler 得到 http.Handler 挂到已有的 http 服务上。
+*/
+
+type WsConfig struct {
+	Path               string
+	Host               string
+	MaxMessageSize     int
+	RecvChanLen        int
+	AcceptChanLen      int
+	HandshakeTimeoutMs int
+	PingIntervalMs     int
+	HBTimeoutMs        int
+	// wss 的证书配置，nil 表示监听使用自签名证书，拨号不校验证书
+	Tls *TlsConfig
+}
+
+func DefaultWsConfig() *WsConfig {
+	return &WsConfig{
+		Path:               "/",
+		Host:               "",
+		MaxMessageSize:     1024 * 1024,
+		RecvChanLen:        128,
+		AcceptChanLen:      128,
+		HandshakeTimeoutMs: 10000,
+		PingIntervalMs:     5000,
+		HBTimeoutMs:        30000,
+	}
+}
+
+const (
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xa
+
+	wsGuid = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+)
+
+type WsConn struct {
+	secure   bool
+	info     string
+	config   *WsConfig
+	session  *wsSession
+	listener *wsConnListener
+	cancel   context.CancelFunc
+	deadline connDeadline
+}
+
+type wsSession struct {
+	conn         net.Conn
+	reader       *bufio.Reader
+	client       bool
+	wg           *thread.Group
+	recvch       *common.Channel
+	leftover     []byte
+	writelock    sync.Mutex
+	lastRecvTime int64
+	closesend    bool
+}
+
+type wsConnListener struct {
+	listenerconn net.Listener
+	addr         string
+	wg           *thread.Group
+	accept       *common.Channel
+}
+
+func init() {
+	for _, secure := range []bool{false, true} {
+		secure := secure
+		name := "ws"
+		if secure {
+			name = "wss"
+		}
+		mustRegisterProto(name, func(config interface{}) (Conn, error) {
+			c := &WsConn{secure: secure}
+			if config != nil {
+				cfg, ok := config.(*WsConfig)
+				if !ok {
+					return nil, errProtoConfig(name, config)
+				}
+				c.SetConfig(cfg)
+			}
+			return c, nil
+		}, true)
+	}
+}
+
+func (c *WsConn) Name() string {
+	if c.secure {
+		return "wss"
+	}
+	return "ws"
+}
+
+func (c *WsConn) Read(p []byte) (n int, err error) {
+	c.checkConfig()
+
+	if c.listener != nil {
+		return 0, errors.New("listener can not be read")
+	} else if c.session == nil {
+		return 0, errors.New("empty conn")
+	}
+
+	if len(c.session.leftover) > 0 {
+		n = copy(p, c.session.leftover)
+		c.session.leftover = c.session.leftover[n:]
+		return n, nil
+	}
+
+	if c.deadline.readTimeout() {
+		return 0, os.ErrDeadlineExceeded
+	}
+	timeout, stop := deadlineTimer(c.deadline.readDeadline())
+	defer stop()
+
+	var b interface{}
+	select {
+	case b = <-c.session.recvch.Ch():
+	case <-timeout:
+		return 0, os.ErrDeadlineExceeded
+	}
+	if b == nil {
+		return 0, io.EOF
+	}
+	data := b.([]byte)
+	n = copy(p, data)
+	c.session.leftover = data[n:]
+	return n, nil
+}
+
+func (c *WsConn) Write(p []byte) (n int, err error) {
+	c.checkConfig()
+
+	if c.listener != nil {
+		return 0, errors.New("listener can not be write")
+	} else if c.session == nil {
+		return 0, errors.New("empty conn")
+	}
+
+	if c.session.wg.IsExit() {
+		return 0, errors.New("write closed conn")
+	}
+
+	for n < len(p) {
+		size := common.MinOfInt(len(p)-n, c.config.MaxMessageSize)
+		err = c.session.writeFrame(wsOpBinary, p[n:n+size], c.deadline.writeDeadline())
+		if err != nil {
+			return n, err
+		}
+		n += size
+	}
+	return n, nil
+}
+
+func (c *WsConn) Close() error {
+	c.checkConfig()
+
+	if c.cancel != nil {
+		c.cancel()
+	}
+	if c.session != nil {
+		c.session.sendClose()
+		c.session.wg.Stop()
+		c.session.wg.Wait()
+	} else if c.listener != nil {
+		c.listener.wg.Stop()
+		c.listener.wg.Wait()
+	}
+	return nil
+}
+
+func (c *WsConn) Info() string {
+	c.checkConfig()
+
+	if c.info != "" {
+		return c.info
+	}
+	if c.session != nil {
+		c.info = c.session.conn.LocalAddr().String() + "<--" + c.Name() + "-->" + c.session.conn.RemoteAddr().String()
+	} else if c.listener != nil {
+		c.info = c.Name() + "--" + c.listener.addr
+	} else {
+		c.info = "empty " + c.Name() + " conn"
+	}
+	return c.info
+}
+
+func (c *WsConn) LocalAddr() net.Addr {
+	if c.session != nil {
+		return c.session.conn.LocalAddr()
+	} else if c.listener != nil && c.listener.listenerconn != nil {
+		return c.listener.listenerconn.Addr()
+	}
+	return nil
+}
+
+func (c *WsConn) RemoteAddr() net.Addr {
+	if c.session != nil {
+		return c.session.conn.RemoteAddr()
+	}
+	return nil
+}
+
+func (c *WsConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+func (c *WsConn) SetReadDeadline(t time.Time) error {
+	if c.listener != nil {
+		return errListenerDeadline
+	} else if c.session == nil {
+		return errors.New("empty conn")
+	}
+	c.deadline.setRead(t)
+	return nil
+}
+
+func (c *WsConn) SetWriteDeadline(t time.Time) error {
+	if c.listener != nil {
+		return errListenerDeadline
+	} else if c.session == nil {
+		return errors.New("empty conn")
+	}
+	c.deadline.setWrite(t)
+	return nil
+}
+
+func (c *WsConn) Dial(dst string) (Conn, error) {
+	return c.DialContext(context.Background(), dst)
+}
+
+func (c *WsConn) DialContext(ctx context.Context, dst string) (Conn, error) {
+	c.checkConfig()
+
+	u, err := c.parseUrl(dst)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(c.config.HandshakeTimeoutMs)*time.Millisecond)
+	c.cancel = cancel
+	defer func() {
+		c.cancel = nil
+		cancel()
+	}()
+
+	var d net.Dialer
+	if gControlOnConnSetup != nil {
+		d = net.Dialer{Control: gControlOnConnSetup}
+	}
+	conn, err := d.DialContext(ctx, "tcp", u.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.secure {
+		config, err := c.clientTlsConfig(u.Host)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		tlsconn := tls.Client(conn, config)
+		if err := tlsconn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsconn
+	}
+
+	stop := watchContext(ctx, func() {
+		conn.SetDeadline(aLongTimeAgo)
+	})
+	reader, err := c.clientHandshake(conn, u)
+	stop()
+	if ctx.Err() != nil {
+		conn.Close()
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	return c.newSession(conn, reader, true), nil
+}
+
+func (c *WsConn) parseUrl(dst string) (*url.URL, error) {
+	if !strings.Contains(dst, "://") {
+		dst = c.Name() + "://" + dst + c.config.Path
+	}
+	u, err := url.Parse(dst)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "ws" && u.Scheme != "wss" {
+		return nil, errors.New("unsupported scheme " + u.Scheme)
+	}
+	if u.Path == "" {
+		u.Path = "/"
+	}
+	if u.Port() == "" {
+		if u.Scheme == "wss" {
+			u.Host = net.JoinHostPort(u.Hostname(), "443")
+		} else {
+			u.Host = net.JoinHostPort(u.Hostname(), "80")
+		}
+	}
+	return u, nil
+}
+
+func (c *WsConn) clientHandshake(conn net.Conn, u *url.URL) (*bufio.Reader, error) {
+	keyb := make([]byte, 16)
+	if _, err := rand.Read(keyb); err != nil {
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(keyb)
+
+	req := &http.Request{
+		Method:     "GET",
+		URL:        u,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		Host:       u.Host,
+	}
+	if c.config.Host != "" {
+		req.Host = c.config.Host
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return nil, errors.New("websocket handshake fail " + resp.Status)
+	}
+	if !strings.EqualFold(resp.Header.Get("Upgrade"), "websocket") {
+		return nil, errors.New("websocket handshake fail, bad upgrade header")
+	}
+	if resp.Header.Get("Sec-WebSocket-Accept") != wsAcceptKey(key) {
+		return nil, errors.New("websocket handshake fail, bad accept key")
+	}
+	return reader, nil
+}
+
+func (c *WsConn) clientTlsConfig(dst string) (*tls.Config, error) {
+	if c.config.Tls == nil {
+		host, _, _ := net.SplitHostPort(dst)
+		return &tls.Config{
+			ServerName:         host,
+			InsecureSkipVerify: true,
+		}, nil
+	}
+	return c.config.Tls.clientConfigFor(dst)
+}
+
+func (c *WsConn) serverTlsConfig() (*tls.Config, error) {
+	if c.config.Tls == nil {
+		config, err := common.GenerateTLSConfig("")
+		if err != nil {
+			return nil, err
+		}
+		config.NextProtos = nil
+		return config, nil
+	}
+	return c.config.Tls.ServerConfig()
+}
+
+func wsAcceptKey(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + wsGuid))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+func (c *WsConn) Listen(dst string) (Conn, error) {
+	c.checkConfig()
+
+	listenerconn, err := net.Listen("tcp", dst)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.secure {
+		config, err := c.serverTlsConfig()
+		if err != nil {
+			listenerconn.Close()
+			return nil, err
+		}
+		listenerconn = tls.NewListener(listenerconn, config)
+	}
+
+	u := c.newListener(listenerconn, dst)
+	server := &http.Server{Handler: u}
+	u.listener.wg.Go("WsConn Listen Serve"+" "+dst, func() error {
+		server.Serve(listenerconn)
+		return nil
+	})
+
+	return u, nil
+}
+
+// ListenHandler 创建一个不监听端口的 listener，返回的 http.Handler 可以挂到已有的 http 服务上，Accept 得到升级成功的连接。
+func (c *WsConn) ListenHandler() (Conn, http.Handler) {
+	c.checkConfig()
+
+	u := c.newListener(nil, "handler")
+	return u, u
+}
+
+func (c *WsConn) newListener(listenerconn net.Listener, addr string) *WsConn {
+	ch := common.NewChannel(c.config.AcceptChanLen)
+
+	wg := thread.NewGroup("WsConn Listen"+" "+addr, nil, func() {
+		if listenerconn != nil {
+			listenerconn.Close()
+		}
+		ch.Close()
+	})
+
+	listener := &wsConnListener{
+		listenerconn: listenerconn,
+		addr:         addr,
+		wg:           wg,
+		accept:       ch,
+	}
+
+	return &WsConn{secure: c.secure, config: c.config, listener: listener}
+}
+
+func (c *WsConn) Accept() (Conn, error) {
+	return c.AcceptContext(context.Background())
+}
+
+func (c *WsConn) AcceptContext(ctx context.Context) (Conn, error) {
+	c.checkConfig()
+
+	if c.listener == nil {
+		return nil, errors.New("not listen")
+	}
+	for !c.listener.wg.IsExit() {
+		var s interface{}
+		select {
+		case s = <-c.listener.accept.Ch():
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if s == nil {
+			break
+		}
+		return s.(*WsConn), nil
+	}
+	return nil, errors.New("listener close")
+}
+
+func (c *WsConn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.checkConfig()
+
+	if c.listener == nil || c.listener.wg.IsExit() {
+		http.Error(w, "listener closed", http.StatusServiceUnavailable)
+		return
+	}
+
+	if c.listener.listenerconn != nil && r.URL.Path != c.config.Path {
+		http.NotFound(w, r)
+		return
+	}
+
+	if r.Method != "GET" ||
+		!strings.EqualFold(r.Header.Get("Upgrade"), "websocket") ||
+		!strings.Contains(strings.ToLower(r.Header.Get("Connection")), "upgrade") {
+		http.Error(w, "not websocket upgrade", http.StatusBadRequest)
+		return
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported websocket version", http.StatusUpgradeRequired)
+		return
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		http.Error(w, "no websocket key", http.StatusBadRequest)
+		return
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "websocket hijack not supported", http.StatusInternalServerError)
+		return
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		return
+	}
+
+	rsp := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + wsAcceptKey(key) + "\r\n\r\n"
+	conn.SetWriteDeadline(time.Now().Add(time.Duration(c.config.HandshakeTimeoutMs) * time.Millisecond))
+	if _, err := conn.Write([]byte(rsp)); err != nil {
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	u := c.newSession(conn, rw.Reader, false)
+	c.listener.accept.Write(u)
+	if c.listener.wg.IsExit() {
+		u.Close()
+	}
+}
+
+func (c *WsConn) newSession(conn net.Conn, reader *bufio.Reader, client bool) *WsConn {
+	recvch := common.NewChannel(c.config.RecvChanLen)
+
+	session := &wsSession{
+		conn:         conn,
+		reader:       reader,
+		client:       client,
+		recvch:       recvch,
+		lastRecvTime: time.Now().UnixNano(),
+	}
+
+	u := &WsConn{secure: c.secure, config: c.config, session: session}
+
+	session.wg = thread.NewGroup("WsConn session"+" "+u.Info(), nil, func() {
+		conn.Close()
+		recvch.Close()
+	})
+
+	session.wg.Go("WsConn loopRecv"+" "+u.Info(), func() error {
+		return u.loopRecv()
+	})
+	session.wg.Go("WsConn loopPing"+" "+u.Info(), func() error {
+		return u.loopPing()
+	})
+
+	return u
+}
+
+func (c *WsConn) loopRecv() error {
+	s := c.session
+	for !s.wg.IsExit() {
+		op, payload, err := s.readFrame(c.config.MaxMessageSize)
+		if err != nil {
+			return err
+		}
+		atomic.StoreInt64(&s.lastRecvTime, time.Now().UnixNano())
+
+		switch op {
+		case wsOpContinuation, wsOpText, wsOpBinary:
+			if len(payload) <= 0 {
+				continue
+			}
+			for !s.wg.IsExit() {
+				if s.recvch.WriteTimeout(payload, 100) {
+					break
+				}
+				// 本地读得慢不算对端超时
+				atomic.StoreInt64(&s.lastRecvTime, time.Now().UnixNano())
+			}
+		case wsOpPing:
+			err := s.writeFrame(wsOpPong, payload, time.Now().Add(time.Duration(c.config.HBTimeoutMs)*time.Millisecond))
+			if err != nil {
+				return err
+			}
+		case wsOpPong:
+		case wsOpClose:
+			s.sendClose()
+			return io.EOF
+		default:
+			return errors.New("websocket unknown opcode")
+		}
+	}
+	return nil
+}
+
+func (c *WsConn) loopPing() error {
+	s := c.session
+	interval := time.Duration(c.config.PingIntervalMs) * time.Millisecond
+	timeout := time.Duration(c.config.HBTimeoutMs) * time.Millisecond
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for !s.wg.IsExit() {
+		select {
+		case <-ticker.C:
+		case <-s.wg.Done():
+			return nil
+		}
+		last := atomic.LoadInt64(&s.lastRecvTime)
+		if time.Now().UnixNano()-last > int64(timeout) {
+			return errors.New("websocket heartbeat timeout")
+		}
+		err := s.writeFrame(wsOpPing, nil, time.Now().Add(timeout))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *wsSession) readFrame(maxsize int) (byte, []byte, error) {
+	var head [8]byte
+	if _, err := io.ReadFull(s.reader, head[:2]); err != nil {
+		return 0, nil, err
+	}
+	op := head[0] & 0x0f
+	masked := head[1]&0x80 != 0
+	size := uint64(head[1] & 0x7f)
+
+	if masked == s.client {
+		return 0, nil, errors.New("websocket bad mask flag")
+	}
+
+	if size == 126 {
+		if _, err := io.ReadFull(s.reader, head[:2]); err != nil {
+			return 0, nil, err
+		}
+		size = uint64(binary.BigEndian.Uint16(head[:2]))
+	} else if size == 127 {
+		if _, err := io.ReadFull(s.reader, head[:8]); err != nil {
+			return 0, nil, err
+		}
+		size = binary.BigEndian.Uint64(head[:8])
+	}
+	if size > uint64(maxsize) {
+		return 0, nil, errors.New("websocket frame too large")
+	}
+
+	var key [4]byte
+	if masked {
+		if _, err := io.ReadFull(s.reader, key[:]); err != nil {
+			return 0, nil, err
+		}
+	}
+
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(s.reader, payload); err != nil {
+		return 0, nil, err
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= key[i%4]
+		}
+	}
+	return op, payload, nil
+}
+
+func (s *wsSession) writeFrame(op byte, payload []byte, deadline time.Time) error {
+	s.writelock.Lock()
+	defer s.writelock.Unlock()
+
+	buf := make([]byte, 0, 14+len(payload))
+	buf = append(buf, 0x80|op)
+
+	var maskbit byte
+	if s.client {
+		maskbit = 0x80
+	}
+	size := len(payload)
+	if size < 126 {
+		buf = append(buf, maskbit|byte(size))
+	} else if size <= 0xffff {
+		buf = append(buf, maskbit|126)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(size))
+	} else {
+		buf = append(buf, maskbit|127)
+		buf = binary.BigEndian.AppendUint64(buf, uint64(size))
+	}
+
+	if s.client {
+		var key [4]byte
+		if _, err := rand.Read(key[:]); err != nil {
+			return err
+		}
+		buf = append(buf, key[:]...)
+		start := len(buf)
+		buf = append(buf, payload...)
+		for i := range payload {
+			buf[start+i] ^= key[i%4]
+		}
+	} else {
+		buf = append(buf, payload...)
+	}
+
+	s.conn.SetWriteDeadline(deadline)
+	_, err := s.conn.Write(buf)
+	return err
+}
+
+func (s *wsSession) sendClose() {
+	s.writelock.Lock()
+	if s.closesend {
+		s.writelock.Unlock()
+		return
+	}
+	s.closesend = true
+	s.writelock.Unlock()
+
+	// 1000 表示正常关闭
+	s.writeFrame(wsOpClose, []byte{0x03, 0xe8}, time.Now().Add(time.Second))
+}
+
+func (c *WsConn) checkConfig() {
+	if c.config == nil {
+		c.config = DefaultWsConfig()
+	}
+}
+
+func (c *WsConn) SetConfig(config *WsConfig) {
+	c.config = config
+}
+
+func (c *WsConn) GetConfig() *WsConfig {
+	c.checkConfig()
+	return c.config
+}
@@ -0,0 +1,143 @@
+package network
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func wsEcho(t *testing.T, cc Conn, dialer Conn, dst string) {
+	go func() {
+		conn, err := cc.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+
+	ccc, err := dialer.Dial(dst)
+	if err != nil {
+		t.Fatalf("Dial %s fail %v", dst, err)
+	}
+	defer ccc.Close()
+
+	data := bytes.Repeat([]byte("websocket"), 1000)
+	go ccc.Write(data)
+
+	ccc.SetReadDeadline(time.Now().Add(time.Second * 5))
+	buf := make([]byte, len(data))
+	if _, err := io.ReadFull(ccc, buf); err != nil {
+		t.Fatalf("ReadFull fail %v", err)
+	}
+	if !bytes.Equal(buf, data) {
+		t.Fatal("echo data mismatch")
+	}
+}
+
+func TestWSListen(t *testing.T) {
+	for _, proto := range []string{"ws", "wss"} {
+		c, err := NewConn(proto)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		cc, err := c.Listen("127.0.0.1:58093")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// 最大消息较小，验证大数据会被拆成多帧
+		c.(*WsConn).GetConfig().MaxMessageSize = 1000
+		wsEcho(t, cc, c, "127.0.0.1:58093")
+		cc.Close()
+	}
+}
+
+func TestWSListenHandler(t *testing.T) {
+	config := DefaultWsConfig()
+	config.Path = "/tunnel"
+	c, err := NewConnWithConfig("ws", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cc, handler := c.(*WsConn).ListenHandler()
+	defer cc.Close()
+
+	mux := http.NewServeMux()
+	mux.Handle("/tunnel", handler)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	wsEcho(t, cc, c, "ws"+strings.TrimPrefix(server.URL, "http")+"/tunnel")
+
+	resp, err := http.Get(server.URL + "/tunnel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("plain GET status = %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+}
+
+func TestWSHeartbeat(t *testing.T) {
+	config := DefaultWsConfig()
+	config.PingIntervalMs = 100
+	config.HBTimeoutMs = 500
+	c, err := NewConnWithConfig("ws", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cc, err := c.Listen("127.0.0.1:58094")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+
+	ch := make(chan Conn, 1)
+	go func() {
+		conn, err := cc.Accept()
+		if err == nil {
+			ch <- conn
+		}
+	}()
+
+	ccc, err := c.Dial("127.0.0.1:58094")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ccc.Close()
+
+	var sonny Conn
+	select {
+	case sonny = <-ch:
+	case <-time.After(time.Second * 5):
+		t.Fatal("accept timeout")
+	}
+
+	// 空闲超过心跳超时，ping/pong 应保持连接存活
+	time.Sleep(time.Second)
+	if _, err := ccc.Write([]byte("ping")); err != nil {
+		t.Fatalf("Write after idle fail %v", err)
+	}
+	sonny.SetReadDeadline(time.Now().Add(time.Second * 2))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(sonny, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("Read after idle = %q, %v", buf, err)
+	}
+
+	// 对端关闭后读到 EOF
+	ccc.Close()
+	sonny.SetReadDeadline(time.Now().Add(time.Second * 2))
+	if _, err := sonny.Read(buf); err != io.EOF {
+		t.Fatalf("Read after close = %v, want EOF", err)
+	}
+	sonny.Close()
+}